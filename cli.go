@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/swiveltech/pdf-processor/processor"
+)
+
+const usage = `Usage: bootstrap <command> [flags]
+
+Without a command the binary runs as the Lambda handler.
+
+Commands:
+  coversheet  generate a barcode cover sheet PDF
+  replay      re-run the events of failure records
+  serve       run the HTTP scan API
+`
+
+// runCommand runs a command line subcommand and returns the exit code.
+func runCommand(args []string, stdout, stderr io.Writer) int {
+	switch args[0] {
+	case "coversheet":
+		return runCoverSheet(args[1:], stdout, stderr)
+	case "replay":
+		return runReplay(args[1:], stdout, stderr)
+	case "serve":
+		return runServe(args[1:], stderr)
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(stdout, usage)
+		return 0
+	default:
+		fmt.Fprintf(stderr, "unknown command %q\n\n%s", args[0], usage)
+		return 2
+	}
+}
+
+// runCoverSheet generates a cover sheet and writes it to a file, or to
+// stdout if no file is given.
+func runCoverSheet(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("coversheet", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	var sheet processor.CoverSheet
+	flags.StringVar(&sheet.Value, "value", "", "value to encode (required)")
+	flags.StringVar(&sheet.Format, "format", "CODE_128", "symbology, one of "+strings.Join(processor.CoverSheetFormats(), ", "))
+	flags.StringVar(&sheet.Text, "text", "", "text printed above the barcode, a template that can use {{.Value}} and {{.Format}}")
+	output := flags.String("o", "", "output file (default stdout)")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if sheet.Value == "" {
+		fmt.Fprintln(stderr, "coversheet: -value is required")
+		flags.Usage()
+		return 2
+	}
+
+	data, err := processor.GenerateCoverSheet(sheet)
+	if err != nil {
+		fmt.Fprintf(stderr, "coversheet: %v\n", err)
+		return 1
+	}
+	if *output == "" {
+		_, err = stdout.Write(data)
+	} else {
+		err = os.WriteFile(*output, data, 0644)
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "coversheet: error writing cover sheet: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// runReplay reads failure records from a file, a directory or an S3 prefix
+// and runs each record's event through the handler again, reporting the
+// outcome of each. It fails if any replay does.
+func runReplay(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: bootstrap replay [flags] <file, directory or s3://bucket/prefix>")
+		flags.PrintDefaults()
+	}
+	dryRun := flags.Bool("dry-run", false, "list the records without replaying them")
+	force := flags.Bool("force", false, "process objects even if the dedupe store has a result for them")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	ctx := context.Background()
+	if *force {
+		ctx = processor.WithForce(ctx)
+	}
+	records, err := processor.ReadFailureRecords(ctx, flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(stderr, "replay: %v\n", err)
+		return 1
+	}
+
+	failed := 0
+	for _, record := range records {
+		object := record.Bucket + "/" + record.Key
+		if record.Key == "" {
+			object = "(unknown object)"
+		}
+		// Failures of direct invocations do not know their attempt
+		attempts := "?"
+		if record.Attempt > 0 {
+			attempts = fmt.Sprint(record.Attempt)
+		}
+		description := fmt.Sprintf("%s stage=%s class=%s attempts=%s", object, record.Stage, record.ErrorClass, attempts)
+		if *dryRun {
+			fmt.Fprintf(stdout, "%s: %s\n", description, record.Error)
+			continue
+		}
+		response, err := processor.ReplayFailure(ctx, record)
+		if err != nil {
+			failed++
+			fmt.Fprintf(stdout, "FAIL %s: %v\n", description, err)
+			continue
+		}
+		fmt.Fprintf(stdout, "OK   %s: status %d\n", description, response.StatusCode)
+	}
+	fmt.Fprintf(stdout, "%d records, %d failed\n", len(records), failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// runServe runs the HTTP scan API until it is interrupted.
+func runServe(args []string, stderr io.Writer) int {
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	var config processor.ServerConfig
+	addr := flags.String("addr", ":8080", "address to listen on")
+	flags.Int64Var(&config.MaxRequestBytes, "max-request-bytes", 0, "largest request body accepted (default enough for a document of MAX_DOCUMENT_BYTES sent base64-encoded)")
+	flags.IntVar(&config.Concurrency, "concurrency", 0, "documents scanned at once (default the number of CPUs)")
+	flags.DurationVar(&config.QueueTimeout, "queue-timeout", 30*time.Second, "how long a request waits for a scan to finish before it is turned away")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 0 {
+		fmt.Fprintf(stderr, "serve: unexpected arguments %v\n", flags.Args())
+		flags.Usage()
+		return 2
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := processor.Serve(ctx, *addr, config); err != nil {
+		fmt.Fprintf(stderr, "serve: %v\n", err)
+		return 1
+	}
+	return 0
+}
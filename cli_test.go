@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunCommand(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	output := filepath.Join(t.TempDir(), "sheet.pdf")
+	tests := []struct {
+		name       string
+		args       []string
+		wantCode   int
+		wantStdout string
+		wantStderr string
+	}{
+		{"Help", []string{"help"}, 0, "Commands:", ""},
+		{"Unknown command", []string{"scan"}, 2, "", `unknown command "scan"`},
+		{"Cover sheet to stdout", []string{"coversheet", "-value", "SEP-1"}, 0, "%PDF-", ""},
+		{"Cover sheet to file", []string{"coversheet", "-value", "SEP-1", "-format", "QR_CODE", "-text", "Batch {{.Value}}", "-o", output}, 0, "", ""},
+		{"Cover sheet without value", []string{"coversheet"}, 2, "", "-value is required"},
+		{"Cover sheet with unknown format", []string{"coversheet", "-value", "X", "-format", "NOPE"}, 1, "", "unsupported cover sheet format"},
+		{"Cover sheet with unknown flag", []string{"coversheet", "-size", "2"}, 2, "", "flag provided but not defined"},
+		{"Serve with arguments", []string{"serve", "extra"}, 2, "", "unexpected arguments"},
+		{"Serve with invalid address", []string{"serve", "-addr", "localhost:http-alt-nope"}, 1, "", "serve:"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			if code := runCommand(tt.args, &stdout, &stderr); code != tt.wantCode {
+				t.Errorf("got exit code %d, want %d (stderr %q)", code, tt.wantCode, stderr.String())
+			}
+			if !strings.Contains(stdout.String(), tt.wantStdout) {
+				t.Errorf("stdout does not contain %q", tt.wantStdout)
+			}
+			if !strings.Contains(stderr.String(), tt.wantStderr) {
+				t.Errorf("got stderr %q, want it to contain %q", stderr.String(), tt.wantStderr)
+			}
+		})
+	}
+
+	data, err := os.ReadFile(output)
+	if err != nil || !bytes.HasPrefix(data, []byte("%PDF-")) {
+		t.Errorf("cover sheet was not written to %s (%v)", output, err)
+	}
+}
+
+func TestRunReplay(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	pdfPath, err := filepath.Abs(testPDFPath)
+	if err != nil {
+		t.Fatalf("failed to get absolute path: %v", err)
+	}
+	os.Setenv("TEST_PDF_PATH", pdfPath)
+	os.Setenv("WEBHOOK_URL", server.URL)
+	os.Setenv("WEBHOOK_TOKEN", "test-token")
+	defer func() {
+		os.Unsetenv("TEST_PDF_PATH")
+		os.Unsetenv("WEBHOOK_URL")
+		os.Unsetenv("WEBHOOK_TOKEN")
+	}()
+
+	records := filepath.Join(t.TempDir(), "failures.jsonl")
+	record := `{"event":{"Records":[]},"bucket":"test-bucket","key":"sample2.pdf","stage":"delivery","error_class":"transient","error":"webhook returned 502"}`
+	if err := os.WriteFile(records, []byte(record+"\n"+record+"\n"), 0644); err != nil {
+		t.Fatalf("failed to write records: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		args       []string
+		status     int
+		wantCode   int
+		wantStdout string
+		wantStderr string
+	}{
+		{"Dry run", []string{"replay", "-dry-run", records}, http.StatusOK, 0, "test-bucket/sample2.pdf stage=delivery class=transient attempts=?: webhook returned 502", ""},
+		{"Replayed", []string{"replay", records}, http.StatusOK, 0, "2 records, 0 failed", ""},
+		{"Still failing", []string{"replay", records}, http.StatusBadGateway, 1, "2 records, 2 failed", ""},
+		{"No location", []string{"replay"}, http.StatusOK, 2, "", "Usage: bootstrap replay"},
+		{"Invalid records", []string{"replay", testPDFPath}, http.StatusOK, 1, "", "replay:"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status = tt.status
+			var stdout, stderr bytes.Buffer
+			if code := runCommand(tt.args, &stdout, &stderr); code != tt.wantCode {
+				t.Errorf("got exit code %d, want %d (stderr %q)", code, tt.wantCode, stderr.String())
+			}
+			if !strings.Contains(stdout.String(), tt.wantStdout) {
+				t.Errorf("got stdout %q, want it to contain %q", stdout.String(), tt.wantStdout)
+			}
+			if !strings.Contains(stderr.String(), tt.wantStderr) {
+				t.Errorf("got stderr %q, want it to contain %q", stderr.String(), tt.wantStderr)
+			}
+		})
+	}
+}
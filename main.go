@@ -1,10 +1,16 @@
 package main
 
 import (
+	"os"
+
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/swiveltech/pdf-processor/processor"
 )
 
 func main() {
-	lambda.Start(processor.HandleRequest)
-}
\ No newline at end of file
+	// With arguments the binary is a command line tool, otherwise the Lambda handler
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:], os.Stdout, os.Stderr))
+	}
+	lambda.Start(processor.LambdaHandler)
+}
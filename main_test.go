@@ -3,6 +3,8 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"testing"
@@ -12,7 +14,7 @@ import (
 )
 
 const (
-	testPDFPath = "test/pdfs/sample1.pdf"
+	testPDFPath = "test/pdfs/sample2.pdf"
 	testBucket  = "test-bucket"
 )
 
@@ -32,11 +34,6 @@ func setupTest(t *testing.T, pdfPath string) (string, events.S3Event, func()) {
 		t.Fatalf("failed to get absolute path: %v", err)
 	}
 
-	// Check if file exists
-	if _, err := os.Stat(absPath); os.IsNotExist(err) {
-		t.Fatalf("test file does not exist: %v", err)
-	}
-
 	// Create a debug directory and copy the PDF there
 	debugDir := "debug-images"
 	if err := os.MkdirAll(debugDir, 0755); err != nil {
@@ -54,6 +51,13 @@ func setupTest(t *testing.T, pdfPath string) (string, events.S3Event, func()) {
 	// Set environment variable for test mode
 	os.Setenv("TEST_PDF_PATH", absPath)
 
+	// Local stand-in for the Rails webhook, since failed deliveries fail the request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	os.Setenv("WEBHOOK_URL", server.URL)
+	os.Setenv("WEBHOOK_TOKEN", "test-token")
+
 	// Create a dummy S3 event
 	s3Event := events.S3Event{
 		Records: []events.S3EventRecord{
@@ -69,6 +73,9 @@ func setupTest(t *testing.T, pdfPath string) (string, events.S3Event, func()) {
 	cleanup := func() {
 		os.Unsetenv("TEST_PDF_PATH")
 		os.Unsetenv("PDF_PAGE_LIMIT")
+		os.Unsetenv("WEBHOOK_URL")
+		os.Unsetenv("WEBHOOK_TOKEN")
+		server.Close()
 		os.RemoveAll(debugDir)
 	}
 
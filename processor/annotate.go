@@ -0,0 +1,328 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"os"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
+)
+
+// Look of the stamps added by annotatePDF.
+const (
+	stampColor     = "#E00000"
+	stampFontSize  = 9
+	stampLineWidth = 2
+	// maxStampBox caps the size of box images, in points
+	maxStampBox = 5000
+)
+
+// pdfMatrix is a PDF transformation matrix [a b c d e f].
+type pdfMatrix [6]float64
+
+var identityMatrix = pdfMatrix{1, 0, 0, 1, 0, 0}
+
+// multiply returns the transformation m followed by n.
+func (m pdfMatrix) multiply(n pdfMatrix) pdfMatrix {
+	return pdfMatrix{
+		m[0]*n[0] + m[1]*n[2],
+		m[0]*n[1] + m[1]*n[3],
+		m[2]*n[0] + m[3]*n[2],
+		m[2]*n[1] + m[3]*n[3],
+		m[4]*n[0] + m[5]*n[2] + n[4],
+		m[4]*n[1] + m[5]*n[3] + n[5],
+	}
+}
+
+func (m pdfMatrix) apply(x, y float64) (float64, float64) {
+	return m[0]*x + m[2]*y + m[4], m[1]*x + m[3]*y + m[5]
+}
+
+// invert returns the transformation that undoes m, or false if m collapses
+// the plane and cannot be undone.
+func (m pdfMatrix) invert() (pdfMatrix, bool) {
+	det := m[0]*m[3] - m[1]*m[2]
+	if det == 0 {
+		return pdfMatrix{}, false
+	}
+	return pdfMatrix{
+		m[3] / det,
+		-m[1] / det,
+		-m[2] / det,
+		m[0] / det,
+		(m[2]*m[5] - m[3]*m[4]) / det,
+		(m[1]*m[4] - m[0]*m[5]) / det,
+	}, true
+}
+
+// pageLayout is where a page's images are drawn.
+type pageLayout struct {
+	// Viewport is the visible part of the page, its crop box or media box
+	Viewport types.Rectangle
+	// Images maps image resource names to the matrix they are drawn with,
+	// which maps the unit square onto the page
+	Images map[string]pdfMatrix
+}
+
+// placement returns the matrix an image resource is drawn with. Images whose
+// placement is unknown are taken to cover the whole page, as scans do.
+func (l pageLayout) placement(resource string) pdfMatrix {
+	if m, ok := l.Images[resource]; ok {
+		return m
+	}
+	vp := l.Viewport
+	return pdfMatrix{vp.Width(), 0, 0, vp.Height(), vp.LL.X, vp.LL.Y}
+}
+
+// readPageLayouts returns the layout of the first pageLimit pages of a PDF,
+// or of every page if pageLimit is 0. Images drawn by form XObjects are not
+// followed.
+func readPageLayouts(ctx *model.Context, pageLimit int) ([]pageLayout, error) {
+	var layouts []pageLayout
+	for page := 1; page <= ctx.PageCount; page++ {
+		if pageLimit > 0 && page > pageLimit {
+			break
+		}
+		d, _, inherited, err := ctx.PageDict(page, false)
+		if err != nil {
+			return nil, fmt.Errorf("error reading page %d: %v", page, err)
+		}
+		layout := pageLayout{Images: map[string]pdfMatrix{}}
+		if viewport := inherited.CropBox; viewport != nil {
+			layout.Viewport = *viewport
+		} else if inherited.MediaBox != nil {
+			layout.Viewport = *inherited.MediaBox
+		}
+		content, err := ctx.PageContent(d)
+		if err != nil && !errors.Is(err, model.ErrNoContent) {
+			return nil, fmt.Errorf("error reading content of page %d: %v", page, err)
+		}
+		collectImagePlacements(ctx.XRefTable, content, inherited.Resources, layout.Images)
+		layouts = append(layouts, layout)
+	}
+	return layouts, nil
+}
+
+// collectImagePlacements follows the graphics state of a content stream and
+// records the matrix each image is first drawn with.
+func collectImagePlacements(xRefTable *model.XRefTable, content []byte, resources types.Dict, placements map[string]pdfMatrix) {
+	lexer := &contentLexer{data: content}
+	ctm := identityMatrix
+	var stack []pdfMatrix
+	var operands []interface{}
+	for {
+		obj, ok := lexer.next()
+		if !ok {
+			return
+		}
+		op, isOp := obj.(contentOperator)
+		if !isOp {
+			operands = append(operands, obj)
+			continue
+		}
+
+		switch op {
+		case "q":
+			stack = append(stack, ctm)
+		case "Q":
+			if len(stack) > 0 {
+				ctm = stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+			}
+		case "cm":
+			if len(operands) == 6 {
+				var m pdfMatrix
+				valid := true
+				for i := range m {
+					v, ok := operands[i].(float64)
+					valid = valid && ok
+					m[i] = v
+				}
+				if valid {
+					ctm = m.multiply(ctm)
+				}
+			}
+		case "Do":
+			if len(operands) == 1 {
+				name, ok := operands[0].(contentName)
+				if !ok {
+					break
+				}
+				if _, seen := placements[string(name)]; seen {
+					break
+				}
+				sd, _, err := xRefTable.DereferenceStreamDict(resourceEntry(xRefTable, resources, "XObject", string(name)))
+				if err != nil || sd == nil {
+					break
+				}
+				if subtype := sd.Subtype(); subtype != nil && *subtype == "Image" {
+					placements[string(name)] = ctm
+				}
+			}
+		case "BI":
+			lexer.skipInlineImage()
+		}
+		operands = operands[:0]
+	}
+}
+
+// stamp is a decoded value to write onto a page, with a box around where it
+// was found if that is known.
+type stamp struct {
+	Page int
+	Text string
+	Box  *types.Rectangle
+}
+
+// stampsForBarcodes stamps each barcode on its page, with a box around the
+// page region placeBarcodes found for it.
+func stampsForBarcodes(barcodes []Barcode, layouts []pageLayout) []stamp {
+	var stamps []stamp
+	for _, barcode := range barcodes {
+		if barcode.Page < 1 || barcode.Page > len(layouts) {
+			continue
+		}
+		s := stamp{Page: barcode.Page, Text: barcode.Text}
+		if r := barcode.Region; r != nil {
+			s.Box = types.NewRectangle(r.X, r.Y, r.X+r.Width, r.Y+r.Height)
+		}
+		stamps = append(stamps, s)
+	}
+	return stamps
+}
+
+// placeBarcodes sets the page region of each barcode from where its image
+// is drawn on its page. Barcodes whose image is unknown are left unplaced.
+func placeBarcodes(barcodes []Barcode, images map[string]pdfImage, layouts []pageLayout) {
+	for i, barcode := range barcodes {
+		if barcode.Page < 1 || barcode.Page > len(layouts) {
+			continue
+		}
+		img, ok := images[barcode.Image]
+		if !ok || img.Image == nil {
+			continue
+		}
+		placement := layouts[barcode.Page-1].placement(img.Resource)
+		bounds := img.Image.Bounds()
+		region := image.Rect(0, 0, bounds.Dx(), bounds.Dy())
+		if r := barcode.ImageRegion; r != nil {
+			region = image.Rect(r.X, r.Y, r.X+r.Width, r.Y+r.Height)
+		}
+		box := placeRegion(placement, bounds.Dx(), bounds.Dy(), region)
+		if box == nil {
+			continue
+		}
+		barcodes[i].Region = &PageRegion{X: box.LL.X, Y: box.LL.Y, Width: box.Width(), Height: box.Height()}
+	}
+}
+
+// placeRegion maps a region of an image's pixels, counted from its top-left
+// corner, to the page through the matrix the image is drawn with.
+func placeRegion(placement pdfMatrix, width, height int, region image.Rectangle) *types.Rectangle {
+	if width <= 0 || height <= 0 {
+		return nil
+	}
+	minX, minY := math.Inf(1), math.Inf(1)
+	maxX, maxY := math.Inf(-1), math.Inf(-1)
+	for _, corner := range []image.Point{region.Min, {region.Max.X, region.Min.Y}, region.Max, {region.Min.X, region.Max.Y}} {
+		// Image space has its origin at the bottom-left
+		x, y := placement.apply(float64(corner.X)/float64(width), 1-float64(corner.Y)/float64(height))
+		minX, minY = math.Min(minX, x), math.Min(minY, y)
+		maxX, maxY = math.Max(maxX, x), math.Max(maxY, y)
+	}
+	return types.NewRectangle(minX, minY, maxX, maxY)
+}
+
+// annotatePDF stamps the values, and boxes around them, onto a copy of a PDF
+// and returns the copy.
+func annotatePDF(path string, stamps []stamp, layouts []pageLayout, conf *model.Configuration) ([]byte, error) {
+	watermarks := map[int][]*model.Watermark{}
+	for _, s := range stamps {
+		vp := layouts[s.Page-1].Viewport
+		// The label goes above the box, or below it at the top of the page
+		labelX, labelY := vp.LL.X+stampLineWidth, vp.UR.Y-2*stampFontSize
+		if s.Box != nil {
+			labelX, labelY = s.Box.LL.X, s.Box.UR.Y+stampLineWidth
+			if labelY+2*stampFontSize > vp.UR.Y {
+				labelY = s.Box.LL.Y - stampLineWidth - 2*stampFontSize
+			}
+
+			box, err := api.ImageWatermarkForReader(bytes.NewReader(stampBoxPNG(s.Box)),
+				fmt.Sprintf("pos:bl, off:%.2f %.2f, scale:1 abs, rot:0", s.Box.LL.X-vp.LL.X, s.Box.LL.Y-vp.LL.Y),
+				true, false, types.POINTS)
+			if err != nil {
+				return nil, fmt.Errorf("error creating box stamp: %v", err)
+			}
+			watermarks[s.Page] = append(watermarks[s.Page], box)
+		}
+
+		label, err := api.TextWatermark(s.Text,
+			fmt.Sprintf("font:Helvetica, points:%d, pos:bl, off:%.2f %.2f, scale:1 abs, rot:0, fillcolor:%s, bgcolor:#FFFFFF",
+				stampFontSize, labelX-vp.LL.X, labelY-vp.LL.Y, stampColor),
+			true, false, types.POINTS)
+		if err != nil {
+			return nil, fmt.Errorf("error creating text stamp: %v", err)
+		}
+		watermarks[s.Page] = append(watermarks[s.Page], label)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var buf bytes.Buffer
+	if err := api.AddWatermarksSliceMap(f, &buf, watermarks, conf); err != nil {
+		return nil, fmt.Errorf("error stamping PDF: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// stampBoxPNG draws the outline of a box one pixel per point, so it is
+// stamped at its natural size.
+func stampBoxPNG(box *types.Rectangle) []byte {
+	w := min(max(int(math.Round(box.Width())), 2*stampLineWidth+1), maxStampBox)
+	h := min(max(int(math.Round(box.Height())), 2*stampLineWidth+1), maxStampBox)
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	outline := color.NRGBA{R: 0xE0, A: 0xFF}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if x < stampLineWidth || y < stampLineWidth || x >= w-stampLineWidth || y >= h-stampLineWidth {
+				img.SetNRGBA(x, y, outline)
+			}
+		}
+	}
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	return buf.Bytes()
+}
+
+// saveAnnotatedPDF stamps the barcodes onto a copy of the PDF, whose pages
+// are laid out as layouts, and saves it under key in the output location,
+// leaving the original alone. It returns where the copy was saved.
+func saveAnnotatedPDF(ctx context.Context, path, key string, barcodes []Barcode, layouts []pageLayout, output string, conf *model.Configuration) (string, error) {
+	stamps := stampsForBarcodes(barcodes, layouts)
+	data, err := guarded(func() ([]byte, error) {
+		return annotatePDF(path, stamps, layouts, conf)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	store, prefix, err := openObjectStore(output)
+	if err != nil {
+		return "", err
+	}
+	if err := store.Put(ctx, prefix+key, data, "application/pdf"); err != nil {
+		return "", err
+	}
+	return store.Location(prefix + key), nil
+}
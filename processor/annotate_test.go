@@ -0,0 +1,227 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
+)
+
+func TestPlaceRegion(t *testing.T) {
+	// An image of 300x80 pixels drawn at 150x40 points from (20, 700)
+	placement := pdfMatrix{150, 0, 0, 40, 20, 700}
+	tests := []struct {
+		name      string
+		placement pdfMatrix
+		region    image.Rectangle
+		want      *types.Rectangle
+	}{
+		{"Whole image", placement, image.Rect(0, 0, 300, 80), types.NewRectangle(20, 700, 170, 740)},
+		{"Top-left quarter", placement, image.Rect(0, 0, 150, 40), types.NewRectangle(20, 720, 95, 740)},
+		{"Rotated a quarter turn", pdfMatrix{0, 150, -40, 0, 100, 100}, image.Rect(0, 0, 300, 80), types.NewRectangle(60, 100, 100, 250)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := placeRegion(tt.placement, 300, 80, tt.region)
+			if !sameRectangle(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPlaceBarcodes(t *testing.T) {
+	images := map[string]pdfImage{
+		"input_1_Im0.png": {Name: "input_1_Im0.png", Page: 1, Resource: "Im0", Image: image.NewGray(image.Rect(0, 0, 300, 80))},
+		"input_1_Im1.png": {Name: "input_1_Im1.png", Page: 1, Resource: "Im1", Image: image.NewGray(image.Rect(0, 0, 100, 100))},
+	}
+	layouts := []pageLayout{{
+		Viewport: *types.NewRectangle(0, 0, 595, 842),
+		Images:   map[string]pdfMatrix{"Im0": {150, 0, 0, 40, 20, 700}},
+	}}
+	barcodes := []Barcode{
+		{Text: "A-1", Page: 1, Image: "input_1_Im0.png", ImageRegion: &ImageRegion{Width: 150, Height: 40}},
+		// Not placed by the content stream, so it covers the page
+		{Text: "B-2", Page: 1, Image: "input_1_Im1.png"},
+		{Text: "C-3", Page: 2, Image: "input_2_Im0.png"},
+	}
+	placeBarcodes(barcodes, images, layouts)
+
+	want := []*PageRegion{
+		{X: 20, Y: 720, Width: 75, Height: 20},
+		{X: 0, Y: 0, Width: 595, Height: 842},
+		nil,
+	}
+	for i, b := range barcodes {
+		if (b.Region == nil) != (want[i] == nil) || b.Region != nil && *b.Region != *want[i] {
+			t.Errorf("barcode %q: got region %+v, want %+v", b.Text, b.Region, want[i])
+		}
+	}
+}
+
+func TestStampsForBarcodes(t *testing.T) {
+	layouts := []pageLayout{{Viewport: *types.NewRectangle(0, 0, 595, 842)}}
+	barcodes := []Barcode{
+		{Text: "A-1", Page: 1, Image: "input_1_Im0.png", Region: &PageRegion{X: 20, Y: 720, Width: 75, Height: 20}},
+		{Text: "B-2", Page: 1},
+		{Text: "C-3", Page: 2, Region: &PageRegion{Width: 10, Height: 10}},
+	}
+	stamps := stampsForBarcodes(barcodes, layouts)
+	if len(stamps) != 2 {
+		t.Fatalf("got %d stamps, want 2", len(stamps))
+	}
+	// The box is the region reported for the barcode
+	if !sameRectangle(stamps[0].Box, types.NewRectangle(20, 720, 95, 740)) {
+		t.Errorf("got box %v for %q, want its region", stamps[0].Box, stamps[0].Text)
+	}
+	if stamps[1].Box != nil {
+		t.Errorf("got box %v for a barcode without a region", stamps[1].Box)
+	}
+}
+
+func TestCollectImagePlacements(t *testing.T) {
+	path := writeTestPDF(t, testPDFPage{
+		content: "q 2 0 0 2 0 0 cm q 150 0 0 40 20 300 cm /Im0 Do Q /Im1 Do Q /Im0 Do BT (q) Tj ET",
+		images: []testPDFImage{
+			{"/Width 1 /Height 1 /ColorSpace /DeviceGray /BitsPerComponent 8", []byte{0}},
+			{"/Width 1 /Height 1 /ColorSpace /DeviceGray /BitsPerComponent 8", []byte{0}},
+		},
+	})
+	layouts, err := readPageLayouts(readTestContext(t, path), 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(layouts) != 1 {
+		t.Fatalf("got %d layouts, want 1", len(layouts))
+	}
+	if vp := layouts[0].Viewport; vp.Width() != 595 || vp.Height() != 842 {
+		t.Errorf("got viewport %v, want the media box", vp)
+	}
+	want := map[string]pdfMatrix{
+		// Only the first placement counts
+		"Im0": {300, 0, 0, 80, 40, 600},
+		"Im1": {2, 0, 0, 2, 0, 0},
+	}
+	if len(layouts[0].Images) != len(want) {
+		t.Errorf("got placements %v, want %v", layouts[0].Images, want)
+	}
+	for name, m := range want {
+		if got := layouts[0].Images[name]; got != m {
+			t.Errorf("%s: got %v, want %v", name, got, m)
+		}
+	}
+}
+
+func TestAnnotatePDF(t *testing.T) {
+	path := writeTestPDF(t, testPDFPage{}, testPDFPage{})
+	original, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read test PDF: %v", err)
+	}
+	conf := model.NewDefaultConfiguration()
+	conf.ValidationMode = model.ValidationRelaxed
+	layouts, err := readPageLayouts(readTestContext(t, path), 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	stamps := []stamp{
+		{Page: 1, Text: "ABC-123", Box: types.NewRectangle(20, 700, 170, 740)},
+		// Too close to the top for a label above the box
+		{Page: 1, Text: "TOP", Box: types.NewRectangle(20, 820, 120, 840)},
+		{Page: 2, Text: "NO-BOX"},
+	}
+	data, err := annotatePDF(path, stamps, layouts, conf)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ctx, err := api.ReadContext(bytes.NewReader(data), conf)
+	if err != nil {
+		t.Fatalf("annotated copy is unreadable: %v", err)
+	}
+	if err := ctx.EnsurePageCount(); err != nil || ctx.PageCount != 2 {
+		t.Errorf("got %d pages (%v), want 2", ctx.PageCount, err)
+	}
+	if found, err := api.HasWatermarks(bytes.NewReader(data), conf); err != nil || !found {
+		t.Errorf("annotated copy has no stamps (%v)", err)
+	}
+	after, err := os.ReadFile(path)
+	if err != nil || !bytes.Equal(after, original) {
+		t.Errorf("original PDF was changed")
+	}
+}
+
+func TestHandleRequestAnnotate(t *testing.T) {
+	ctx := withLogger(context.Background(), discardLogger)
+
+	var payload BarcodeData
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&payload)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	img := barcodeImage(t, "STAMP-1")
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	path := writeTestPDF(t, testPDFPage{
+		content: drawImages(1),
+		images: []testPDFImage{{
+			fmt.Sprintf("/Width %d /Height %d /ColorSpace /DeviceGray /BitsPerComponent 8", w, h),
+			img.Pix,
+		}},
+	})
+	output := t.TempDir()
+
+	os.Setenv("TEST_PDF_PATH", path)
+	os.Setenv("PROFILES_CONFIG", fmt.Sprintf(`{"profiles": [{"name": "stamped", "annotate_output": %q}]}`, output))
+	os.Setenv("WEBHOOK_URL", server.URL)
+	os.Setenv("WEBHOOK_TOKEN", "test-token")
+	defer func() {
+		os.Unsetenv("TEST_PDF_PATH")
+		os.Unsetenv("PROFILES_CONFIG")
+		os.Unsetenv("WEBHOOK_URL")
+		os.Unsetenv("WEBHOOK_TOKEN")
+	}()
+
+	response, err := HandleRequest(ctx, events.S3Event{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if response.StatusCode != 200 {
+		t.Fatalf("got status %d, want 200", response.StatusCode)
+	}
+	want := filepath.Join(output, path)
+	if payload.Annotated != want {
+		t.Fatalf("webhook got annotated copy %q, want %q", payload.Annotated, want)
+	}
+	data, err := os.ReadFile(want)
+	if err != nil {
+		t.Fatalf("annotated copy was not saved: %v", err)
+	}
+	conf := model.NewDefaultConfiguration()
+	conf.ValidationMode = model.ValidationRelaxed
+	if found, err := api.HasWatermarks(bytes.NewReader(data), conf); err != nil || !found {
+		t.Errorf("annotated copy has no stamps (%v)", err)
+	}
+}
+
+func sameRectangle(a, b *types.Rectangle) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	near := func(x, y float64) bool { return math.Abs(x-y) < 1e-6 }
+	return near(a.LL.X, b.LL.X) && near(a.LL.Y, b.LL.Y) && near(a.UR.X, b.UR.X) && near(a.UR.Y, b.UR.Y)
+}
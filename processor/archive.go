@@ -0,0 +1,295 @@
+package processor
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Default limits for unpacking archives, guarding against zip bombs.
+const (
+	defaultArchiveMaxEntries = 100
+	defaultArchiveMaxBytes   = 256 << 20
+	defaultArchiveMaxDepth   = 3
+)
+
+// archiveLimits bound what unpackArchive reads from an archive, counting the
+// entries and uncompressed bytes of nested archives too.
+type archiveLimits struct {
+	maxEntries int
+	maxBytes   int64
+	// maxDepth is the number of archives that may be nested in each other,
+	// counting the outermost one
+	maxDepth int
+}
+
+// getArchiveLimits reads ARCHIVE_MAX_ENTRIES, ARCHIVE_MAX_BYTES and
+// ARCHIVE_MAX_DEPTH. Invalid values are logged and the defaults used.
+func getArchiveLimits(ctx context.Context) archiveLimits {
+	limits := archiveLimits{
+		maxEntries: defaultArchiveMaxEntries,
+		maxBytes:   defaultArchiveMaxBytes,
+		maxDepth:   defaultArchiveMaxDepth,
+	}
+	for _, setting := range []struct {
+		env   string
+		apply func(n int64)
+	}{
+		{"ARCHIVE_MAX_ENTRIES", func(n int64) { limits.maxEntries = int(n) }},
+		{"ARCHIVE_MAX_BYTES", func(n int64) { limits.maxBytes = n }},
+		{"ARCHIVE_MAX_DEPTH", func(n int64) { limits.maxDepth = int(n) }},
+	} {
+		value := os.Getenv(setting.env)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n <= 0 {
+			loggerFrom(ctx).Warn("Invalid archive limit, using the default", "setting", setting.env, "value", value)
+			continue
+		}
+		setting.apply(n)
+	}
+	return limits
+}
+
+// archiveDocument is a PDF or image unpacked from an archive. Its key joins
+// the keys of the archives it was found in with "!/", as in
+// "archive.zip!/inner.pdf".
+type archiveDocument struct {
+	Key  string
+	Data []byte
+}
+
+// processArchive unpacks a ZIP archive or email and processes each document
+// in it, which sends its barcodes to the webhook under its composite key. A
+// document that fails is reported in its result and the others still run;
+// the documents' errors are returned joined.
+func processArchive(ctx context.Context, bucket, key string, data []byte, format string, pageLimit int) (Response, error) {
+	logger := loggerFrom(ctx)
+	documents, err := unpackArchive(ctx, key, data, format, getArchiveLimits(ctx))
+	if err != nil {
+		logger.Error("Error unpacking archive", "error", err)
+		return Response{StatusCode: 400, Body: fmt.Sprintf("Error unpacking archive: %v", err)}, processingError(ErrorParse, err)
+	}
+	if len(documents) == 0 {
+		return Response{StatusCode: 400, Body: "No PDFs or images in archive"}, processingError(ErrorParse, fmt.Errorf("no PDFs or images in archive %s", key))
+	}
+	logger.Info("Unpacked archive", "documents", len(documents))
+
+	body := ResponseBody{
+		Bucket:   bucket,
+		Key:      key,
+		Barcodes: []string{},
+	}
+	var errs []error
+	for _, document := range documents {
+		response, err := processDocument(withLogAttrs(ctx, "document", document.Key), bucket, document.Key, document.Data, pageLimit)
+		result := DocumentResponse{Key: document.Key, StatusCode: response.StatusCode}
+		var documentBody ResponseBody
+		if json.Unmarshal([]byte(response.Body), &documentBody) == nil {
+			result.Result = &documentBody
+			body.Barcodes = append(body.Barcodes, documentBody.Barcodes...)
+		} else {
+			result.Error = response.Body
+		}
+		if err != nil {
+			logger.Error("Error processing document", "document", document.Key, "error", err)
+			errs = append(errs, fmt.Errorf("%s: %w", document.Key, err))
+			if result.Error == "" {
+				result.Error = err.Error()
+			}
+		}
+		body.Documents = append(body.Documents, result)
+	}
+
+	jsonBody, _ := json.Marshal(body)
+	return Response{
+		StatusCode: 200,
+		Body:       string(jsonBody),
+	}, errors.Join(errs...)
+}
+
+// isArchiveFormat reports whether an input format holds other documents.
+func isArchiveFormat(format string) bool {
+	return format == inputZIP || format == inputEML
+}
+
+// unpackArchive returns the PDFs and images in a ZIP archive or email, and
+// in the archives and emails nested in it. Other files are skipped. Going
+// over a limit fails the whole archive.
+func unpackArchive(ctx context.Context, key string, data []byte, format string, limits archiveLimits) ([]archiveDocument, error) {
+	u := &archiveUnpacker{limits: limits, logger: loggerFrom(ctx)}
+	if err := u.unpack(key, data, format, 1); err != nil {
+		return nil, err
+	}
+	return u.documents, nil
+}
+
+// archiveUnpacker keeps count of what has been unpacked against the limits.
+type archiveUnpacker struct {
+	limits    archiveLimits
+	logger    *slog.Logger
+	entries   int
+	bytes     int64
+	documents []archiveDocument
+}
+
+func (u *archiveUnpacker) unpack(key string, data []byte, format string, depth int) error {
+	if depth > u.limits.maxDepth {
+		return fmt.Errorf("archive %s is nested more than %d deep", key, u.limits.maxDepth)
+	}
+	if format == inputZIP {
+		return u.unpackZIP(key, data, depth)
+	}
+	return u.unpackEML(key, data, depth)
+}
+
+// add keeps a PDF or image, unpacks a nested archive and skips anything else.
+func (u *archiveUnpacker) add(key string, data []byte, depth int) error {
+	format := sniffInput(data)
+	switch {
+	case isArchiveFormat(format):
+		return u.unpack(key, data, format, depth+1)
+	case format != "":
+		u.documents = append(u.documents, archiveDocument{Key: key, Data: data})
+	default:
+		u.logger.Warn("Skipping archive entry that is not a PDF or image", "entry", key)
+	}
+	return nil
+}
+
+// read reads one entry, counting it and its uncompressed size.
+func (u *archiveUnpacker) read(key string, r io.Reader) ([]byte, error) {
+	u.entries++
+	if u.entries > u.limits.maxEntries {
+		return nil, fmt.Errorf("archive has more than %d entries", u.limits.maxEntries)
+	}
+	remaining := u.limits.maxBytes - u.bytes
+	data, err := io.ReadAll(io.LimitReader(r, remaining+1))
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", key, err)
+	}
+	u.bytes += int64(len(data))
+	if u.bytes > u.limits.maxBytes {
+		return nil, fmt.Errorf("archive unpacks to more than %d bytes", u.limits.maxBytes)
+	}
+	return data, nil
+}
+
+func (u *archiveUnpacker) unpackZIP(key string, data []byte, depth int) error {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return fmt.Errorf("error reading ZIP archive %s: %v", key, err)
+	}
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		entryKey := key + "!/" + f.Name
+		rc, err := f.Open()
+		if err != nil {
+			return fmt.Errorf("error opening %s: %v", entryKey, err)
+		}
+		entry, err := u.read(entryKey, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+		if err := u.add(entryKey, entry, depth); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (u *archiveUnpacker) unpackEML(key string, data []byte, depth int) error {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("error reading email %s: %v", key, err)
+	}
+	parts := 0
+	return u.unpackMIMEPart(key, msg.Header, msg.Body, depth, &parts)
+}
+
+// mimeHeader is the header of an email or of one of its parts.
+type mimeHeader interface {
+	Get(name string) string
+}
+
+// unpackMIMEPart walks the parts of a multipart body and adds the content of
+// each leaf part. Parts are named by their file name, or numbered.
+func (u *archiveUnpacker) unpackMIMEPart(key string, header mimeHeader, body io.Reader, depth int, parts *int) error {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("error reading email %s: %v", key, err)
+			}
+			if err := u.unpackMIMEPart(key, part.Header, part, depth, parts); err != nil {
+				return err
+			}
+		}
+	}
+
+	*parts++
+	name := mimePartName(header, params)
+	if name == "" {
+		name = fmt.Sprintf("part%d", *parts)
+	}
+	partKey := key + "!/" + name
+	content, err := u.read(partKey, transferDecoder(header.Get("Content-Transfer-Encoding"), body))
+	if err != nil {
+		return err
+	}
+	return u.add(partKey, content, depth)
+}
+
+// mimePartName returns the file name of a MIME part, if it has one.
+func mimePartName(header mimeHeader, contentTypeParams map[string]string) string {
+	if _, params, err := mime.ParseMediaType(header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		return decodeMIMEWords(params["filename"])
+	}
+	return decodeMIMEWords(contentTypeParams["name"])
+}
+
+func decodeMIMEWords(s string) string {
+	decoded, err := new(mime.WordDecoder).DecodeHeader(s)
+	if err != nil {
+		return s
+	}
+	return decoded
+}
+
+// transferDecoder undoes a Content-Transfer-Encoding.
+func transferDecoder(encoding string, r io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		// The decoder skips the line breaks
+		return base64.NewDecoder(base64.StdEncoding, r)
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	}
+	return r
+}
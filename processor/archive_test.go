@@ -0,0 +1,312 @@
+package processor
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// zipEntry is one file for writeZIP.
+type zipEntry struct {
+	name string
+	data []byte
+}
+
+func writeZIP(t testing.TB, entries ...zipEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, entry := range entries {
+		w, err := zw.Create(entry.name)
+		if err != nil {
+			t.Fatalf("failed to create ZIP entry: %v", err)
+		}
+		w.Write(entry.data)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("failed to write ZIP: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// writeEML writes a multipart email with a text body and the given entries
+// as base64 attachments.
+func writeEML(attachments ...zipEntry) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("From: scanner@example.com\r\nTo: inbox@example.com\r\nSubject: Scans\r\nMIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: multipart/mixed; boundary=\"outer\"\r\n\r\n")
+	buf.WriteString("--outer\r\nContent-Type: text/plain\r\n\r\nSee attached.\r\n")
+	for _, attachment := range attachments {
+		buf.WriteString("--outer\r\nContent-Type: application/octet-stream\r\nContent-Transfer-Encoding: base64\r\n")
+		fmt.Fprintf(&buf, "Content-Disposition: attachment; filename=%q\r\n\r\n", attachment.name)
+		encoded := base64.StdEncoding.EncodeToString(attachment.data)
+		for len(encoded) > 76 {
+			buf.WriteString(encoded[:76] + "\r\n")
+			encoded = encoded[76:]
+		}
+		buf.WriteString(encoded + "\r\n")
+	}
+	buf.WriteString("--outer--\r\n")
+	return buf.Bytes()
+}
+
+func TestUnpackArchive(t *testing.T) {
+	ctx := withLogger(context.Background(), discardLogger)
+
+	pdf := []byte("%PDF-1.7\n")
+	var pngData bytes.Buffer
+	png.Encode(&pngData, barcodeImage(t, "ZIP-1"))
+	limits := archiveLimits{maxEntries: 10, maxBytes: 1 << 20, maxDepth: 3}
+
+	tests := []struct {
+		name    string
+		data    []byte
+		format  string
+		limits  archiveLimits
+		want    []string
+		wantErr string
+	}{
+		{
+			name: "ZIP with a PDF, an image and a text file",
+			data: writeZIP(t,
+				zipEntry{"invoices/a.pdf", pdf},
+				zipEntry{"scan.png", pngData.Bytes()},
+				zipEntry{"readme.txt", []byte("hello")}),
+			format: inputZIP,
+			limits: limits,
+			want:   []string{"upload.zip!/invoices/a.pdf", "upload.zip!/scan.png"},
+		},
+		{
+			name:   "Nested ZIP",
+			data:   writeZIP(t, zipEntry{"inner.zip", writeZIP(t, zipEntry{"b.pdf", pdf})}),
+			format: inputZIP,
+			limits: limits,
+			want:   []string{"upload.zip!/inner.zip!/b.pdf"},
+		},
+		{
+			name:   "Email with attachments",
+			data:   writeEML(zipEntry{"a.pdf", pdf}, zipEntry{"more.zip", writeZIP(t, zipEntry{"b.pdf", pdf})}),
+			format: inputEML,
+			limits: limits,
+			want:   []string{"upload.zip!/a.pdf", "upload.zip!/more.zip!/b.pdf"},
+		},
+		{
+			name:    "Too many entries",
+			data:    writeZIP(t, zipEntry{"a.pdf", pdf}, zipEntry{"b.pdf", pdf}, zipEntry{"c.pdf", pdf}),
+			format:  inputZIP,
+			limits:  archiveLimits{maxEntries: 2, maxBytes: 1 << 20, maxDepth: 3},
+			wantErr: "more than 2 entries",
+		},
+		{
+			name:    "Too large",
+			data:    writeZIP(t, zipEntry{"a.pdf", append(append([]byte{}, pdf...), make([]byte, 4096)...)}),
+			format:  inputZIP,
+			limits:  archiveLimits{maxEntries: 10, maxBytes: 1024, maxDepth: 3},
+			wantErr: "more than 1024 bytes",
+		},
+		{
+			name:    "Nested too deep",
+			data:    writeZIP(t, zipEntry{"1.zip", writeZIP(t, zipEntry{"2.zip", writeZIP(t, zipEntry{"c.pdf", pdf})})}),
+			format:  inputZIP,
+			limits:  archiveLimits{maxEntries: 10, maxBytes: 1 << 20, maxDepth: 2},
+			wantErr: "nested more than 2 deep",
+		},
+		{
+			name:    "Corrupt ZIP",
+			data:    []byte("PK\x03\x04 not really"),
+			format:  inputZIP,
+			limits:  limits,
+			wantErr: "error reading ZIP archive",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			documents, err := unpackArchive(ctx, "upload.zip", tt.data, tt.format, tt.limits)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want one mentioning %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var got []string
+			for _, document := range documents {
+				got = append(got, document.Key)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("got documents %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSniffInputArchives(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"ZIP", writeZIP(t, zipEntry{"a.txt", []byte("a")}), inputZIP},
+		{"Empty ZIP", writeZIP(t), inputZIP},
+		{"Email", writeEML(), inputEML},
+		{"Header-like text", []byte("Subject: hello\r\n\r\nbody"), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sniffInput(tt.data); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetArchiveLimits(t *testing.T) {
+	ctx := withLogger(context.Background(), discardLogger)
+
+	os.Setenv("ARCHIVE_MAX_ENTRIES", "5")
+	os.Setenv("ARCHIVE_MAX_BYTES", "not-a-number")
+	os.Setenv("ARCHIVE_MAX_DEPTH", "-1")
+	defer func() {
+		os.Unsetenv("ARCHIVE_MAX_ENTRIES")
+		os.Unsetenv("ARCHIVE_MAX_BYTES")
+		os.Unsetenv("ARCHIVE_MAX_DEPTH")
+	}()
+
+	want := archiveLimits{maxEntries: 5, maxBytes: defaultArchiveMaxBytes, maxDepth: defaultArchiveMaxDepth}
+	if got := getArchiveLimits(ctx); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestHandleRequestZIP(t *testing.T) {
+	ctx := withLogger(context.Background(), discardLogger)
+
+	var mu sync.Mutex
+	payloads := map[string]BarcodeData{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload BarcodeData
+		json.NewDecoder(r.Body).Decode(&payload)
+		mu.Lock()
+		// The last call for each document carries all its barcodes
+		payloads[payload.S3Key] = payload
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	sample, err := os.ReadFile("../test/pdfs/sample2.pdf")
+	if err != nil {
+		t.Fatalf("failed to read sample PDF: %v", err)
+	}
+	var pngData bytes.Buffer
+	png.Encode(&pngData, barcodeImage(t, "ZIP-1"))
+	path := filepath.Join(t.TempDir(), "batch.zip")
+	archive := writeZIP(t,
+		zipEntry{"sample2.pdf", sample},
+		zipEntry{"photo.png", pngData.Bytes()},
+		zipEntry{"notes.txt", []byte("not a document")})
+	if err := os.WriteFile(path, archive, 0644); err != nil {
+		t.Fatalf("failed to write ZIP: %v", err)
+	}
+
+	os.Setenv("TEST_PDF_PATH", path)
+	os.Setenv("WEBHOOK_URL", server.URL)
+	os.Setenv("WEBHOOK_TOKEN", "test-token")
+	defer func() {
+		os.Unsetenv("TEST_PDF_PATH")
+		os.Unsetenv("WEBHOOK_URL")
+		os.Unsetenv("WEBHOOK_TOKEN")
+	}()
+
+	response, err := HandleRequest(ctx, events.S3Event{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if response.StatusCode != 200 {
+		t.Fatalf("got status %d, want 200", response.StatusCode)
+	}
+	var body ResponseBody
+	if err := json.Unmarshal([]byte(response.Body), &body); err != nil {
+		t.Fatalf("invalid response body: %v", err)
+	}
+	if len(body.Documents) != 2 {
+		t.Fatalf("got %d documents, want 2", len(body.Documents))
+	}
+
+	wantKeys := []string{path + "!/photo.png", path + "!/sample2.pdf"}
+	var gotKeys []string
+	for key, payload := range payloads {
+		gotKeys = append(gotKeys, key)
+		if len(payload.BarcodeArray) == 0 {
+			t.Errorf("no barcodes sent for %s", key)
+		}
+	}
+	sort.Strings(gotKeys)
+	if strings.Join(gotKeys, ",") != strings.Join(wantKeys, ",") {
+		t.Errorf("webhook got keys %v, want %v", gotKeys, wantKeys)
+	}
+	if got := payloads[path+"!/photo.png"].BarcodeArray; len(got) != 1 || got[0] != "ZIP-1" {
+		t.Errorf("got barcodes %v for the image, want [ZIP-1]", got)
+	}
+}
+
+func TestProcessDocumentPageLimit(t *testing.T) {
+	ctx := withLogger(context.Background(), discardLogger)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	os.Setenv("WEBHOOK_URL", server.URL)
+	os.Setenv("WEBHOOK_TOKEN", "test-token")
+	defer func() {
+		os.Unsetenv("WEBHOOK_URL")
+		os.Unsetenv("WEBHOOK_TOKEN")
+	}()
+
+	var pages []testPDFPage
+	for _, text := range []string{"PAGE-1", "PAGE-2"} {
+		img := barcodeImage(t, text)
+		pages = append(pages, testPDFPage{
+			content: drawImages(1),
+			images: []testPDFImage{{
+				fmt.Sprintf("/Width %d /Height %d /ColorSpace /DeviceGray /BitsPerComponent 8", img.Bounds().Dx(), img.Bounds().Dy()),
+				img.Pix,
+			}},
+		})
+	}
+	data, err := os.ReadFile(writeTestPDF(t, pages...))
+	if err != nil {
+		t.Fatalf("failed to read test PDF: %v", err)
+	}
+
+	// The limit passed in holds, whatever PDF_PAGE_LIMIT is
+	response, err := processDocument(ctx, "test-bucket", "two-pages.pdf", data, 2)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var body ResponseBody
+	if err := json.Unmarshal([]byte(response.Body), &body); err != nil {
+		t.Fatalf("invalid response body: %v", err)
+	}
+	if strings.Join(body.Barcodes, ",") != "PAGE-1,PAGE-2" {
+		t.Errorf("got barcodes %v, want both pages", body.Barcodes)
+	}
+}
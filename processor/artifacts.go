@@ -0,0 +1,131 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"sort"
+
+	"golang.org/x/image/draw"
+)
+
+const (
+	// thumbnailMaxDimension is the longer side of page thumbnails, in pixels
+	thumbnailMaxDimension = 256
+	thumbnailQuality      = 75
+	// cropMargin widens barcode crops on each side by this share of their
+	// size, so the quiet zone and any damage around the code are kept
+	cropMargin = 0.1
+)
+
+// Kinds of artifact.
+const (
+	artifactThumbnail = "thumbnail"
+	artifactCrop      = "crop"
+)
+
+// Artifact is a file saved alongside the results to show what was scanned.
+type Artifact struct {
+	Kind string `json:"kind"`
+	Page int    `json:"page,omitempty"`
+	// Barcode is the value decoded from a crop
+	Barcode  string `json:"barcode,omitempty"`
+	Location string `json:"location"`
+}
+
+// saveArtifacts saves a thumbnail of each page and a crop of each barcode
+// under key in the output location. A page's thumbnail is taken from its
+// largest image, which for scans is the page itself. Artifacts saved before
+// an error are returned with it.
+func saveArtifacts(ctx context.Context, key string, pdfImages []pdfImage, barcodes []Barcode, output string) ([]Artifact, error) {
+	store, prefix, err := openObjectStore(output)
+	if err != nil {
+		return nil, err
+	}
+
+	pageImages := map[int]image.Image{}
+	images := map[string]image.Image{}
+	for _, img := range pdfImages {
+		if img.Err != nil || img.Image == nil {
+			continue
+		}
+		images[img.Name] = img.Image
+		if largest, ok := pageImages[img.Page]; !ok || imageArea(img.Image) > imageArea(largest) {
+			pageImages[img.Page] = img.Image
+		}
+	}
+	pages := make([]int, 0, len(pageImages))
+	for page := range pageImages {
+		pages = append(pages, page)
+	}
+	sort.Ints(pages)
+
+	var artifacts []Artifact
+	for _, page := range pages {
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, thumbnail(pageImages[page]), &jpeg.Options{Quality: thumbnailQuality}); err != nil {
+			return artifacts, fmt.Errorf("error encoding thumbnail of page %d: %v", page, err)
+		}
+		name := fmt.Sprintf("%s%s/page-%d.jpg", prefix, key, page)
+		if err := store.Put(ctx, name, buf.Bytes(), "image/jpeg"); err != nil {
+			return artifacts, err
+		}
+		artifacts = append(artifacts, Artifact{Kind: artifactThumbnail, Page: page, Location: store.Location(name)})
+	}
+
+	for i, barcode := range barcodes {
+		img, ok := images[barcode.Image]
+		if !ok || barcode.ImageRegion == nil {
+			continue
+		}
+		crop := cropRegion(img, *barcode.ImageRegion)
+		if crop.Bounds().Empty() {
+			continue
+		}
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, crop); err != nil {
+			return artifacts, fmt.Errorf("error encoding crop of barcode %q: %v", barcode.Text, err)
+		}
+		name := fmt.Sprintf("%s%s/barcode-%d.png", prefix, key, i+1)
+		if err := store.Put(ctx, name, buf.Bytes(), "image/png"); err != nil {
+			return artifacts, err
+		}
+		artifacts = append(artifacts, Artifact{Kind: artifactCrop, Page: barcode.Page, Barcode: barcode.Text, Location: store.Location(name)})
+	}
+	return artifacts, nil
+}
+
+func imageArea(img image.Image) int {
+	return img.Bounds().Dx() * img.Bounds().Dy()
+}
+
+// thumbnail scales an image down so its longer side is at most
+// thumbnailMaxDimension. Smaller images are kept at their size.
+func thumbnail(img image.Image) image.Image {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	longer := max(w, h)
+	if longer <= thumbnailMaxDimension {
+		return img
+	}
+	w = max(1, w*thumbnailMaxDimension/longer)
+	h = max(1, h*thumbnailMaxDimension/longer)
+	out := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(out, out.Bounds(), img, bounds, draw.Src, nil)
+	return out
+}
+
+// cropRegion cuts a barcode's region, widened by cropMargin, out of the image
+// it was found in.
+func cropRegion(img image.Image, region ImageRegion) image.Image {
+	bounds := img.Bounds()
+	marginX := int(float64(region.Width) * cropMargin)
+	marginY := int(float64(region.Height) * cropMargin)
+	r := image.Rect(region.X-marginX, region.Y-marginY, region.X+region.Width+marginX, region.Y+region.Height+marginY).
+		Add(bounds.Min).
+		Intersect(bounds)
+	return cropImage(img, r)
+}
@@ -0,0 +1,163 @@
+package processor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestThumbnail(t *testing.T) {
+	tests := []struct {
+		name  string
+		w, h  int
+		wantW int
+		wantH int
+	}{
+		{"Portrait page", 2480, 3508, 180, 256},
+		{"Landscape page", 1000, 500, 256, 128},
+		{"Small image", 200, 100, 200, 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := thumbnail(image.NewGray(image.Rect(0, 0, tt.w, tt.h))).Bounds()
+			if got.Dx() != tt.wantW || got.Dy() != tt.wantH {
+				t.Errorf("got %dx%d, want %dx%d", got.Dx(), got.Dy(), tt.wantW, tt.wantH)
+			}
+		})
+	}
+}
+
+func TestCropRegion(t *testing.T) {
+	tests := []struct {
+		name   string
+		bounds image.Rectangle
+		region ImageRegion
+		want   image.Rectangle
+	}{
+		{"With margin", image.Rect(0, 0, 500, 500), ImageRegion{X: 100, Y: 100, Width: 200, Height: 50}, image.Rect(80, 95, 320, 155)},
+		{"Clipped to the image", image.Rect(0, 0, 500, 500), ImageRegion{X: 0, Y: 480, Width: 100, Height: 20}, image.Rect(0, 478, 110, 500)},
+		{"Image not at the origin", image.Rect(10, 20, 510, 520), ImageRegion{X: 100, Y: 100, Width: 200, Height: 50}, image.Rect(90, 115, 330, 175)},
+		{"Outside the image", image.Rect(0, 0, 100, 100), ImageRegion{X: 200, Y: 200, Width: 10, Height: 10}, image.Rectangle{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := cropRegion(image.NewGray(tt.bounds), tt.region).Bounds()
+			if got != tt.want && !(got.Empty() && tt.want.Empty()) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSaveArtifacts(t *testing.T) {
+	output := t.TempDir()
+	pdfImages := []pdfImage{
+		{Name: "input_1_Im0.png", Page: 1, Image: image.NewGray(image.Rect(0, 0, 300, 80))},
+		{Name: "input_1_Im1.png", Page: 1, Image: image.NewGray(image.Rect(0, 0, 1240, 1754))},
+		{Name: "input_2_Im0.png", Page: 2, Image: image.NewGray(image.Rect(0, 0, 100, 100))},
+		{Name: "input_2_Im1.jpg", Page: 2, Err: fmt.Errorf("broken")},
+	}
+	barcodes := []Barcode{
+		{Text: "A-1", Page: 1, Image: "input_1_Im0.png", ImageRegion: &ImageRegion{X: 0, Y: 0, Width: 300, Height: 80}},
+		{Text: "B-2", Page: 2, Image: "input_2_Im1.jpg", ImageRegion: &ImageRegion{Width: 10, Height: 10}},
+		{Text: "C-3", Page: 2, Image: "input_2_Im0.png"},
+	}
+
+	artifacts, err := saveArtifacts(context.Background(), "scans/doc.pdf", pdfImages, barcodes, output)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []Artifact{
+		{Kind: artifactThumbnail, Page: 1, Location: filepath.Join(output, "scans/doc.pdf/page-1.jpg")},
+		{Kind: artifactThumbnail, Page: 2, Location: filepath.Join(output, "scans/doc.pdf/page-2.jpg")},
+		{Kind: artifactCrop, Page: 1, Barcode: "A-1", Location: filepath.Join(output, "scans/doc.pdf/barcode-1.png")},
+	}
+	if len(artifacts) != len(want) {
+		t.Fatalf("got %+v, want %+v", artifacts, want)
+	}
+	for i := range want {
+		if artifacts[i] != want[i] {
+			t.Errorf("artifact %d is %+v, want %+v", i, artifacts[i], want[i])
+		}
+	}
+
+	// The thumbnail of page 1 is taken from its largest image
+	f, err := os.Open(want[0].Location)
+	if err != nil {
+		t.Fatalf("thumbnail was not saved: %v", err)
+	}
+	defer f.Close()
+	if img, err := jpeg.Decode(f); err != nil || img.Bounds().Dy() != thumbnailMaxDimension {
+		t.Errorf("got thumbnail %v (%v), want the page image scaled down", img.Bounds(), err)
+	}
+}
+
+func TestHandleRequestArtifacts(t *testing.T) {
+	ctx := withLogger(context.Background(), discardLogger)
+
+	var payload BarcodeData
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&payload)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	img := barcodeImage(t, "CROP-7")
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	path := writeTestPDF(t, testPDFPage{
+		content: drawImages(1),
+		images: []testPDFImage{{
+			fmt.Sprintf("/Width %d /Height %d /ColorSpace /DeviceGray /BitsPerComponent 8", w, h),
+			img.Pix,
+		}},
+	})
+	output := t.TempDir()
+
+	os.Setenv("TEST_PDF_PATH", path)
+	os.Setenv("PROFILES_CONFIG", fmt.Sprintf(`{"profiles": [{"name": "artifacts", "artifact_output": %q}]}`, output))
+	os.Setenv("WEBHOOK_URL", server.URL)
+	os.Setenv("WEBHOOK_TOKEN", "test-token")
+	defer func() {
+		os.Unsetenv("TEST_PDF_PATH")
+		os.Unsetenv("PROFILES_CONFIG")
+		os.Unsetenv("WEBHOOK_URL")
+		os.Unsetenv("WEBHOOK_TOKEN")
+	}()
+
+	response, err := HandleRequest(ctx, events.S3Event{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if response.StatusCode != 200 {
+		t.Fatalf("got status %d, want 200", response.StatusCode)
+	}
+	if len(payload.Artifacts) != 2 {
+		t.Fatalf("webhook got artifacts %+v, want a thumbnail and a crop", payload.Artifacts)
+	}
+	crop := payload.Artifacts[1]
+	if crop.Kind != artifactCrop || crop.Barcode != "CROP-7" {
+		t.Fatalf("got %+v, want the crop of CROP-7", crop)
+	}
+	f, err := os.Open(crop.Location)
+	if err != nil {
+		t.Fatalf("crop was not saved: %v", err)
+	}
+	defer f.Close()
+	saved, err := png.Decode(f)
+	if err != nil {
+		t.Fatalf("crop is not a PNG: %v", err)
+	}
+	if text, err := extractBarcodeFromImage(saved); err != nil || text != "CROP-7" {
+		t.Errorf("crop decodes as %q (%v), want CROP-7", text, err)
+	}
+}
@@ -0,0 +1,124 @@
+package processor
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// resultCacheVersion changes when the scanning results for the same input
+// and settings may change, so older entries are no longer used.
+const resultCacheVersion = 1
+
+// documentScan is what scanning a document found, before it is sent to the
+// webhook. It is what the result cache keeps.
+type documentScan struct {
+	Barcodes    []Barcode         `json:"barcodes,omitempty"`
+	Undecodable []ImageError      `json:"undecodable,omitempty"`
+	Recovery    string            `json:"recovery,omitempty"`
+	TextMatches []TextMatch       `json:"text_matches,omitempty"`
+	Metadata    *DocumentMetadata `json:"metadata,omitempty"`
+	Images      int               `json:"images"`
+	Pages       int               `json:"pages"`
+	Created     time.Time         `json:"created"`
+}
+
+// getResultCache returns the store named by RESULT_CACHE, "s3://bucket/prefix"
+// or a local directory, and the key of a document's scan in it. The key is
+// the SHA-256 of the content followed by a hash of the settings the scan
+// depends on, so the same file uploaded under another key is not scanned
+// again, while a change of profile or preprocessing is. It returns a nil
+// store if RESULT_CACHE is not set, or if the profile saves outputs that need
+// the extracted images: annotated copies, artifacts or debug bundles.
+func getResultCache(ctx context.Context, data []byte, profile Profile, pageLimit int) (objectStore, string) {
+	location := os.Getenv("RESULT_CACHE")
+	if location == "" {
+		return nil, ""
+	}
+	if profile.AnnotateOutput != "" || profile.ArtifactOutput != "" || profile.DebugBundleOutput != "" {
+		return nil, ""
+	}
+	store, prefix, err := openObjectStore(location)
+	if err != nil {
+		loggerFrom(ctx).Warn("Error opening result cache, scanning document", "error", err)
+		return nil, ""
+	}
+	settings, err := scanSettingsHash(ctx, profile, pageLimit)
+	if err != nil {
+		loggerFrom(ctx).Warn("Error hashing scan settings, scanning document", "error", err)
+		return nil, ""
+	}
+	sum := sha256.Sum256(data)
+	return store, fmt.Sprintf("%s%s/%s.json", prefix, hex.EncodeToString(sum[:]), settings)
+}
+
+// scanSettingsHash hashes the effective profile: the profile itself, the
+// preprocessing chains, the page limit and the pages and symbologies of a
+// direct request.
+func scanSettingsHash(ctx context.Context, profile Profile, pageLimit int) (string, error) {
+	var chains []string
+	for _, chain := range getPreprocessChains(ctx) {
+		chains = append(chains, chain.name)
+	}
+	options := scanOptionsFrom(ctx)
+	settings, err := json.Marshal(struct {
+		Version     int      `json:"version"`
+		Profile     Profile  `json:"profile"`
+		Chains      []string `json:"chains"`
+		PageLimit   int      `json:"page_limit"`
+		FirstPage   int      `json:"first_page,omitempty"`
+		Symbologies []string `json:"symbologies,omitempty"`
+	}{resultCacheVersion, profile, chains, pageLimit, options.FirstPage, options.Symbologies})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(settings)
+	return hex.EncodeToString(sum[:16]), nil
+}
+
+// lookupCachedScan returns the cached scan under key, or nil if there is none
+// or the request is forced, whose new scan then replaces the entry. Cache
+// errors are logged and the document scanned again.
+func lookupCachedScan(ctx context.Context, store objectStore, key string) *documentScan {
+	if store == nil || forced(ctx) {
+		return nil
+	}
+	logger := loggerFrom(ctx)
+	data, err := store.Get(ctx, key)
+	if err != nil {
+		if !isNotFound(err) {
+			logger.Warn("Error reading result cache, scanning document", "error", err)
+		}
+		metricsFrom(ctx).count("CacheMisses", 1)
+		return nil
+	}
+	var scan documentScan
+	if err := json.Unmarshal(data, &scan); err != nil {
+		logger.Warn("Invalid result cache entry, scanning document", "location", store.Location(key), "error", err)
+		metricsFrom(ctx).count("CacheMisses", 1)
+		return nil
+	}
+	logger.Info("Using cached scan", "location", store.Location(key), "scanned", scan.Created)
+	metricsFrom(ctx).count("CacheHits", 1)
+	return &scan
+}
+
+// saveCachedScan stores a scan under key. Errors are logged.
+func saveCachedScan(ctx context.Context, store objectStore, key string, scan documentScan) {
+	if store == nil {
+		return
+	}
+	scan.Created = time.Now().UTC()
+	data, err := json.Marshal(scan)
+	if err != nil {
+		loggerFrom(ctx).Warn("Error encoding cached scan", "error", err)
+		return
+	}
+	if err := store.Put(ctx, key, data, "application/json"); err != nil {
+		loggerFrom(ctx).Warn("Error saving scan to result cache", "error", err)
+	}
+}
@@ -0,0 +1,201 @@
+package processor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestGetResultCache(t *testing.T) {
+	defer os.Unsetenv("RESULT_CACHE")
+	defer os.Unsetenv("PREPROCESS_CHAINS")
+	ctx := context.Background()
+	data := []byte("%PDF-1.4 test")
+
+	if store, _ := getResultCache(ctx, data, defaultProfile, 1); store != nil {
+		t.Error("got a result cache without RESULT_CACHE")
+	}
+
+	os.Setenv("RESULT_CACHE", t.TempDir())
+	_, key := getResultCache(ctx, data, defaultProfile, 1)
+	if key == "" {
+		t.Fatal("got no cache key")
+	}
+
+	tests := []struct {
+		name      string
+		data      []byte
+		profile   Profile
+		pageLimit int
+		chains    string
+		wantSame  bool
+		wantStore bool
+	}{
+		{"same input", data, defaultProfile, 1, "", true, true},
+		{"other content", []byte("%PDF-1.4 other"), defaultProfile, 1, "", false, true},
+		{"other profile", data, Profile{Name: "default", TextPatterns: []string{`INV-\d+`}}, 1, "", false, true},
+		{"other page limit", data, defaultProfile, 2, "", false, true},
+		{"other chains", data, defaultProfile, 1, "gray", false, true},
+		{"annotated output", data, Profile{Name: "stamped", AnnotateOutput: t.TempDir()}, 1, "", false, false},
+		{"artifact output", data, Profile{Name: "artifacts", ArtifactOutput: t.TempDir()}, 1, "", false, false},
+		{"debug bundle output", data, Profile{Name: "debug", DebugBundleOutput: t.TempDir()}, 1, "", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.chains != "" {
+				os.Setenv("PREPROCESS_CHAINS", tt.chains)
+				defer os.Unsetenv("PREPROCESS_CHAINS")
+			}
+			store, got := getResultCache(ctx, tt.data, tt.profile, tt.pageLimit)
+			if (store != nil) != tt.wantStore {
+				t.Fatalf("got store %v, want one: %v", store, tt.wantStore)
+			}
+			if tt.wantStore && (got == key) != tt.wantSame {
+				t.Errorf("got key %q against %q, want the same: %v", got, key, tt.wantSame)
+			}
+		})
+	}
+}
+
+func TestLookupCachedScan(t *testing.T) {
+	ctx := context.Background()
+	store := &dirStore{dir: t.TempDir()}
+
+	if scan := lookupCachedScan(ctx, store, "missing.json"); scan != nil {
+		t.Errorf("got %+v for a missing entry, want nil", scan)
+	}
+	if err := store.Put(ctx, "broken.json", []byte("{"), "application/json"); err != nil {
+		t.Fatal(err)
+	}
+	if scan := lookupCachedScan(ctx, store, "broken.json"); scan != nil {
+		t.Errorf("got %+v for an invalid entry, want nil", scan)
+	}
+
+	saveCachedScan(ctx, store, "scan.json", documentScan{
+		Barcodes: []Barcode{{Text: "CACHED-1", Format: "QR_CODE", Page: 1}},
+		Images:   2,
+		Pages:    1,
+	})
+	scan := lookupCachedScan(ctx, store, "scan.json")
+	if scan == nil {
+		t.Fatal("got no scan for a saved entry")
+	}
+	if len(scan.Barcodes) != 1 || scan.Barcodes[0].Text != "CACHED-1" || scan.Images != 2 || scan.Created.IsZero() {
+		t.Errorf("got %+v, want the saved scan", scan)
+	}
+}
+
+func TestProcessDocumentResultCache(t *testing.T) {
+	metricsOutput = io.Discard
+	defer func() { metricsOutput = os.Stdout }()
+
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	img := barcodeImage(t, "CACHE-1")
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	path := writeTestPDF(t, testPDFPage{
+		content: drawImages(1),
+		images: []testPDFImage{{
+			fmt.Sprintf("/Width %d /Height %d /ColorSpace /DeviceGray /BitsPerComponent 8", w, h),
+			img.Pix,
+		}},
+	})
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacheDir := t.TempDir()
+	os.Setenv("WEBHOOK_URL", server.URL)
+	os.Setenv("WEBHOOK_TOKEN", "test-token")
+	os.Setenv("RESULT_CACHE", cacheDir)
+	defer func() {
+		os.Unsetenv("WEBHOOK_URL")
+		os.Unsetenv("WEBHOOK_TOKEN")
+		os.Unsetenv("RESULT_CACHE")
+	}()
+
+	barcodesOf := func(response Response) []string {
+		t.Helper()
+		var body ResponseBody
+		if err := json.Unmarshal([]byte(response.Body), &body); err != nil {
+			t.Fatalf("invalid response body %q: %v", response.Body, err)
+		}
+		return body.Barcodes
+	}
+
+	ctx := withLogger(context.Background(), discardLogger)
+	first, err := processDocument(ctx, "bucket", "first.pdf", data, 1)
+	if err != nil {
+		t.Fatalf("first scan failed: %v", err)
+	}
+	if got := barcodesOf(first); len(got) != 1 || got[0] != "CACHE-1" {
+		t.Fatalf("got barcodes %v, want [CACHE-1]", got)
+	}
+	firstCalls := atomic.LoadInt32(&calls)
+
+	// Replace the cached barcode, so a result that comes from the cache can
+	// be told from a new scan
+	_, cacheKey := getResultCache(ctx, data, defaultProfile, 1)
+	entryPath := filepath.Join(cacheDir, filepath.FromSlash(cacheKey))
+	entry, err := os.ReadFile(entryPath)
+	if err != nil {
+		t.Fatalf("scan was not cached: %v", err)
+	}
+	var scan documentScan
+	if err := json.Unmarshal(entry, &scan); err != nil {
+		t.Fatal(err)
+	}
+	scan.Barcodes[0].Text = "FROM-CACHE"
+	entry, _ = json.Marshal(scan)
+	if err := os.WriteFile(entryPath, entry, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The same content under another key is answered from the cache, and
+	// still sent to the webhook
+	repeat, err := processDocument(ctx, "bucket", "copy.pdf", data, 1)
+	if err != nil {
+		t.Fatalf("cached scan failed: %v", err)
+	}
+	if got := barcodesOf(repeat); len(got) != 1 || got[0] != "FROM-CACHE" {
+		t.Errorf("got barcodes %v, want the cached [FROM-CACHE]", got)
+	}
+	if got := atomic.LoadInt32(&calls) - firstCalls; got != firstCalls {
+		t.Errorf("got %d webhook calls for a cached scan, want %d", got, firstCalls)
+	}
+
+	// A forced request scans the document again and replaces the entry
+	forcedResponse, err := processDocument(WithForce(ctx), "bucket", "copy.pdf", data, 1)
+	if err != nil {
+		t.Fatalf("forced scan failed: %v", err)
+	}
+	if got := barcodesOf(forcedResponse); len(got) != 1 || got[0] != "CACHE-1" {
+		t.Errorf("got barcodes %v when forced, want [CACHE-1]", got)
+	}
+	if scan := lookupCachedScan(ctx, &dirStore{dir: cacheDir}, cacheKey); scan == nil || scan.Barcodes[0].Text != "CACHE-1" {
+		t.Errorf("got cached scan %+v after a forced request, want the new scan", scan)
+	}
+
+	// A cached miss counts the images of the scan that was cached
+	scan.Barcodes = nil
+	entry, _ = json.Marshal(scan)
+	if err := os.WriteFile(entryPath, entry, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := processDocument(ctx, "bucket", "copy.pdf", data, 1); err == nil || !strings.Contains(err.Error(), "no barcode found in 1 images") {
+		t.Errorf("got error %v for a cached miss, want no barcode found in 1 images", err)
+	}
+}
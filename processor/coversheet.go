@@ -0,0 +1,203 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/makiuchi-d/gozxing"
+	"github.com/makiuchi-d/gozxing/datamatrix"
+	"github.com/makiuchi-d/gozxing/oned"
+	"github.com/makiuchi-d/gozxing/qrcode"
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
+)
+
+// Layout of generated cover sheets, in points on an A4 page.
+const (
+	coverSheetTitleSize = 24
+	coverSheetValueSize = 14
+	// coverSheetTitleOffset is the distance of the title from the top of the page
+	coverSheetTitleOffset = 120
+	// coverSheetValueGap is the space between the barcode and the value below it
+	coverSheetValueGap = 24
+)
+
+// coverSheetSymbology is how a cover sheet barcode is drawn: its writer and
+// its size in pixels, which is also its size on the page in points.
+type coverSheetSymbology struct {
+	format        gozxing.BarcodeFormat
+	writer        func() gozxing.Writer
+	width, height int
+}
+
+func linearSymbology(format gozxing.BarcodeFormat, writer func() gozxing.Writer) coverSheetSymbology {
+	return coverSheetSymbology{format, writer, 400, 120}
+}
+
+func matrixSymbology(format gozxing.BarcodeFormat, writer func() gozxing.Writer) coverSheetSymbology {
+	return coverSheetSymbology{format, writer, 240, 240}
+}
+
+// coverSheetSymbologies are the symbologies cover sheets can be printed in,
+// keyed by the format names found barcodes are reported with. Each of them
+// is read by newBarcodeReaders. UPC-A is left out since those readers report
+// it as EAN-13 with a leading zero.
+var coverSheetSymbologies = map[string]coverSheetSymbology{
+	"CODE_128":    linearSymbology(gozxing.BarcodeFormat_CODE_128, oned.NewCode128Writer),
+	"CODE_39":     linearSymbology(gozxing.BarcodeFormat_CODE_39, oned.NewCode39Writer),
+	"CODE_93":     linearSymbology(gozxing.BarcodeFormat_CODE_93, oned.NewCode93Writer),
+	"CODABAR":     linearSymbology(gozxing.BarcodeFormat_CODABAR, oned.NewCodaBarWriter),
+	"ITF":         linearSymbology(gozxing.BarcodeFormat_ITF, oned.NewITFWriter),
+	"EAN_8":       linearSymbology(gozxing.BarcodeFormat_EAN_8, oned.NewEAN8Writer),
+	"EAN_13":      linearSymbology(gozxing.BarcodeFormat_EAN_13, oned.NewEAN13Writer),
+	"UPC_E":       linearSymbology(gozxing.BarcodeFormat_UPC_E, oned.NewUPCEWriter),
+	"QR_CODE":     matrixSymbology(gozxing.BarcodeFormat_QR_CODE, func() gozxing.Writer { return qrcode.NewQRCodeWriter() }),
+	"DATA_MATRIX": matrixSymbology(gozxing.BarcodeFormat_DATA_MATRIX, datamatrix.NewDataMatrixWriter),
+}
+
+// CoverSheetFormats returns the symbology names GenerateCoverSheet accepts.
+func CoverSheetFormats() []string {
+	formats := make([]string, 0, len(coverSheetSymbologies))
+	for name := range coverSheetSymbologies {
+		formats = append(formats, name)
+	}
+	sort.Strings(formats)
+	return formats
+}
+
+// CoverSheet describes a cover or separator sheet to print.
+type CoverSheet struct {
+	// Value is what the barcode encodes. EAN and UPC values include their
+	// check digit.
+	Value string
+	// Format is the symbology, as in "CODE_128", the default, or "QR_CODE"
+	Format string
+	// Text is printed above the barcode. It is a text/template that can use
+	// {{.Value}} and {{.Format}}, and may span several lines.
+	Text string
+}
+
+// GenerateCoverSheet draws a one-page A4 PDF with the sheet's barcode in the
+// middle, its value below and its text above. The barcode is read back with
+// the same readers used on incoming documents before the PDF is written, so
+// a sheet that would not be recognised is an error rather than a printout.
+func GenerateCoverSheet(sheet CoverSheet) ([]byte, error) {
+	if sheet.Format == "" {
+		sheet.Format = "CODE_128"
+	}
+	symbology, ok := coverSheetSymbologies[strings.ToUpper(sheet.Format)]
+	if !ok {
+		return nil, fmt.Errorf("unsupported cover sheet format %q, use one of %s", sheet.Format, strings.Join(CoverSheetFormats(), ", "))
+	}
+	sheet.Format = symbology.format.String()
+	if sheet.Value == "" {
+		return nil, fmt.Errorf("cover sheet has no value")
+	}
+
+	title, err := coverSheetText(sheet)
+	if err != nil {
+		return nil, err
+	}
+	img, err := renderCoverSheetBarcode(sheet.Value, symbology)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkCoverSheetBarcode(img, sheet); err != nil {
+		return nil, err
+	}
+
+	var pngData bytes.Buffer
+	if err := png.Encode(&pngData, img); err != nil {
+		return nil, fmt.Errorf("error encoding barcode image: %v", err)
+	}
+	conf := model.NewDefaultConfiguration()
+	imp := pdfcpu.DefaultImportConfig()
+	imp.Pos = types.Center
+	imp.Scale = 1
+	imp.ScaleAbs = true
+	var page bytes.Buffer
+	if err := api.ImportImages(nil, &page, []io.Reader{&pngData}, imp, conf); err != nil {
+		return nil, fmt.Errorf("error creating cover sheet page: %v", err)
+	}
+
+	var watermarks []*model.Watermark
+	value, err := api.TextWatermark(sheet.Value,
+		fmt.Sprintf("font:Helvetica, points:%d, pos:c, off:0 %d, scale:1 abs, rot:0, fillcolor:#000000",
+			coverSheetValueSize, -(symbology.height/2+coverSheetValueGap)),
+		true, false, types.POINTS)
+	if err != nil {
+		return nil, fmt.Errorf("error creating cover sheet value: %v", err)
+	}
+	watermarks = append(watermarks, value)
+	if title != "" {
+		text, err := api.TextWatermark(title,
+			fmt.Sprintf("font:Helvetica, points:%d, pos:tc, off:0 %d, scale:1 abs, rot:0, fillcolor:#000000",
+				coverSheetTitleSize, -coverSheetTitleOffset),
+			true, false, types.POINTS)
+		if err != nil {
+			return nil, fmt.Errorf("error creating cover sheet text: %v", err)
+		}
+		watermarks = append(watermarks, text)
+	}
+
+	var out bytes.Buffer
+	if err := api.AddWatermarksSliceMap(bytes.NewReader(page.Bytes()), &out, map[int][]*model.Watermark{1: watermarks}, conf); err != nil {
+		return nil, fmt.Errorf("error writing cover sheet text: %v", err)
+	}
+	return out.Bytes(), nil
+}
+
+// coverSheetText fills in the sheet's text template.
+func coverSheetText(sheet CoverSheet) (string, error) {
+	if sheet.Text == "" {
+		return "", nil
+	}
+	tmpl, err := template.New("coversheet").Option("missingkey=error").Parse(sheet.Text)
+	if err != nil {
+		return "", fmt.Errorf("invalid cover sheet text: %v", err)
+	}
+	var text strings.Builder
+	if err := tmpl.Execute(&text, sheet); err != nil {
+		return "", fmt.Errorf("invalid cover sheet text: %v", err)
+	}
+	return strings.TrimSpace(text.String()), nil
+}
+
+// renderCoverSheetBarcode draws a value as a grayscale image, quiet zone
+// included.
+func renderCoverSheetBarcode(value string, symbology coverSheetSymbology) (*image.Gray, error) {
+	matrix, err := symbology.writer().Encode(value, symbology.format, symbology.width, symbology.height, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding %q as %s: %v", value, symbology.format, err)
+	}
+	bounds := matrix.Bounds()
+	img := image.NewGray(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			img.Set(x, y, matrix.At(x, y))
+		}
+	}
+	return img, nil
+}
+
+// checkCoverSheetBarcode reads a rendered barcode back as extractBarcodeFromImage
+// would and checks it gives the sheet's value and format.
+func checkCoverSheetBarcode(img image.Image, sheet CoverSheet) error {
+	barcode, err := decodeBarcode(context.Background(), img)
+	if err != nil {
+		return fmt.Errorf("generated %s barcode for %q cannot be read back: %v", sheet.Format, sheet.Value, err)
+	}
+	if barcode.Text != sheet.Value || barcode.Format != sheet.Format {
+		return fmt.Errorf("generated %s barcode for %q reads back as %s %q", sheet.Format, sheet.Value, barcode.Format, barcode.Text)
+	}
+	return nil
+}
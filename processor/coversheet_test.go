@@ -0,0 +1,92 @@
+package processor
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+)
+
+func TestGenerateCoverSheet(t *testing.T) {
+	tests := []struct {
+		name    string
+		sheet   CoverSheet
+		wantErr bool
+	}{
+		{"Default format", CoverSheet{Value: "BATCH-0042", Text: "Batch {{.Value}}\nScan first"}, false},
+		{"Code 39", CoverSheet{Value: "SEP-7", Format: "CODE_39"}, false},
+		{"Code 93", CoverSheet{Value: "SEP-93", Format: "CODE_93"}, false},
+		{"Codabar", CoverSheet{Value: "12345", Format: "CODABAR"}, false},
+		// The readers drop Codabar start and stop characters
+		{"Codabar with start and stop", CoverSheet{Value: "A12345B", Format: "CODABAR"}, true},
+		{"ITF", CoverSheet{Value: "00123456", Format: "ITF"}, false},
+		{"EAN-8", CoverSheet{Value: "96385074", Format: "EAN_8"}, false},
+		{"EAN-13", CoverSheet{Value: "4006381333931", Format: "EAN_13"}, false},
+		{"UPC-E", CoverSheet{Value: "01234565", Format: "UPC_E"}, false},
+		{"Lower case format", CoverSheet{Value: "https://example.com/batch/42", Format: "qr_code", Text: "{{.Format}}"}, false},
+		{"Data Matrix", CoverSheet{Value: "DM-1", Format: "DATA_MATRIX"}, false},
+		{"No value", CoverSheet{Format: "CODE_128"}, true},
+		{"Unknown format", CoverSheet{Value: "X", Format: "PDF_417"}, true},
+		{"UPC-A", CoverSheet{Value: "036000291452", Format: "UPC_A"}, true},
+		{"Unencodable value", CoverSheet{Value: "ABC", Format: "EAN_13"}, true},
+		{"Bad template", CoverSheet{Value: "X", Text: "{{.Missing}}"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := GenerateCoverSheet(tt.sheet)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			// The sheet's image reads back as its value
+			path := filepath.Join(t.TempDir(), "sheet.pdf")
+			if err := os.WriteFile(path, data, 0644); err != nil {
+				t.Fatalf("failed to write sheet: %v", err)
+			}
+			conf := model.NewDefaultConfiguration()
+			conf.ValidationMode = model.ValidationRelaxed
+			images, err := extractPDFImages(path, 0, conf)
+			if err != nil {
+				t.Fatalf("failed to extract images: %v", err)
+			}
+			if len(images) != 1 {
+				t.Fatalf("got %d images, want 1", len(images))
+			}
+			text, err := extractBarcodeFromImage(images[0].Image)
+			if err != nil {
+				t.Fatalf("sheet does not decode: %v", err)
+			}
+			if text != tt.sheet.Value {
+				t.Errorf("sheet decodes as %q, want %q", text, tt.sheet.Value)
+			}
+			if found, err := api.HasWatermarks(bytes.NewReader(data), conf); err != nil || !found {
+				t.Errorf("sheet has no text (%v)", err)
+			}
+		})
+	}
+}
+
+func TestCoverSheetFormats(t *testing.T) {
+	formats := CoverSheetFormats()
+	if len(formats) != len(coverSheetSymbologies) || formats[0] != "CODABAR" {
+		t.Errorf("got %v, want every symbology in order", formats)
+	}
+	for _, name := range formats {
+		if symbology := coverSheetSymbologies[name]; symbology.format.String() != name {
+			t.Errorf("%s is keyed by %q", symbology.format, name)
+		}
+	}
+	if !strings.Contains(strings.Join(formats, ","), "QR_CODE") {
+		t.Errorf("got %v, want QR_CODE among them", formats)
+	}
+}
@@ -0,0 +1,188 @@
+package processor
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultDebugBundleRetentionDays = 30
+	// maxDebugBundleImages bounds how many images a bundle holds, with their
+	// variants, so a long document does not make a huge bundle
+	maxDebugBundleImages = 20
+)
+
+// Reasons for writing a debug bundle.
+const (
+	debugReasonNoBarcodes = "no_barcodes"
+	// debugReasonTextDisagrees is a read the text layer contradicts
+	debugReasonTextDisagrees = "text_disagrees"
+)
+
+// debugEnvironment are the settings copied into debug bundles. Tokens and
+// secrets are left out.
+var debugEnvironment = []string{
+	"PDF_PAGE_LIMIT",
+	"PREPROCESS_CHAINS",
+	"ARCHIVE_MAX_ENTRIES",
+	"ARCHIVE_MAX_BYTES",
+	"ARCHIVE_MAX_DEPTH",
+}
+
+// debugSummary is the summary.json of a debug bundle: what was found in
+// the document and why it was bundled.
+type debugSummary struct {
+	Bucket      string       `json:"bucket"`
+	Key         string       `json:"key"`
+	Reason      string       `json:"reason"`
+	Created     time.Time    `json:"created"`
+	Recovery    string       `json:"recovery,omitempty"`
+	Results     []Barcode    `json:"results,omitempty"`
+	Undecodable []ImageError `json:"undecodable,omitempty"`
+	TextMatches []TextMatch  `json:"text_matches,omitempty"`
+}
+
+// debugConfig is the config.json of a debug bundle.
+type debugConfig struct {
+	// Profile is the profile used, without its passwords
+	Profile          Profile           `json:"profile"`
+	PreprocessChains []string          `json:"preprocess_chains"`
+	Environment      map[string]string `json:"environment,omitempty"`
+}
+
+// debugBundleReason returns why a document's results need a debug bundle,
+// or "" if they do not.
+func debugBundleReason(barcodes []Barcode, textMatches []TextMatch) string {
+	if len(barcodes) == 0 {
+		return debugReasonNoBarcodes
+	}
+	for _, match := range textMatches {
+		if match.Agreement == textDisagrees {
+			return debugReasonTextDisagrees
+		}
+	}
+	return ""
+}
+
+// saveDebugBundle writes a debug bundle for a document to the profile's
+// debug bundle location, tagged with its retention, and returns where it was
+// saved. Bundles go under the object's key, one per run.
+func saveDebugBundle(ctx context.Context, profile Profile, pdfImages []pdfImage, summary debugSummary) (string, error) {
+	data, err := buildDebugBundle(ctx, profile, pdfImages, summary)
+	if err != nil {
+		return "", err
+	}
+
+	store, prefix, err := openObjectStore(profile.DebugBundleOutput)
+	if err != nil {
+		return "", err
+	}
+	retention := profile.DebugBundleRetentionDays
+	if retention <= 0 {
+		retention = defaultDebugBundleRetentionDays
+	}
+	store = withTags(store, map[string]string{"retention-days": strconv.Itoa(retention)})
+
+	name := fmt.Sprintf("%s%s/%s.zip", prefix, summary.Key, summary.Created.UTC().Format("20060102T150405Z"))
+	if err := store.Put(ctx, name, data, "application/zip"); err != nil {
+		return "", err
+	}
+	return store.Location(name), nil
+}
+
+// buildDebugBundle zips the extracted images, each image after every
+// preprocessing chain, the reader errors from decoding each image whole, and
+// snapshots of the results and configuration.
+func buildDebugBundle(ctx context.Context, profile Profile, pdfImages []pdfImage, summary debugSummary) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	add := func(name string, write func(*bytes.Buffer) error) error {
+		var data bytes.Buffer
+		if err := write(&data); err != nil {
+			return fmt.Errorf("error writing %s to debug bundle: %v", name, err)
+		}
+		w, err := zw.Create(name)
+		if err != nil {
+			return fmt.Errorf("error adding %s to debug bundle: %v", name, err)
+		}
+		_, err = w.Write(data.Bytes())
+		return err
+	}
+	addJSON := func(name string, v interface{}) error {
+		return add(name, func(data *bytes.Buffer) error {
+			encoder := json.NewEncoder(data)
+			encoder.SetIndent("", "  ")
+			return encoder.Encode(v)
+		})
+	}
+
+	chains := getPreprocessChains(ctx)
+	attempts := map[string][]decodeAttempt{}
+	bundled := 0
+	for _, extracted := range pdfImages {
+		if extracted.Err != nil || extracted.Image == nil {
+			continue
+		}
+		if bundled == maxDebugBundleImages {
+			break
+		}
+		bundled++
+
+		base := strings.TrimSuffix(extracted.Name, filepath.Ext(extracted.Name))
+		img := extracted.Image
+		if err := add("images/"+base+".png", func(data *bytes.Buffer) error { return png.Encode(data, img) }); err != nil {
+			return nil, err
+		}
+		for _, chain := range chains {
+			variant := chain.apply(img)
+			name := fmt.Sprintf("variants/%s/%s.png", base, strings.ReplaceAll(chain.name, ",", "+"))
+			if err := add(name, func(data *bytes.Buffer) error { return png.Encode(data, variant) }); err != nil {
+				return nil, err
+			}
+		}
+
+		var imageAttempts []decodeAttempt
+		decodeBarcodeTraced(ctx, img, classifyImage(img.Bounds()), func(attempt decodeAttempt) {
+			imageAttempts = append(imageAttempts, attempt)
+		})
+		attempts[extracted.Name] = imageAttempts
+	}
+
+	// Passwords stay out of bundles; secret names are kept
+	profile.Passwords = nil
+	config := debugConfig{Profile: profile}
+	for _, chain := range chains {
+		config.PreprocessChains = append(config.PreprocessChains, chain.name)
+	}
+	for _, name := range debugEnvironment {
+		if value, ok := os.LookupEnv(name); ok {
+			if config.Environment == nil {
+				config.Environment = map[string]string{}
+			}
+			config.Environment[name] = value
+		}
+	}
+
+	if err := addJSON("summary.json", summary); err != nil {
+		return nil, err
+	}
+	if err := addJSON("errors.json", attempts); err != nil {
+		return nil, err
+	}
+	if err := addJSON("config.json", config); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("error closing debug bundle: %v", err)
+	}
+	return buf.Bytes(), nil
+}
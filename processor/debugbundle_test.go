@@ -0,0 +1,164 @@
+package processor
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestDebugBundleReason(t *testing.T) {
+	tests := []struct {
+		name        string
+		barcodes    []Barcode
+		textMatches []TextMatch
+		want        string
+	}{
+		{"Nothing found", nil, nil, debugReasonNoBarcodes},
+		{"Found", []Barcode{{Text: "A"}}, nil, ""},
+		{"Text agrees", []Barcode{{Text: "A"}}, []TextMatch{{Text: "A", Agreement: textAgrees}}, ""},
+		{"Text disagrees", []Barcode{{Text: "A"}}, []TextMatch{{Text: "B", Agreement: textDisagrees}}, debugReasonTextDisagrees},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := debugBundleReason(tt.barcodes, tt.textMatches); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildDebugBundle(t *testing.T) {
+	ctx := withLogger(context.Background(), discardLogger)
+	os.Setenv("PREPROCESS_CHAINS", "gray;upscale,sharpen")
+	os.Setenv("PDF_PAGE_LIMIT", "3")
+	defer os.Unsetenv("PREPROCESS_CHAINS")
+	defer os.Unsetenv("PDF_PAGE_LIMIT")
+
+	blank := image.NewGray(image.Rect(0, 0, 120, 40))
+	for i := range blank.Pix {
+		blank.Pix[i] = 255
+	}
+	pdfImages := []pdfImage{
+		{Name: "input_1_Im0.png", Page: 1, Image: blank},
+		{Name: "input_1_Im1.jpg", Page: 1, Err: fmt.Errorf("broken")},
+	}
+	profile := Profile{Name: "secret", Passwords: []PDFPassword{{User: "hunter2"}}, PasswordSecrets: []string{"pdf/passwords"}}
+	summary := debugSummary{Bucket: "b", Key: "scans/doc.pdf", Reason: debugReasonNoBarcodes, Created: time.Now()}
+
+	data, err := buildDebugBundle(ctx, profile, pdfImages, summary)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("bundle is not a zip: %v", err)
+	}
+	files := map[string][]byte{}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("failed to open %s: %v", f.Name, err)
+		}
+		files[f.Name], _ = io.ReadAll(rc)
+		rc.Close()
+	}
+	for _, name := range []string{
+		"images/input_1_Im0.png",
+		"variants/input_1_Im0/gray.png",
+		"variants/input_1_Im0/upscale+sharpen.png",
+		"summary.json",
+		"errors.json",
+		"config.json",
+	} {
+		if _, ok := files[name]; !ok {
+			t.Errorf("bundle has no %s", name)
+		}
+	}
+	if len(files) != 6 {
+		t.Errorf("got %d files, want 6", len(files))
+	}
+
+	var attempts map[string][]decodeAttempt
+	if err := json.Unmarshal(files["errors.json"], &attempts); err != nil {
+		t.Fatalf("invalid errors.json: %v", err)
+	}
+	if len(attempts["input_1_Im0.png"]) == 0 || attempts["input_1_Im0.png"][0].Reader == "" {
+		t.Errorf("got attempts %+v, want the reader errors of input_1_Im0.png", attempts)
+	}
+
+	var config debugConfig
+	if err := json.Unmarshal(files["config.json"], &config); err != nil {
+		t.Fatalf("invalid config.json: %v", err)
+	}
+	if strings.Contains(string(files["config.json"]), "hunter2") {
+		t.Error("config.json holds a password")
+	}
+	if config.Profile.Name != "secret" || len(config.PreprocessChains) != 2 || config.Environment["PDF_PAGE_LIMIT"] != "3" {
+		t.Errorf("got config %+v, want the profile, chains and environment", config)
+	}
+}
+
+func TestHandleRequestDebugBundle(t *testing.T) {
+	ctx := withLogger(context.Background(), discardLogger)
+
+	var payload BarcodeData
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&payload)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	blank := image.NewGray(image.Rect(0, 0, 60, 20))
+	for i := range blank.Pix {
+		blank.Pix[i] = 255
+	}
+	path := writeTestPDF(t, testPDFPage{
+		content: drawImages(1),
+		images:  []testPDFImage{{"/Width 60 /Height 20 /ColorSpace /DeviceGray /BitsPerComponent 8", blank.Pix}},
+	})
+	output := t.TempDir()
+
+	os.Setenv("TEST_PDF_PATH", path)
+	os.Setenv("PROFILES_CONFIG", fmt.Sprintf(`{"profiles": [{"name": "debug", "debug_bundle_output": %q}]}`, output))
+	os.Setenv("WEBHOOK_URL", server.URL)
+	os.Setenv("WEBHOOK_TOKEN", "test-token")
+	defer func() {
+		os.Unsetenv("TEST_PDF_PATH")
+		os.Unsetenv("PROFILES_CONFIG")
+		os.Unsetenv("WEBHOOK_URL")
+		os.Unsetenv("WEBHOOK_TOKEN")
+	}()
+
+	if _, err := HandleRequest(ctx, events.S3Event{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.HasPrefix(payload.DebugBundle, output) || !strings.HasSuffix(payload.DebugBundle, ".zip") {
+		t.Fatalf("webhook got debug bundle %q, want a zip in %s", payload.DebugBundle, output)
+	}
+	data, err := os.ReadFile(payload.DebugBundle)
+	if err != nil {
+		t.Fatalf("debug bundle was not saved: %v", err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("debug bundle is not a zip: %v", err)
+	}
+	for _, f := range zr.File {
+		if f.Name == "summary.json" {
+			return
+		}
+	}
+	t.Error("debug bundle has no summary.json")
+}
@@ -0,0 +1,385 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"image"
+
+	"github.com/makiuchi-d/gozxing"
+	"github.com/makiuchi-d/gozxing/aztec"
+	"github.com/makiuchi-d/gozxing/datamatrix"
+	"github.com/makiuchi-d/gozxing/oned"
+	"github.com/makiuchi-d/gozxing/qrcode"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	// Images no larger than this on their longer side are treated as crops
+	cropMaxDimension = 400
+	// Wide strips up to pageMinDimension are treated as crops as well,
+	// since that is what an extracted barcode XObject usually looks like
+	cropMinAspect    = 2.0
+	pageMinDimension = 1000
+)
+
+// imageKind distinguishes images that contain just a barcode from full pages
+// where the barcode is one object among text, logos and lines.
+type imageKind int
+
+const (
+	imageKindPage imageKind = iota
+	imageKindCrop
+)
+
+func (k imageKind) String() string {
+	if k == imageKindCrop {
+		return "crop"
+	}
+	return "page"
+}
+
+// classifyImage guesses whether an image is a tightly cropped barcode or a full page from its dimensions.
+func classifyImage(bounds image.Rectangle) imageKind {
+	longer, shorter := bounds.Dx(), bounds.Dy()
+	if shorter > longer {
+		longer, shorter = shorter, longer
+	}
+	if longer <= cropMaxDimension {
+		return imageKindCrop
+	}
+	if longer < pageMinDimension && shorter > 0 && float64(longer)/float64(shorter) >= cropMinAspect {
+		return imageKindCrop
+	}
+	return imageKindPage
+}
+
+// decodeHintsFor returns the hint sets to try for an image kind, in order.
+// PURE_BARCODE is only correct for crops; for a crop we still fall back to
+// the general search in case the crop carries surrounding text or margins.
+func decodeHintsFor(kind imageKind) []map[gozxing.DecodeHintType]interface{} {
+	general := map[gozxing.DecodeHintType]interface{}{
+		gozxing.DecodeHintType_TRY_HARDER: true,
+	}
+	if kind == imageKindPage {
+		return []map[gozxing.DecodeHintType]interface{}{general}
+	}
+	pure := map[gozxing.DecodeHintType]interface{}{
+		gozxing.DecodeHintType_TRY_HARDER:   true,
+		gozxing.DecodeHintType_PURE_BARCODE: true,
+	}
+	return []map[gozxing.DecodeHintType]interface{}{pure, general}
+}
+
+// binarizerOption is a named way of turning a luminance source into a binarizer.
+type binarizerOption struct {
+	name   string
+	create func(gozxing.LuminanceSource) gozxing.Binarizer
+}
+
+// grayscaleBinarizers are used when the preprocessing chain left the image in
+// grayscale, so gozxing does the one and only thresholding pass.
+var grayscaleBinarizers = []binarizerOption{
+	{"hybrid", func(source gozxing.LuminanceSource) gozxing.Binarizer {
+		return newMatrixRowBinarizer(gozxing.NewHybridBinarizer(source))
+	}},
+	{"global", gozxing.NewGlobalHistgramBinarizer},
+}
+
+// thresholdedBinarizers are used when a preprocessing chain already produced
+// pure black and white, which must not be thresholded a second time.
+var thresholdedBinarizers = []binarizerOption{
+	{"thresholded", newThresholdedBinarizer},
+}
+
+// barcodeReader pairs a gozxing reader with a name for logging and the
+// formats it reports.
+type barcodeReader struct {
+	name    string
+	reader  gozxing.Reader
+	formats []string
+}
+
+func newBarcodeReaders(hints map[gozxing.DecodeHintType]interface{}) []barcodeReader {
+	return []barcodeReader{
+		{"UPC/EAN", oned.NewMultiFormatUPCEANReader(hints), []string{"UPC_A", "UPC_E", "EAN_8", "EAN_13"}},
+		{"Code128", oned.NewCode128Reader(), []string{"CODE_128"}},
+		{"Code39", oned.NewCode39Reader(), []string{"CODE_39"}},
+		{"Code93", oned.NewCode93Reader(), []string{"CODE_93"}},
+		{"ITF", oned.NewITFReader(), []string{"ITF"}},
+		{"CodaBar", oned.NewCodaBarReader(), []string{"CODABAR"}},
+		{"QRCode", qrcode.NewQRCodeReader(), []string{"QR_CODE"}},
+		{"DataMatrix", datamatrix.NewDataMatrixReader(), []string{"DATA_MATRIX"}},
+		{"Aztec", aztec.NewAztecReader(), []string{"AZTEC"}},
+	}
+}
+
+// symbologies are the format names of all the barcodes the readers find.
+func symbologies() []string {
+	var formats []string
+	for _, r := range newBarcodeReaders(nil) {
+		formats = append(formats, r.formats...)
+	}
+	return formats
+}
+
+// selectReaders returns the readers that report any of the formats, or all
+// of them if no formats are given.
+func selectReaders(readers []barcodeReader, formats []string) []barcodeReader {
+	if len(formats) == 0 {
+		return readers
+	}
+	var selected []barcodeReader
+	for _, r := range readers {
+		if containsAny(r.formats, formats) {
+			selected = append(selected, r)
+		}
+	}
+	return selected
+}
+
+func containsAny(values, wanted []string) bool {
+	for _, value := range values {
+		for _, w := range wanted {
+			if value == w {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func extractBarcodeFromImage(img image.Image) (string, error) {
+	barcode, err := decodeBarcode(context.Background(), img)
+	if err != nil {
+		return "", err
+	}
+	return barcode.Text, nil
+}
+
+// decodeBarcode reads a single barcode from an image, guessing from its
+// dimensions whether it is a crop or a full page.
+func decodeBarcode(ctx context.Context, img image.Image) (Barcode, error) {
+	if img == nil {
+		return Barcode{}, fmt.Errorf("no image to process")
+	}
+	return decodeBarcodeAs(ctx, img, classifyImage(img.Bounds()))
+}
+
+// decodeAttempt is a failed try at reading an image, as kept in debug bundles.
+type decodeAttempt struct {
+	Chain     string `json:"chain"`
+	Binarizer string `json:"binarizer"`
+	Pure      bool   `json:"pure"`
+	Reader    string `json:"reader,omitempty"`
+	Error     string `json:"error"`
+}
+
+// decodeBarcodeAs tries every combination of preprocessing chain, binarizer,
+// hint set and reader until one of them reads a barcode. The returned region
+// is in the coordinates of img, relative to its top-left corner.
+func decodeBarcodeAs(ctx context.Context, img image.Image, kind imageKind) (Barcode, error) {
+	return decodeBarcodeTraced(ctx, img, kind, nil)
+}
+
+// decodeBarcodeTraced is decodeBarcodeAs, passing each failed attempt to
+// record if it is not nil.
+func decodeBarcodeTraced(ctx context.Context, img image.Image, kind imageKind, record func(decodeAttempt)) (Barcode, error) {
+	if img == nil {
+		return Barcode{}, fmt.Errorf("no image to process")
+	}
+
+	logger := loggerFrom(ctx)
+	bounds := img.Bounds()
+	logger.Debug("Decoding image", "kind", kind.String(), "width", bounds.Dx(), "height", bounds.Dy())
+
+	hintSets := decodeHintsFor(kind)
+	// Direct requests may only look for some symbologies
+	wanted := scanOptionsFrom(ctx).Symbologies
+
+	var lastErr error
+	for _, chain := range getPreprocessChains(ctx) {
+		processedImg := chain.apply(img)
+		source := gozxing.NewLuminanceSourceFromImage(processedImg)
+
+		binarizers := grayscaleBinarizers
+		if isBinaryImage(processedImg) {
+			binarizers = thresholdedBinarizers
+		}
+
+		for _, b := range binarizers {
+			// One bitmap per binarizer so its black matrix is computed once for all readers
+			bmp, err := gozxing.NewBinaryBitmap(b.create(source))
+			if err != nil {
+				lastErr = fmt.Errorf("error creating binary bitmap: %v", err)
+				logger.Debug("Preprocessing chain failed", "chain", chain.name, "binarizer", b.name, "error", lastErr)
+				if record != nil {
+					record(decodeAttempt{Chain: chain.name, Binarizer: b.name, Error: lastErr.Error()})
+				}
+				continue
+			}
+
+			for _, hints := range hintSets {
+				_, pure := hints[gozxing.DecodeHintType_PURE_BARCODE]
+				for _, r := range selectReaders(newBarcodeReaders(hints), wanted) {
+					_, span := startSpan(ctx, spanReaderAttempt, attribute.String("reader", r.name),
+						attribute.String("chain", chain.name), attribute.String("binarizer", b.name), attribute.Bool("pure", pure))
+					result, err := r.reader.Decode(bmp, hints)
+					// Most attempts find nothing, which is not a failure of the request
+					span.SetAttributes(attribute.Bool("found", err == nil))
+					span.End()
+					if err == nil && len(wanted) > 0 && !containsAny([]string{result.GetBarcodeFormat().String()}, wanted) {
+						// The UPC/EAN reader reports formats that were not asked for
+						err = fmt.Errorf("found %s barcode, which was not asked for", result.GetBarcodeFormat().String())
+					}
+					if err == nil {
+						logger.Debug("Reader found barcode", "format", result.GetBarcodeFormat().String(), "reader", r.name,
+							"chain", chain.name, "binarizer", b.name, "pure", pure, "text", result.GetText())
+						return Barcode{
+							Text:        result.GetText(),
+							Format:      result.GetBarcodeFormat().String(),
+							ImageRegion: resultRegion(result, bounds, processedImg.Bounds()),
+						}, nil
+					}
+					lastErr = err
+					logger.Debug("Reader failed", "reader", r.name, "chain", chain.name, "binarizer", b.name, "pure", pure, "error", err)
+					if record != nil {
+						record(decodeAttempt{Chain: chain.name, Binarizer: b.name, Pure: pure, Reader: r.name, Error: err.Error()})
+					}
+				}
+			}
+		}
+	}
+
+	return Barcode{}, fmt.Errorf("no barcode found with any reader, last error: %v", lastErr)
+}
+
+// resultRegion maps the result points of a read from the preprocessed image
+// back to the original image. 1D readers only report the two ends of the
+// scanned row, so their region is given a nominal height of a quarter of its
+// width, the usual proportion of a linear barcode.
+func resultRegion(result *gozxing.Result, original, processed image.Rectangle) *ImageRegion {
+	points := result.GetResultPoints()
+	if len(points) == 0 || processed.Dx() == 0 || processed.Dy() == 0 {
+		return regionFromRect(image.Rect(0, 0, original.Dx(), original.Dy()))
+	}
+
+	scaleX := float64(original.Dx()) / float64(processed.Dx())
+	scaleY := float64(original.Dy()) / float64(processed.Dy())
+	minX, minY := points[0].GetX(), points[0].GetY()
+	maxX, maxY := minX, minY
+	for _, p := range points[1:] {
+		minX, maxX = minFloat(minX, p.GetX()), maxFloat(maxX, p.GetX())
+		minY, maxY = minFloat(minY, p.GetY()), maxFloat(maxY, p.GetY())
+	}
+
+	r := image.Rect(int(minX*scaleX), int(minY*scaleY), int(maxX*scaleX)+1, int(maxY*scaleY)+1)
+	if r.Dy() < r.Dx()/4 {
+		grow := (r.Dx()/4 - r.Dy()) / 2
+		r.Min.Y -= grow
+		r.Max.Y += grow
+	}
+	return regionFromRect(r.Intersect(image.Rect(0, 0, original.Dx(), original.Dy())))
+}
+
+// isBinaryImage reports whether every pixel is pure black or pure white.
+func isBinaryImage(img *image.Gray) bool {
+	for _, v := range img.Pix {
+		if v != 0 && v != 255 {
+			return false
+		}
+	}
+	return true
+}
+
+// matrixRowBinarizer serves 1D row requests from the wrapped binarizer's black
+// matrix. gozxing's HybridBinarizer only applies its local block thresholds to
+// the matrix and falls back to a per-row global histogram for rows, which is
+// exactly what fails on unevenly lit scans.
+type matrixRowBinarizer struct {
+	gozxing.Binarizer
+}
+
+func newMatrixRowBinarizer(b gozxing.Binarizer) gozxing.Binarizer {
+	return &matrixRowBinarizer{b}
+}
+
+func (b *matrixRowBinarizer) GetBlackRow(y int, row *gozxing.BitArray) (*gozxing.BitArray, error) {
+	matrix, err := b.GetBlackMatrix()
+	if err != nil {
+		return nil, err
+	}
+	return matrix.GetRow(y, row), nil
+}
+
+func (b *matrixRowBinarizer) CreateBinarizer(source gozxing.LuminanceSource) gozxing.Binarizer {
+	return newMatrixRowBinarizer(b.Binarizer.CreateBinarizer(source))
+}
+
+// thresholdedBinarizer maps an already black and white luminance source
+// straight to bits without estimating a threshold of its own.
+type thresholdedBinarizer struct {
+	source gozxing.LuminanceSource
+	matrix *gozxing.BitMatrix
+}
+
+func newThresholdedBinarizer(source gozxing.LuminanceSource) gozxing.Binarizer {
+	return &thresholdedBinarizer{source: source}
+}
+
+func (b *thresholdedBinarizer) GetLuminanceSource() gozxing.LuminanceSource {
+	return b.source
+}
+
+func (b *thresholdedBinarizer) GetWidth() int {
+	return b.source.GetWidth()
+}
+
+func (b *thresholdedBinarizer) GetHeight() int {
+	return b.source.GetHeight()
+}
+
+func (b *thresholdedBinarizer) GetBlackRow(y int, row *gozxing.BitArray) (*gozxing.BitArray, error) {
+	width := b.source.GetWidth()
+	if row == nil || row.GetSize() < width {
+		row = gozxing.NewBitArray(width)
+	} else {
+		row.Clear()
+	}
+
+	luminances, err := b.source.GetRow(y, nil)
+	if err != nil {
+		return nil, err
+	}
+	for x := 0; x < width; x++ {
+		if luminances[x] < 128 {
+			row.Set(x)
+		}
+	}
+	return row, nil
+}
+
+func (b *thresholdedBinarizer) GetBlackMatrix() (*gozxing.BitMatrix, error) {
+	if b.matrix != nil {
+		return b.matrix, nil
+	}
+
+	width, height := b.source.GetWidth(), b.source.GetHeight()
+	matrix, err := gozxing.NewBitMatrix(width, height)
+	if err != nil {
+		return nil, err
+	}
+	luminances := b.source.GetMatrix()
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if luminances[y*width+x] < 128 {
+				matrix.Set(x, y)
+			}
+		}
+	}
+	b.matrix = matrix
+	return matrix, nil
+}
+
+func (b *thresholdedBinarizer) CreateBinarizer(source gozxing.LuminanceSource) gozxing.Binarizer {
+	return newThresholdedBinarizer(source)
+}
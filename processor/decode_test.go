@@ -0,0 +1,321 @@
+package processor
+
+import (
+	"image"
+	"image/color"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/makiuchi-d/gozxing"
+	"github.com/makiuchi-d/gozxing/oned"
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+)
+
+// corpusBarcodes lists the barcodes known to be present in the test PDFs, by
+// the name pdfcpu extracts the image holding each one under. The other
+// images of the PDFs are logos and icons.
+var corpusBarcodes = map[string]map[string]string{
+	"sample2.pdf": {
+		"sample2_1_FormXob.901610d5c16225467979d186eaff2d1d.png": "*29581200051216188000014453",
+	},
+}
+
+type corpusEntry struct {
+	name string
+	img  image.Image
+	want string
+}
+
+func TestClassifyImage(t *testing.T) {
+	tests := []struct {
+		name   string
+		bounds image.Rectangle
+		want   imageKind
+	}{
+		{"Small square", image.Rect(0, 0, 300, 300), imageKindCrop},
+		{"Wide barcode strip", image.Rect(0, 0, 590, 112), imageKindCrop},
+		{"Tall barcode strip", image.Rect(0, 0, 112, 590), imageKindCrop},
+		{"A4 page at 200dpi", image.Rect(0, 0, 1654, 2339), imageKindPage},
+		{"Square logo", image.Rect(0, 0, 700, 800), imageKindPage},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classifyImage(tt.bounds); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeHintsFor(t *testing.T) {
+	pageHints := decodeHintsFor(imageKindPage)
+	for _, hints := range pageHints {
+		if _, ok := hints[gozxing.DecodeHintType_PURE_BARCODE]; ok {
+			t.Error("PURE_BARCODE must not be hinted for full pages")
+		}
+	}
+
+	cropHints := decodeHintsFor(imageKindCrop)
+	if len(cropHints) != 2 {
+		t.Fatalf("got %d hint sets for crops, want 2", len(cropHints))
+	}
+	if _, ok := cropHints[0][gozxing.DecodeHintType_PURE_BARCODE]; !ok {
+		t.Error("crops should be tried with PURE_BARCODE first")
+	}
+	if _, ok := cropHints[1][gozxing.DecodeHintType_PURE_BARCODE]; ok {
+		t.Error("crops should fall back to a search without PURE_BARCODE")
+	}
+}
+
+func TestThresholdedBinarizer(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 4, 1))
+	copy(img.Pix, []uint8{0, 255, 0, 255})
+
+	binarizer := newThresholdedBinarizer(gozxing.NewLuminanceSourceFromImage(img))
+	row, err := binarizer.GetBlackRow(0, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for x, want := range []bool{true, false, true, false} {
+		if row.Get(x) != want {
+			t.Errorf("pixel %d: got black=%v, want %v", x, row.Get(x), want)
+		}
+	}
+}
+
+func TestDecodeCorpus(t *testing.T) {
+	if testing.Short() {
+		t.Skip("decoding the corpus is slow")
+	}
+	var current, legacy int
+	for _, entry := range loadDecodeCorpus(t) {
+		if got, err := extractBarcodeFromImage(entry.img); err == nil && got == entry.want {
+			current++
+		} else {
+			t.Logf("%s: not detected (got %q, err %v)", entry.name, got, err)
+		}
+		if got, err := legacyExtractBarcode(entry.img); err == nil && got == entry.want {
+			legacy++
+		}
+	}
+
+	if current < legacy {
+		t.Errorf("detected %d corpus barcodes, fewer than the %d found by the previous pipeline", current, legacy)
+	}
+}
+
+// BenchmarkDetectionRate compares the current decoding strategy with the
+// previous hard-threshold pipeline on the test corpus.
+func BenchmarkDetectionRate(b *testing.B) {
+	corpus := loadDecodeCorpus(b)
+	strategies := []struct {
+		name   string
+		decode func(image.Image) (string, error)
+	}{
+		{"legacy", legacyExtractBarcode},
+		{"current", extractBarcodeFromImage},
+	}
+
+	for _, s := range strategies {
+		b.Run(s.name, func(b *testing.B) {
+			var detected int
+			for i := 0; i < b.N; i++ {
+				detected = 0
+				for _, entry := range corpus {
+					if got, err := s.decode(entry.img); err == nil && got == entry.want {
+						detected++
+					}
+				}
+			}
+			b.ReportMetric(100*float64(detected)/float64(len(corpus)), "%detected")
+		})
+	}
+}
+
+// loadDecodeCorpus returns the barcode images of the test PDFs plus generated
+// barcodes, each in a set of degraded variants seen in real scans.
+func loadDecodeCorpus(tb testing.TB) []corpusEntry {
+	tb.Helper()
+
+	var sources []corpusEntry
+	for pdfName, barcodes := range corpusBarcodes {
+		images := extractTestImages(tb, filepath.Join("../test/pdfs", pdfName))
+		for imageName, want := range barcodes {
+			img, ok := images[imageName]
+			if !ok {
+				tb.Fatalf("image %s not extracted from %s", imageName, pdfName)
+			}
+			sources = append(sources, corpusEntry{name: pdfName, img: img, want: want})
+		}
+	}
+
+	generated := []struct {
+		format   gozxing.BarcodeFormat
+		writer   gozxing.Writer
+		contents string
+	}{
+		{gozxing.BarcodeFormat_CODE_128, oned.NewCode128Writer(), "INV-2024-000815"},
+		{gozxing.BarcodeFormat_CODE_39, oned.NewCode39Writer(), "ORDER42"},
+		{gozxing.BarcodeFormat_EAN_13, oned.NewEAN13Writer(), "9501101530003"},
+		{gozxing.BarcodeFormat_ITF, oned.NewITFWriter(), "00012345678905"},
+	}
+	for _, g := range generated {
+		matrix, err := g.writer.Encode(g.contents, g.format, 360, 90, nil)
+		if err != nil {
+			tb.Fatalf("failed to encode %s test barcode: %v", g.format, err)
+		}
+		sources = append(sources, corpusEntry{name: g.format.String(), img: matrix, want: g.contents})
+	}
+
+	var corpus []corpusEntry
+	for _, src := range sources {
+		gray := toGray(src.img)
+		corpus = append(corpus,
+			corpusEntry{src.name + "/clean", gray, src.want},
+			corpusEntry{src.name + "/shaded", shadeImage(gray), src.want},
+			corpusEntry{src.name + "/noisy", addNoise(gray, 0.04), src.want},
+			corpusEntry{src.name + "/low-contrast", reduceContrast(gray, 90, 150), src.want},
+			corpusEntry{src.name + "/on-page", placeOnPage(gray), src.want},
+		)
+	}
+	return corpus
+}
+
+// extractTestImages returns the images of a PDF by the name pdfcpu extracts
+// them under.
+func extractTestImages(tb testing.TB, pdfPath string) map[string]image.Image {
+	tb.Helper()
+	if _, err := os.Stat(pdfPath); os.IsNotExist(err) {
+		tb.Skipf("test file %s not found", pdfPath)
+	}
+
+	dir := tb.TempDir()
+	conf := model.NewDefaultConfiguration()
+	conf.ValidationMode = model.ValidationRelaxed
+	if err := api.ExtractImagesFile(pdfPath, dir, nil, conf); err != nil {
+		tb.Fatalf("failed to extract images from %s: %v", pdfPath, err)
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		tb.Fatalf("failed to read %s: %v", dir, err)
+	}
+	images := map[string]image.Image{}
+	for _, file := range files {
+		f, err := os.Open(filepath.Join(dir, file.Name()))
+		if err != nil {
+			continue
+		}
+		img, _, err := image.Decode(f)
+		f.Close()
+		if err == nil {
+			images[file.Name()] = img
+		}
+	}
+	return images
+}
+
+func shadeImage(img *image.Gray) *image.Gray {
+	out := image.NewGray(img.Bounds())
+	w := img.Bounds().Dx()
+	for y := 0; y < img.Bounds().Dy(); y++ {
+		for x := 0; x < w; x++ {
+			light := 240 - x*180/w
+			out.SetGray(x, y, color.Gray{Y: uint8(int(img.GrayAt(x, y).Y) * light / 255)})
+		}
+	}
+	return out
+}
+
+func addNoise(img *image.Gray, density float64) *image.Gray {
+	rng := rand.New(rand.NewSource(1))
+	out := image.NewGray(img.Bounds())
+	copy(out.Pix, img.Pix)
+	for i := range out.Pix {
+		if rng.Float64() < density {
+			out.Pix[i] = 255 - out.Pix[i]
+		}
+	}
+	return out
+}
+
+func reduceContrast(img *image.Gray, low, high int) *image.Gray {
+	out := image.NewGray(img.Bounds())
+	for i, v := range img.Pix {
+		out.Pix[i] = uint8(low + int(v)*(high-low)/255)
+	}
+	return out
+}
+
+func placeOnPage(img *image.Gray) *image.Gray {
+	page := image.NewGray(image.Rect(0, 0, 1240, 1754))
+	for i := range page.Pix {
+		page.Pix[i] = 255
+	}
+	offset := image.Pt(page.Bounds().Dx()-img.Bounds().Dx()-60, 60)
+	for y := 0; y < img.Bounds().Dy(); y++ {
+		for x := 0; x < img.Bounds().Dx(); x++ {
+			page.SetGray(offset.X+x, offset.Y+y, img.GrayAt(x, y))
+		}
+	}
+	return page
+}
+
+// legacyExtractBarcode is the pipeline this package used before binarization
+// was left to gozxing: a global contrast stretch, a hard threshold at 128,
+// PURE_BARCODE hinted for every image and the 1D readers alone. It is kept for
+// the detection benchmark.
+func legacyExtractBarcode(img image.Image) (string, error) {
+	gray := toGray(img)
+	var min, max uint8 = 255, 0
+	for _, v := range gray.Pix {
+		if v < min {
+			min = v
+		}
+		if v > max {
+			max = v
+		}
+	}
+	if gray.Bounds().Dx() < 100 || gray.Bounds().Dy() < 100 {
+		min, max = 0, 255
+	}
+	if max-min >= 30 || min == 0 && max == 255 {
+		for i, v := range gray.Pix {
+			if float64(v-min)/float64(max-min)*255 > 128 {
+				gray.Pix[i] = 255
+			} else {
+				gray.Pix[i] = 0
+			}
+		}
+	}
+
+	bmp, err := gozxing.NewBinaryBitmapFromImage(gray)
+	if err != nil {
+		return "", err
+	}
+	hints := map[gozxing.DecodeHintType]interface{}{
+		gozxing.DecodeHintType_TRY_HARDER:   true,
+		gozxing.DecodeHintType_PURE_BARCODE: true,
+	}
+	var lastErr error
+	readers := []gozxing.Reader{
+		oned.NewMultiFormatUPCEANReader(hints),
+		oned.NewCode128Reader(),
+		oned.NewCode39Reader(),
+		oned.NewCode93Reader(),
+		oned.NewITFReader(),
+		oned.NewCodaBarReader(),
+	}
+	for _, r := range readers {
+		result, err := r.Decode(bmp, hints)
+		if err == nil {
+			return result.GetText(), nil
+		}
+		lastErr = err
+	}
+	return "", lastErr
+}
@@ -0,0 +1,114 @@
+package processor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+)
+
+// outcomeEncryptedNoPassword is reported for encrypted PDFs that none of the
+// profile's passwords open.
+const outcomeEncryptedNoPassword = "encrypted_no_password"
+
+// errNoPassword is returned by decryptPDF when no password opens the PDF.
+var errNoPassword = errors.New("no password opens the encrypted PDF")
+
+// PDFPassword is a user (document open) and owner (permissions) password
+// pair for encrypted PDFs. Either one is enough to decrypt.
+type PDFPassword struct {
+	User  string `json:"user,omitempty"`
+	Owner string `json:"owner,omitempty"`
+}
+
+// parsePasswordSecret reads a secret holding a PDFPassword as JSON, or just
+// the user password as plain text.
+func parsePasswordSecret(value string) PDFPassword {
+	trimmed := strings.TrimSpace(value)
+	if strings.HasPrefix(trimmed, "{") {
+		var password PDFPassword
+		if err := json.Unmarshal([]byte(trimmed), &password); err == nil {
+			return password
+		}
+	}
+	return PDFPassword{User: value}
+}
+
+// profilePasswords returns the profile's passwords followed by those in its
+// password secrets. Secrets that cannot be read are logged and skipped.
+func profilePasswords(ctx context.Context, profile Profile) []PDFPassword {
+	passwords := append([]PDFPassword{}, profile.Passwords...)
+	if len(profile.PasswordSecrets) == 0 {
+		return passwords
+	}
+
+	secrets, err := getSecretSource(ctx)
+	if err != nil {
+		loggerFrom(ctx).Warn("Error initializing secrets source, skipping password secrets", "error", err)
+		return passwords
+	}
+	for _, name := range profile.PasswordSecrets {
+		value, err := secrets.GetSecret(ctx, name)
+		if err != nil {
+			loggerFrom(ctx).Warn("Error reading password secret", "secret", name, "error", err)
+			continue
+		}
+		passwords = append(passwords, parsePasswordSecret(value))
+	}
+	return passwords
+}
+
+// isEncryptedPDF reports whether a PDF is encrypted. PDFs that open without a
+// password but restrict permissions count as encrypted.
+func isEncryptedPDF(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	conf := model.NewDefaultConfiguration()
+	conf.ValidationMode = model.ValidationRelaxed
+	ctx, err := api.ReadContext(f, conf)
+	if errors.Is(err, pdfcpu.ErrWrongPassword) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return ctx.Encrypt != nil, nil
+}
+
+// decryptPDF replaces an encrypted PDF with a decrypted copy, trying an empty
+// password and then each of the given passwords in turn.
+func decryptPDF(ctx context.Context, path string, passwords []PDFPassword) error {
+	decrypted := path + ".decrypted"
+	candidates := append([]PDFPassword{{}}, passwords...)
+	for i, password := range candidates {
+		conf := model.NewDefaultConfiguration()
+		conf.ValidationMode = model.ValidationRelaxed
+		conf.UserPW = password.User
+		conf.OwnerPW = password.Owner
+
+		err := api.DecryptFile(path, decrypted, conf)
+		if errors.Is(err, pdfcpu.ErrWrongPassword) {
+			continue
+		}
+		if err != nil {
+			os.Remove(decrypted)
+			return fmt.Errorf("error decrypting PDF: %v", err)
+		}
+		if i > 0 {
+			loggerFrom(ctx).Info("Decrypted PDF", "password", i, "passwords", len(passwords))
+		}
+		return os.Rename(decrypted, path)
+	}
+	os.Remove(decrypted)
+	return errNoPassword
+}
@@ -0,0 +1,180 @@
+package processor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+)
+
+// writeEncryptedTestPDF writes a one-image PDF encrypted with AES-256.
+func writeEncryptedTestPDF(t *testing.T, userPW, ownerPW string) string {
+	t.Helper()
+	img := testPDFImage{"/Width 8 /Height 8 /ColorSpace /DeviceGray /BitsPerComponent 8", make([]byte, 64)}
+	path := writeTestPDF(t, testPDFPage{content: drawImages(1), images: []testPDFImage{img}})
+	if err := api.EncryptFile(path, "", model.NewAESConfiguration(userPW, ownerPW, 256)); err != nil {
+		t.Fatalf("failed to encrypt test PDF: %v", err)
+	}
+	return path
+}
+
+func TestDecryptPDF(t *testing.T) {
+	ctx := withLogger(context.Background(), discardLogger)
+
+	tests := []struct {
+		name      string
+		userPW    string
+		ownerPW   string
+		passwords []PDFPassword
+		wantErr   error
+	}{
+		{
+			name:    "Owner password only opens without a password",
+			ownerPW: "owner-secret",
+		},
+		{
+			name:    "User password missing",
+			userPW:  "user-secret",
+			ownerPW: "owner-secret",
+			wantErr: errNoPassword,
+		},
+		{
+			name:      "Wrong passwords",
+			userPW:    "user-secret",
+			ownerPW:   "owner-secret",
+			passwords: []PDFPassword{{User: "guess"}, {Owner: "guess"}},
+			wantErr:   errNoPassword,
+		},
+		{
+			name:      "User password after a wrong one",
+			userPW:    "user-secret",
+			ownerPW:   "owner-secret",
+			passwords: []PDFPassword{{User: "guess"}, {User: "user-secret"}},
+		},
+		{
+			name:      "Owner password",
+			userPW:    "user-secret",
+			ownerPW:   "owner-secret",
+			passwords: []PDFPassword{{Owner: "owner-secret"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeEncryptedTestPDF(t, tt.userPW, tt.ownerPW)
+
+			encrypted, err := isEncryptedPDF(path)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !encrypted {
+				t.Fatal("encrypted PDF not detected")
+			}
+
+			err = decryptPDF(ctx, path, tt.passwords)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("got error %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if encrypted, err := isEncryptedPDF(path); err != nil || encrypted {
+				t.Errorf("PDF still encrypted after decryption (err: %v)", err)
+			}
+			conf := model.NewDefaultConfiguration()
+			conf.ValidationMode = model.ValidationRelaxed
+			images, err := extractPDFImages(path, 0, conf)
+			if err != nil || len(images) != 1 {
+				t.Errorf("got %d images from decrypted PDF (err: %v), want 1", len(images), err)
+			}
+		})
+	}
+}
+
+func TestIsEncryptedPDFUnencrypted(t *testing.T) {
+	path := writeTestPDF(t, testPDFPage{})
+	encrypted, err := isEncryptedPDF(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if encrypted {
+		t.Error("unencrypted PDF reported as encrypted")
+	}
+}
+
+func TestProfilePasswords(t *testing.T) {
+	ctx := withLogger(context.Background(), discardLogger)
+
+	secretsFile := filepath.Join(t.TempDir(), "secrets.json")
+	secrets := `{"bank/json": "{\"user\": \"u1\", \"owner\": \"o1\"}", "bank/plain": "u2"}`
+	if err := os.WriteFile(secretsFile, []byte(secrets), 0644); err != nil {
+		t.Fatalf("failed to write secrets: %v", err)
+	}
+	os.Setenv("SECRETS_FILE", secretsFile)
+	defer os.Unsetenv("SECRETS_FILE")
+
+	profile := Profile{
+		Passwords:       []PDFPassword{{User: "inline"}},
+		PasswordSecrets: []string{"bank/json", "bank/missing", "bank/plain"},
+	}
+	got := profilePasswords(ctx, profile)
+	want := []PDFPassword{{User: "inline"}, {User: "u1", Owner: "o1"}, {User: "u2"}}
+	if len(got) != len(want) {
+		t.Fatalf("got %d passwords %+v, want %d", len(got), got, len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("password %d is %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestHandleRequestEncryptedNoPassword(t *testing.T) {
+	ctx := withLogger(context.Background(), discardLogger)
+
+	var payload BarcodeData
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&payload)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	os.Setenv("TEST_PDF_PATH", writeEncryptedTestPDF(t, "user-secret", "owner-secret"))
+	os.Setenv("WEBHOOK_URL", server.URL)
+	os.Setenv("WEBHOOK_TOKEN", "test-token")
+	defer func() {
+		os.Unsetenv("TEST_PDF_PATH")
+		os.Unsetenv("WEBHOOK_URL")
+		os.Unsetenv("WEBHOOK_TOKEN")
+	}()
+
+	response, err := HandleRequest(ctx, events.S3Event{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if response.StatusCode != 422 {
+		t.Errorf("got status %d, want 422", response.StatusCode)
+	}
+	var body ResponseBody
+	if err := json.Unmarshal([]byte(response.Body), &body); err != nil {
+		t.Fatalf("invalid response body: %v", err)
+	}
+	if body.Outcome != outcomeEncryptedNoPassword {
+		t.Errorf("got outcome %q, want %q", body.Outcome, outcomeEncryptedNoPassword)
+	}
+	if payload.Outcome != outcomeEncryptedNoPassword {
+		t.Errorf("webhook got outcome %q, want %q", payload.Outcome, outcomeEncryptedNoPassword)
+	}
+}
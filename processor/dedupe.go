@@ -0,0 +1,413 @@
+package processor
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const defaultDedupeTTLDays = 30
+
+// dedupeClaimTimeout is how long a claim on an object version holds. A claim
+// older than the longest a Lambda invocation runs was left by one that died,
+// and is taken over.
+const dedupeClaimTimeout = 15 * time.Minute
+
+// forceKey is the context key that makes a request skip the dedupe store.
+type forceKey struct{}
+
+// dedupeEntry is the stored result of processing one version of an object,
+// or, while InProgress, the claim of the invocation processing it.
+type dedupeEntry struct {
+	ID         string    `json:"id"`
+	Bucket     string    `json:"bucket"`
+	Key        string    `json:"key"`
+	Version    string    `json:"version"`
+	Response   Response  `json:"response"`
+	Created    time.Time `json:"created"`
+	InProgress bool      `json:"in_progress,omitempty"`
+}
+
+// dedupeStore keeps the results of objects already processed, so repeated
+// events for the same version of an object are answered without scanning it
+// again.
+type dedupeStore interface {
+	// Get returns the entry stored under id, or nil if there is none
+	Get(ctx context.Context, id string) (*dedupeEntry, error)
+	// Claim stores an in-progress entry if there is none under its ID, or
+	// only a claim made before stale. Otherwise it returns the stored entry.
+	Claim(ctx context.Context, claim dedupeEntry, stale time.Time) (*dedupeEntry, error)
+	// Put stores an entry, replacing any under its ID
+	Put(ctx context.Context, entry dedupeEntry) error
+	// Release removes a claim, unless it has been replaced since
+	Release(ctx context.Context, claim dedupeEntry) error
+}
+
+// dynamoDedupeStore keeps results in a DynamoDB table whose partition key is
+// the string attribute "id". Items carry an "expires" attribute for the
+// table's time to live.
+type dynamoDedupeStore struct {
+	client *dynamodb.Client
+	table  string
+	ttl    time.Duration
+}
+
+func (s *dynamoDedupeStore) Get(ctx context.Context, id string) (*dedupeEntry, error) {
+	out, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(s.table),
+		Key:            map[string]dynamodbtypes.AttributeValue{"id": &dynamodbtypes.AttributeValueMemberS{Value: id}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error getting %s from %s: %v", id, s.table, err)
+	}
+	if out.Item == nil {
+		return nil, nil
+	}
+	return s.decode(id, out.Item)
+}
+
+// Claim puts the claim on condition that the item does not exist or holds a
+// claim made before stale. Claims carry a "claimed" attribute, the time of the
+// claim in nanoseconds, for the condition to compare.
+func (s *dynamoDedupeStore) Claim(ctx context.Context, claim dedupeEntry, stale time.Time) (*dedupeEntry, error) {
+	item, err := s.item(claim)
+	if err != nil {
+		return nil, err
+	}
+	_, err = s.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(s.table),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(id) OR claimed < :stale"),
+		ExpressionAttributeValues: map[string]dynamodbtypes.AttributeValue{
+			":stale": &dynamodbtypes.AttributeValueMemberN{Value: strconv.FormatInt(stale.UnixNano(), 10)},
+		},
+		ReturnValuesOnConditionCheckFailure: dynamodbtypes.ReturnValuesOnConditionCheckFailureAllOld,
+	})
+	var conflict *dynamodbtypes.ConditionalCheckFailedException
+	if errors.As(err, &conflict) {
+		return s.decode(claim.ID, conflict.Item)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error claiming %s in %s: %v", claim.ID, s.table, err)
+	}
+	return nil, nil
+}
+
+func (s *dynamoDedupeStore) Put(ctx context.Context, entry dedupeEntry) error {
+	item, err := s.item(entry)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.table),
+		Item:      item,
+	})
+	if err != nil {
+		return fmt.Errorf("error putting %s into %s: %v", entry.ID, s.table, err)
+	}
+	return nil
+}
+
+// Release deletes the claim on condition that the item still holds it.
+func (s *dynamoDedupeStore) Release(ctx context.Context, claim dedupeEntry) error {
+	_, err := s.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName:           aws.String(s.table),
+		Key:                 map[string]dynamodbtypes.AttributeValue{"id": &dynamodbtypes.AttributeValueMemberS{Value: claim.ID}},
+		ConditionExpression: aws.String("claimed = :claimed"),
+		ExpressionAttributeValues: map[string]dynamodbtypes.AttributeValue{
+			":claimed": &dynamodbtypes.AttributeValueMemberN{Value: strconv.FormatInt(claim.Created.UnixNano(), 10)},
+		},
+	})
+	var conflict *dynamodbtypes.ConditionalCheckFailedException
+	if err != nil && !errors.As(err, &conflict) {
+		return fmt.Errorf("error releasing %s in %s: %v", claim.ID, s.table, err)
+	}
+	return nil
+}
+
+// item encodes an entry as the table's item.
+func (s *dynamoDedupeStore) item(entry dedupeEntry) (map[string]dynamodbtypes.AttributeValue, error) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding entry %s: %v", entry.ID, err)
+	}
+	item := map[string]dynamodbtypes.AttributeValue{
+		"id":      &dynamodbtypes.AttributeValueMemberS{Value: entry.ID},
+		"bucket":  &dynamodbtypes.AttributeValueMemberS{Value: entry.Bucket},
+		"key":     &dynamodbtypes.AttributeValueMemberS{Value: entry.Key},
+		"version": &dynamodbtypes.AttributeValueMemberS{Value: entry.Version},
+		"entry":   &dynamodbtypes.AttributeValueMemberS{Value: string(data)},
+		"expires": &dynamodbtypes.AttributeValueMemberN{Value: strconv.FormatInt(entry.Created.Add(s.ttl).Unix(), 10)},
+	}
+	if entry.InProgress {
+		item["claimed"] = &dynamodbtypes.AttributeValueMemberN{Value: strconv.FormatInt(entry.Created.UnixNano(), 10)}
+	}
+	return item, nil
+}
+
+// decode reads the entry of the table's item.
+func (s *dynamoDedupeStore) decode(id string, item map[string]dynamodbtypes.AttributeValue) (*dedupeEntry, error) {
+	attr, ok := item["entry"].(*dynamodbtypes.AttributeValueMemberS)
+	if !ok {
+		return nil, fmt.Errorf("item %s in %s has no entry", id, s.table)
+	}
+	var entry dedupeEntry
+	if err := json.Unmarshal([]byte(attr.Value), &entry); err != nil {
+		return nil, fmt.Errorf("invalid entry %s in %s: %v", id, s.table, err)
+	}
+	return &entry, nil
+}
+
+// memoryDedupeStore keeps results in memory, and in a local JSON file if it
+// has a path. It stands in for DynamoDB in local runs and tests.
+type memoryDedupeStore struct {
+	mu      sync.Mutex
+	path    string
+	entries map[string]dedupeEntry
+}
+
+func (s *memoryDedupeStore) Get(ctx context.Context, id string) (*dedupeEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	entry, ok := s.entries[id]
+	if !ok {
+		return nil, nil
+	}
+	return &entry, nil
+}
+
+func (s *memoryDedupeStore) Claim(ctx context.Context, claim dedupeEntry, stale time.Time) (*dedupeEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	if entry, ok := s.entries[claim.ID]; ok && (!entry.InProgress || !entry.Created.Before(stale)) {
+		return &entry, nil
+	}
+	s.entries[claim.ID] = claim
+	return nil, s.save()
+}
+
+func (s *memoryDedupeStore) Put(ctx context.Context, entry dedupeEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return err
+	}
+	s.entries[entry.ID] = entry
+	return s.save()
+}
+
+func (s *memoryDedupeStore) Release(ctx context.Context, claim dedupeEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return err
+	}
+	if entry, ok := s.entries[claim.ID]; !ok || !entry.InProgress || !entry.Created.Equal(claim.Created) {
+		return nil
+	}
+	delete(s.entries, claim.ID)
+	return s.save()
+}
+
+// save writes the entries to the file, if the store has one.
+func (s *memoryDedupeStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s.entries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding dedupe file: %v", err)
+	}
+	if err := os.WriteFile(s.path, data, 0644); err != nil {
+		return fmt.Errorf("error writing dedupe file: %v", err)
+	}
+	return nil
+}
+
+// load reads the file, if any, so runs sharing it see each other's results.
+func (s *memoryDedupeStore) load() error {
+	if s.entries == nil {
+		s.entries = map[string]dedupeEntry{}
+	}
+	if s.path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading dedupe file: %v", err)
+	}
+	entries := map[string]dedupeEntry{}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("error parsing dedupe file: %v", err)
+	}
+	s.entries = entries
+	return nil
+}
+
+// processMemoryDedupe is the store used with DEDUPE_STORE=memory, which lasts
+// as long as the process.
+var processMemoryDedupe = &memoryDedupeStore{}
+
+// getDedupeStore returns the store named by DEDUPE_STORE: "dynamodb://table",
+// "memory", or the path of a local JSON file. It returns nil if DEDUPE_STORE
+// is not set. DynamoDB items expire after DEDUPE_TTL_DAYS, 30 by default.
+func getDedupeStore(ctx context.Context) (dedupeStore, error) {
+	location := os.Getenv("DEDUPE_STORE")
+	switch {
+	case location == "":
+		return nil, nil
+	case location == "memory":
+		return processMemoryDedupe, nil
+	case !strings.HasPrefix(location, "dynamodb://"):
+		return &memoryDedupeStore{path: strings.TrimPrefix(location, "file://")}, nil
+	}
+
+	table := strings.TrimPrefix(location, "dynamodb://")
+	if table == "" {
+		return nil, fmt.Errorf("dedupe store %q has no table", location)
+	}
+	ttlDays := defaultDedupeTTLDays
+	if value := os.Getenv("DEDUPE_TTL_DAYS"); value != "" {
+		days, err := strconv.Atoi(value)
+		if err != nil || days <= 0 {
+			loggerFrom(ctx).Warn("Invalid DEDUPE_TTL_DAYS, using the default", "value", value)
+		} else {
+			ttlDays = days
+		}
+	}
+	cfg, err := config.LoadDefaultConfig(ctx,
+		config.WithRetryMaxAttempts(3),
+		config.WithRetryMode(aws.RetryModeStandard),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %v", err)
+	}
+	return &dynamoDedupeStore{
+		client: dynamodb.NewFromConfig(cfg),
+		table:  table,
+		ttl:    time.Duration(ttlDays) * 24 * time.Hour,
+	}, nil
+}
+
+// WithForce returns a context whose requests are processed even if their
+// object or content was processed before, replacing the stored results.
+func WithForce(ctx context.Context) context.Context {
+	return context.WithValue(ctx, forceKey{}, true)
+}
+
+// forced reports whether the dedupe store and result cache are skipped, for
+// the request or, with DEDUPE_FORCE=true, for every request.
+func forced(ctx context.Context) bool {
+	force, _ := ctx.Value(forceKey{}).(bool)
+	return force || os.Getenv("DEDUPE_FORCE") == "true"
+}
+
+// objectVersion identifies the version of an object by its version ID, or by
+// its ETag in buckets without versioning.
+func objectVersion(versionID, etag string) string {
+	if versionID != "" && versionID != "null" {
+		return "v:" + versionID
+	}
+	if etag = strings.Trim(etag, `"`); etag != "" {
+		return "etag:" + etag
+	}
+	return ""
+}
+
+// contentVersion identifies content read without an ETag by its MD5, which
+// is the ETag S3 gives objects uploaded in one part.
+func contentVersion(data []byte) string {
+	sum := md5.Sum(data)
+	return "etag:" + hex.EncodeToString(sum[:])
+}
+
+// dedupeID is the key of an object version in the dedupe store.
+func dedupeID(bucket, key, version string) string {
+	return bucket + "/" + key + "@" + version
+}
+
+// claimObject claims an object version for the invocation before it is
+// processed, so events for it handled at the same time do not both process
+// it. It returns the claim, or the stored result of a version processed
+// before. A version another invocation is processing is an error, which
+// fails the invocation for the event to be retried once it is done. Store
+// errors are logged and the object processed without a claim.
+func claimObject(ctx context.Context, store dedupeStore, bucket, key, version string) (*dedupeEntry, *Response, error) {
+	if store == nil || forced(ctx) {
+		return nil, nil, nil
+	}
+	now := time.Now().UTC()
+	claim := dedupeEntry{
+		ID:         dedupeID(bucket, key, version),
+		Bucket:     bucket,
+		Key:        key,
+		Version:    version,
+		Created:    now,
+		InProgress: true,
+	}
+	entry, err := store.Claim(ctx, claim, now.Add(-dedupeClaimTimeout))
+	if err != nil {
+		loggerFrom(ctx).Warn("Error claiming object in dedupe store, processing object", "error", err)
+		return nil, nil, nil
+	}
+	if entry == nil {
+		return &claim, nil, nil
+	}
+	if entry.InProgress {
+		return nil, nil, fmt.Errorf("object %s is being processed by another invocation since %s", claim.ID, entry.Created.Format(time.RFC3339))
+	}
+	loggerFrom(ctx).Info("Skipping object already processed", "id", claim.ID, "processed", entry.Created)
+	return nil, &entry.Response, nil
+}
+
+// recordResult stores the result of an object version in place of the claim,
+// if any. If the error fails the invocation the claim is released instead,
+// for a retry to process the object again.
+func recordResult(ctx context.Context, store dedupeStore, claim *dedupeEntry, bucket, key, version string, response Response, err error) {
+	if store == nil {
+		return
+	}
+	if _, failed := failingKind(getFailurePolicy(ctx), err); failed {
+		if claim == nil {
+			return
+		}
+		if err := store.Release(ctx, *claim); err != nil {
+			loggerFrom(ctx).Warn("Error releasing claim in dedupe store", "error", err)
+		}
+		return
+	}
+	entry := dedupeEntry{
+		ID:       dedupeID(bucket, key, version),
+		Bucket:   bucket,
+		Key:      key,
+		Version:  version,
+		Response: response,
+		Created:  time.Now().UTC(),
+	}
+	if err := store.Put(ctx, entry); err != nil {
+		loggerFrom(ctx).Warn("Error saving result to dedupe store", "error", err)
+	}
+}
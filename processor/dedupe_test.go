@@ -0,0 +1,352 @@
+package processor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+)
+
+func TestObjectVersion(t *testing.T) {
+	tests := []struct {
+		versionID string
+		etag      string
+		want      string
+	}{
+		{"3HL4kqtJlcpXroDTDmJ", `"d41d8cd98f00b204e9800998ecf8427e"`, "v:3HL4kqtJlcpXroDTDmJ"},
+		{"null", `"d41d8cd98f00b204e9800998ecf8427e"`, "etag:d41d8cd98f00b204e9800998ecf8427e"},
+		{"", "d41d8cd98f00b204e9800998ecf8427e", "etag:d41d8cd98f00b204e9800998ecf8427e"},
+		{"", "", ""},
+	}
+	for _, tt := range tests {
+		if got := objectVersion(tt.versionID, tt.etag); got != tt.want {
+			t.Errorf("objectVersion(%q, %q) = %q, want %q", tt.versionID, tt.etag, got, tt.want)
+		}
+	}
+	if got := contentVersion(nil); got != "etag:d41d8cd98f00b204e9800998ecf8427e" {
+		t.Errorf("got content version %q, want the MD5 ETag", got)
+	}
+}
+
+func TestGetDedupeStore(t *testing.T) {
+	ctx := withLogger(context.Background(), discardLogger)
+	defer os.Unsetenv("DEDUPE_STORE")
+
+	path := filepath.Join(t.TempDir(), "dedupe.json")
+	tests := []struct {
+		name     string
+		location string
+		check    func(dedupeStore) bool
+		wantErr  bool
+	}{
+		{"Not set", "", func(s dedupeStore) bool { return s == nil }, false},
+		{"Memory", "memory", func(s dedupeStore) bool { return s == processMemoryDedupe }, false},
+		{"File", path, func(s dedupeStore) bool { m, ok := s.(*memoryDedupeStore); return ok && m.path == path }, false},
+		{"File URL", "file://" + path, func(s dedupeStore) bool { m, ok := s.(*memoryDedupeStore); return ok && m.path == path }, false},
+		{"DynamoDB", "dynamodb://results", func(s dedupeStore) bool {
+			d, ok := s.(*dynamoDedupeStore)
+			return ok && d.table == "results" && d.ttl == defaultDedupeTTLDays*24*time.Hour
+		}, false},
+		{"DynamoDB without table", "dynamodb://", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("DEDUPE_STORE", tt.location)
+			store, err := getDedupeStore(ctx)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !tt.check(store) {
+				t.Errorf("got %#v", store)
+			}
+		})
+	}
+}
+
+// testDedupeStore checks that a store returns what was put into it, and that
+// claims hold until they are stale, released or replaced.
+func testDedupeStore(t *testing.T, store dedupeStore) {
+	t.Helper()
+	ctx := context.Background()
+	entry, err := store.Get(ctx, "scans/a.pdf@etag:1")
+	if err != nil || entry != nil {
+		t.Fatalf("got %v (%v) before any put, want nothing", entry, err)
+	}
+
+	claimed := time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC)
+	claim := dedupeEntry{ID: "scans/a.pdf@etag:1", Bucket: "scans", Key: "a.pdf", Version: "etag:1", Created: claimed, InProgress: true}
+	if entry, err := store.Claim(ctx, claim, claimed.Add(-time.Minute)); err != nil || entry != nil {
+		t.Fatalf("got %v (%v) claiming a new entry, want the claim", entry, err)
+	}
+	if entry, err := store.Claim(ctx, claim, claimed); err != nil || entry == nil || *entry != claim {
+		t.Fatalf("got %v (%v) claiming a claimed entry, want the claim held", entry, err)
+	}
+	// A stale claim is taken over, and the old one's release leaves the new
+	stale := claim
+	claim.Created = claimed.Add(time.Hour)
+	if entry, err := store.Claim(ctx, claim, claimed.Add(time.Second)); err != nil || entry != nil {
+		t.Fatalf("got %v (%v) claiming over a stale claim, want the claim", entry, err)
+	}
+	if err := store.Release(ctx, stale); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if entry, err := store.Get(ctx, claim.ID); err != nil || entry == nil || *entry != claim {
+		t.Fatalf("got %v (%v) after releasing a stale claim, want the new claim", entry, err)
+	}
+	if err := store.Release(ctx, claim); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if entry, err := store.Get(ctx, claim.ID); err != nil || entry != nil {
+		t.Fatalf("got %v (%v) after release, want nothing", entry, err)
+	}
+
+	if _, err := store.Claim(ctx, claim, claimed); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := dedupeEntry{
+		ID:       "scans/a.pdf@etag:1",
+		Bucket:   "scans",
+		Key:      "a.pdf",
+		Version:  "etag:1",
+		Response: Response{StatusCode: 200, Body: `{"barcodes":["A"]}`},
+		Created:  time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC),
+	}
+	if err := store.Put(ctx, want); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	entry, err = store.Get(ctx, want.ID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if entry == nil || *entry != want {
+		t.Errorf("got %+v, want %+v", entry, want)
+	}
+	// A result is neither claimed over nor released
+	if entry, err := store.Claim(ctx, claim, want.Created.Add(time.Hour)); err != nil || entry == nil || *entry != want {
+		t.Errorf("got %v (%v) claiming a result, want the result", entry, err)
+	}
+	if err := store.Release(ctx, claim); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if entry, err := store.Get(ctx, want.ID); err != nil || entry == nil || *entry != want {
+		t.Errorf("got %v (%v) after releasing a claim on a result, want the result", entry, err)
+	}
+}
+
+func TestMemoryDedupeStore(t *testing.T) {
+	testDedupeStore(t, &memoryDedupeStore{})
+
+	// A file is shared by stores opened on it
+	path := filepath.Join(t.TempDir(), "dedupe.json")
+	testDedupeStore(t, &memoryDedupeStore{path: path})
+	entry, err := (&memoryDedupeStore{path: path}).Get(context.Background(), "scans/a.pdf@etag:1")
+	if err != nil || entry == nil {
+		t.Errorf("got %v (%v) from a new store on the file, want the entry", entry, err)
+	}
+}
+
+func TestDynamoDedupeStore(t *testing.T) {
+	// A stand-in for DynamoDB's GetItem, PutItem and DeleteItem, with the
+	// conditions the store uses
+	var mu sync.Mutex
+	items := map[string]json.RawMessage{}
+	claimed := func(item json.RawMessage) int64 {
+		var attrs map[string]map[string]string
+		json.Unmarshal(item, &attrs)
+		n, _ := strconv.ParseInt(attrs["claimed"]["N"], 10, 64)
+		return n
+	}
+	conflict := func(w http.ResponseWriter, item json.RawMessage) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"__type":"com.amazonaws.dynamodb.v20120810#ConditionalCheckFailedException","message":"condition failed","Item":%s}`, item)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var input struct {
+			TableName                 string
+			Key                       map[string]map[string]string
+			Item                      json.RawMessage
+			ConditionExpression       string
+			ExpressionAttributeValues map[string]map[string]string
+		}
+		json.NewDecoder(r.Body).Decode(&input)
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		if input.TableName != "results" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"__type":"com.amazonaws.dynamodb.v20120810#ResourceNotFoundException","message":"no table"}`)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Header.Get("X-Amz-Target") {
+		case "DynamoDB_20120810.GetItem":
+			if item, ok := items[input.Key["id"]["S"]]; ok {
+				fmt.Fprintf(w, `{"Item":%s}`, item)
+				return
+			}
+			fmt.Fprint(w, `{}`)
+		case "DynamoDB_20120810.PutItem":
+			var item map[string]map[string]string
+			json.Unmarshal(input.Item, &item)
+			if item["expires"]["N"] == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `{"__type":"ValidationException","message":"no expires"}`)
+				return
+			}
+			old, ok := items[item["id"]["S"]]
+			if input.ConditionExpression != "" && ok {
+				stale, _ := strconv.ParseInt(input.ExpressionAttributeValues[":stale"]["N"], 10, 64)
+				if n := claimed(old); n == 0 || n >= stale {
+					conflict(w, old)
+					return
+				}
+			}
+			items[item["id"]["S"]] = input.Item
+			fmt.Fprint(w, `{}`)
+		case "DynamoDB_20120810.DeleteItem":
+			id := input.Key["id"]["S"]
+			n, _ := strconv.ParseInt(input.ExpressionAttributeValues[":claimed"]["N"], 10, 64)
+			if old, ok := items[id]; !ok || claimed(old) != n {
+				conflict(w, nil)
+				return
+			}
+			delete(items, id)
+			fmt.Fprint(w, `{}`)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	client := dynamodb.New(dynamodb.Options{
+		BaseEndpoint: aws.String(server.URL),
+		Region:       "us-east-1",
+		Credentials:  aws.AnonymousCredentials{},
+	})
+	testDedupeStore(t, &dynamoDedupeStore{client: client, table: "results", ttl: time.Hour})
+
+	missing := &dynamoDedupeStore{client: client, table: "missing", ttl: time.Hour}
+	if _, err := missing.Get(context.Background(), "x"); err == nil {
+		t.Error("expected an error from a missing table")
+	}
+}
+
+func TestHandleRequestDedupe(t *testing.T) {
+	ctx := withLogger(context.Background(), discardLogger)
+	metricsOutput = io.Discard
+	defer func() { metricsOutput = os.Stdout }()
+
+	var calls int32
+	status := int32(http.StatusOK)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer server.Close()
+
+	img := barcodeImage(t, "ONCE-1")
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	path := writeTestPDF(t, testPDFPage{
+		content: drawImages(1),
+		images: []testPDFImage{{
+			fmt.Sprintf("/Width %d /Height %d /ColorSpace /DeviceGray /BitsPerComponent 8", w, h),
+			img.Pix,
+		}},
+	})
+	os.Setenv("TEST_PDF_PATH", path)
+	os.Setenv("WEBHOOK_URL", server.URL)
+	os.Setenv("WEBHOOK_TOKEN", "test-token")
+	os.Setenv("DEDUPE_STORE", filepath.Join(t.TempDir(), "dedupe.json"))
+	defer func() {
+		os.Unsetenv("TEST_PDF_PATH")
+		os.Unsetenv("WEBHOOK_URL")
+		os.Unsetenv("WEBHOOK_TOKEN")
+		os.Unsetenv("DEDUPE_STORE")
+		os.Unsetenv("DEDUPE_FORCE")
+	}()
+
+	run := func(ctx context.Context) (Response, int32, error) {
+		t.Helper()
+		before := atomic.LoadInt32(&calls)
+		response, err := HandleRequest(ctx, events.S3Event{})
+		return response, atomic.LoadInt32(&calls) - before, err
+	}
+
+	// A failed delivery is not stored, so the retry processes the object
+	atomic.StoreInt32(&status, http.StatusBadGateway)
+	if _, _, err := run(ctx); err == nil {
+		t.Fatal("expected a delivery error")
+	}
+	atomic.StoreInt32(&status, http.StatusOK)
+
+	first, firstCalls, err := run(ctx)
+	if err != nil || firstCalls == 0 {
+		t.Fatalf("got %d webhook calls (%v), want the object processed", firstCalls, err)
+	}
+	repeat, repeatCalls, err := run(ctx)
+	if err != nil || repeatCalls != 0 {
+		t.Errorf("got %d webhook calls (%v) for a repeat, want none", repeatCalls, err)
+	}
+	if repeat != first {
+		t.Errorf("got %+v for a repeat, want the stored %+v", repeat, first)
+	}
+
+	if _, forcedCalls, err := run(WithForce(ctx)); err != nil || forcedCalls != firstCalls {
+		t.Errorf("got %d webhook calls (%v) when forced, want %d", forcedCalls, err, firstCalls)
+	}
+	os.Setenv("DEDUPE_FORCE", "true")
+	if _, forcedCalls, err := run(ctx); err != nil || forcedCalls != firstCalls {
+		t.Errorf("got %d webhook calls (%v) with DEDUPE_FORCE, want %d", forcedCalls, err, firstCalls)
+	}
+	os.Unsetenv("DEDUPE_FORCE")
+
+	// An event for a version another invocation is processing fails, for it
+	// to be retried, unless the claim is stale
+	data, _ := os.ReadFile(path)
+	store := &memoryDedupeStore{path: os.Getenv("DEDUPE_STORE")}
+	version := contentVersion(append(data, '\n'))
+	claim := dedupeEntry{ID: dedupeID("test-bucket", path, version), Bucket: "test-bucket", Key: path, Version: version, Created: time.Now().UTC(), InProgress: true}
+	if err := store.Put(ctx, claim); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		t.Fatalf("failed to change PDF: %v", err)
+	}
+	if _, claimedCalls, err := run(ctx); err == nil || claimedCalls != 0 {
+		t.Errorf("got %d webhook calls (%v) for a claimed object, want an error and none", claimedCalls, err)
+	}
+	claim.Created = claim.Created.Add(-dedupeClaimTimeout - time.Minute)
+	if err := store.Put(ctx, claim); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, staleCalls, err := run(ctx); err != nil || staleCalls != firstCalls {
+		t.Errorf("got %d webhook calls (%v) for a stale claim, want %d", staleCalls, err, firstCalls)
+	}
+
+	// Changed content is a new version of the object
+	data, _ = os.ReadFile(path)
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		t.Fatalf("failed to change PDF: %v", err)
+	}
+	if _, changedCalls, err := run(ctx); err != nil || changedCalls != firstCalls {
+		t.Errorf("got %d webhook calls (%v) for changed content, want %d", changedCalls, err, firstCalls)
+	}
+}
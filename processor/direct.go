@@ -0,0 +1,459 @@
+package processor
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	// sourceDirect is a job of a direct invocation
+	sourceDirect = "direct"
+
+	defaultMaxDocumentBytes = 50 << 20
+	fetchTimeout            = 30 * time.Second
+)
+
+// Sinks results can go to.
+const (
+	sinkWebhook     = "webhook"
+	sinkAnnotate    = "annotate"
+	sinkArtifacts   = "artifacts"
+	sinkDebugBundle = "debug_bundle"
+)
+
+var sinks = []string{sinkWebhook, sinkAnnotate, sinkArtifacts, sinkDebugBundle}
+
+// ScanRequest is the payload of a direct invocation, which scans one document
+// and returns what was found. The document is the S3 object Bucket/Key, the
+// one at URL, or Body.
+type ScanRequest struct {
+	Bucket string `json:"bucket,omitempty"`
+	// Key is the S3 object to scan, or with URL or Body the name the
+	// document is reported and matched to a profile under
+	Key string `json:"key,omitempty"`
+	// URL is fetched with a GET request, from a public address unless its
+	// host is in FETCH_ALLOWED_HOSTS
+	URL string `json:"url,omitempty"`
+	// Body is the document itself, base64-encoded
+	Body string `json:"body,omitempty"`
+
+	// Pages are the pages to scan, as "3" or "2-5". PDF_PAGE_LIMIT applies
+	// if not set. Broken files whose pages cannot be read are scanned up to
+	// the last page, from the first.
+	Pages string `json:"pages,omitempty"`
+	// Symbologies are the format names of the barcodes to look for, such as
+	// "QR_CODE" or "CODE_128". All are looked for if not set.
+	Symbologies []string `json:"symbologies,omitempty"`
+	// Sinks are the outputs of the profile to use, of webhook, annotate,
+	// artifacts and debug_bundle. All are used if not set, or on the HTTP
+	// API those configured, and none if empty.
+	Sinks []string `json:"sinks"`
+	// ReturnInline returns the results in the response, which it does
+	// unless it is false
+	ReturnInline *bool `json:"return_inline,omitempty"`
+
+	// document is a document uploaded to the server, in place of Body
+	document []byte
+}
+
+// ScanResponse is the response to a direct invocation.
+type ScanResponse struct {
+	StatusCode int `json:"status_code"`
+	// Result is left out if the request did not ask for it inline
+	Result *ResponseBody `json:"result,omitempty"`
+	Error  string        `json:"error,omitempty"`
+}
+
+// scanOptionsKey is the context key of a direct request's scan options.
+type scanOptionsKey struct{}
+
+// scanOptions are the settings a direct request overrides.
+type scanOptions struct {
+	// FirstPage and LastPage bound the pages to scan, if LastPage is set
+	FirstPage   int
+	LastPage    int
+	Symbologies []string
+	// Sinks are the outputs to use, or all of them if nil
+	Sinks []string
+}
+
+func withScanOptions(ctx context.Context, options scanOptions) context.Context {
+	return context.WithValue(ctx, scanOptionsKey{}, options)
+}
+
+// scanOptionsFrom returns the context's scan options, which are empty
+// outside direct requests.
+func scanOptionsFrom(ctx context.Context) scanOptions {
+	options, _ := ctx.Value(scanOptionsKey{}).(scanOptions)
+	return options
+}
+
+// sinkEnabled reports whether results go to a sink.
+func (o scanOptions) sinkEnabled(sink string) bool {
+	return o.Sinks == nil || containsAny(o.Sinks, []string{sink})
+}
+
+// apply turns off the outputs of a profile the options do not use.
+func (o scanOptions) apply(profile Profile) Profile {
+	if !o.sinkEnabled(sinkAnnotate) {
+		profile.AnnotateOutput = ""
+	}
+	if !o.sinkEnabled(sinkArtifacts) {
+		profile.ArtifactOutput = ""
+	}
+	if !o.sinkEnabled(sinkDebugBundle) {
+		profile.DebugBundleOutput = ""
+	}
+	return profile
+}
+
+// keepPages drops the images of pages before the first one to scan. Images
+// of unknown pages, found by a raw scan of a broken file, are kept.
+func (o scanOptions) keepPages(images []pdfImage) []pdfImage {
+	if o.FirstPage <= 1 {
+		return images
+	}
+	var kept []pdfImage
+	for _, image := range images {
+		if image.Page == 0 || image.Page >= o.FirstPage {
+			kept = append(kept, image)
+		}
+	}
+	return kept
+}
+
+// parsePages reads a page range, "3" or "2-5".
+func parsePages(pages string) (first, last int, err error) {
+	from, to, isRange := strings.Cut(strings.TrimSpace(pages), "-")
+	first, err = strconv.Atoi(strings.TrimSpace(from))
+	if err != nil || first < 1 {
+		return 0, 0, fmt.Errorf("invalid pages %q", pages)
+	}
+	last = first
+	if isRange {
+		last, err = strconv.Atoi(strings.TrimSpace(to))
+		if err != nil || last < first {
+			return 0, 0, fmt.Errorf("invalid pages %q", pages)
+		}
+	}
+	return first, last, nil
+}
+
+// options checks the settings of a request.
+func (r ScanRequest) options() (scanOptions, error) {
+	var options scanOptions
+	if r.Pages != "" {
+		var err error
+		options.FirstPage, options.LastPage, err = parsePages(r.Pages)
+		if err != nil {
+			return options, err
+		}
+	}
+	known := symbologies()
+	for _, name := range r.Symbologies {
+		format := strings.ToUpper(strings.TrimSpace(name))
+		if !containsAny(known, []string{format}) {
+			return options, fmt.Errorf("unknown symbology %q, expected one of %s", name, strings.Join(known, ", "))
+		}
+		options.Symbologies = append(options.Symbologies, format)
+	}
+	if r.Sinks != nil {
+		options.Sinks = []string{}
+		for _, name := range r.Sinks {
+			sink := strings.ToLower(strings.TrimSpace(name))
+			if !containsAny(sinks, []string{sink}) {
+				return options, fmt.Errorf("unknown sink %q, expected one of %s", name, strings.Join(sinks, ", "))
+			}
+			options.Sinks = append(options.Sinks, sink)
+		}
+	}
+	return options, nil
+}
+
+// job returns the job of a request, with the document if it came in the
+// request or from its URL.
+func (r ScanRequest) job(ctx context.Context) (job, error) {
+	if err := checkKey(r.Key); err != nil {
+		return job{}, err
+	}
+	if r.document != nil {
+		if r.URL != "" || r.Body != "" {
+			return job{}, fmt.Errorf("request has an uploaded file and a url or body")
+		}
+		if limit := getMaxDocumentBytes(ctx); int64(len(r.document)) > limit {
+			return job{}, fmt.Errorf("file is larger than %d bytes", limit)
+		}
+		j := job{Bucket: r.Bucket, Key: r.Key, Source: sourceDirect, Data: r.document}
+		if j.Bucket == "" {
+			j.Bucket = sourceDirect
+		}
+		if j.Key == "" {
+			j.Key = "upload"
+		}
+		return j, nil
+	}
+	if r.URL != "" && r.Body != "" {
+		return job{}, fmt.Errorf("request has both a url and a body")
+	}
+	if r.URL == "" && r.Body == "" && r.Key == "" {
+		return job{}, fmt.Errorf("request needs a key, url or body")
+	}
+
+	j := job{Bucket: r.Bucket, Key: r.Key, Source: sourceDirect}
+	switch {
+	case r.Body != "":
+		data, err := base64.StdEncoding.DecodeString(r.Body)
+		if err != nil {
+			return job{}, fmt.Errorf("body is not base64: %v", err)
+		}
+		if limit := getMaxDocumentBytes(ctx); int64(len(data)) > limit {
+			return job{}, fmt.Errorf("body is larger than %d bytes", limit)
+		}
+		j.Data = data
+		if j.Key == "" {
+			j.Key = "body"
+		}
+	case r.URL != "":
+		data, err := fetchDocument(ctx, r.URL)
+		if err != nil {
+			return job{}, err
+		}
+		j.Data = data
+		if j.Key == "" {
+			j.Key = urlKey(r.URL)
+		}
+	default:
+		if j.Bucket == "" {
+			return job{}, fmt.Errorf("request with a key needs a bucket")
+		}
+	}
+	if j.Data != nil && j.Bucket == "" {
+		j.Bucket = sourceDirect
+	}
+	return j, nil
+}
+
+// checkKey rejects a requested key that is absolute or climbs out of its
+// directory, since outputs such as annotated PDFs are saved under the key.
+func checkKey(key string) error {
+	if strings.HasPrefix(key, "/") || containsAny(strings.Split(key, "/"), []string{".."}) {
+		return fmt.Errorf("invalid key %q", key)
+	}
+	return nil
+}
+
+// urlKey names a document fetched from a URL after the last element of its
+// path.
+func urlKey(rawURL string) string {
+	if u, err := url.Parse(rawURL); err == nil {
+		if name := path.Base(u.Path); name != "." && name != "/" {
+			return name
+		}
+	}
+	return "document"
+}
+
+// getMaxDocumentBytes reads the size limit of documents sent or fetched
+// with a request from MAX_DOCUMENT_BYTES, 50 MiB by default.
+func getMaxDocumentBytes(ctx context.Context) int64 {
+	value := os.Getenv("MAX_DOCUMENT_BYTES")
+	if value == "" {
+		return defaultMaxDocumentBytes
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n <= 0 {
+		loggerFrom(ctx).Warn("Invalid MAX_DOCUMENT_BYTES, using the default", "value", value)
+		return defaultMaxDocumentBytes
+	}
+	return n
+}
+
+// getFetchAllowedHosts reads the hosts documents may be fetched from at
+// private addresses, such as an internal document store, from
+// FETCH_ALLOWED_HOSTS, a comma-separated list of host names or IP addresses.
+func getFetchAllowedHosts() map[string]bool {
+	hosts := map[string]bool{}
+	for _, host := range strings.Split(os.Getenv("FETCH_ALLOWED_HOSTS"), ",") {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			hosts[host] = true
+		}
+	}
+	return hosts
+}
+
+// internalNetworks are the ranges that reach internal hosts although the
+// standard library does not call them private: carrier-grade NAT, which
+// VPC peering and some VPNs use, and NAT64 prefixes, which translate to
+// any IPv4 address, private ones included.
+var internalNetworks = []*net.IPNet{
+	mustParseCIDR("100.64.0.0/10"),
+	mustParseCIDR("64:ff9b::/96"),
+	mustParseCIDR("64:ff9b:1::/48"),
+}
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, network, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return network
+}
+
+// isPublicIP reports whether an address is one documents may be fetched
+// from without being allowed: not loopback, private, link-local, such as
+// the instance metadata service, multicast or in an internalNetworks range.
+func isPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	for _, network := range internalNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// newFetchClient returns the client documents are fetched with. It only
+// connects to the allowed hosts or to public addresses, checked once a host
+// name is resolved and for every redirect, so a request cannot reach
+// internal services through the function or server.
+func newFetchClient(allowed map[string]bool) *http.Client {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	publicDialer := &net.Dialer{
+		Timeout: dialer.Timeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+				return fmt.Errorf("%s is not a public address, and its host is not in FETCH_ALLOWED_HOSTS", host)
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// A proxy would connect on the client's behalf, past the checks
+	transport.Proxy = nil
+	transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		if allowed[strings.ToLower(host)] {
+			return dialer.DialContext(ctx, network, address)
+		}
+		return publicDialer.DialContext(ctx, network, address)
+	}
+	return &http.Client{Transport: transport}
+}
+
+// fetchDocument gets a document from an HTTP or HTTPS URL, at a public
+// address unless its host is allowed.
+func fetchDocument(ctx context.Context, rawURL string) ([]byte, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("url %q is not an HTTP or HTTPS URL", rawURL)
+	}
+	ctx, cancel := context.WithTimeout(ctx, fetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %v", err)
+	}
+	res, err := newFetchClient(getFetchAllowedHosts()).Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching %s: %v", u.Redacted(), err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s returned status %d", u.Redacted(), res.StatusCode)
+	}
+	limit := getMaxDocumentBytes(ctx)
+	data, err := io.ReadAll(io.LimitReader(res.Body, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", u.Redacted(), err)
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("document at %s is larger than %d bytes", u.Redacted(), limit)
+	}
+	return data, nil
+}
+
+// isScanRequest reports whether an invocation payload is a ScanRequest
+// rather than an event.
+func isScanRequest(payload []byte) bool {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(payload, &fields) != nil {
+		return false
+	}
+	if _, ok := fields["Records"]; ok {
+		return false
+	}
+	for _, name := range []string{"key", "url", "body"} {
+		if _, ok := fields[name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ScanDocument scans the document of a direct request and returns what was
+// found. Events already processed are not looked up in the dedupe store,
+// since a request may scan again with other settings, and failures are
+// returned to the caller rather than saved.
+func ScanDocument(ctx context.Context, request ScanRequest) ScanResponse {
+	ctx = withLogger(ctx, requestLogger(ctx).With("source", sourceDirect))
+	initTracing(ctx)
+	ctx, span := startSpan(ctx, spanHandleRequest, attribute.String("source", sourceDirect))
+	response, err := scanRequest(ctx, request)
+	span.SetAttributes(attribute.Int("status_code", response.StatusCode))
+	endSpan(span, err)
+	flushTraces(ctx)
+	return response
+}
+
+func scanRequest(ctx context.Context, request ScanRequest) (ScanResponse, error) {
+	options, err := request.options()
+	if err != nil {
+		return ScanResponse{StatusCode: 400, Error: err.Error()}, err
+	}
+	j, err := request.job(ctx)
+	if err != nil {
+		loggerFrom(ctx).Error("Invalid request", "error", err)
+		return ScanResponse{StatusCode: 400, Error: err.Error()}, err
+	}
+
+	response, err := handleJob(withScanOptions(ctx, options), j)
+	response, err = applyFailurePolicy(ctx, response, err)
+	result := ScanResponse{StatusCode: response.StatusCode}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	if request.ReturnInline == nil || *request.ReturnInline {
+		var body ResponseBody
+		if json.Unmarshal([]byte(response.Body), &body) == nil {
+			result.Result = &body
+		} else if result.Error == "" {
+			result.Error = response.Body
+		}
+	}
+	return result, err
+}
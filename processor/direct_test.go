@@ -0,0 +1,328 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestParsePages(t *testing.T) {
+	tests := []struct {
+		pages     string
+		wantFirst int
+		wantLast  int
+		wantErr   bool
+	}{
+		{"3", 3, 3, false},
+		{"2-5", 2, 5, false},
+		{" 1 - 2 ", 1, 2, false},
+		{"0", 0, 0, true},
+		{"5-2", 0, 0, true},
+		{"2-", 0, 0, true},
+		{"all", 0, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pages, func(t *testing.T) {
+			first, last, err := parsePages(tt.pages)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want one: %v", err, tt.wantErr)
+			}
+			if first != tt.wantFirst || last != tt.wantLast {
+				t.Errorf("got pages %d-%d, want %d-%d", first, last, tt.wantFirst, tt.wantLast)
+			}
+		})
+	}
+}
+
+func TestScanRequestOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		request ScanRequest
+		want    scanOptions
+		wantErr bool
+	}{
+		{name: "Defaults", request: ScanRequest{}, want: scanOptions{}},
+		{
+			name:    "Settings",
+			request: ScanRequest{Pages: "2-3", Symbologies: []string{"qr_code", "CODE_128"}, Sinks: []string{"Webhook"}},
+			want:    scanOptions{FirstPage: 2, LastPage: 3, Symbologies: []string{"QR_CODE", "CODE_128"}, Sinks: []string{"webhook"}},
+		},
+		{name: "No sinks", request: ScanRequest{Sinks: []string{}}, want: scanOptions{Sinks: []string{}}},
+		{name: "Unknown symbology", request: ScanRequest{Symbologies: []string{"PDF_417"}}, wantErr: true},
+		{name: "Unknown sink", request: ScanRequest{Sinks: []string{"email"}}, wantErr: true},
+		{name: "Invalid pages", request: ScanRequest{Pages: "first"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options, err := tt.request.options()
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected error but got %+v", options)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(options, tt.want) {
+				t.Errorf("got %+v, want %+v", options, tt.want)
+			}
+		})
+	}
+}
+
+func TestFetchDocument(t *testing.T) {
+	documents := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/scan.pdf":
+			w.Write([]byte("%PDF-"))
+		case "/metadata":
+			http.Redirect(w, r, "http://169.254.169.254/latest/meta-data/", http.StatusFound)
+		case "/localhost":
+			http.Redirect(w, r, "http://localhost"+strings.TrimPrefix(r.Host, "127.0.0.1")+"/scan.pdf", http.StatusFound)
+		default:
+			http.Redirect(w, r, "/scan.pdf", http.StatusFound)
+		}
+	}))
+	defer documents.Close()
+	defer os.Unsetenv("FETCH_ALLOWED_HOSTS")
+
+	tests := []struct {
+		name    string
+		url     string
+		allowed string
+		wantErr bool
+	}{
+		{"Loopback", documents.URL + "/scan.pdf", "", true},
+		{"Allowed host", documents.URL + "/scan.pdf", "example.com, 127.0.0.1", false},
+		{"Redirect within allowed host", documents.URL + "/moved", "127.0.0.1", false},
+		{"Redirect to link-local address", documents.URL + "/metadata", "127.0.0.1", true},
+		{"Redirect to other host", documents.URL + "/localhost", "127.0.0.1", true},
+		{"Private address", "http://10.0.0.1/scan.pdf", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("FETCH_ALLOWED_HOSTS", tt.allowed)
+			data, err := fetchDocument(context.Background(), tt.url)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want one: %v", err, tt.wantErr)
+			}
+			if err == nil && string(data) != "%PDF-" {
+				t.Errorf("got %q, want the document", data)
+			}
+		})
+	}
+}
+
+func TestIsPublicIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1::", true},
+		{"127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"192.168.0.1", false},
+		{"169.254.169.254", false},
+		{"0.0.0.0", false},
+		{"::1", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"100.64.0.1", false},
+		{"100.127.255.254", false},
+		{"100.128.0.1", true},
+		{"64:ff9b::a9fe:a9fe", false},
+		{"64:ff9b:1::1", false},
+	}
+	for _, tt := range tests {
+		if got := isPublicIP(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("isPublicIP(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestIsScanRequest(t *testing.T) {
+	tests := []struct {
+		payload string
+		want    bool
+	}{
+		{`{"bucket":"scans","key":"in/a.pdf"}`, true},
+		{`{"url":"https://example.com/a.pdf","return_inline":true}`, true},
+		{`{"body":"JVBERi0="}`, true},
+		{testS3Event, false},
+		{testEventBridgeEvent, false},
+		{`{"Service":"Amazon S3","Event":"s3:TestEvent","Bucket":"scans"}`, false},
+		{`hello`, false},
+	}
+	for _, tt := range tests {
+		if got := isScanRequest([]byte(tt.payload)); got != tt.want {
+			t.Errorf("isScanRequest(%s) = %v, want %v", tt.payload, got, tt.want)
+		}
+	}
+}
+
+func TestScanDocument(t *testing.T) {
+	ctx := withLogger(context.Background(), discardLogger)
+	metricsOutput = io.Discard
+	defer func() { metricsOutput = os.Stdout }()
+
+	var calls int32
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer webhook.Close()
+
+	page := func(text string) testPDFPage {
+		img := barcodeImage(t, text)
+		return testPDFPage{
+			content: drawImages(1),
+			images: []testPDFImage{{
+				fmt.Sprintf("/Width %d /Height %d /ColorSpace /DeviceGray /BitsPerComponent 8", img.Bounds().Dx(), img.Bounds().Dy()),
+				img.Pix,
+			}},
+		}
+	}
+	data, err := os.ReadFile(writeTestPDF(t, page("DIRECT-1"), page("DIRECT-2")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	documents := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/docs/scan.pdf" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	}))
+	defer documents.Close()
+
+	os.Setenv("WEBHOOK_URL", webhook.URL)
+	os.Setenv("WEBHOOK_TOKEN", "test-token")
+	os.Setenv("PDF_PAGE_LIMIT", "2")
+	os.Setenv("FETCH_ALLOWED_HOSTS", "127.0.0.1")
+	defer func() {
+		os.Unsetenv("WEBHOOK_URL")
+		os.Unsetenv("WEBHOOK_TOKEN")
+		os.Unsetenv("PDF_PAGE_LIMIT")
+		os.Unsetenv("MAX_DOCUMENT_BYTES")
+		os.Unsetenv("FETCH_ALLOWED_HOSTS")
+	}()
+
+	body := base64.StdEncoding.EncodeToString(data)
+	// Without a readable catalog, images are found by a raw scan and have no page
+	broken := base64.StdEncoding.EncodeToString(bytes.Replace(data, []byte("<< /Type /Catalog /Pages 2 0 R >>"), []byte("<< /Type /Catalog /Pages 2 0 R"), 1))
+	no := false
+	tests := []struct {
+		name         string
+		request      ScanRequest
+		maxBytes     string
+		wantStatus   int
+		wantKey      string
+		wantBarcodes []string
+		wantCalls    bool
+		wantInline   bool
+		wantErr      bool
+	}{
+		{
+			name:         "Body without sinks",
+			request:      ScanRequest{Body: body, Sinks: []string{}},
+			wantStatus:   200,
+			wantKey:      "body",
+			wantBarcodes: []string{"DIRECT-1", "DIRECT-2"},
+			wantInline:   true,
+		},
+		{
+			name:         "URL with the webhook",
+			request:      ScanRequest{URL: documents.URL + "/docs/scan.pdf"},
+			wantStatus:   200,
+			wantKey:      "scan.pdf",
+			wantBarcodes: []string{"DIRECT-1", "DIRECT-2"},
+			wantCalls:    true,
+			wantInline:   true,
+		},
+		{
+			name:         "Page range",
+			request:      ScanRequest{Key: "named.pdf", Body: body, Pages: "2", Sinks: []string{}},
+			wantStatus:   200,
+			wantKey:      "named.pdf",
+			wantBarcodes: []string{"DIRECT-2"},
+			wantInline:   true,
+		},
+		{
+			name:         "Page range of a broken file",
+			request:      ScanRequest{Body: broken, Pages: "2", Sinks: []string{}},
+			wantStatus:   200,
+			wantKey:      "body",
+			wantBarcodes: []string{"DIRECT-1", "DIRECT-2"},
+			wantInline:   true,
+		},
+		{
+			name:         "Other symbologies",
+			request:      ScanRequest{Body: body, Symbologies: []string{"QR_CODE"}, Sinks: []string{}},
+			wantStatus:   200,
+			wantKey:      "body",
+			wantBarcodes: []string{},
+			wantInline:   true,
+		},
+		{
+			name:       "Not inline",
+			request:    ScanRequest{Body: body, ReturnInline: &no},
+			wantStatus: 200,
+			wantCalls:  true,
+		},
+		{name: "URL and body", request: ScanRequest{URL: documents.URL, Body: body}, wantStatus: 400, wantErr: true},
+		{name: "Key climbing out", request: ScanRequest{Key: "../../etc/cron.d/x", Body: body}, wantStatus: 400, wantErr: true},
+		{name: "Absolute key", request: ScanRequest{Key: "/etc/cron.d/x", Body: body}, wantStatus: 400, wantErr: true},
+		{name: "Key without bucket", request: ScanRequest{Key: "in/a.pdf"}, wantStatus: 400, wantErr: true},
+		{name: "Body not base64", request: ScanRequest{Body: "%%%"}, wantStatus: 400, wantErr: true},
+		{name: "Body too large", request: ScanRequest{Body: body}, maxBytes: "100", wantStatus: 400, wantErr: true},
+		{name: "URL not found", request: ScanRequest{URL: documents.URL + "/missing.pdf"}, wantStatus: 400, wantErr: true},
+		{name: "URL not HTTP", request: ScanRequest{URL: "file:///etc/passwd"}, wantStatus: 400, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.maxBytes != "" {
+				os.Setenv("MAX_DOCUMENT_BYTES", tt.maxBytes)
+				defer os.Unsetenv("MAX_DOCUMENT_BYTES")
+			}
+			before := atomic.LoadInt32(&calls)
+			response := ScanDocument(ctx, tt.request)
+			if response.StatusCode != tt.wantStatus || (response.Error != "") != tt.wantErr {
+				t.Fatalf("got %+v, want status %d and an error: %v", response, tt.wantStatus, tt.wantErr)
+			}
+			if called := atomic.LoadInt32(&calls) > before; called != tt.wantCalls {
+				t.Errorf("got webhook called: %v, want %v", called, tt.wantCalls)
+			}
+			if (response.Result != nil) != tt.wantInline {
+				t.Fatalf("got result %+v, want one inline: %v", response.Result, tt.wantInline)
+			}
+			if response.Result == nil {
+				return
+			}
+			if response.Result.Key != tt.wantKey || !reflect.DeepEqual(response.Result.Barcodes, tt.wantBarcodes) {
+				t.Errorf("got %s with barcodes %v, want %s with %v", response.Result.Key, response.Result.Barcodes, tt.wantKey, tt.wantBarcodes)
+			}
+		})
+	}
+
+	// Lambda hands requests to ScanDocument
+	payload, _ := json.Marshal(ScanRequest{Body: body, Pages: "1", Sinks: []string{}})
+	result, err := LambdaHandler(ctx, payload)
+	response, ok := result.(ScanResponse)
+	if err != nil || !ok || response.Result == nil || !reflect.DeepEqual(response.Result.Barcodes, []string{"DIRECT-1"}) {
+		t.Errorf("got %+v (%v) from LambdaHandler, want the scan of page 1", result, err)
+	}
+}
@@ -0,0 +1,171 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ErrorKind is the stage of processing an error comes from.
+type ErrorKind string
+
+// Kinds of processing error.
+const (
+	// ErrorSource is an error getting the object: a bad event, S3 or an
+	// empty object
+	ErrorSource ErrorKind = "source"
+	// ErrorParse is an input we cannot read: an unsupported format, a broken
+	// archive or a PDF that cannot be decrypted
+	ErrorParse ErrorKind = "parse"
+	// ErrorExtract is an error getting the images out of a document
+	ErrorExtract ErrorKind = "extract"
+	// ErrorDecode is a document in which no barcode was found
+	ErrorDecode ErrorKind = "decode"
+	// ErrorDelivery is a webhook call that failed
+	ErrorDelivery ErrorKind = "delivery"
+)
+
+var errorKinds = []ErrorKind{ErrorSource, ErrorParse, ErrorExtract, ErrorDecode, ErrorDelivery}
+
+// defaultFailOn are the kinds of error that fail the invocation when FAIL_ON
+// is not set. A document without barcodes is a result, not a failure, and
+// retrying it would not find any.
+var defaultFailOn = []ErrorKind{ErrorSource, ErrorParse, ErrorExtract, ErrorDelivery}
+
+// ProcessingError is an error of one stage of processing a document.
+type ProcessingError struct {
+	Kind ErrorKind
+	Err  error
+}
+
+func (e *ProcessingError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ProcessingError) Unwrap() error {
+	return e.Err
+}
+
+// processingError wraps err as an error of kind, or returns nil if err is nil.
+func processingError(kind ErrorKind, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &ProcessingError{Kind: kind, Err: err}
+}
+
+// metricName is the name of the metric counting errors of the kind.
+func (k ErrorKind) metricName() string {
+	return strings.ToUpper(string(k[:1])) + string(k[1:]) + "Errors"
+}
+
+// statusCode is the response status of an invocation failed by an error of
+// the kind.
+func (k ErrorKind) statusCode() int {
+	switch k {
+	case ErrorParse, ErrorDecode:
+		return 422
+	case ErrorDelivery:
+		return 502
+	}
+	return 500
+}
+
+// errorKindsOf returns the kinds of the processing errors in err, including
+// those joined into it, in order and without repeats.
+func errorKindsOf(err error) []ErrorKind {
+	var kinds []ErrorKind
+	var walk func(error)
+	walk = func(err error) {
+		switch e := err.(type) {
+		case *ProcessingError:
+			for _, kind := range kinds {
+				if kind == e.Kind {
+					return
+				}
+			}
+			kinds = append(kinds, e.Kind)
+		case interface{ Unwrap() []error }:
+			for _, err := range e.Unwrap() {
+				walk(err)
+			}
+		case interface{ Unwrap() error }:
+			walk(e.Unwrap())
+		}
+	}
+	walk(err)
+	return kinds
+}
+
+// getFailurePolicy reads the kinds of error that fail the invocation from
+// FAIL_ON, a comma-separated list of source, parse, extract, decode and
+// delivery, or "none". Failing lets S3's asynchronous invocation retry the
+// object and then hand it to the function's failure destination or dead
+// letter queue.
+func getFailurePolicy(ctx context.Context) map[ErrorKind]bool {
+	policy := map[ErrorKind]bool{}
+	value := strings.TrimSpace(os.Getenv("FAIL_ON"))
+	if value == "" {
+		for _, kind := range defaultFailOn {
+			policy[kind] = true
+		}
+		return policy
+	}
+	if value == "none" {
+		return policy
+	}
+	for _, name := range strings.Split(value, ",") {
+		kind := ErrorKind(strings.ToLower(strings.TrimSpace(name)))
+		known := false
+		for _, k := range errorKinds {
+			known = known || k == kind
+		}
+		if !known {
+			loggerFrom(ctx).Warn("Ignoring unknown error kind in FAIL_ON", "kind", name)
+			continue
+		}
+		policy[kind] = true
+	}
+	return policy
+}
+
+// failingKind returns the kind of error in err the policy fails on, and
+// whether it fails at all. Errors without a kind always fail.
+func failingKind(policy map[ErrorKind]bool, err error) (ErrorKind, bool) {
+	if err == nil {
+		return "", false
+	}
+	kinds := errorKindsOf(err)
+	if len(kinds) == 0 {
+		return "", true
+	}
+	for _, kind := range kinds {
+		if policy[kind] {
+			return kind, true
+		}
+	}
+	return "", false
+}
+
+// applyFailurePolicy decides whether an error fails the invocation. Errors
+// the policy fails on are returned, with a failure status code if the
+// response had none; others are logged and the response is returned as a
+// success.
+func applyFailurePolicy(ctx context.Context, response Response, err error) (Response, error) {
+	kind, failed := failingKind(getFailurePolicy(ctx), err)
+	if !failed {
+		if err != nil {
+			loggerFrom(ctx).Info("Not failing invocation", "kinds", errorKindsOf(err), "error", err)
+		}
+		return response, nil
+	}
+	if kind == "" {
+		return response, err
+	}
+	if response.StatusCode < 400 {
+		response.StatusCode = kind.statusCode()
+	}
+	// The kind that failed the invocation comes first
+	return response, processingError(kind, fmt.Errorf("%s error: %w", kind, err))
+}
@@ -0,0 +1,185 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestErrorKindsOf(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want []ErrorKind
+	}{
+		{"Nil", nil, nil},
+		{"Untyped", fmt.Errorf("boom"), nil},
+		{"Typed", processingError(ErrorSource, fmt.Errorf("boom")), []ErrorKind{ErrorSource}},
+		{"Wrapped", fmt.Errorf("doc: %w", processingError(ErrorExtract, fmt.Errorf("boom"))), []ErrorKind{ErrorExtract}},
+		{
+			"Joined",
+			errors.Join(
+				processingError(ErrorDecode, fmt.Errorf("none")),
+				fmt.Errorf("doc: %w", errors.Join(
+					processingError(ErrorDelivery, fmt.Errorf("502")),
+					processingError(ErrorDecode, fmt.Errorf("none")),
+				)),
+			),
+			[]ErrorKind{ErrorDecode, ErrorDelivery},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := errorKindsOf(tt.err); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if processingError(ErrorSource, nil) != nil {
+		t.Error("got an error wrapping nil")
+	}
+}
+
+func TestGetFailurePolicy(t *testing.T) {
+	ctx := withLogger(context.Background(), discardLogger)
+	defer os.Unsetenv("FAIL_ON")
+
+	tests := []struct {
+		value string
+		want  []ErrorKind
+	}{
+		{"", defaultFailOn},
+		{"none", nil},
+		{"delivery", []ErrorKind{ErrorDelivery}},
+		{" Decode , delivery,bogus", []ErrorKind{ErrorDecode, ErrorDelivery}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			os.Setenv("FAIL_ON", tt.value)
+			policy := getFailurePolicy(ctx)
+			if len(policy) != len(tt.want) {
+				t.Errorf("got %v, want %v", policy, tt.want)
+			}
+			for _, kind := range tt.want {
+				if !policy[kind] {
+					t.Errorf("got %v, want %s to fail", policy, kind)
+				}
+			}
+		})
+	}
+}
+
+func TestApplyFailurePolicy(t *testing.T) {
+	ctx := withLogger(context.Background(), discardLogger)
+	defer os.Unsetenv("FAIL_ON")
+
+	tests := []struct {
+		name       string
+		failOn     string
+		response   Response
+		err        error
+		wantStatus int
+		wantErr    bool
+	}{
+		{"No error", "", Response{StatusCode: 200}, nil, 200, false},
+		{"Untyped error", "none", Response{StatusCode: 500}, fmt.Errorf("boom"), 500, true},
+		{"Delivery fails by default", "", Response{StatusCode: 200}, processingError(ErrorDelivery, fmt.Errorf("502")), 502, true},
+		{"Decode passes by default", "", Response{StatusCode: 200}, processingError(ErrorDecode, fmt.Errorf("none")), 200, false},
+		{"Decode fails when configured", "decode", Response{StatusCode: 200}, processingError(ErrorDecode, fmt.Errorf("none")), 422, true},
+		{"Status code kept", "", Response{StatusCode: 400}, processingError(ErrorSource, fmt.Errorf("empty")), 400, true},
+		{"Source passes when not configured", "delivery", Response{StatusCode: 400}, processingError(ErrorSource, fmt.Errorf("empty")), 400, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("FAIL_ON", tt.failOn)
+			response, err := applyFailurePolicy(ctx, tt.response, tt.err)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error: %v", err, tt.wantErr)
+			}
+			if response.StatusCode != tt.wantStatus {
+				t.Errorf("got status %d, want %d", response.StatusCode, tt.wantStatus)
+			}
+			var processingErr *ProcessingError
+			if err != nil && tt.err != nil && errorKindsOf(tt.err) != nil && !errors.As(err, &processingErr) {
+				t.Errorf("got %v, want the processing error kept", err)
+			}
+		})
+	}
+}
+
+func TestHandleRequestFailurePolicy(t *testing.T) {
+	ctx := withLogger(context.Background(), discardLogger)
+	metricsOutput = io.Discard
+	defer func() { metricsOutput = os.Stdout }()
+
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	img := barcodeImage(t, "POLICY-1")
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	dict := fmt.Sprintf("/Width %d /Height %d /ColorSpace /DeviceGray /BitsPerComponent 8", w, h)
+	withBarcode := writeTestPDF(t, testPDFPage{content: drawImages(1), images: []testPDFImage{{dict, img.Pix}}})
+	blank := writeTestPDF(t, testPDFPage{content: drawImages(1), images: []testPDFImage{{dict, make([]byte, w*h)}}})
+
+	os.Setenv("WEBHOOK_URL", server.URL)
+	os.Setenv("WEBHOOK_TOKEN", "test-token")
+	defer func() {
+		os.Unsetenv("TEST_PDF_PATH")
+		os.Unsetenv("WEBHOOK_URL")
+		os.Unsetenv("WEBHOOK_TOKEN")
+		os.Unsetenv("FAIL_ON")
+	}()
+
+	tests := []struct {
+		name       string
+		path       string
+		status     int
+		failOn     string
+		wantStatus int
+		wantKind   ErrorKind
+	}{
+		{"Delivered", withBarcode, http.StatusOK, "", 200, ""},
+		{"Webhook fails", withBarcode, http.StatusInternalServerError, "", 502, ErrorDelivery},
+		{"Webhook fails, delivery not failing", withBarcode, http.StatusInternalServerError, "source,parse,extract", 200, ""},
+		{"No barcodes", blank, http.StatusOK, "", 200, ""},
+		{"No barcodes, decode failing", blank, http.StatusOK, "decode", 422, ErrorDecode},
+		{"Missing file", "/nonexistent.pdf", http.StatusOK, "", 500, ErrorSource},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("TEST_PDF_PATH", tt.path)
+			os.Setenv("FAIL_ON", tt.failOn)
+			status = tt.status
+
+			response, err := HandleRequest(ctx, events.S3Event{})
+			if response.StatusCode != tt.wantStatus {
+				t.Errorf("got status %d, want %d", response.StatusCode, tt.wantStatus)
+			}
+			if tt.wantKind == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			var processingErr *ProcessingError
+			if !errors.As(err, &processingErr) || processingErr.Kind != tt.wantKind {
+				t.Errorf("got error %v, want a %s error", err, tt.wantKind)
+			}
+		})
+	}
+}
@@ -0,0 +1,271 @@
+package processor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Sources of the events that announce objects to process.
+const (
+	sourceS3          = "s3"
+	sourceSNS         = "sns"
+	sourceSQS         = "sqs"
+	sourceEventBridge = "eventbridge"
+)
+
+// job is an object to process, whatever event announced it.
+type job struct {
+	Bucket string
+	// Key is the object's key, URL-decoded
+	Key string
+	// Source is the kind of event the job came in
+	Source string
+	// MessageID is the SQS message the job came in, if any
+	MessageID string
+	// Attempt is the number of times the message was received, or 0 when
+	// the event source does not count deliveries
+	Attempt int
+	// Data is the document, if it came with a direct request rather than
+	// from S3
+	Data []byte
+}
+
+// event returns an S3 event for the job's object, which replays it. The key
+// is URL-encoded, as in the events S3 sends.
+func (j job) event() events.S3Event {
+	record := events.S3EventRecord{EventSource: "aws:s3"}
+	record.S3.Bucket.Name = j.Bucket
+	record.S3.Object.Key = strings.ReplaceAll(url.QueryEscape(j.Key), "%2F", "/")
+	return events.S3Event{Records: []events.S3EventRecord{record}}
+}
+
+// eventEnvelope holds the fields that tell the supported events apart.
+type eventEnvelope struct {
+	Records []struct {
+		// EventSource is "EventSource" in SNS records, which JSON field
+		// matching also accepts
+		EventSource string `json:"eventSource"`
+	} `json:"Records"`
+	// Source and DetailType are set in EventBridge events
+	Source     string `json:"source"`
+	DetailType string `json:"detail-type"`
+	// Type is "Notification" in SNS messages delivered to SQS without raw
+	// message delivery
+	Type string `json:"Type"`
+	// Event is "s3:TestEvent" in the message S3 sends when a notification
+	// is configured
+	Event string `json:"Event"`
+}
+
+func (e eventEnvelope) recordSource() string {
+	if len(e.Records) == 0 {
+		return ""
+	}
+	return e.Records[0].EventSource
+}
+
+// s3EventDetail is the detail of an EventBridge "Object Created" event.
+type s3EventDetail struct {
+	Bucket struct {
+		Name string `json:"name"`
+	} `json:"bucket"`
+	Object struct {
+		Key string `json:"key"`
+	} `json:"object"`
+}
+
+// s3EventJobs returns the objects of an S3 event.
+func s3EventJobs(event events.S3Event) []job {
+	var jobs []job
+	for _, record := range event.Records {
+		// Keys arrive URL-encoded, but events built in code only set Key
+		key := record.S3.Object.URLDecodedKey
+		if key == "" {
+			key = record.S3.Object.Key
+		}
+		jobs = append(jobs, job{Bucket: record.S3.Bucket.Name, Key: key, Source: sourceS3})
+	}
+	return jobs
+}
+
+// eventJobs returns the objects announced by an S3 event, an SNS event or
+// message wrapping one, or an EventBridge event. S3 test events and other
+// EventBridge events have none. SQS batches are handled by
+// handleSQSEvent.
+func eventJobs(data []byte) ([]job, error) {
+	var envelope eventEnvelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return nil, fmt.Errorf("event is not a JSON object: %v", err)
+	}
+
+	switch {
+	case envelope.Event == "s3:TestEvent":
+		return nil, nil
+
+	case envelope.Source == "aws.s3":
+		var event events.EventBridgeEvent
+		if err := json.Unmarshal(data, &event); err != nil {
+			return nil, fmt.Errorf("invalid EventBridge event: %v", err)
+		}
+		if event.DetailType != "Object Created" {
+			return nil, nil
+		}
+		var detail s3EventDetail
+		if err := json.Unmarshal(event.Detail, &detail); err != nil {
+			return nil, fmt.Errorf("invalid EventBridge event detail: %v", err)
+		}
+		// EventBridge keys are not URL-encoded
+		return []job{{Bucket: detail.Bucket.Name, Key: detail.Object.Key, Source: sourceEventBridge}}, nil
+
+	case envelope.Type == "Notification":
+		var message events.SNSEntity
+		if err := json.Unmarshal(data, &message); err != nil {
+			return nil, fmt.Errorf("invalid SNS message: %v", err)
+		}
+		return snsMessageJobs(message)
+
+	case envelope.recordSource() == "aws:sns":
+		var event events.SNSEvent
+		if err := json.Unmarshal(data, &event); err != nil {
+			return nil, fmt.Errorf("invalid SNS event: %v", err)
+		}
+		var jobs []job
+		for _, record := range event.Records {
+			recordJobs, err := snsMessageJobs(record.SNS)
+			if err != nil {
+				return nil, err
+			}
+			jobs = append(jobs, recordJobs...)
+		}
+		return jobs, nil
+
+	case envelope.recordSource() == "aws:sqs":
+		return nil, fmt.Errorf("SQS batch inside another event")
+
+	case len(envelope.Records) > 0:
+		// Records without an event source are taken for S3 records, as in
+		// events written by hand
+		var event events.S3Event
+		if err := json.Unmarshal(data, &event); err != nil {
+			return nil, fmt.Errorf("invalid S3 event: %v", err)
+		}
+		return s3EventJobs(event), nil
+	}
+	return nil, fmt.Errorf("unsupported event")
+}
+
+// snsMessageJobs returns the objects of the S3 event an SNS message carries.
+func snsMessageJobs(message events.SNSEntity) ([]job, error) {
+	jobs, err := eventJobs([]byte(message.Message))
+	if err != nil {
+		return nil, fmt.Errorf("SNS message %s: %v", message.MessageID, err)
+	}
+	for i := range jobs {
+		jobs[i].Source = sourceSNS
+	}
+	return jobs, nil
+}
+
+// LambdaHandler is the handler for the Lambda runtime. It takes S3 events,
+// SNS events and EventBridge events, answered like HandleRequest, SQS
+// batches of any of them, answered with the messages that failed, and
+// ScanRequests, answered by ScanDocument. The event source mapping needs
+// ReportBatchItemFailures for failed messages to be retried alone.
+//
+// A failed invocation returns its failure record as the error message, with
+// the failing stage as the error type, so on-failure destinations receive
+// it.
+func LambdaHandler(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+	var envelope eventEnvelope
+	if json.Unmarshal(payload, &envelope) == nil && envelope.recordSource() == "aws:sqs" {
+		var event events.SQSEvent
+		if err := json.Unmarshal(payload, &event); err != nil {
+			return nil, fmt.Errorf("invalid SQS event: %v", err)
+		}
+		return handleSQSEvent(ctx, event), nil
+	}
+	if isScanRequest(payload) {
+		var request ScanRequest
+		if err := json.Unmarshal(payload, &request); err != nil {
+			return ScanResponse{StatusCode: 400, Error: fmt.Sprintf("invalid request: %v", err)}, nil
+		}
+		return ScanDocument(ctx, request), nil
+	}
+
+	jobs, err := eventJobs(payload)
+	if err != nil {
+		loggerFrom(ctx).Error("Error reading event", "error", err)
+		response := Response{StatusCode: 400, Body: fmt.Sprintf("Unsupported event: %v", err)}
+		response, err = applyFailurePolicy(ctx, response, processingError(ErrorSource, err))
+		if err != nil {
+			// The event names no object, so the record keeps the event itself
+			record := newFailureRecord(ctx, job{}, err)
+			record.Event = payload
+			err = invocationError(ctx, record, err)
+		}
+		return response, lambdaError(err)
+	}
+	// The test file is processed whatever the event
+	if len(jobs) == 0 && os.Getenv("TEST_PDF_PATH") != "" {
+		jobs = []job{{Source: sourceS3}}
+	}
+	if len(jobs) == 0 {
+		loggerFrom(ctx).Info("No objects to process in event")
+		return Response{StatusCode: 200, Body: "No objects to process"}, nil
+	}
+
+	var responses []Response
+	var errs []error
+	for _, j := range jobs {
+		response, err := processJob(ctx, j)
+		responses = append(responses, response)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(responses) == 1 {
+		return responses[0], lambdaError(errors.Join(errs...))
+	}
+	return responses, lambdaError(errors.Join(errs...))
+}
+
+// handleSQSEvent processes the objects announced by each message of an SQS
+// batch. A message whose event cannot be read, or one of whose objects fails
+// by the failure policy, is reported as failed, so SQS delivers it again and
+// eventually moves it to the dead letter queue.
+func handleSQSEvent(ctx context.Context, event events.SQSEvent) events.SQSEventResponse {
+	response := events.SQSEventResponse{BatchItemFailures: []events.SQSBatchItemFailure{}}
+	for _, message := range event.Records {
+		if err := handleSQSMessage(ctx, message); err != nil {
+			loggerFrom(ctx).Error("Error processing message", "message_id", message.MessageId, "error", err)
+			response.BatchItemFailures = append(response.BatchItemFailures, events.SQSBatchItemFailure{ItemIdentifier: message.MessageId})
+		}
+	}
+	return response
+}
+
+func handleSQSMessage(ctx context.Context, message events.SQSMessage) error {
+	jobs, err := eventJobs([]byte(message.Body))
+	if err != nil {
+		return processingError(ErrorSource, err)
+	}
+	attempt, _ := strconv.Atoi(message.Attributes["ApproximateReceiveCount"])
+	var errs []error
+	for _, j := range jobs {
+		j.Source = sourceSQS
+		j.MessageID = message.MessageId
+		j.Attempt = attempt
+		if _, err := processJob(ctx, j); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
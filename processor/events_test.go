@@ -0,0 +1,251 @@
+package processor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda/messages"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+)
+
+const (
+	testEventBridgeEvent = `{"version":"0","id":"e1","detail-type":"Object Created","source":"aws.s3","account":"123456789012",` +
+		`"time":"2024-05-01T10:00:00Z","region":"eu-west-1","resources":["arn:aws:s3:::scans"],` +
+		`"detail":{"version":"0","bucket":{"name":"scans"},"object":{"key":"in/my file.pdf","size":1024,"etag":"abc"},"reason":"PutObject"}}`
+	testEncodedS3Event = `{"Records":[{"eventSource":"aws:s3","eventName":"ObjectCreated:Put",` +
+		`"s3":{"bucket":{"name":"scans"},"object":{"key":"in/my+file%281%29.pdf"}}}]}`
+)
+
+func TestEventJobs(t *testing.T) {
+	snsMessage := mustJSON(t, map[string]string{
+		"Type":      "Notification",
+		"MessageId": "m1",
+		"TopicArn":  "arn:aws:sns:eu-west-1:123456789012:scans",
+		"Message":   testEncodedS3Event,
+	})
+	snsEvent := `{"Records":[{"EventSource":"aws:sns","Sns":` + snsMessage + `}]}`
+
+	tests := []struct {
+		name    string
+		event   string
+		want    []job
+		wantErr bool
+	}{
+		{
+			name:  "S3 event",
+			event: testEncodedS3Event,
+			want:  []job{{Bucket: "scans", Key: "in/my file(1).pdf", Source: sourceS3}},
+		},
+		{
+			name:  "S3 event without event source",
+			event: testS3Event,
+			want:  []job{{Bucket: "scans", Key: "in/a.pdf", Source: sourceS3}},
+		},
+		{
+			name:  "SNS event",
+			event: snsEvent,
+			want:  []job{{Bucket: "scans", Key: "in/my file(1).pdf", Source: sourceSNS}},
+		},
+		{
+			name:  "SNS message",
+			event: snsMessage,
+			want:  []job{{Bucket: "scans", Key: "in/my file(1).pdf", Source: sourceSNS}},
+		},
+		{
+			name:  "EventBridge event",
+			event: testEventBridgeEvent,
+			want:  []job{{Bucket: "scans", Key: "in/my file.pdf", Source: sourceEventBridge}},
+		},
+		{name: "EventBridge deletion", event: `{"detail-type":"Object Deleted","source":"aws.s3","detail":{}}`},
+		{name: "S3 test event", event: `{"Service":"Amazon S3","Event":"s3:TestEvent","Bucket":"scans"}`},
+		{name: "SNS message without an S3 event", event: `{"Type":"Notification","MessageId":"m2","Message":"hello"}`, wantErr: true},
+		{name: "SQS batch", event: `{"Records":[{"eventSource":"aws:sqs","body":"{}"}]}`, wantErr: true},
+		{name: "Unsupported", event: `{"hello":"world"}`, wantErr: true},
+		{name: "Not JSON", event: `hello`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jobs, err := eventJobs([]byte(tt.event))
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected error but got jobs %+v", jobs)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(jobs, tt.want) {
+				t.Errorf("got jobs %+v, want %+v", jobs, tt.want)
+			}
+		})
+	}
+}
+
+func TestJobEvent(t *testing.T) {
+	want := job{Bucket: "scans", Key: "in/my file+(1).pdf", Source: sourceS3}
+	data, err := json.Marshal(want.event())
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs, err := eventJobs(data)
+	if err != nil || !reflect.DeepEqual(jobs, []job{want}) {
+		t.Errorf("got jobs %+v (%v) from %s, want %+v", jobs, err, data, want)
+	}
+}
+
+func TestLambdaHandlerSQS(t *testing.T) {
+	metricsOutput = io.Discard
+	defer func() { metricsOutput = os.Stdout }()
+
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	img := barcodeImage(t, "QUEUE-1")
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	path := writeTestPDF(t, testPDFPage{
+		content: drawImages(1),
+		images: []testPDFImage{{
+			fmt.Sprintf("/Width %d /Height %d /ColorSpace /DeviceGray /BitsPerComponent 8", w, h),
+			img.Pix,
+		}},
+	})
+	output := t.TempDir()
+	os.Setenv("TEST_PDF_PATH", path)
+	os.Setenv("WEBHOOK_URL", server.URL)
+	os.Setenv("WEBHOOK_TOKEN", "test-token")
+	os.Setenv("FAILURE_OUTPUT", output)
+	defer func() {
+		os.Unsetenv("TEST_PDF_PATH")
+		os.Unsetenv("WEBHOOK_URL")
+		os.Unsetenv("WEBHOOK_TOKEN")
+		os.Unsetenv("FAILURE_OUTPUT")
+	}()
+
+	receivedTwice := map[string]string{"ApproximateReceiveCount": "2"}
+	batch := events.SQSEvent{Records: []events.SQSMessage{
+		{MessageId: "s3", EventSource: "aws:sqs", Body: testEncodedS3Event, Attributes: receivedTwice},
+		{MessageId: "eventbridge", EventSource: "aws:sqs", Body: testEventBridgeEvent, Attributes: receivedTwice},
+		{MessageId: "test", EventSource: "aws:sqs", Body: `{"Service":"Amazon S3","Event":"s3:TestEvent"}`},
+		{MessageId: "broken", EventSource: "aws:sqs", Body: `hello`},
+	}}
+	payload, err := json.Marshal(batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		status int
+		want   []string
+	}{
+		{"Webhook up", http.StatusOK, []string{"broken"}},
+		{"Webhook down", http.StatusBadGateway, []string{"s3", "eventbridge", "broken"}},
+	}
+	// Every message of a batch is handled under the invocation's request ID
+	ctx := lambdacontext.NewContext(withLogger(context.Background(), discardLogger), &lambdacontext.LambdaContext{AwsRequestID: "req-batch"})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status = tt.status
+			result, err := LambdaHandler(ctx, payload)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			response, ok := result.(events.SQSEventResponse)
+			if !ok {
+				t.Fatalf("got %T, want an SQS event response", result)
+			}
+			var failed []string
+			for _, failure := range response.BatchItemFailures {
+				failed = append(failed, failure.ItemIdentifier)
+			}
+			if !reflect.DeepEqual(failed, tt.want) {
+				t.Errorf("got failed messages %v, want %v", failed, tt.want)
+			}
+		})
+	}
+
+	// The failures of the messages' objects are saved with their receive
+	// count, each in a record of its own
+	records, err := ReadFailureRecords(ctx, output)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("got %d failure records, want 2", len(records))
+	}
+	var ids []string
+	for _, record := range records {
+		if record.Attempt != 2 {
+			t.Errorf("got attempt %d, want the receive count 2", record.Attempt)
+		}
+		if record.RequestID != "req-batch" {
+			t.Errorf("got request ID %q, want req-batch", record.RequestID)
+		}
+		ids = append(ids, record.MessageID)
+	}
+	sort.Strings(ids)
+	if !reflect.DeepEqual(ids, []string{"eventbridge", "s3"}) {
+		t.Errorf("got records of messages %v, want eventbridge and s3", ids)
+	}
+}
+
+func TestLambdaHandlerEvents(t *testing.T) {
+	ctx := withLogger(context.Background(), discardLogger)
+
+	tests := []struct {
+		name       string
+		event      string
+		failOn     string
+		wantStatus int
+		wantErr    bool
+	}{
+		{"S3 test event", `{"Service":"Amazon S3","Event":"s3:TestEvent"}`, "", 200, false},
+		{"Unsupported event", `{"hello":"world"}`, "", 400, true},
+		{"Unsupported event, not failing on source errors", `{"hello":"world"}`, "delivery", 400, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("FAIL_ON", tt.failOn)
+			defer os.Unsetenv("FAIL_ON")
+
+			result, err := LambdaHandler(ctx, json.RawMessage(tt.event))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want one: %v", err, tt.wantErr)
+			}
+			response, ok := result.(Response)
+			if !ok || response.StatusCode != tt.wantStatus {
+				t.Errorf("got %+v, want status %d", result, tt.wantStatus)
+			}
+			if !tt.wantErr {
+				return
+			}
+
+			// Lambda gets the failure record, with the event to replay
+			lambdaErr, ok := err.(messages.InvokeResponse_Error)
+			if !ok || lambdaErr.Type != string(ErrorSource) {
+				t.Fatalf("got error %#v, want a source invocation error", err)
+			}
+			var record FailureRecord
+			if err := json.Unmarshal([]byte(lambdaErr.Message), &record); err != nil {
+				t.Fatalf("invalid failure record: %v", err)
+			}
+			if record.Stage != ErrorSource || string(record.Event) != tt.event {
+				t.Errorf("got record %+v, want a source failure of the event", record)
+			}
+		})
+	}
+}
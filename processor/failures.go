@@ -0,0 +1,287 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambda/messages"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+)
+
+// Classes of error, for deciding whether replaying a failure can help.
+const (
+	// errorClassTransient may pass on another attempt: S3, the webhook or an
+	// error we could not classify
+	errorClassTransient = "transient"
+	// errorClassPermanent comes from the document itself and needs a fix or
+	// a configuration change first
+	errorClassPermanent = "permanent"
+)
+
+// FailureRecord describes a failed invocation: the event to replay and why it
+// failed.
+type FailureRecord struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id,omitempty"`
+	// MessageID is the SQS message the event came in, if any
+	MessageID string `json:"message_id,omitempty"`
+	// Event is an S3 event for the object, or the event the function was
+	// invoked with in on-failure destination records
+	Event  json.RawMessage `json:"event"`
+	Bucket string          `json:"bucket,omitempty"`
+	Key    string          `json:"key,omitempty"`
+	// Stage is the kind of error that failed the invocation
+	Stage      ErrorKind `json:"stage,omitempty"`
+	ErrorClass string    `json:"error_class"`
+	Error      string    `json:"error"`
+	// Attempt is the number of times the event was delivered: the receive
+	// count of SQS messages, or the number of times Lambda invoked the
+	// function in on-failure destination records. Lambda does not tell the
+	// function about its retries of direct invocations, so it is 0, unknown,
+	// in their records.
+	Attempt int `json:"attempt,omitempty"`
+}
+
+// InvocationError is the error of a failed invocation, with its failure
+// record.
+type InvocationError struct {
+	Record FailureRecord
+	Err    error
+}
+
+func (e *InvocationError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *InvocationError) Unwrap() error {
+	return e.Err
+}
+
+// errorClass returns the class of an error kind.
+func errorClass(kind ErrorKind) string {
+	switch kind {
+	case ErrorParse, ErrorExtract, ErrorDecode:
+		return errorClassPermanent
+	}
+	return errorClassTransient
+}
+
+// newFailureRecord describes the failure of a job.
+func newFailureRecord(ctx context.Context, j job, err error) FailureRecord {
+	record := FailureRecord{
+		Time:       time.Now().UTC(),
+		ErrorClass: errorClassTransient,
+		Error:      err.Error(),
+		Attempt:    j.Attempt,
+		MessageID:  j.MessageID,
+	}
+	if lc, ok := lambdacontext.FromContext(ctx); ok {
+		record.RequestID = lc.AwsRequestID
+	}
+	record.Event, _ = json.Marshal(j.event())
+	if testPath := os.Getenv("TEST_PDF_PATH"); testPath != "" {
+		record.Bucket, record.Key = "test-bucket", testPath
+	} else {
+		record.Bucket, record.Key = j.Bucket, j.Key
+	}
+	if kinds := errorKindsOf(err); len(kinds) > 0 {
+		record.Stage = kinds[0]
+		record.ErrorClass = errorClass(kinds[0])
+	}
+	return record
+}
+
+// invocationError saves the failure record of an error that fails the
+// invocation, and returns the error with it.
+func invocationError(ctx context.Context, record FailureRecord, err error) error {
+	saveFailureRecord(ctx, record)
+	return &InvocationError{Record: record, Err: err}
+}
+
+// saveFailureRecord writes a failure record to FAILURE_OUTPUT, an S3 or local
+// location, if it is set. Lambda's on-failure destinations only see events
+// that failed every retry, so this keeps a trace of each failed attempt.
+func saveFailureRecord(ctx context.Context, record FailureRecord) {
+	output := os.Getenv("FAILURE_OUTPUT")
+	if output == "" {
+		return
+	}
+	logger := loggerFrom(ctx)
+	store, prefix, err := openObjectStore(output)
+	if err != nil {
+		logger.Error("Error opening failure output", "error", err)
+		return
+	}
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		logger.Error("Error encoding failure record", "error", err)
+		return
+	}
+	// The messages of an SQS batch share a request ID, so the message ID, or
+	// the time to the nanosecond without one, tells their records apart
+	id := record.MessageID
+	if id == "" {
+		id = fmt.Sprint(record.Time.UnixNano())
+	}
+	if record.RequestID != "" {
+		id = record.RequestID + "-" + id
+	}
+	name := fmt.Sprintf("%s%s-%s.json", prefix, record.Time.Format("20060102T150405Z"), id)
+	if err := store.Put(ctx, name, data, "application/json"); err != nil {
+		logger.Error("Error saving failure record", "error", err)
+		return
+	}
+	logger.Info("Saved failure record", "location", store.Location(name))
+}
+
+// lambdaError returns the error of a failed invocation for the Lambda
+// runtime: its failure record as the error message, with the failing stage as
+// the error type.
+func lambdaError(err error) error {
+	var invocationErr *InvocationError
+	if !errors.As(err, &invocationErr) {
+		return err
+	}
+	message, jsonErr := json.Marshal(invocationErr.Record)
+	if jsonErr != nil {
+		return err
+	}
+	errorType := string(invocationErr.Record.Stage)
+	if errorType == "" {
+		errorType = "InvocationError"
+	}
+	return messages.InvokeResponse_Error{Message: string(message), Type: errorType}
+}
+
+// destinationRecord is the record Lambda sends to an on-failure destination.
+type destinationRecord struct {
+	RequestContext struct {
+		RequestID              string `json:"requestId"`
+		ApproximateInvokeCount int    `json:"approximateInvokeCount"`
+	} `json:"requestContext"`
+	RequestPayload  json.RawMessage `json:"requestPayload"`
+	ResponsePayload struct {
+		ErrorMessage string `json:"errorMessage"`
+		ErrorType    string `json:"errorType"`
+	} `json:"responsePayload"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// ParseFailureRecords reads the failure records in data: records saved to
+// FAILURE_OUTPUT, or on-failure destination records, either one JSON
+// document or one per line.
+func ParseFailureRecords(data []byte) ([]FailureRecord, error) {
+	var records []FailureRecord
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	for {
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err != nil {
+			if errors.Is(err, io.EOF) {
+				return records, nil
+			}
+			return records, fmt.Errorf("error reading failure record: %v", err)
+		}
+		record, err := parseFailureRecord(raw)
+		if err != nil {
+			return records, err
+		}
+		records = append(records, record)
+	}
+}
+
+func parseFailureRecord(raw json.RawMessage) (FailureRecord, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return FailureRecord{}, fmt.Errorf("failure record is not an object: %v", err)
+	}
+	if _, ok := fields["requestPayload"]; !ok {
+		var record FailureRecord
+		if err := json.Unmarshal(raw, &record); err != nil {
+			return FailureRecord{}, fmt.Errorf("invalid failure record: %v", err)
+		}
+		if len(record.Event) == 0 {
+			return FailureRecord{}, fmt.Errorf("failure record has no event")
+		}
+		return record, nil
+	}
+
+	var destination destinationRecord
+	if err := json.Unmarshal(raw, &destination); err != nil {
+		return FailureRecord{}, fmt.Errorf("invalid destination record: %v", err)
+	}
+	// Our own failures carry their record as the error message; anything
+	// else, such as a timeout, is described from the destination record
+	var record FailureRecord
+	if json.Unmarshal([]byte(destination.ResponsePayload.ErrorMessage), &record) != nil || len(record.Event) == 0 {
+		record = FailureRecord{
+			Time:       destination.Timestamp,
+			RequestID:  destination.RequestContext.RequestID,
+			ErrorClass: errorClassTransient,
+			Error:      strings.TrimSpace(destination.ResponsePayload.ErrorType + ": " + destination.ResponsePayload.ErrorMessage),
+		}
+		if jobs, err := eventJobs(destination.RequestPayload); err == nil && len(jobs) > 0 {
+			record.Bucket, record.Key = jobs[0].Bucket, jobs[0].Key
+		}
+	}
+	record.Event = destination.RequestPayload
+	record.Attempt = destination.RequestContext.ApproximateInvokeCount
+	return record, nil
+}
+
+// ReadFailureRecords reads the failure records in a local file, or in the
+// files below a local directory or an "s3://bucket/prefix" location.
+func ReadFailureRecords(ctx context.Context, location string) ([]FailureRecord, error) {
+	if info, err := os.Stat(location); err == nil && !info.IsDir() {
+		data, err := os.ReadFile(location)
+		if err != nil {
+			return nil, err
+		}
+		return ParseFailureRecords(data)
+	}
+
+	store, prefix, err := openObjectStore(location)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := store.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	var records []FailureRecord
+	for _, key := range keys {
+		data, err := store.Get(ctx, key)
+		if err != nil {
+			return records, err
+		}
+		parsed, err := ParseFailureRecords(data)
+		if err != nil {
+			return records, fmt.Errorf("%s: %v", store.Location(key), err)
+		}
+		records = append(records, parsed...)
+	}
+	return records, nil
+}
+
+// ReplayFailure processes the object in the event of a failure record again.
+func ReplayFailure(ctx context.Context, record FailureRecord) (Response, error) {
+	// Records of events without an object fall back on the record's own
+	// bucket and key
+	jobs, err := eventJobs(record.Event)
+	if err == nil && len(jobs) == 0 {
+		err = fmt.Errorf("event has no object")
+	}
+	if err != nil {
+		if record.Bucket == "" || record.Key == "" {
+			return Response{StatusCode: 400, Body: "Invalid event in failure record"}, fmt.Errorf("invalid event in failure record: %v", err)
+		}
+		jobs = []job{{Bucket: record.Bucket, Key: record.Key}}
+	}
+	return processJob(ctx, jobs[0])
+}
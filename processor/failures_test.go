@@ -0,0 +1,170 @@
+package processor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda/messages"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+)
+
+const testS3Event = `{"Records":[{"s3":{"bucket":{"name":"scans"},"object":{"key":"in/a.pdf"}}}]}`
+
+func TestParseFailureRecords(t *testing.T) {
+	own := `{"time":"2024-05-01T10:00:00Z","event":` + testS3Event + `,"bucket":"scans","key":"in/a.pdf","stage":"delivery","error_class":"transient","error":"webhook returned 502"}`
+	ownMessage, _ := json.Marshal(own)
+
+	tests := []struct {
+		name    string
+		data    string
+		want    []FailureRecord
+		wantErr bool
+	}{
+		{
+			name: "Saved record",
+			data: own,
+			want: []FailureRecord{{Bucket: "scans", Key: "in/a.pdf", Stage: ErrorDelivery, ErrorClass: errorClassTransient, Error: "webhook returned 502"}},
+		},
+		{
+			name: "Destination record of our failure",
+			data: `{"requestContext":{"requestId":"r1","approximateInvokeCount":3},"requestPayload":` + testS3Event +
+				`,"responsePayload":{"errorMessage":` + string(ownMessage) + `,"errorType":"delivery"}}`,
+			want: []FailureRecord{{Bucket: "scans", Key: "in/a.pdf", Stage: ErrorDelivery, ErrorClass: errorClassTransient, Error: "webhook returned 502", Attempt: 3}},
+		},
+		{
+			name: "Destination record of a timeout",
+			data: `{"requestContext":{"requestId":"r2","approximateInvokeCount":2},"requestPayload":` + testS3Event +
+				`,"responsePayload":{"errorMessage":"Task timed out after 30.00 seconds","errorType":"Runtime.ExitError"}}`,
+			want: []FailureRecord{{RequestID: "r2", Bucket: "scans", Key: "in/a.pdf", ErrorClass: errorClassTransient, Error: "Runtime.ExitError: Task timed out after 30.00 seconds", Attempt: 2}},
+		},
+		{
+			name: "One per line",
+			data: own + "\n" + own + "\n",
+			want: []FailureRecord{
+				{Bucket: "scans", Key: "in/a.pdf", Stage: ErrorDelivery, ErrorClass: errorClassTransient, Error: "webhook returned 502"},
+				{Bucket: "scans", Key: "in/a.pdf", Stage: ErrorDelivery, ErrorClass: errorClassTransient, Error: "webhook returned 502"},
+			},
+		},
+		{name: "No event", data: `{"error":"boom"}`, wantErr: true},
+		{name: "Not JSON", data: `boom`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records, err := ParseFailureRecords([]byte(tt.data))
+			if tt.wantErr {
+				if err == nil {
+					t.Error("expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(records) != len(tt.want) {
+				t.Fatalf("got %d records, want %d", len(records), len(tt.want))
+			}
+			for i, record := range records {
+				var event events.S3Event
+				if json.Unmarshal(record.Event, &event) != nil || len(event.Records) != 1 {
+					t.Errorf("record %d: got event %s, want the S3 event", i, record.Event)
+				}
+				want := tt.want[i]
+				if record.Bucket != want.Bucket || record.Key != want.Key || record.Stage != want.Stage ||
+					record.ErrorClass != want.ErrorClass || record.Error != want.Error || record.Attempt != want.Attempt ||
+					(want.RequestID != "" && record.RequestID != want.RequestID) {
+					t.Errorf("record %d: got %+v, want %+v", i, record, want)
+				}
+			}
+		})
+	}
+}
+
+func TestHandleRequestFailureRecord(t *testing.T) {
+	metricsOutput = io.Discard
+	defer func() { metricsOutput = os.Stdout }()
+
+	status := http.StatusBadGateway
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	img := barcodeImage(t, "FAIL-1")
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	path := writeTestPDF(t, testPDFPage{
+		content: drawImages(1),
+		images: []testPDFImage{{
+			fmt.Sprintf("/Width %d /Height %d /ColorSpace /DeviceGray /BitsPerComponent 8", w, h),
+			img.Pix,
+		}},
+	})
+	output := t.TempDir()
+	os.Setenv("TEST_PDF_PATH", path)
+	os.Setenv("WEBHOOK_URL", server.URL)
+	os.Setenv("WEBHOOK_TOKEN", "test-token")
+	os.Setenv("FAILURE_OUTPUT", output)
+	defer func() {
+		os.Unsetenv("TEST_PDF_PATH")
+		os.Unsetenv("WEBHOOK_URL")
+		os.Unsetenv("WEBHOOK_TOKEN")
+		os.Unsetenv("FAILURE_OUTPUT")
+	}()
+	ctx := lambdacontext.NewContext(withLogger(context.Background(), discardLogger), &lambdacontext.LambdaContext{AwsRequestID: "req-9"})
+
+	_, err := HandleRequest(ctx, events.S3Event{})
+	var invocationErr *InvocationError
+	if !errors.As(err, &invocationErr) {
+		t.Fatalf("got error %v, want an invocation error", err)
+	}
+	record := invocationErr.Record
+	if record.RequestID != "req-9" || record.Key != path || record.Stage != ErrorDelivery || record.ErrorClass != errorClassTransient {
+		t.Errorf("got record %+v, want a transient delivery failure of req-9", record)
+	}
+
+	// The record is saved where replay reads it
+	saved, err := ReadFailureRecords(ctx, output)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(saved) != 1 || saved[0].RequestID != "req-9" || saved[0].Stage != ErrorDelivery {
+		t.Fatalf("got saved records %+v, want the failure", saved)
+	}
+
+	// Lambda gets the record as the error message
+	_, err = LambdaHandler(ctx, json.RawMessage(testS3Event))
+	lambdaErr, ok := err.(messages.InvokeResponse_Error)
+	if !ok || lambdaErr.Type != string(ErrorDelivery) {
+		t.Fatalf("got error %#v, want a delivery invocation error", err)
+	}
+	destination := `{"requestContext":{"approximateInvokeCount":3},"requestPayload":{},"responsePayload":{"errorMessage":` +
+		strings.TrimSpace(mustJSON(t, lambdaErr.Message)) + `,"errorType":"delivery"}}`
+	parsed, err := ParseFailureRecords([]byte(destination))
+	if err != nil || len(parsed) != 1 || parsed[0].Key != path || parsed[0].Attempt != 3 {
+		t.Errorf("got %+v (%v), want the record from the error message", parsed, err)
+	}
+
+	// Once the webhook is back, the replay succeeds
+	status = http.StatusOK
+	if _, err := ReplayFailure(ctx, saved[0]); err != nil {
+		t.Errorf("unexpected replay error: %v", err)
+	}
+}
+
+func mustJSON(t *testing.T, v interface{}) string {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("error encoding JSON: %v", err)
+	}
+	return string(data)
+}
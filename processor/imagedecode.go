@@ -0,0 +1,659 @@
+package processor
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/filter"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
+)
+
+// pdfImage is an image XObject from a page of a PDF, decoded or with the
+// reason it could not be.
+type pdfImage struct {
+	// Name follows pdfcpu's extracted file names: "<base>_<page>_<resource>.<ext>"
+	Name string
+	Page int
+	// Resource is the image's name in the page resources, if known
+	Resource string
+	Encoding string
+	Image    image.Image
+	Err      error
+}
+
+// imageDecoder turns the stream of an image XObject into an image.
+type imageDecoder struct {
+	ext    string
+	decode func(xRefTable *model.XRefTable, sd *types.StreamDict) (image.Image, error)
+}
+
+// imageDecoders is keyed by the last filter of an image stream, which is the
+// one that names its encoding. Streams without filters hold raw samples.
+var imageDecoders = map[string]imageDecoder{
+	"":               {"png", decodeSampledImage},
+	filter.Flate:     {"png", decodeSampledImage},
+	filter.LZW:       {"png", decodeSampledImage},
+	filter.RunLength: {"png", decodeSampledImage},
+	filter.ASCII85:   {"png", decodeSampledImage},
+	filter.ASCIIHex:  {"png", decodeSampledImage},
+	// pdfcpu's CCITT filter expands G3 and G4 fax data to 1-bit samples
+	filter.CCITTFax: {"png", decodeCCITTImage},
+	filter.DCT:      {"jpg", decodeDCTImage},
+	filter.JPX:      {"jpx", unsupportedEncoding("JPEG 2000")},
+	filter.JBIG2:    {"jb2", decodeJBIG2Image},
+}
+
+// extractPDFImages decodes the images on the first pageLimit pages of a PDF,
+// or on every page if pageLimit is 0. Images that cannot be decoded are
+// returned with their error so they can be reported.
+func extractPDFImages(path string, pageLimit int, conf *model.Configuration) ([]pdfImage, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	c := *conf
+	c.Cmd = model.EXTRACTIMAGES
+	ctx, err := api.ReadValidateAndOptimize(f, &c)
+	if err != nil {
+		return nil, err
+	}
+	return extractContextImages(ctx, strings.TrimSuffix(filepath.Base(path), ".pdf"), pageLimit), nil
+}
+
+// extractContextImages decodes the images of an optimized context, whose
+// image objects pdfcpu has collected per page.
+func extractContextImages(ctx *model.Context, base string, pageLimit int) []pdfImage {
+	var images []pdfImage
+	for page := 1; page <= ctx.PageCount; page++ {
+		if pageLimit > 0 && page > pageLimit {
+			break
+		}
+		objNrs := pdfcpu.ImageObjNrs(ctx, page)
+		sort.Ints(objNrs)
+		for _, objNr := range objNrs {
+			obj := ctx.Optimize.ImageObjects[objNr]
+			if obj == nil || obj.ImageDict == nil {
+				continue
+			}
+			images = append(images, decodePDFImage(ctx.XRefTable, obj.ImageDict, base, page, obj.ResourceNames[page-1]))
+		}
+	}
+	return images
+}
+
+// decodePDFImage decodes one image XObject with the decoder for its encoding.
+func decodePDFImage(xRefTable *model.XRefTable, sd *types.StreamDict, base string, page int, resource string) pdfImage {
+	encoding := ""
+	if n := len(sd.FilterPipeline); n > 0 {
+		encoding = sd.FilterPipeline[n-1].Name
+	}
+
+	decoder, ok := imageDecoders[encoding]
+	if !ok {
+		decoder = imageDecoder{"bin", unsupportedEncoding(encoding)}
+	}
+
+	img, err := decoder.decode(xRefTable, sd)
+	if err == nil && img == nil {
+		err = fmt.Errorf("no image data")
+	}
+	return pdfImage{
+		Name:     fmt.Sprintf("%s_%d_%s.%s", base, page, resource, decoder.ext),
+		Page:     page,
+		Resource: resource,
+		Encoding: encoding,
+		Image:    img,
+		Err:      err,
+	}
+}
+
+func unsupportedEncoding(name string) func(*model.XRefTable, *types.StreamDict) (image.Image, error) {
+	return func(*model.XRefTable, *types.StreamDict) (image.Image, error) {
+		return nil, fmt.Errorf("unsupported image encoding %s", name)
+	}
+}
+
+// encodedImageData returns the data of an image stream in its encoding,
+// with the filters in front of the last one applied.
+func encodedImageData(sd *types.StreamDict) ([]byte, error) {
+	n := len(sd.FilterPipeline)
+	if n <= 1 {
+		return sd.Raw, nil
+	}
+	outer := *sd
+	outer.FilterPipeline = sd.FilterPipeline[:n-1]
+	outer.Content = nil
+	if err := outer.Decode(); err != nil {
+		return nil, err
+	}
+	return outer.Content, nil
+}
+
+// decodeDCTImage decodes a JPEG stream. Filters in front of the DCT filter
+// are applied first, since the JPEG decoder needs the plain JPEG file.
+func decodeDCTImage(xRefTable *model.XRefTable, sd *types.StreamDict) (image.Image, error) {
+	data, err := encodedImageData(sd)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding JPEG stream filters: %v", err)
+	}
+
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding JPEG: %v", err)
+	}
+	return img, nil
+}
+
+// decodeCCITTImage decodes a CCITT fax stream to 1-bit samples. Rows is
+// optional in its parameters, but pdfcpu's filter needs it, so it is taken
+// from the image's height when missing. pdfcpu cannot expand mixed one- and
+// two-dimensional Group 3 data, so that is reported as an unsupported
+// encoding.
+func decodeCCITTImage(xRefTable *model.XRefTable, sd *types.StreamDict) (image.Image, error) {
+	n := len(sd.FilterPipeline)
+	parms := types.Dict{}
+	if sd.FilterPipeline[n-1].DecodeParms != nil {
+		parms = sd.FilterPipeline[n-1].DecodeParms.Clone().(types.Dict)
+	}
+	if k := parms.IntEntry("K"); k != nil && *k > 0 {
+		return nil, fmt.Errorf("unsupported image encoding CCITT Group 3 2-D (K %d)", *k)
+	}
+	if parms.IntEntry("Rows") == nil {
+		h, err := imageDimension(xRefTable, sd, "Height")
+		if err != nil {
+			return nil, err
+		}
+		parms["Rows"] = types.Integer(h)
+	}
+
+	withRows := *sd
+	withRows.FilterPipeline = append([]types.PDFFilter{}, sd.FilterPipeline...)
+	withRows.FilterPipeline[n-1].DecodeParms = parms
+	return decodeSampledImage(xRefTable, &withRows)
+}
+
+// decodeJBIG2Image decodes a JBIG2 stream together with the segments its
+// JBIG2Globals parameter shares with other images. JBIG2 pixels are black
+// where 1, unless a Decode array inverts them.
+func decodeJBIG2Image(xRefTable *model.XRefTable, sd *types.StreamDict) (image.Image, error) {
+	width, err := imageDimension(xRefTable, sd, "Width")
+	if err != nil {
+		return nil, err
+	}
+	height, err := imageDimension(xRefTable, sd, "Height")
+	if err != nil {
+		return nil, err
+	}
+	data, err := encodedImageData(sd)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding JBIG2 stream filters: %v", err)
+	}
+	var globals []byte
+	if parms := sd.FilterPipeline[len(sd.FilterPipeline)-1].DecodeParms; parms != nil {
+		if o, found := parms.Find("JBIG2Globals"); found {
+			globalsDict, _, err := xRefTable.DereferenceStreamDict(o)
+			if err != nil || globalsDict == nil {
+				return nil, fmt.Errorf("invalid JBIG2Globals: %v", err)
+			}
+			if err := globalsDict.Decode(); err != nil {
+				return nil, fmt.Errorf("error decoding JBIG2Globals: %v", err)
+			}
+			globals = globalsDict.Content
+		}
+	}
+
+	bitmap, err := decodeJBIG2(globals, data, width, height)
+	if err != nil {
+		return nil, err
+	}
+	decode, err := decodeArray(xRefTable, sd)
+	if err != nil {
+		return nil, err
+	}
+	return bitmap.gray(len(decode) >= 2 && decode[0] > decode[1]), nil
+}
+
+// decodeSampledImage decodes an image whose filters produce raw samples, in
+// any bit depth and color space a scanner is likely to produce.
+func decodeSampledImage(xRefTable *model.XRefTable, sd *types.StreamDict) (image.Image, error) {
+	w, err := imageDimension(xRefTable, sd, "Width")
+	if err != nil {
+		return nil, err
+	}
+	h, err := imageDimension(xRefTable, sd, "Height")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := sd.Decode(); err != nil {
+		return nil, fmt.Errorf("error decoding image stream: %v", err)
+	}
+
+	// Stencil masks and fax images are 1-bit gray without a color space
+	cs := colorSpace{model: colorModelGray, components: 1}
+	bpc := 1
+	if mask := sd.BooleanEntry("ImageMask"); mask == nil || !*mask {
+		if o, found := sd.Find("ColorSpace"); found {
+			cs, err = resolveColorSpace(xRefTable, o)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if i := sd.IntEntry("BitsPerComponent"); i != nil {
+			bpc = *i
+		}
+	}
+
+	decode, err := decodeArray(xRefTable, sd)
+	if err != nil {
+		return nil, err
+	}
+	return rasterize(sd.Content, w, h, bpc, cs, decode)
+}
+
+func imageDimension(xRefTable *model.XRefTable, sd *types.StreamDict, key string) (int, error) {
+	o, found := sd.Find(key)
+	if !found {
+		return 0, fmt.Errorf("image has no %s", key)
+	}
+	i, err := xRefTable.DereferenceInteger(o)
+	if err != nil || i == nil {
+		return 0, fmt.Errorf("invalid image %s: %v", key, err)
+	}
+	if i.Value() <= 0 {
+		return 0, fmt.Errorf("invalid image %s %d", key, i.Value())
+	}
+	return i.Value(), nil
+}
+
+func decodeArray(xRefTable *model.XRefTable, sd *types.StreamDict) ([]float64, error) {
+	o, found := sd.Find("Decode")
+	if !found {
+		return nil, nil
+	}
+	arr, err := xRefTable.DereferenceArray(o)
+	if err != nil {
+		return nil, fmt.Errorf("invalid image Decode array: %v", err)
+	}
+	decode := make([]float64, len(arr))
+	for i, v := range arr {
+		if decode[i], err = xRefTable.DereferenceNumber(v); err != nil {
+			return nil, fmt.Errorf("invalid image Decode array: %v", err)
+		}
+	}
+	return decode, nil
+}
+
+type colorModel int
+
+const (
+	colorModelGray colorModel = iota
+	colorModelRGB
+	colorModelCMYK
+	// colorModelInk is Separation and DeviceN, where samples are tints of
+	// colorants. Their tint transforms are not evaluated; any ink is dark.
+	colorModelInk
+	colorModelIndexed
+)
+
+type colorSpace struct {
+	model      colorModel
+	components int
+
+	// Indexed color spaces only
+	base   *colorSpace
+	hival  int
+	lookup []byte
+}
+
+func colorSpaceForName(name string) (colorSpace, error) {
+	switch name {
+	case model.DeviceGrayCS, model.CalGrayCS:
+		return colorSpace{model: colorModelGray, components: 1}, nil
+	case model.DeviceRGBCS, model.CalRGBCS:
+		return colorSpace{model: colorModelRGB, components: 3}, nil
+	case model.DeviceCMYKCS:
+		return colorSpace{model: colorModelCMYK, components: 4}, nil
+	}
+	return colorSpace{}, fmt.Errorf("unsupported color space %s", name)
+}
+
+func colorSpaceForComponents(n int) (colorSpace, error) {
+	switch n {
+	case 1:
+		return colorSpaceForName(model.DeviceGrayCS)
+	case 3:
+		return colorSpaceForName(model.DeviceRGBCS)
+	case 4:
+		return colorSpaceForName(model.DeviceCMYKCS)
+	}
+	return colorSpace{}, fmt.Errorf("unsupported number of color components %d", n)
+}
+
+func resolveColorSpace(xRefTable *model.XRefTable, o types.Object) (colorSpace, error) {
+	o, err := xRefTable.Dereference(o)
+	if err != nil {
+		return colorSpace{}, fmt.Errorf("invalid color space: %v", err)
+	}
+
+	switch cs := o.(type) {
+	case types.Name:
+		return colorSpaceForName(string(cs))
+
+	case types.Array:
+		if len(cs) == 0 {
+			return colorSpace{}, fmt.Errorf("empty color space array")
+		}
+		family, ok := cs[0].(types.Name)
+		if !ok {
+			return colorSpace{}, fmt.Errorf("invalid color space family %v", cs[0])
+		}
+
+		switch string(family) {
+		case model.ICCBasedCS:
+			if len(cs) < 2 {
+				return colorSpace{}, fmt.Errorf("ICCBased color space without profile")
+			}
+			profile, _, err := xRefTable.DereferenceStreamDict(cs[1])
+			if err != nil || profile == nil {
+				return colorSpace{}, fmt.Errorf("invalid ICC profile: %v", err)
+			}
+			n := profile.IntEntry("N")
+			if n == nil {
+				return colorSpace{}, fmt.Errorf("ICC profile without N")
+			}
+			return colorSpaceForComponents(*n)
+
+		case model.SeparationCS:
+			return colorSpace{model: colorModelInk, components: 1}, nil
+
+		case model.DeviceNCS:
+			if len(cs) < 2 {
+				return colorSpace{}, fmt.Errorf("DeviceN color space without colorants")
+			}
+			names, err := xRefTable.DereferenceArray(cs[1])
+			if err != nil || len(names) == 0 {
+				return colorSpace{}, fmt.Errorf("invalid DeviceN colorants: %v", err)
+			}
+			return colorSpace{model: colorModelInk, components: len(names)}, nil
+
+		case model.IndexedCS:
+			return resolveIndexedColorSpace(xRefTable, cs)
+		}
+		return colorSpaceForName(string(family))
+	}
+	return colorSpace{}, fmt.Errorf("invalid color space %v", o)
+}
+
+func resolveIndexedColorSpace(xRefTable *model.XRefTable, cs types.Array) (colorSpace, error) {
+	if len(cs) != 4 {
+		return colorSpace{}, fmt.Errorf("invalid Indexed color space")
+	}
+	base, err := resolveColorSpace(xRefTable, cs[1])
+	if err != nil {
+		return colorSpace{}, err
+	}
+	if base.model == colorModelIndexed {
+		return colorSpace{}, fmt.Errorf("Indexed color space with an Indexed base")
+	}
+	hival, err := xRefTable.DereferenceInteger(cs[2])
+	if err != nil || hival == nil || hival.Value() < 0 || hival.Value() > 255 {
+		return colorSpace{}, fmt.Errorf("invalid Indexed color space hival: %v", err)
+	}
+
+	o, err := xRefTable.Dereference(cs[3])
+	if err != nil {
+		return colorSpace{}, fmt.Errorf("invalid Indexed color space lookup: %v", err)
+	}
+	var lookup []byte
+	switch l := o.(type) {
+	case types.StringLiteral:
+		lookup, err = types.Unescape(l.Value())
+	case types.HexLiteral:
+		lookup, err = l.Bytes()
+	case types.StreamDict:
+		if err = l.Decode(); err == nil {
+			lookup = l.Content
+		}
+	default:
+		err = fmt.Errorf("unexpected %T", o)
+	}
+	if err != nil {
+		return colorSpace{}, fmt.Errorf("invalid Indexed color space lookup: %v", err)
+	}
+
+	return colorSpace{
+		model:      colorModelIndexed,
+		components: 1,
+		base:       &base,
+		hival:      hival.Value(),
+		lookup:     lookup,
+	}, nil
+}
+
+// palette returns the colors of an Indexed color space. Entries missing
+// from a short lookup table are black.
+func (cs colorSpace) palette() color.Palette {
+	n := cs.base.components
+	palette := make(color.Palette, cs.hival+1)
+	for i := range palette {
+		entry := cs.lookup[min(i*n, len(cs.lookup)):min((i+1)*n, len(cs.lookup))]
+		if len(entry) < n {
+			palette[i] = color.Black
+			continue
+		}
+		switch cs.base.model {
+		case colorModelGray:
+			palette[i] = color.Gray{Y: entry[0]}
+		case colorModelRGB:
+			palette[i] = color.RGBA{R: entry[0], G: entry[1], B: entry[2], A: 255}
+		case colorModelCMYK:
+			palette[i] = color.CMYK{C: entry[0], M: entry[1], Y: entry[2], K: entry[3]}
+		case colorModelInk:
+			var ink uint8
+			for _, v := range entry {
+				ink = maxUint8(ink, v)
+			}
+			palette[i] = color.Gray{Y: 255 - ink}
+		}
+	}
+	return palette
+}
+
+// rasterize unpacks the samples of an image into the closest standard image
+// type. Rows start on byte boundaries, as PDF requires.
+func rasterize(data []byte, w, h, bpc int, cs colorSpace, decode []float64) (image.Image, error) {
+	switch bpc {
+	case 1, 2, 4, 8, 16:
+	default:
+		return nil, fmt.Errorf("unsupported bits per component %d", bpc)
+	}
+	if cs.model == colorModelIndexed && bpc == 16 {
+		return nil, fmt.Errorf("unsupported bits per component %d for Indexed color space", bpc)
+	}
+
+	comps := cs.components
+	stride := (w*comps*bpc + 7) / 8
+	if len(data) < stride*h {
+		return nil, fmt.Errorf("image data is truncated: %d bytes for %dx%d samples", len(data), w, h)
+	}
+
+	samples := newSampleDecoder(bpc, comps, cs, decode)
+	rect := image.Rect(0, 0, w, h)
+	switch cs.model {
+	case colorModelGray:
+		if bpc == 16 {
+			img := image.NewGray16(rect)
+			for y := 0; y < h; y++ {
+				row := data[y*stride:]
+				for x := 0; x < w; x++ {
+					img.SetGray16(x, y, color.Gray16{Y: uint16(samples.value(0, sampleAt(row, x, bpc)) * 65535)})
+				}
+			}
+			return img, nil
+		}
+		img := image.NewGray(rect)
+		for y := 0; y < h; y++ {
+			row := data[y*stride:]
+			pix := img.Pix[y*img.Stride:]
+			for x := 0; x < w; x++ {
+				pix[x] = samples.byteValue(0, sampleAt(row, x, bpc))
+			}
+		}
+		return img, nil
+
+	case colorModelInk:
+		img := image.NewGray(rect)
+		for y := 0; y < h; y++ {
+			row := data[y*stride:]
+			pix := img.Pix[y*img.Stride:]
+			for x := 0; x < w; x++ {
+				var ink uint8
+				for c := 0; c < comps; c++ {
+					if v := samples.byteValue(c, sampleAt(row, x*comps+c, bpc)); v > ink {
+						ink = v
+					}
+				}
+				pix[x] = 255 - ink
+			}
+		}
+		return img, nil
+
+	case colorModelRGB:
+		if bpc == 16 {
+			img := image.NewRGBA64(rect)
+			for y := 0; y < h; y++ {
+				row := data[y*stride:]
+				for x := 0; x < w; x++ {
+					img.SetRGBA64(x, y, color.RGBA64{
+						R: uint16(samples.value(0, sampleAt(row, x*3, bpc)) * 65535),
+						G: uint16(samples.value(1, sampleAt(row, x*3+1, bpc)) * 65535),
+						B: uint16(samples.value(2, sampleAt(row, x*3+2, bpc)) * 65535),
+						A: 65535,
+					})
+				}
+			}
+			return img, nil
+		}
+		img := image.NewRGBA(rect)
+		for y := 0; y < h; y++ {
+			row := data[y*stride:]
+			pix := img.Pix[y*img.Stride:]
+			for x := 0; x < w; x++ {
+				for c := 0; c < 3; c++ {
+					pix[x*4+c] = samples.byteValue(c, sampleAt(row, x*3+c, bpc))
+				}
+				pix[x*4+3] = 255
+			}
+		}
+		return img, nil
+
+	case colorModelCMYK:
+		img := image.NewCMYK(rect)
+		for y := 0; y < h; y++ {
+			row := data[y*stride:]
+			pix := img.Pix[y*img.Stride:]
+			for x := 0; x < w; x++ {
+				for c := 0; c < 4; c++ {
+					pix[x*4+c] = samples.byteValue(c, sampleAt(row, x*4+c, bpc))
+				}
+			}
+		}
+		return img, nil
+
+	case colorModelIndexed:
+		img := image.NewPaletted(rect, cs.palette())
+		for y := 0; y < h; y++ {
+			row := data[y*stride:]
+			pix := img.Pix[y*img.Stride:]
+			for x := 0; x < w; x++ {
+				index := int(math.Round(samples.value(0, sampleAt(row, x, bpc))))
+				pix[x] = uint8(clampInt(index, 0, cs.hival))
+			}
+		}
+		return img, nil
+	}
+	return nil, fmt.Errorf("unsupported color space")
+}
+
+// sampleAt returns the i-th sample of a row.
+func sampleAt(row []byte, i, bpc int) int {
+	switch bpc {
+	case 8:
+		return int(row[i])
+	case 16:
+		return int(row[2*i])<<8 | int(row[2*i+1])
+	}
+	bit := i * bpc
+	shift := 8 - bpc - bit%8
+	return int(row[bit/8]>>shift) & (1<<bpc - 1)
+}
+
+// sampleDecoder maps samples through the image's Decode array. Color
+// components decode to 0..1; Indexed samples decode to palette indices.
+type sampleDecoder struct {
+	maxValue float64
+	ranges   [][2]float64
+	indexed  bool
+	// lookup caches byteValue for every sample of up to 8 bits
+	lookup [][]uint8
+}
+
+func newSampleDecoder(bpc, comps int, cs colorSpace, decode []float64) *sampleDecoder {
+	maxValue := float64(int(1)<<bpc - 1)
+	d := &sampleDecoder{
+		maxValue: maxValue,
+		ranges:   make([][2]float64, comps),
+		indexed:  cs.model == colorModelIndexed,
+	}
+	for c := range d.ranges {
+		switch {
+		case len(decode) == 2*comps:
+			d.ranges[c] = [2]float64{decode[2*c], decode[2*c+1]}
+		case d.indexed:
+			d.ranges[c] = [2]float64{0, maxValue}
+		default:
+			d.ranges[c] = [2]float64{0, 1}
+		}
+	}
+
+	if bpc <= 8 && !d.indexed {
+		d.lookup = make([][]uint8, comps)
+		for c := range d.lookup {
+			d.lookup[c] = make([]uint8, int(maxValue)+1)
+			for s := range d.lookup[c] {
+				d.lookup[c][s] = uint8(math.Round(d.value(c, s) * 255))
+			}
+		}
+	}
+	return d
+}
+
+func (d *sampleDecoder) value(c, sample int) float64 {
+	r := d.ranges[c]
+	v := r[0] + float64(sample)*(r[1]-r[0])/d.maxValue
+	if d.indexed {
+		return v
+	}
+	return math.Max(0, math.Min(1, v))
+}
+
+func (d *sampleDecoder) byteValue(c, sample int) uint8 {
+	if d.lookup != nil {
+		return d.lookup[c][sample]
+	}
+	return uint8(d.value(c, sample)*255 + 0.5)
+}
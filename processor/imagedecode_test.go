@@ -0,0 +1,495 @@
+package processor
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/makiuchi-d/gozxing"
+	"github.com/makiuchi-d/gozxing/oned"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+)
+
+// testPDFImage is an image XObject for writeTestPDF: the entries of its
+// stream dictionary other than Type, Subtype and Length, and its stream data.
+type testPDFImage struct {
+	dict string
+	data []byte
+}
+
+// testPDFPage is one page for writeTestPDF.
+type testPDFPage struct {
+	content string
+	images  []testPDFImage
+}
+
+// writeTestPDF writes a minimal PDF with the given pages to a temporary
+// directory. Images are named Im0, Im1, ... in each page's resources.
+func writeTestPDF(t testing.TB, pages ...testPDFPage) string {
+	t.Helper()
+
+	var objects []string
+	add := func(obj string) int {
+		objects = append(objects, obj)
+		return len(objects)
+	}
+	stream := func(dict string, data []byte) string {
+		return fmt.Sprintf("<< %s /Length %d >>\nstream\n%s\nendstream", dict, len(data), data)
+	}
+
+	add("<< /Type /Catalog /Pages 2 0 R >>")
+	add("") // page tree, written once the pages are known
+	var kids []string
+	for _, page := range pages {
+		var xobjects []string
+		for i, img := range page.images {
+			nr := add(stream("/Type /XObject /Subtype /Image "+img.dict, img.data))
+			xobjects = append(xobjects, fmt.Sprintf("/Im%d %d 0 R", i, nr))
+		}
+		content := add(stream("", []byte(page.content)))
+		nr := add(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 595 842] /Contents %d 0 R /Resources << /XObject << %s >> >> >>",
+			content, strings.Join(xobjects, " ")))
+		kids = append(kids, fmt.Sprintf("%d 0 R", nr))
+	}
+	objects[1] = fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(kids))
+	return writePDFObjects(t, objects, "/Root 1 0 R")
+}
+
+// writePDFObjects writes the given objects, numbered from 1, to a PDF in a
+// temporary directory. trailer holds the trailer entries other than Size.
+func writePDFObjects(t testing.TB, objects []string, trailer string) string {
+	t.Helper()
+
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.7\n")
+	offsets := make([]int, len(objects))
+	for i, obj := range objects {
+		offsets[i] = buf.Len()
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d %s >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, trailer, xref)
+
+	path := filepath.Join(t.TempDir(), "input.pdf")
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("failed to write test PDF: %v", err)
+	}
+	return path
+}
+
+// drawImages places every image of a page next to each other.
+func drawImages(n int) string {
+	var content strings.Builder
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&content, "q 150 0 0 40 %d 700 cm /Im%d Do Q\n", 20+i*10, i)
+	}
+	return content.String()
+}
+
+// readTestContext reads a PDF written by writeTestPDF or writePDFObjects.
+func readTestContext(t testing.TB, path string) *model.Context {
+	t.Helper()
+	conf := model.NewDefaultConfiguration()
+	conf.ValidationMode = model.ValidationRelaxed
+	ctx, err := readPDFContext(path, conf)
+	if err != nil {
+		t.Fatalf("failed to read test PDF: %v", err)
+	}
+	return ctx
+}
+
+func flateEncode(t testing.TB, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		t.Fatalf("failed to compress: %v", err)
+	}
+	w.Close()
+	return buf.Bytes()
+}
+
+// packSamples packs one sample per pixel and component, row by row, with
+// each row starting on a byte boundary.
+func packSamples(w, h, comps, bpc int, sample func(x, y, c int) int) []byte {
+	stride := (w*comps*bpc + 7) / 8
+	data := make([]byte, stride*h)
+	for y := 0; y < h; y++ {
+		row := data[y*stride:]
+		for x := 0; x < w; x++ {
+			for c := 0; c < comps; c++ {
+				v := sample(x, y, c)
+				i := x*comps + c
+				switch bpc {
+				case 8:
+					row[i] = byte(v)
+				case 16:
+					row[2*i], row[2*i+1] = byte(v>>8), byte(v)
+				default:
+					bit := i * bpc
+					row[bit/8] |= byte(v << (8 - bpc - bit%8))
+				}
+			}
+		}
+	}
+	return data
+}
+
+func TestExtractPDFImageEncodings(t *testing.T) {
+	const text = "ENC-4711"
+	matrix, err := oned.NewCode128Writer().Encode(text, gozxing.BarcodeFormat_CODE_128, 300, 80, nil)
+	if err != nil {
+		t.Fatalf("failed to encode Code128: %v", err)
+	}
+	w, h := matrix.GetWidth(), matrix.GetHeight()
+	bar := func(x, y int) bool { return matrix.Get(x, y) }
+
+	gray := image.NewGray(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if !bar(x, y) {
+				gray.SetGray(x, y, color.Gray{Y: 255})
+			}
+		}
+	}
+	var jpg bytes.Buffer
+	if err := jpeg.Encode(&jpg, gray, &jpeg.Options{Quality: 90}); err != nil {
+		t.Fatalf("failed to encode JPEG: %v", err)
+	}
+
+	// JBIG2 pages of the barcode as is and inverted, for a /Decode [1 0]
+	jbig2Page := func(invert bool) []byte {
+		region, err := newJBIG2Bitmap(w, h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				if bar(x, y) != invert {
+					region.pix[y*w+x] = 1
+				}
+			}
+		}
+		return bytes.Join([][]byte{
+			jbig2SegmentBytes(0, jbig2PageInformation, jbig2PageInfo(uint32(w), uint32(h), 0)),
+			jbig2SegmentBytes(1, jbig2ImmediateLosslessGeneric, jbig2GenericRegion(region, 0, 0, 0, true)),
+			jbig2SegmentBytes(2, jbig2EndOfPage, nil),
+		}, nil)
+	}
+
+	dims := fmt.Sprintf("/Width %d /Height %d ", w, h)
+	tests := []struct {
+		name     string
+		image    testPDFImage
+		encoding string
+		wantErr  string
+	}{
+		{
+			name: "8-bit gray, Flate",
+			image: testPDFImage{dims + "/ColorSpace /DeviceGray /BitsPerComponent 8 /Filter /FlateDecode",
+				flateEncode(t, packSamples(w, h, 1, 8, func(x, y, c int) int {
+					if bar(x, y) {
+						return 0
+					}
+					return 255
+				}))},
+			encoding: "FlateDecode",
+		},
+		{
+			name: "16-bit gray",
+			image: testPDFImage{dims + "/ColorSpace /DeviceGray /BitsPerComponent 16",
+				packSamples(w, h, 1, 16, func(x, y, c int) int {
+					if bar(x, y) {
+						return 0x1000
+					}
+					return 0xf000
+				})},
+		},
+		{
+			name: "16-bit RGB",
+			image: testPDFImage{dims + "/ColorSpace /DeviceRGB /BitsPerComponent 16 /Filter /FlateDecode",
+				flateEncode(t, packSamples(w, h, 3, 16, func(x, y, c int) int {
+					if bar(x, y) {
+						return 0x2000
+					}
+					return 0xffff
+				}))},
+			encoding: "FlateDecode",
+		},
+		{
+			name: "CMYK",
+			image: testPDFImage{dims + "/ColorSpace /DeviceCMYK /BitsPerComponent 8",
+				packSamples(w, h, 4, 8, func(x, y, c int) int {
+					if bar(x, y) && c == 3 {
+						return 255
+					}
+					return 0
+				})},
+		},
+		{
+			name: "Indexed, 1-bit",
+			image: testPDFImage{dims + "/ColorSpace [/Indexed /DeviceRGB 1 <FFFFF0000080>] /BitsPerComponent 1",
+				packSamples(w, h, 1, 1, func(x, y, c int) int {
+					if bar(x, y) {
+						return 1
+					}
+					return 0
+				})},
+		},
+		{
+			name: "Separation, 4-bit",
+			image: testPDFImage{dims + "/ColorSpace [/Separation /Black /DeviceGray << /FunctionType 2 /Domain [0 1] /C0 [1] /C1 [0] /N 1 >>] /BitsPerComponent 4",
+				packSamples(w, h, 1, 4, func(x, y, c int) int {
+					if bar(x, y) {
+						return 15
+					}
+					return 1
+				})},
+		},
+		{
+			name: "Inverted image mask",
+			image: testPDFImage{dims + "/ImageMask true /Decode [1 0]",
+				packSamples(w, h, 1, 1, func(x, y, c int) int {
+					if bar(x, y) {
+						return 1
+					}
+					return 0
+				})},
+		},
+		{
+			name:     "JPEG",
+			image:    testPDFImage{dims + "/ColorSpace /DeviceGray /BitsPerComponent 8 /Filter /DCTDecode", jpg.Bytes()},
+			encoding: "DCTDecode",
+		},
+		{
+			name:     "JBIG2",
+			image:    testPDFImage{dims + "/ColorSpace /DeviceGray /BitsPerComponent 1 /Filter /JBIG2Decode", jbig2Page(false)},
+			encoding: "JBIG2Decode",
+		},
+		{
+			name:     "JBIG2, inverted",
+			image:    testPDFImage{dims + "/ColorSpace /DeviceGray /BitsPerComponent 1 /Decode [1 0] /Filter /JBIG2Decode", jbig2Page(true)},
+			encoding: "JBIG2Decode",
+		},
+		{
+			name:     "Invalid JBIG2",
+			image:    testPDFImage{dims + "/ColorSpace /DeviceGray /BitsPerComponent 1 /Filter /JBIG2Decode", []byte{0, 1, 2, 3}},
+			encoding: "JBIG2Decode",
+			wantErr:  "JBIG2",
+		},
+		{
+			name:    "Truncated samples",
+			image:   testPDFImage{dims + "/ColorSpace /DeviceGray /BitsPerComponent 8", make([]byte, w)},
+			wantErr: "truncated",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeTestPDF(t, testPDFPage{content: drawImages(1), images: []testPDFImage{tt.image}})
+			conf := model.NewDefaultConfiguration()
+			conf.ValidationMode = model.ValidationRelaxed
+
+			images, err := extractPDFImages(path, 0, conf)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(images) != 1 {
+				t.Fatalf("got %d images, want 1", len(images))
+			}
+			got := images[0]
+			if got.Page != 1 || !strings.HasPrefix(got.Name, "input_1_Im0.") {
+				t.Errorf("got image %q on page %d, want input_1_Im0 on page 1", got.Name, got.Page)
+			}
+			if got.Encoding != tt.encoding {
+				t.Errorf("got encoding %q, want %q", got.Encoding, tt.encoding)
+			}
+
+			if tt.wantErr != "" {
+				if got.Err == nil || !strings.Contains(got.Err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want one mentioning %q", got.Err, tt.wantErr)
+				}
+				return
+			}
+			if got.Err != nil {
+				t.Fatalf("unexpected decode error: %v", got.Err)
+			}
+			if got.Image.Bounds().Dx() != w || got.Image.Bounds().Dy() != h {
+				t.Fatalf("got %v image, want %dx%d", got.Image.Bounds(), w, h)
+			}
+			decoded, err := extractBarcodeFromImage(got.Image)
+			if err != nil {
+				t.Fatalf("failed to read barcode from %T: %v", got.Image, err)
+			}
+			if decoded != text {
+				t.Errorf("got %q, want %q", decoded, text)
+			}
+		})
+	}
+}
+
+// Group 4 fax codes of the runs in the test barcode, white then black.
+var (
+	faxWhiteRuns = map[int]string{2: "0111", 4: "1011", 6: "1110", 8: "10011", 38: "00010111"}
+	faxBlackRuns = map[int]string{2: "11", 4: "011", 6: "0010", 8: "000101"}
+)
+
+// encodeG4 codes a 1-bit image whose rows are all the same as Group 4 fax
+// data: the first row in horizontal mode, the others as vertical mode copies
+// of the row above, then the end of block. The row must end in white.
+func encodeG4(t testing.TB, row []bool, height int) []byte {
+	t.Helper()
+
+	// Runs alternate from white, which may be empty
+	var runs []int
+	color, n := false, 0
+	for _, black := range row {
+		if black != color {
+			runs = append(runs, n)
+			color, n = black, 0
+		}
+		n++
+	}
+	runs = append(runs, n)
+	if len(runs)%2 == 0 {
+		t.Fatal("row must end in white")
+	}
+
+	var bits strings.Builder
+	for i := 0; i+1 < len(runs); i += 2 {
+		white, okWhite := faxWhiteRuns[runs[i]]
+		black, okBlack := faxBlackRuns[runs[i+1]]
+		if !okWhite || !okBlack {
+			t.Fatalf("no code for runs %d and %d", runs[i], runs[i+1])
+		}
+		bits.WriteString("001" + white + black)
+	}
+	bits.WriteString("1") // the last white run reaches the end of the row
+	for y := 1; y < height; y++ {
+		bits.WriteString(strings.Repeat("1", len(runs)))
+	}
+	bits.WriteString("000000000001000000000001")
+
+	data := make([]byte, (bits.Len()+7)/8)
+	for i, b := range bits.String() {
+		if b == '1' {
+			data[i/8] |= 0x80 >> (i % 8)
+		}
+	}
+	return data
+}
+
+func TestDecodeCCITTImages(t *testing.T) {
+	const text = "FAX-4711"
+	img := barcodeImage(t, text)
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	row := make([]bool, w)
+	for x := range row {
+		row[x] = img.GrayAt(x, 0).Y == 0
+	}
+	data := encodeG4(t, row, h)
+
+	tests := []struct {
+		name    string
+		parms   string
+		wantErr string
+	}{
+		{"Group 4", fmt.Sprintf("/K -1 /Columns %d /Rows %d", w, h), ""},
+		{"Group 4 without rows", fmt.Sprintf("/K -1 /Columns %d", w), ""},
+		{"Group 3 2-D", fmt.Sprintf("/K 4 /Columns %d /Rows %d", w, h), "CCITT Group 3 2-D"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dict := fmt.Sprintf("/Width %d /Height %d /ColorSpace /DeviceGray /BitsPerComponent 1 /Filter /CCITTFaxDecode /DecodeParms << %s >>", w, h, tt.parms)
+			path := writeTestPDF(t, testPDFPage{content: drawImages(1), images: []testPDFImage{{dict, data}}})
+			conf := model.NewDefaultConfiguration()
+			conf.ValidationMode = model.ValidationRelaxed
+
+			images, err := extractPDFImages(path, 0, conf)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(images) != 1 {
+				t.Fatalf("got %d images, want 1", len(images))
+			}
+			got := images[0]
+			if tt.wantErr != "" {
+				if got.Err == nil || !strings.Contains(got.Err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want one mentioning %q", got.Err, tt.wantErr)
+				}
+				return
+			}
+			if got.Err != nil {
+				t.Fatalf("unexpected decode error: %v", got.Err)
+			}
+			if filepath.Ext(got.Name) != ".png" {
+				t.Errorf("got name %q, want a .png", got.Name)
+			}
+			if got.Image.Bounds().Dx() != w || got.Image.Bounds().Dy() != h {
+				t.Fatalf("got %v image, want %dx%d", got.Image.Bounds(), w, h)
+			}
+			decoded, err := extractBarcodeFromImage(got.Image)
+			if err != nil {
+				t.Fatalf("failed to read barcode: %v", err)
+			}
+			if decoded != text {
+				t.Errorf("got %q, want %q", decoded, text)
+			}
+		})
+	}
+}
+
+func TestExtractPDFImagesPageLimit(t *testing.T) {
+	// Every image differs, so pdfcpu does not merge them
+	var pages []testPDFPage
+	for p := 0; p < 3; p++ {
+		page := testPDFPage{content: drawImages(2)}
+		for i := 0; i < 2; i++ {
+			data := bytes.Repeat([]byte{byte(p*2 + i)}, 64)
+			page.images = append(page.images, testPDFImage{"/Width 8 /Height 8 /ColorSpace /DeviceGray /BitsPerComponent 8", data})
+		}
+		pages = append(pages, page)
+	}
+	path := writeTestPDF(t, pages...)
+
+	tests := []struct {
+		pageLimit int
+		want      int
+	}{
+		{0, 6},
+		{1, 2},
+		{2, 4},
+		{5, 6},
+	}
+	for _, tt := range tests {
+		conf := model.NewDefaultConfiguration()
+		conf.ValidationMode = model.ValidationRelaxed
+		cmd := conf.Cmd
+		images, err := extractPDFImages(path, tt.pageLimit, conf)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if conf.Cmd != cmd {
+			t.Errorf("page limit %d: configuration changed to command %v", tt.pageLimit, conf.Cmd)
+		}
+		if len(images) != tt.want {
+			t.Errorf("page limit %d: got %d images, want %d", tt.pageLimit, len(images), tt.want)
+		}
+		for _, img := range images {
+			if img.Page < 1 || (tt.pageLimit > 0 && img.Page > tt.pageLimit) {
+				t.Errorf("page limit %d: got image from page %d", tt.pageLimit, img.Page)
+			}
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package processor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/mail"
+
+	"golang.org/x/image/tiff"
+)
+
+// Input formats recognized by sniffInput.
+const (
+	inputPDF  = "pdf"
+	inputTIFF = "tiff"
+	inputPNG  = "png"
+	inputJPEG = "jpeg"
+	inputZIP  = "zip"
+	inputEML  = "eml"
+)
+
+// sniffInput identifies the format of an input file from its leading bytes,
+// returning "" for formats that cannot be processed.
+func sniffInput(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte("%PDF")):
+		return inputPDF
+	case bytes.HasPrefix(data, []byte("II*\x00")), bytes.HasPrefix(data, []byte("MM\x00*")):
+		return inputTIFF
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return inputPNG
+	case bytes.HasPrefix(data, []byte("\xff\xd8\xff")):
+		return inputJPEG
+	case bytes.HasPrefix(data, []byte("PK\x03\x04")), bytes.HasPrefix(data, []byte("PK\x05\x06")):
+		return inputZIP
+	case isEmail(data):
+		return inputEML
+	}
+	return ""
+}
+
+// isEmail reports whether data parses as a MIME message with a sender. Any
+// text starting with "Name: value" lines parses as a message, so a sender and
+// a MIME header are required.
+func isEmail(data []byte) bool {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return false
+	}
+	return msg.Header.Get("From") != "" &&
+		(msg.Header.Get("MIME-Version") != "" || msg.Header.Get("Content-Type") != "")
+}
+
+// decodeImageInput decodes an image file in place of a PDF's images. Each
+// frame of a multi-page TIFF is a page of its own, numbered from 1, and
+// frames after the first pageLimit are skipped unless pageLimit is 0. Frames
+// that cannot be decoded are returned with their error.
+func decodeImageInput(data []byte, format string, pageLimit int) ([]pdfImage, error) {
+	switch format {
+	case inputTIFF:
+		offsets, err := tiffFrameOffsets(data)
+		if err != nil {
+			return nil, err
+		}
+		var images []pdfImage
+		for i, offset := range offsets {
+			page := i + 1
+			if pageLimit > 0 && page > pageLimit {
+				break
+			}
+			img, err := decodeTIFFFrame(data, offset)
+			images = append(images, pdfImage{
+				Name:     fmt.Sprintf("input_%d_Frame%d.tif", page, page),
+				Page:     page,
+				Encoding: format,
+				Image:    img,
+				Err:      err,
+			})
+		}
+		return images, nil
+	case inputPNG, inputJPEG:
+		var img image.Image
+		var err error
+		ext := "png"
+		if format == inputJPEG {
+			ext = "jpg"
+			img, err = jpeg.Decode(bytes.NewReader(data))
+		} else {
+			img, err = png.Decode(bytes.NewReader(data))
+		}
+		return []pdfImage{{
+			Name:     "input_1_Frame1." + ext,
+			Page:     1,
+			Encoding: format,
+			Image:    img,
+			Err:      err,
+		}}, nil
+	}
+	return nil, fmt.Errorf("unsupported input format %q", format)
+}
+
+// tiffFrameOffsets follows the chain of image file directories of a TIFF and
+// returns their offsets in order.
+func tiffFrameOffsets(data []byte) ([]uint32, error) {
+	if len(data) < 8 {
+		return nil, fmt.Errorf("TIFF header is truncated")
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if data[0] == 'M' {
+		order = binary.BigEndian
+	}
+
+	var offsets []uint32
+	seen := map[uint32]bool{}
+	offset := order.Uint32(data[4:8])
+	for offset != 0 {
+		// Directories that loop back or run past the end of the file end the
+		// chain; the frames before them can still be read
+		if seen[offset] || int64(offset)+2 > int64(len(data)) {
+			break
+		}
+		seen[offset] = true
+		offsets = append(offsets, offset)
+
+		entries := int64(order.Uint16(data[offset:]))
+		next := int64(offset) + 2 + entries*12
+		if next+4 > int64(len(data)) {
+			break
+		}
+		offset = order.Uint32(data[next:])
+	}
+	if len(offsets) == 0 {
+		return nil, fmt.Errorf("TIFF has no image directories")
+	}
+	return offsets, nil
+}
+
+// decodeTIFFFrame decodes the frame whose directory is at offset. The TIFF
+// decoder only reads the first directory, so it reads the file through a
+// header that points at the frame's directory instead.
+func decodeTIFFFrame(data []byte, offset uint32) (image.Image, error) {
+	frame := &tiffFrameReader{data: data}
+	copy(frame.header[:], data[:8])
+	if data[0] == 'M' {
+		binary.BigEndian.PutUint32(frame.header[4:8], offset)
+	} else {
+		binary.LittleEndian.PutUint32(frame.header[4:8], offset)
+	}
+	img, err := tiff.Decode(io.NewSectionReader(frame, 0, int64(len(data))))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding TIFF frame: %v", err)
+	}
+	return img, nil
+}
+
+// tiffFrameReader reads a TIFF file with its header replaced, without
+// copying the file for every frame.
+type tiffFrameReader struct {
+	data   []byte
+	header [8]byte
+}
+
+func (r *tiffFrameReader) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(r.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, r.data[off:])
+	if off < int64(len(r.header)) {
+		copy(p, r.header[off:])
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -0,0 +1,226 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/makiuchi-d/gozxing"
+	"github.com/makiuchi-d/gozxing/oned"
+)
+
+// barcodeImage draws a Code128 barcode on a white background.
+func barcodeImage(t testing.TB, text string) *image.Gray {
+	t.Helper()
+	matrix, err := oned.NewCode128Writer().Encode(text, gozxing.BarcodeFormat_CODE_128, 300, 80, nil)
+	if err != nil {
+		t.Fatalf("failed to encode Code128: %v", err)
+	}
+	img := image.NewGray(image.Rect(0, 0, matrix.GetWidth(), matrix.GetHeight()))
+	for y := 0; y < matrix.GetHeight(); y++ {
+		for x := 0; x < matrix.GetWidth(); x++ {
+			if !matrix.Get(x, y) {
+				img.SetGray(x, y, color.Gray{Y: 255})
+			}
+		}
+	}
+	return img
+}
+
+// writeMultiPageTIFF encodes uncompressed 8-bit gray frames as one
+// little-endian TIFF with a directory per frame.
+func writeMultiPageTIFF(frames ...*image.Gray) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("II*\x00")
+	binary.Write(&buf, binary.LittleEndian, uint32(8))
+	for i, frame := range frames {
+		w, h := frame.Bounds().Dx(), frame.Bounds().Dy()
+		const entries = 9
+		dataOffset := buf.Len() + 2 + entries*12 + 4
+		next := uint32(0)
+		if i < len(frames)-1 {
+			next = uint32(dataOffset + w*h)
+		}
+
+		binary.Write(&buf, binary.LittleEndian, uint16(entries))
+		for _, entry := range [][3]uint32{
+			{256, 4, uint32(w)},          // ImageWidth
+			{257, 4, uint32(h)},          // ImageLength
+			{258, 3, 8},                  // BitsPerSample
+			{259, 3, 1},                  // Compression: none
+			{262, 3, 1},                  // PhotometricInterpretation: BlackIsZero
+			{273, 4, uint32(dataOffset)}, // StripOffsets
+			{277, 3, 1},                  // SamplesPerPixel
+			{278, 4, uint32(h)},          // RowsPerStrip
+			{279, 4, uint32(w * h)},      // StripByteCounts
+		} {
+			binary.Write(&buf, binary.LittleEndian, uint16(entry[0]))
+			binary.Write(&buf, binary.LittleEndian, uint16(entry[1]))
+			binary.Write(&buf, binary.LittleEndian, uint32(1))
+			if entry[1] == 3 {
+				binary.Write(&buf, binary.LittleEndian, uint16(entry[2]))
+				binary.Write(&buf, binary.LittleEndian, uint16(0))
+			} else {
+				binary.Write(&buf, binary.LittleEndian, entry[2])
+			}
+		}
+		binary.Write(&buf, binary.LittleEndian, next)
+		for y := 0; y < h; y++ {
+			buf.Write(frame.Pix[y*frame.Stride : y*frame.Stride+w])
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestSniffInput(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{"PDF", "%PDF-1.7\n", inputPDF},
+		{"Little-endian TIFF", "II*\x00\x08\x00\x00\x00", inputTIFF},
+		{"Big-endian TIFF", "MM\x00*\x00\x00\x00\x08", inputTIFF},
+		{"PNG", "\x89PNG\r\n\x1a\n", inputPNG},
+		{"JPEG", "\xff\xd8\xff\xe0", inputJPEG},
+		{"GIF", "GIF89a", ""},
+		{"Too short", "%P", ""},
+		{"Empty", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sniffInput([]byte(tt.data)); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeImageInput(t *testing.T) {
+	first, second := barcodeImage(t, "FRAME-1"), barcodeImage(t, "FRAME-2")
+	var pngData, jpegData bytes.Buffer
+	if err := png.Encode(&pngData, first); err != nil {
+		t.Fatalf("failed to encode PNG: %v", err)
+	}
+	if err := jpeg.Encode(&jpegData, first, &jpeg.Options{Quality: 90}); err != nil {
+		t.Fatalf("failed to encode JPEG: %v", err)
+	}
+	tiffData := writeMultiPageTIFF(first, second)
+
+	tests := []struct {
+		name      string
+		data      []byte
+		pageLimit int
+		want      []string
+	}{
+		{"PNG", pngData.Bytes(), 1, []string{"FRAME-1"}},
+		{"JPEG", jpegData.Bytes(), 1, []string{"FRAME-1"}},
+		{"Multi-page TIFF", tiffData, 0, []string{"FRAME-1", "FRAME-2"}},
+		{"Multi-page TIFF, first page only", tiffData, 1, []string{"FRAME-1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			format := sniffInput(tt.data)
+			original := bytes.Clone(tt.data)
+			images, err := decodeImageInput(tt.data, format, tt.pageLimit)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !bytes.Equal(tt.data, original) {
+				t.Error("input data was changed")
+			}
+			if len(images) != len(tt.want) {
+				t.Fatalf("got %d images, want %d", len(images), len(tt.want))
+			}
+			for i, img := range images {
+				if img.Page != i+1 {
+					t.Errorf("image %d is on page %d, want %d", i, img.Page, i+1)
+				}
+				if img.Encoding != format {
+					t.Errorf("got encoding %q, want %q", img.Encoding, format)
+				}
+				if img.Err != nil {
+					t.Fatalf("unexpected decode error: %v", img.Err)
+				}
+				got, err := extractBarcodeFromImage(img.Image)
+				if err != nil || got != tt.want[i] {
+					t.Errorf("page %d: got %q (err: %v), want %q", img.Page, got, err, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeImageInputBrokenTIFF(t *testing.T) {
+	data := writeMultiPageTIFF(barcodeImage(t, "FRAME-1"), barcodeImage(t, "FRAME-2"))
+
+	// A directory offset past the end stops the chain
+	truncated := bytes.Clone(data)
+	binary.LittleEndian.PutUint32(truncated[4:8], uint32(len(data)+100))
+	if _, err := decodeImageInput(truncated, inputTIFF, 0); err == nil {
+		t.Error("expected error for TIFF without readable directories")
+	}
+
+	// A frame whose strip is cut off is reported, the frame before it is not
+	images, err := decodeImageInput(data[:len(data)-100], inputTIFF, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(images) != 2 || images[0].Err != nil || images[1].Err == nil {
+		t.Errorf("got %d images, want frame 1 decoded and frame 2 failed", len(images))
+	}
+}
+
+func TestHandleRequestMultiPageTIFF(t *testing.T) {
+	ctx := withLogger(context.Background(), discardLogger)
+
+	var payload BarcodeData
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The last call carries every barcode found
+		json.NewDecoder(r.Body).Decode(&payload)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "scan.tif")
+	if err := os.WriteFile(path, writeMultiPageTIFF(barcodeImage(t, "FRAME-1"), barcodeImage(t, "FRAME-2")), 0644); err != nil {
+		t.Fatalf("failed to write TIFF: %v", err)
+	}
+	os.Setenv("TEST_PDF_PATH", path)
+	os.Setenv("PDF_PAGE_LIMIT", "2")
+	os.Setenv("WEBHOOK_URL", server.URL)
+	os.Setenv("WEBHOOK_TOKEN", "test-token")
+	defer func() {
+		os.Unsetenv("TEST_PDF_PATH")
+		os.Unsetenv("PDF_PAGE_LIMIT")
+		os.Unsetenv("WEBHOOK_URL")
+		os.Unsetenv("WEBHOOK_TOKEN")
+	}()
+
+	response, err := HandleRequest(ctx, events.S3Event{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if response.StatusCode != 200 {
+		t.Fatalf("got status %d, want 200", response.StatusCode)
+	}
+	if len(payload.Results) != 2 {
+		t.Fatalf("got %d results, want 2", len(payload.Results))
+	}
+	for i, result := range payload.Results {
+		if result.Page != i+1 {
+			t.Errorf("result %q is on page %d, want %d", result.Text, result.Page, i+1)
+		}
+	}
+}
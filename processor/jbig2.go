@@ -0,0 +1,632 @@
+package processor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"sort"
+
+	"golang.org/x/image/ccitt"
+)
+
+// JBIG2 segment types (ITU-T T.88, 7.3).
+const (
+	jbig2SymbolDictionary            = 0
+	jbig2IntermediateTextRegion      = 4
+	jbig2ImmediateTextRegion         = 6
+	jbig2ImmediateLosslessText       = 7
+	jbig2PatternDictionary           = 16
+	jbig2IntermediateHalftone        = 20
+	jbig2ImmediateHalftone           = 22
+	jbig2ImmediateLosslessHalftone   = 23
+	jbig2IntermediateGenericRegion   = 36
+	jbig2ImmediateGenericRegion      = 38
+	jbig2ImmediateLosslessGeneric    = 39
+	jbig2IntermediateRefinement      = 40
+	jbig2ImmediateRefinement         = 42
+	jbig2ImmediateLosslessRefinement = 43
+	jbig2PageInformation             = 48
+	jbig2EndOfPage                   = 49
+	jbig2EndOfStripe                 = 50
+	jbig2EndOfFile                   = 51
+
+	// jbig2UnknownLength is the data length of an immediate generic region
+	// whose end is found by its end marker
+	jbig2UnknownLength = 0xffffffff
+	// jbig2MaxPixels bounds the size of a page, a byte a pixel, to that of
+	// an A3 page at 600 dpi
+	jbig2MaxPixels = 7016 * 9921
+)
+
+// jbig2Bitmap is a bilevel image with a byte per pixel, 1 for black.
+type jbig2Bitmap struct {
+	width, height int
+	pix           []byte
+}
+
+func newJBIG2Bitmap(width, height int) (*jbig2Bitmap, error) {
+	if width < 0 || height < 0 || width*height > jbig2MaxPixels {
+		return nil, fmt.Errorf("invalid JBIG2 bitmap size %dx%d", width, height)
+	}
+	return &jbig2Bitmap{width: width, height: height, pix: make([]byte, width*height)}, nil
+}
+
+// at returns a pixel, 0 outside the bitmap.
+func (b *jbig2Bitmap) at(x, y int) byte {
+	if x < 0 || y < 0 || x >= b.width || y >= b.height {
+		return 0
+	}
+	return b.pix[y*b.width+x]
+}
+
+// grow makes the bitmap at least height rows high, with new rows of the
+// given pixel value.
+func (b *jbig2Bitmap) grow(height int, value byte) error {
+	if height <= b.height {
+		return nil
+	}
+	if b.width*height > jbig2MaxPixels {
+		return fmt.Errorf("JBIG2 page is larger than %d pixels", jbig2MaxPixels)
+	}
+	start := len(b.pix)
+	b.pix = append(b.pix, make([]byte, b.width*(height-b.height))...)
+	for i := start; i < len(b.pix); i++ {
+		b.pix[i] = value
+	}
+	b.height = height
+	return nil
+}
+
+// compose combines a region onto the bitmap at x, y with a combination
+// operator: 0 OR, 1 AND, 2 XOR, 3 XNOR and 4 REPLACE.
+func (b *jbig2Bitmap) compose(region *jbig2Bitmap, x, y int, op byte) {
+	for ry := 0; ry < region.height; ry++ {
+		py := y + ry
+		if py < 0 || py >= b.height {
+			continue
+		}
+		for rx := 0; rx < region.width; rx++ {
+			px := x + rx
+			if px < 0 || px >= b.width {
+				continue
+			}
+			src, dst := region.pix[ry*region.width+rx], &b.pix[py*b.width+px]
+			switch op {
+			case 0:
+				*dst |= src
+			case 1:
+				*dst &= src
+			case 2:
+				*dst ^= src
+			case 3:
+				*dst = 1 ^ (*dst ^ src)
+			default:
+				*dst = src
+			}
+		}
+	}
+}
+
+// gray returns the bitmap as a gray image, black where pixels are 1 unless
+// inverted.
+func (b *jbig2Bitmap) gray(invert bool) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, b.width, b.height))
+	var black byte = 1
+	if invert {
+		black = 0
+	}
+	for i, p := range b.pix {
+		if p != black {
+			img.Pix[i] = 0xff
+		}
+	}
+	return img
+}
+
+// jbig2Segment is a segment of a JBIG2 stream, as embedded in PDF.
+type jbig2Segment struct {
+	number uint32
+	kind   int
+	data   []byte
+}
+
+// jbig2Reader reads the big-endian fields of JBIG2 headers.
+type jbig2Reader struct {
+	data []byte
+	pos  int
+}
+
+func (r *jbig2Reader) bytes(n int) ([]byte, error) {
+	if n < 0 || len(r.data)-r.pos < n {
+		return nil, fmt.Errorf("truncated JBIG2 data")
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b, nil
+}
+
+func (r *jbig2Reader) uint32() (uint32, error) {
+	b, err := r.bytes(4)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(b), nil
+}
+
+func (r *jbig2Reader) byte() (byte, error) {
+	b, err := r.bytes(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// readJBIG2Segments splits a stream in the embedded organization, a sequence
+// of segments each with its header (T.88, 7.2), up to an end of file segment.
+func readJBIG2Segments(data []byte) ([]jbig2Segment, error) {
+	var segments []jbig2Segment
+	r := &jbig2Reader{data: data}
+	for r.pos < len(data) {
+		number, err := r.uint32()
+		if err != nil {
+			return nil, err
+		}
+		flags, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+		segment := jbig2Segment{number: number, kind: int(flags & 0x3f)}
+
+		// Referred-to segments only matter to the regions not supported
+		countByte, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+		count := int(countByte >> 5)
+		if count == 7 {
+			r.pos--
+			long, err := r.uint32()
+			if err != nil {
+				return nil, err
+			}
+			count = int(long & 0x1fffffff)
+			if _, err := r.bytes((count + 8) / 8); err != nil {
+				return nil, err
+			}
+		}
+		referenceSize := 1
+		if number > 65536 {
+			referenceSize = 4
+		} else if number > 256 {
+			referenceSize = 2
+		}
+		if _, err := r.bytes(count * referenceSize); err != nil {
+			return nil, err
+		}
+		pageSize := 1
+		if flags&0x40 != 0 {
+			pageSize = 4
+		}
+		if _, err := r.bytes(pageSize); err != nil {
+			return nil, err
+		}
+
+		length, err := r.uint32()
+		if err != nil {
+			return nil, err
+		}
+		if length == jbig2UnknownLength {
+			if segment.kind != jbig2ImmediateGenericRegion {
+				return nil, fmt.Errorf("JBIG2 segment %d of type %d has no length", number, segment.kind)
+			}
+			n, err := genericRegionLength(data[r.pos:])
+			if err != nil {
+				return nil, err
+			}
+			length = uint32(n)
+		}
+		if segment.data, err = r.bytes(int(length)); err != nil {
+			return nil, err
+		}
+		segments = append(segments, segment)
+		if segment.kind == jbig2EndOfFile {
+			break
+		}
+	}
+	return segments, nil
+}
+
+// genericRegionLength finds the end of an immediate generic region written
+// without its length: the data ends with a marker, 0xFFAC for arithmetic
+// coding or 0x0000 for MMR, and the number of rows (T.88, 7.2.7).
+func genericRegionLength(data []byte) (int, error) {
+	const headerSize = 18
+	if len(data) < headerSize {
+		return 0, fmt.Errorf("truncated JBIG2 generic region")
+	}
+	// Arithmetic coding has adaptive pixels after the flags: four for
+	// template 0, one for the others
+	marker, start := []byte{0x00, 0x00}, headerSize
+	if flags := data[17]; flags&1 == 0 {
+		marker, start = []byte{0xff, 0xac}, headerSize+2
+		if (flags>>1)&3 == 0 {
+			start = headerSize + 8
+		}
+	}
+	if start > len(data) {
+		return 0, fmt.Errorf("truncated JBIG2 generic region")
+	}
+	end := bytes.Index(data[start:], marker)
+	if end < 0 || start+end+6 > len(data) {
+		return 0, fmt.Errorf("JBIG2 generic region without end marker")
+	}
+	return start + end + 6, nil
+}
+
+// decodeJBIG2 decodes the page of a JBIG2 stream embedded in a PDF, after
+// the segments of its JBIG2Globals stream if any. Only generic regions,
+// which fax and bilevel scanner output is made of, are decoded; text,
+// halftone and refinement regions are reported as unsupported. The page
+// must have the width and height of the image, which bound the regions and
+// stripes on it.
+func decodeJBIG2(globals, data []byte, width, height int) (*jbig2Bitmap, error) {
+	if width <= 0 || height <= 0 {
+		return nil, fmt.Errorf("invalid JBIG2 image size %dx%d", width, height)
+	}
+	if width*height > jbig2MaxPixels {
+		return nil, fmt.Errorf("JBIG2 image %dx%d is larger than %d pixels", width, height, jbig2MaxPixels)
+	}
+	var segments []jbig2Segment
+	for _, stream := range [][]byte{globals, data} {
+		streamSegments, err := readJBIG2Segments(stream)
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, streamSegments...)
+	}
+
+	var page *jbig2Bitmap
+	var defaultPixel byte
+	grow := func(rows int) error {
+		if rows > height {
+			return fmt.Errorf("JBIG2 page grows past the image height %d", height)
+		}
+		return page.grow(rows, defaultPixel)
+	}
+	for _, segment := range segments {
+		switch segment.kind {
+		case jbig2PageInformation:
+			if page != nil {
+				return nil, fmt.Errorf("JBIG2 stream has more than one page")
+			}
+			r := &jbig2Reader{data: segment.data}
+			info, err := r.bytes(17)
+			if err != nil {
+				return nil, err
+			}
+			pageWidth := binary.BigEndian.Uint32(info[0:])
+			pageHeight := binary.BigEndian.Uint32(info[4:])
+			defaultPixel = (info[16] >> 2) & 1
+			if pageWidth != uint32(width) || (pageHeight != uint32(height) && pageHeight != jbig2UnknownLength) {
+				return nil, fmt.Errorf("JBIG2 page size %dx%d is not the image size %dx%d", pageWidth, pageHeight, width, height)
+			}
+			if page, err = newJBIG2Bitmap(width, 0); err != nil {
+				return nil, err
+			}
+			// Striped pages of unknown height grow with their stripes
+			if pageHeight != jbig2UnknownLength {
+				if err := grow(height); err != nil {
+					return nil, err
+				}
+			}
+
+		case jbig2ImmediateGenericRegion, jbig2ImmediateLosslessGeneric:
+			if page == nil {
+				return nil, fmt.Errorf("JBIG2 region before the page information")
+			}
+			region, x, y, op, err := decodeGenericRegionSegment(segment.data, width, height)
+			if err != nil {
+				return nil, fmt.Errorf("JBIG2 generic region %d: %v", segment.number, err)
+			}
+			if err := grow(y + region.height); err != nil {
+				return nil, err
+			}
+			page.compose(region, x, y, op)
+
+		case jbig2EndOfStripe:
+			if page == nil || len(segment.data) < 4 {
+				return nil, fmt.Errorf("invalid JBIG2 end of stripe")
+			}
+			if err := grow(int(binary.BigEndian.Uint32(segment.data)) + 1); err != nil {
+				return nil, err
+			}
+
+		case jbig2IntermediateTextRegion, jbig2ImmediateTextRegion, jbig2ImmediateLosslessText:
+			return nil, fmt.Errorf("JBIG2 text regions are not supported")
+		case jbig2IntermediateHalftone, jbig2ImmediateHalftone, jbig2ImmediateLosslessHalftone:
+			return nil, fmt.Errorf("JBIG2 halftone regions are not supported")
+		case jbig2IntermediateRefinement, jbig2ImmediateRefinement, jbig2ImmediateLosslessRefinement:
+			return nil, fmt.Errorf("JBIG2 refinement regions are not supported")
+
+		case jbig2EndOfPage, jbig2EndOfFile:
+			if page == nil {
+				return nil, fmt.Errorf("JBIG2 stream has no page")
+			}
+			return page, nil
+		}
+		// Dictionaries, intermediate generic regions, tables and extensions
+		// are only used by the regions not supported
+	}
+	if page == nil {
+		return nil, fmt.Errorf("JBIG2 stream has no page")
+	}
+	return page, nil
+}
+
+// jbig2Pixel is a template pixel, relative to the pixel being decoded.
+type jbig2Pixel struct{ x, y int }
+
+// jbig2Templates are the fixed pixels of the generic region templates, to
+// which the adaptive pixels are added (T.88, 6.2.5.3).
+var jbig2Templates = [4][]jbig2Pixel{
+	{{-1, -2}, {0, -2}, {1, -2}, {-2, -1}, {-1, -1}, {0, -1}, {1, -1}, {2, -1}, {-4, 0}, {-3, 0}, {-2, 0}, {-1, 0}},
+	{{-1, -2}, {0, -2}, {1, -2}, {2, -2}, {-2, -1}, {-1, -1}, {0, -1}, {1, -1}, {2, -1}, {-3, 0}, {-2, 0}, {-1, 0}},
+	{{-1, -2}, {0, -2}, {1, -2}, {-2, -1}, {-1, -1}, {0, -1}, {1, -1}, {-2, 0}, {-1, 0}},
+	{{-3, -1}, {-2, -1}, {-1, -1}, {0, -1}, {1, -1}, {-4, 0}, {-3, 0}, {-2, 0}, {-1, 0}},
+}
+
+// jbig2TypicalContexts are the contexts of the bit that tells whether a row
+// is the same as the one above, for each template (T.88, 6.2.5.7).
+var jbig2TypicalContexts = [4]int{0x9b25, 0x0795, 0x00e5, 0x0195}
+
+// jbig2ContextPixels returns the pixels forming the context of a generic
+// region template, in the order they are read.
+func jbig2ContextPixels(template int, adaptive []jbig2Pixel) []jbig2Pixel {
+	pixels := append(append([]jbig2Pixel{}, jbig2Templates[template]...), adaptive...)
+	sort.SliceStable(pixels, func(i, j int) bool {
+		if pixels[i].y != pixels[j].y {
+			return pixels[i].y < pixels[j].y
+		}
+		return pixels[i].x < pixels[j].x
+	})
+	return pixels
+}
+
+// decodeGenericRegionSegment decodes the data of an immediate generic region
+// segment (T.88, 7.4.6), returning the region with where and how it goes on
+// the page. Regions larger than the page are refused.
+func decodeGenericRegionSegment(data []byte, pageWidth, pageHeight int) (region *jbig2Bitmap, x, y int, op byte, err error) {
+	r := &jbig2Reader{data: data}
+	info, err := r.bytes(17)
+	if err != nil {
+		return nil, 0, 0, 0, err
+	}
+	width := binary.BigEndian.Uint32(info[0:])
+	height := binary.BigEndian.Uint32(info[4:])
+	x = int(int32(binary.BigEndian.Uint32(info[8:])))
+	y = int(int32(binary.BigEndian.Uint32(info[12:])))
+	op = info[16] & 7
+
+	flags, err := r.byte()
+	if err != nil {
+		return nil, 0, 0, 0, err
+	}
+	mmr := flags&1 != 0
+	template := int(flags>>1) & 3
+	typical := flags&8 != 0
+	if flags&0x10 != 0 {
+		return nil, 0, 0, 0, fmt.Errorf("extended templates are not supported")
+	}
+
+	var adaptive []jbig2Pixel
+	if !mmr {
+		n := 1
+		if template == 0 {
+			n = 4
+		}
+		at, err := r.bytes(2 * n)
+		if err != nil {
+			return nil, 0, 0, 0, err
+		}
+		for i := 0; i < n; i++ {
+			adaptive = append(adaptive, jbig2Pixel{int(int8(at[2*i])), int(int8(at[2*i+1]))})
+		}
+	}
+
+	coded := data[r.pos:]
+	// Regions of unknown length end with a marker and their number of rows
+	if len(coded) >= 6 && height == jbig2UnknownLength {
+		height = binary.BigEndian.Uint32(coded[len(coded)-4:])
+		coded = coded[:len(coded)-4]
+	}
+	if width > uint32(pageWidth) || height > uint32(pageHeight) {
+		return nil, 0, 0, 0, fmt.Errorf("region size %dx%d is larger than the page", width, height)
+	}
+	if mmr {
+		region, err = decodeMMRRegion(coded, int(width), int(height))
+	} else {
+		region, err = decodeArithmeticRegion(coded, int(width), int(height), template, typical, adaptive)
+	}
+	return region, x, y, op, err
+}
+
+// decodeMMRRegion decodes a generic region coded as in T.6 fax (MMR).
+func decodeMMRRegion(data []byte, width, height int) (*jbig2Bitmap, error) {
+	region, err := newJBIG2Bitmap(width, height)
+	if err != nil || width == 0 || height == 0 {
+		return region, err
+	}
+	stride := (width + 7) / 8
+	rows := make([]byte, stride*height)
+	reader := ccitt.NewReader(bytes.NewReader(data), ccitt.MSB, ccitt.Group4, width, height, &ccitt.Options{Invert: true})
+	if _, err := io.ReadFull(reader, rows); err != nil {
+		return nil, fmt.Errorf("error decoding MMR data: %v", err)
+	}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			region.pix[y*width+x] = (rows[y*stride+x/8] >> (7 - x%8)) & 1
+		}
+	}
+	return region, nil
+}
+
+// decodeArithmeticRegion decodes a generic region coded with the MQ
+// arithmetic coder (T.88, 6.2.5). Each pixel is decoded in the context of
+// the template's pixels, read as a number with the top-left one first.
+func decodeArithmeticRegion(data []byte, width, height, template int, typical bool, adaptive []jbig2Pixel) (*jbig2Bitmap, error) {
+	region, err := newJBIG2Bitmap(width, height)
+	if err != nil {
+		return nil, err
+	}
+	pixels := jbig2ContextPixels(template, adaptive)
+	decoder := newMQDecoder(data)
+	contexts := make([]byte, 1<<len(pixels))
+	skip := false
+	for y := 0; y < height; y++ {
+		if typical {
+			skip = skip != (decoder.decode(contexts, jbig2TypicalContexts[template]) == 1)
+			if skip {
+				if y > 0 {
+					copy(region.pix[y*width:(y+1)*width], region.pix[(y-1)*width:y*width])
+				}
+				continue
+			}
+		}
+		for x := 0; x < width; x++ {
+			context := 0
+			for _, p := range pixels {
+				context = context<<1 | int(region.at(x+p.x, y+p.y))
+			}
+			region.pix[y*width+x] = byte(decoder.decode(contexts, context))
+		}
+	}
+	return region, nil
+}
+
+// mqState is a state of the MQ coder's probability estimation (T.88,
+// Table E.1).
+type mqState struct {
+	qe         uint32
+	nmps, nlps byte
+	switchMPS  bool
+}
+
+var mqStates = [47]mqState{
+	{0x5601, 1, 1, true}, {0x3401, 2, 6, false}, {0x1801, 3, 9, false}, {0x0ac1, 4, 12, false},
+	{0x0521, 5, 29, false}, {0x0221, 38, 33, false}, {0x5601, 7, 6, true}, {0x5401, 8, 14, false},
+	{0x4801, 9, 14, false}, {0x3801, 10, 14, false}, {0x3001, 11, 17, false}, {0x2401, 12, 18, false},
+	{0x1c01, 13, 20, false}, {0x1601, 29, 21, false}, {0x5601, 15, 14, true}, {0x5401, 16, 14, false},
+	{0x5101, 17, 15, false}, {0x4801, 18, 16, false}, {0x3801, 19, 17, false}, {0x3401, 20, 18, false},
+	{0x3001, 21, 19, false}, {0x2801, 22, 19, false}, {0x2401, 23, 20, false}, {0x2201, 24, 21, false},
+	{0x1c01, 25, 22, false}, {0x1801, 26, 23, false}, {0x1601, 27, 24, false}, {0x1401, 28, 25, false},
+	{0x1201, 29, 26, false}, {0x1101, 30, 27, false}, {0x0ac1, 31, 28, false}, {0x09c1, 32, 29, false},
+	{0x08a1, 33, 30, false}, {0x0521, 34, 31, false}, {0x0441, 35, 32, false}, {0x02a1, 36, 33, false},
+	{0x0221, 37, 34, false}, {0x0141, 38, 35, false}, {0x0111, 39, 36, false}, {0x0085, 40, 37, false},
+	{0x0049, 41, 38, false}, {0x0025, 42, 39, false}, {0x0015, 43, 40, false}, {0x0009, 44, 41, false},
+	{0x0005, 45, 42, false}, {0x0001, 45, 43, false}, {0x5601, 46, 46, false},
+}
+
+// mqDecoder is the MQ arithmetic decoder (T.88, Annex E.3), with the C
+// register split in a high and low half. Contexts hold their state index
+// shifted left by one and their more probable symbol in the low bit.
+type mqDecoder struct {
+	data        []byte
+	pos         int
+	chigh, clow uint32
+	a           uint32
+	ct          int
+}
+
+func newMQDecoder(data []byte) *mqDecoder {
+	d := &mqDecoder{data: data}
+	d.chigh = uint32(d.byteAt(0))
+	d.byteIn()
+	d.chigh = (d.chigh<<7)&0xffff | (d.clow>>9)&0x7f
+	d.clow = (d.clow << 7) & 0xffff
+	d.ct -= 7
+	d.a = 0x8000
+	return d
+}
+
+// byteAt returns a byte of the data, with 0xFF past its end.
+func (d *mqDecoder) byteAt(pos int) byte {
+	if pos >= len(d.data) {
+		return 0xff
+	}
+	return d.data[pos]
+}
+
+func (d *mqDecoder) byteIn() {
+	if d.byteAt(d.pos) == 0xff {
+		if d.byteAt(d.pos+1) > 0x8f {
+			d.clow += 0xff00
+			d.ct = 8
+		} else {
+			d.pos++
+			d.clow += uint32(d.byteAt(d.pos)) << 9
+			d.ct = 7
+		}
+	} else {
+		d.pos++
+		d.clow += uint32(d.byteAt(d.pos)) << 8
+		d.ct = 8
+	}
+	if d.clow > 0xffff {
+		d.chigh += d.clow >> 16
+		d.clow &= 0xffff
+	}
+}
+
+// decode decodes a bit in a context.
+func (d *mqDecoder) decode(contexts []byte, context int) int {
+	index, mps := contexts[context]>>1, int(contexts[context]&1)
+	state := mqStates[index]
+	d.a -= state.qe
+
+	var bit int
+	if d.chigh < state.qe {
+		// LPS exchange
+		if d.a < state.qe {
+			d.a = state.qe
+			bit = mps
+			index = state.nmps
+		} else {
+			d.a = state.qe
+			bit = 1 ^ mps
+			if state.switchMPS {
+				mps = bit
+			}
+			index = state.nlps
+		}
+	} else {
+		d.chigh -= state.qe
+		if d.a&0x8000 != 0 {
+			return mps
+		}
+		// MPS exchange
+		if d.a < state.qe {
+			bit = 1 ^ mps
+			if state.switchMPS {
+				mps = bit
+			}
+			index = state.nlps
+		} else {
+			bit = mps
+			index = state.nmps
+		}
+	}
+
+	for d.a&0x8000 == 0 {
+		if d.ct == 0 {
+			d.byteIn()
+		}
+		d.a <<= 1
+		d.chigh = (d.chigh<<1)&0xffff | (d.clow>>15)&1
+		d.clow = (d.clow << 1) & 0xffff
+		d.ct--
+	}
+	contexts[context] = index<<1 | byte(mps)
+	return bit
+}
@@ -0,0 +1,426 @@
+package processor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// The test sequence of the arithmetic coder, coded in a single context
+// (T.88, Annex H.2).
+var (
+	mqTestData  = []byte{0x00, 0x02, 0x00, 0x51, 0x00, 0x00, 0x00, 0xc0, 0x03, 0x52, 0x87, 0x2a, 0xaa, 0xaa, 0xaa, 0xaa, 0x82, 0xc0, 0x20, 0x00, 0xfc, 0xd7, 0x9e, 0xf6, 0xbf, 0x7f, 0xed, 0x90, 0x4f, 0x46, 0xa3, 0xbf}
+	mqTestCoded = []byte{0x84, 0xc7, 0x3b, 0xfc, 0xe1, 0xa1, 0x43, 0x04, 0x02, 0x20, 0x00, 0x00, 0x41, 0x0d, 0xbb, 0x86, 0xf4, 0x31, 0x7f, 0xff, 0x88, 0xff, 0x37, 0x47, 0x1a, 0xdb, 0x6a, 0xdf, 0xff, 0xac}
+)
+
+// mqEncoder is the MQ arithmetic encoder (T.88, Annex E.2), for writing
+// test streams. out holds the byte before the first, which is dropped.
+type mqEncoder struct {
+	out  []byte
+	a, c uint32
+	ct   int
+}
+
+func newMQEncoder() *mqEncoder {
+	return &mqEncoder{out: []byte{0}, a: 0x8000, ct: 12}
+}
+
+func (e *mqEncoder) encode(contexts []byte, context, bit int) {
+	index, mps := contexts[context]>>1, int(contexts[context]&1)
+	state := mqStates[index]
+	e.a -= state.qe
+	if bit == mps {
+		if e.a&0x8000 != 0 {
+			e.c += state.qe
+			return
+		}
+		if e.a < state.qe {
+			e.a = state.qe
+		} else {
+			e.c += state.qe
+		}
+		index = state.nmps
+	} else {
+		if e.a < state.qe {
+			e.c += state.qe
+		} else {
+			e.a = state.qe
+		}
+		if state.switchMPS {
+			mps = 1 - mps
+		}
+		index = state.nlps
+	}
+	for {
+		e.a <<= 1
+		e.c <<= 1
+		e.ct--
+		if e.ct == 0 {
+			e.byteOut()
+		}
+		if e.a&0x8000 != 0 {
+			break
+		}
+	}
+	contexts[context] = index<<1 | byte(mps)
+}
+
+func (e *mqEncoder) byteOut() {
+	last := &e.out[len(e.out)-1]
+	if *last != 0xff && e.c >= 0x8000000 {
+		*last++
+		e.c &= 0x7ffffff
+	}
+	if *last == 0xff {
+		e.out = append(e.out, byte(e.c>>20))
+		e.c &= 0xfffff
+		e.ct = 7
+		return
+	}
+	e.out = append(e.out, byte(e.c>>19))
+	e.c &= 0x7ffff
+	e.ct = 8
+}
+
+// flush ends the coded data with the 0xFFAC marker.
+func (e *mqEncoder) flush() []byte {
+	temp := e.c + e.a
+	e.c |= 0xffff
+	if e.c >= temp {
+		e.c -= 0x8000
+	}
+	e.c <<= uint(e.ct)
+	e.byteOut()
+	e.c <<= uint(e.ct)
+	e.byteOut()
+	if e.out[len(e.out)-1] != 0xff {
+		e.out = append(e.out, 0xff)
+	}
+	return append(e.out[1:], 0xac)
+}
+
+// encodeArithmeticRegion codes a bitmap as decodeArithmeticRegion decodes it.
+func encodeArithmeticRegion(b *jbig2Bitmap, template int, typical bool, adaptive []jbig2Pixel) []byte {
+	pixels := jbig2ContextPixels(template, adaptive)
+	e := newMQEncoder()
+	contexts := make([]byte, 1<<len(pixels))
+	skip := false
+	for y := 0; y < b.height; y++ {
+		if typical {
+			same := y > 0 && bytes.Equal(b.pix[y*b.width:(y+1)*b.width], b.pix[(y-1)*b.width:y*b.width])
+			if y == 0 {
+				same = !bytes.ContainsRune(b.pix[:b.width], 1)
+			}
+			bit := 0
+			if same != skip {
+				bit = 1
+			}
+			e.encode(contexts, jbig2TypicalContexts[template], bit)
+			if skip = same; skip {
+				continue
+			}
+		}
+		for x := 0; x < b.width; x++ {
+			context := 0
+			for _, p := range pixels {
+				context = context<<1 | int(b.at(x+p.x, y+p.y))
+			}
+			e.encode(contexts, context, int(b.pix[y*b.width+x]))
+		}
+	}
+	return e.flush()
+}
+
+// jbig2SegmentBytes writes a segment with its header, on page 1.
+func jbig2SegmentBytes(number uint32, kind int, data []byte) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, number)
+	b.Write([]byte{byte(kind), 0, 1})
+	binary.Write(&b, binary.BigEndian, uint32(len(data)))
+	b.Write(data)
+	return b.Bytes()
+}
+
+func jbig2PageInfo(width, height uint32, flags byte) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, []uint32{width, height, 0, 0})
+	b.WriteByte(flags)
+	b.Write([]byte{0, 0})
+	return b.Bytes()
+}
+
+// jbig2GenericRegion writes the data of an immediate generic region segment
+// coded with template 0, at x, y.
+func jbig2GenericRegion(b *jbig2Bitmap, x, y uint32, op byte, typical bool) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, []uint32{uint32(b.width), uint32(b.height), x, y})
+	flags := byte(0)
+	if typical {
+		flags |= 8
+	}
+	buf.Write([]byte{op, flags, 3, 0xff, 0xfd, 0xff, 2, 0xfe, 0xfe, 0xfe})
+	buf.Write(encodeArithmeticRegion(b, 0, typical, []jbig2Pixel{{3, -1}, {-3, -1}, {2, -2}, {-2, -2}}))
+	return buf.Bytes()
+}
+
+// testJBIG2Bitmap returns a bitmap of random dots, blank and repeated rows.
+func testJBIG2Bitmap(t *testing.T, width, height int) *jbig2Bitmap {
+	b, err := newJBIG2Bitmap(width, height)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rng := rand.New(rand.NewSource(int64(width * height)))
+	for y := 0; y < height; y++ {
+		switch y % 5 {
+		case 0:
+		case 1:
+			copy(b.pix[y*width:], b.pix[(y-1)*width:y*width])
+		default:
+			for x := 0; x < width; x++ {
+				if rng.Intn(3) == 0 {
+					b.pix[y*width+x] = 1
+				}
+			}
+		}
+	}
+	return b
+}
+
+func TestMQDecoder(t *testing.T) {
+	d := newMQDecoder(mqTestCoded)
+	contexts := make([]byte, 1)
+	var got []byte
+	for range mqTestData {
+		var b byte
+		for i := 0; i < 8; i++ {
+			b = b<<1 | byte(d.decode(contexts, 0))
+		}
+		got = append(got, b)
+	}
+	if !bytes.Equal(got, mqTestData) {
+		t.Errorf("got % x, want % x", got, mqTestData)
+	}
+
+	// The encoder the tests write streams with codes the same sequence
+	e := newMQEncoder()
+	contexts = make([]byte, 1)
+	for _, b := range mqTestData {
+		for i := 7; i >= 0; i-- {
+			e.encode(contexts, 0, int(b>>i)&1)
+		}
+	}
+	if coded := e.flush(); !bytes.Equal(coded, mqTestCoded) {
+		t.Errorf("test encoder got % x, want % x", coded, mqTestCoded)
+	}
+}
+
+func TestDecodeArithmeticRegion(t *testing.T) {
+	want := testJBIG2Bitmap(t, 37, 23)
+	tests := []struct {
+		name     string
+		template int
+		typical  bool
+		adaptive []jbig2Pixel
+	}{
+		{"Template 0", 0, false, []jbig2Pixel{{3, -1}, {-3, -1}, {2, -2}, {-2, -2}}},
+		{"Template 0, typical prediction", 0, true, []jbig2Pixel{{3, -1}, {-3, -1}, {2, -2}, {-2, -2}}},
+		{"Template 0, moved adaptive pixels", 0, false, []jbig2Pixel{{-5, 0}, {4, -2}, {0, -3}, {-7, -1}}},
+		{"Template 1", 1, true, []jbig2Pixel{{3, -1}}},
+		{"Template 2", 2, true, []jbig2Pixel{{2, -1}}},
+		{"Template 3", 3, false, []jbig2Pixel{{2, -1}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			coded := encodeArithmeticRegion(want, tt.template, tt.typical, tt.adaptive)
+			got, err := decodeArithmeticRegion(coded, want.width, want.height, tt.template, tt.typical, tt.adaptive)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !bytes.Equal(got.pix, want.pix) {
+				t.Errorf("decoded bitmap differs from the coded one")
+			}
+		})
+	}
+}
+
+func TestDecodeMMRRegion(t *testing.T) {
+	// Two rows of 8 pixels, both white-white-4 black-white-white: the first
+	// in horizontal mode (001, white run 2 0111, black run 4 011) and V0
+	// (1), the second as three V0 codes, then EOFB
+	bits := "0010111011" + "1" + "111" + "000000000001" + "000000000001"
+	for len(bits)%8 != 0 {
+		bits += "0"
+	}
+	data := make([]byte, len(bits)/8)
+	for i, c := range bits {
+		if c == '1' {
+			data[i/8] |= 0x80 >> (i % 8)
+		}
+	}
+
+	got, err := decodeMMRRegion(data, 8, 2)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []byte{0, 0, 1, 1, 1, 1, 0, 0, 0, 0, 1, 1, 1, 1, 0, 0}
+	if !bytes.Equal(got.pix, want) {
+		t.Errorf("got %v, want %v", got.pix, want)
+	}
+	if _, err := decodeMMRRegion([]byte{0x00}, 8, 2); err == nil {
+		t.Errorf("expected error for truncated MMR data")
+	}
+}
+
+func TestDecodeJBIG2(t *testing.T) {
+	region := testJBIG2Bitmap(t, 40, 20)
+	generic := jbig2GenericRegion(region, 4, 6, 0, true)
+	stream := func(segments ...[]byte) []byte {
+		return bytes.Join(segments, nil)
+	}
+
+	// Region data of unknown length and height ends with the marker and the
+	// number of rows
+	unknownLength := stream(
+		jbig2SegmentBytes(1, jbig2PageInformation, jbig2PageInfo(48, 30, 0)),
+		jbig2SegmentBytes(2, jbig2ImmediateGenericRegion, nil)[:7],
+		[]byte{0xff, 0xff, 0xff, 0xff},
+		generic,
+		[]byte{0, 0, 0, 20},
+		jbig2SegmentBytes(3, jbig2EndOfPage, nil),
+	)
+	binary.BigEndian.PutUint32(unknownLength[len(jbig2SegmentBytes(1, jbig2PageInformation, jbig2PageInfo(48, 30, 0)))+15:], 0xffffffff)
+
+	tests := []struct {
+		name    string
+		globals []byte
+		data    []byte
+		// width and height of the image, 48x30 if zero
+		width      int
+		height     int
+		wantHeight int
+		wantWhite  byte
+		wantErr    string
+	}{
+		{
+			name: "Generic region",
+			data: stream(
+				jbig2SegmentBytes(1, jbig2PageInformation, jbig2PageInfo(48, 30, 0)),
+				jbig2SegmentBytes(2, jbig2ImmediateGenericRegion, generic),
+				jbig2SegmentBytes(3, jbig2EndOfPage, nil),
+			),
+			wantHeight: 30,
+		},
+		{
+			name:    "Page in the globals",
+			globals: jbig2SegmentBytes(1, jbig2PageInformation, jbig2PageInfo(48, 30, 0)),
+			data: stream(
+				jbig2SegmentBytes(2, jbig2ImmediateLosslessGeneric, generic),
+				jbig2SegmentBytes(3, jbig2EndOfFile, nil),
+			),
+			wantHeight: 30,
+		},
+		{
+			name: "Striped page of unknown height",
+			data: stream(
+				jbig2SegmentBytes(1, jbig2PageInformation, jbig2PageInfo(48, 0xffffffff, 0)),
+				jbig2SegmentBytes(2, jbig2ImmediateGenericRegion, generic),
+				jbig2SegmentBytes(3, jbig2EndOfStripe, []byte{0, 0, 0, 31}),
+			),
+			height:     32,
+			wantHeight: 32,
+		},
+		{
+			name: "Black default pixel, replaced by the region",
+			data: stream(
+				jbig2SegmentBytes(1, jbig2PageInformation, jbig2PageInfo(48, 30, 4)),
+				jbig2SegmentBytes(2, jbig2ImmediateGenericRegion, jbig2GenericRegion(region, 4, 6, 4, false)),
+			),
+			wantHeight: 30,
+			wantWhite:  1,
+		},
+		{name: "Region of unknown length", data: unknownLength, wantHeight: 30},
+		{
+			name: "Text region",
+			data: stream(
+				jbig2SegmentBytes(1, jbig2PageInformation, jbig2PageInfo(48, 30, 0)),
+				jbig2SegmentBytes(2, jbig2SymbolDictionary, []byte{0, 0}),
+				jbig2SegmentBytes(3, jbig2ImmediateTextRegion, []byte{0, 0}),
+			),
+			wantErr: "text regions are not supported",
+		},
+		{name: "Region before the page", data: jbig2SegmentBytes(2, jbig2ImmediateGenericRegion, generic), wantErr: "before the page"},
+		{name: "No page", data: jbig2SegmentBytes(1, jbig2EndOfFile, nil), wantErr: "no page"},
+		{name: "Truncated", data: jbig2SegmentBytes(1, jbig2PageInformation, jbig2PageInfo(48, 30, 0))[:20], wantErr: "truncated"},
+		{
+			name:    "Page not the size of the image",
+			data:    jbig2SegmentBytes(1, jbig2PageInformation, jbig2PageInfo(48, 30, 0)),
+			width:   40,
+			wantErr: "not the image size",
+		},
+		{
+			name: "Stripe past the image height",
+			data: stream(
+				jbig2SegmentBytes(1, jbig2PageInformation, jbig2PageInfo(48, 0xffffffff, 0)),
+				jbig2SegmentBytes(2, jbig2EndOfStripe, []byte{0, 0, 0, 40}),
+			),
+			wantErr: "past the image height",
+		},
+		{
+			name: "Region larger than the page",
+			data: stream(
+				jbig2SegmentBytes(1, jbig2PageInformation, jbig2PageInfo(48, 30, 0)),
+				jbig2SegmentBytes(2, jbig2ImmediateGenericRegion, jbig2GenericRegion(testJBIG2Bitmap(t, 64, 20), 0, 0, 0, true)),
+			),
+			wantErr: "larger than the page",
+		},
+		{
+			// An empty region on a page this size once took seconds and
+			// half a gigabyte to decode
+			name: "Huge page",
+			data: stream(
+				jbig2SegmentBytes(1, jbig2PageInformation, jbig2PageInfo(16384, 16384, 0)),
+				jbig2SegmentBytes(2, jbig2ImmediateGenericRegion, jbig2GenericRegion(testJBIG2Bitmap(t, 8, 1), 0, 0, 0, true)),
+			),
+			width:   16384,
+			height:  16384,
+			wantErr: "larger than",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			width, height := 48, 30
+			if tt.width != 0 {
+				width = tt.width
+			}
+			if tt.height != 0 {
+				height = tt.height
+			}
+			page, err := decodeJBIG2(tt.globals, tt.data, width, height)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want one mentioning %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if page.width != 48 || page.height != tt.wantHeight {
+				t.Fatalf("got %dx%d page, want 48x%d", page.width, page.height, tt.wantHeight)
+			}
+			for y := 0; y < page.height; y++ {
+				for x := 0; x < page.width; x++ {
+					want := tt.wantWhite
+					if x >= 4 && x < 44 && y >= 6 && y < 26 {
+						want = region.pix[(y-6)*region.width+x-4]
+					}
+					if got := page.at(x, y); got != want {
+						t.Fatalf("got pixel %d at %d,%d, want %d", got, x, y, want)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,402 @@
+package processor
+
+import (
+	"context"
+	"image"
+	"sort"
+
+	"github.com/makiuchi-d/gozxing"
+	multidetector "github.com/makiuchi-d/gozxing/multi/qrcode/detector"
+)
+
+const (
+	// Pages are searched at this resolution (longer side) to keep localization cheap
+	localizeWorkDimension = 1000
+	// Gradient responses below this are never part of a barcode, whatever Otsu says
+	localizeMinGradient = 40
+	// Smallest candidate accepted, in pixels at the working resolution
+	localizeMinWidth  = 24
+	localizeMinHeight = 16
+	// Fraction of the bounding box that must be covered by the component
+	localizeMinFill = 0.45
+	// Upper bound on candidates decoded per page, largest first
+	localizeMaxCandidates = 8
+	// Quiet zone margin added around 1D candidates, as a fraction of their size
+	localizeMargin = 0.1
+	// Quiet zone margin added around QR finder patterns, in modules
+	finderPatternMargin = 8
+)
+
+// scanImage decodes every barcode it can find in an image. Crops are decoded
+// whole. Pages are first searched for candidate barcode regions, which are
+// cropped, upscaled and decoded individually; if none of them yields a read
+// the whole page is decoded as a fallback. Regions are in the image's pixels.
+func scanImage(ctx context.Context, img image.Image) []Barcode {
+	if img == nil {
+		return nil
+	}
+
+	logger := loggerFrom(ctx)
+	if classifyImage(img.Bounds()) == imageKindCrop {
+		barcode, err := decodeBarcodeAs(ctx, img, imageKindCrop)
+		if err != nil {
+			logger.Debug("No barcode in image", "error", err)
+			return nil
+		}
+		return []Barcode{barcode}
+	}
+
+	var found []Barcode
+	seen := make(map[string]bool)
+	candidates := localizeBarcodes(img)
+	logger.Debug("Localized candidate barcode regions", "candidates", len(candidates))
+	for _, rect := range candidates {
+		crop := upscaleSmall(toGray(cropImage(img, rect)))
+		barcode, err := decodeBarcodeAs(ctx, crop, imageKindCrop)
+		if err != nil {
+			logger.Debug("No barcode in candidate region", "region", rect.String(), "error", err)
+			continue
+		}
+		if seen[barcode.Format+"\x00"+barcode.Text] {
+			continue
+		}
+		seen[barcode.Format+"\x00"+barcode.Text] = true
+		barcode.ImageRegion = regionFromRect(rect.Sub(img.Bounds().Min))
+		found = append(found, barcode)
+	}
+	if len(found) > 0 {
+		return found
+	}
+
+	barcode, err := decodeBarcodeAs(ctx, img, imageKindPage)
+	if err != nil {
+		logger.Debug("No barcode on page", "error", err)
+		return nil
+	}
+	return []Barcode{barcode}
+}
+
+// localizeBarcodes returns candidate barcode regions in the image's
+// coordinates: 1D barcodes found from gradient structure and QR codes found
+// from their finder patterns. Overlapping candidates are merged.
+func localizeBarcodes(img image.Image) []image.Rectangle {
+	gray := toGray(img)
+	candidates := append(localize1D(gray), localize2D(gray)...)
+	candidates = mergeOverlapping(candidates)
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return area(candidates[i]) > area(candidates[j])
+	})
+	if len(candidates) > localizeMaxCandidates {
+		candidates = candidates[:localizeMaxCandidates]
+	}
+
+	offset := img.Bounds().Min
+	for i := range candidates {
+		candidates[i] = candidates[i].Add(offset)
+	}
+	return candidates
+}
+
+// localize1D finds areas dominated by parallel edges in one direction, which
+// is what the bars of a 1D barcode look like and text does not: the gradient
+// difference is blurred, thresholded, closed across the gaps between bars
+// and split into connected components.
+func localize1D(gray *image.Gray) []image.Rectangle {
+	w, h := gray.Bounds().Dx(), gray.Bounds().Dy()
+	work, scale := gray, 1.0
+	if longer := maxInt(w, h); longer > localizeWorkDimension {
+		scale = float64(longer) / localizeWorkDimension
+		work = resizeGray(gray, int(float64(w)/scale), int(float64(h)/scale))
+	}
+
+	horizontal, vertical := gradientDifference(work)
+
+	var rects []image.Rectangle
+	// Vertical bars (horizontal barcode): close gaps along x
+	for _, r := range gradientRegions(horizontal, 15, 3) {
+		rects = append(rects, scaleRect(r, scale, gray.Bounds()))
+	}
+	// Horizontal bars (barcode rotated by 90 degrees): close gaps along y
+	for _, r := range gradientRegions(vertical, 3, 15) {
+		rects = append(rects, scaleRect(r, scale, gray.Bounds()))
+	}
+	return rects
+}
+
+// gradientDifference returns, per pixel, how much stronger the horizontal
+// Sobel gradient is than the vertical one, and vice versa.
+func gradientDifference(img *image.Gray) (*image.Gray, *image.Gray) {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	horizontal := image.NewGray(img.Bounds())
+	vertical := image.NewGray(img.Bounds())
+	for y := 1; y < h-1; y++ {
+		for x := 1; x < w-1; x++ {
+			p := func(dx, dy int) int { return int(grayAt(img, x+dx, y+dy)) }
+			gx := (p(1, -1) + 2*p(1, 0) + p(1, 1)) - (p(-1, -1) + 2*p(-1, 0) + p(-1, 1))
+			gy := (p(-1, 1) + 2*p(0, 1) + p(1, 1)) - (p(-1, -1) + 2*p(0, -1) + p(1, -1))
+			gx, gy = absInt(gx), absInt(gy)
+			horizontal.Pix[y*horizontal.Stride+x] = uint8(clampInt((gx-gy)/4, 0, 255))
+			vertical.Pix[y*vertical.Stride+x] = uint8(clampInt((gy-gx)/4, 0, 255))
+		}
+	}
+	return horizontal, vertical
+}
+
+// gradientRegions thresholds a blurred gradient map, closes it with a
+// closeW x closeH rectangle, removes specks and returns component bounds.
+func gradientRegions(gradient *image.Gray, closeW, closeH int) []image.Rectangle {
+	w, h := gradient.Bounds().Dx(), gradient.Bounds().Dy()
+	blurred := boxBlur(gradient, 4)
+
+	threshold := otsuLevel(blurred)
+	if threshold < localizeMinGradient {
+		threshold = localizeMinGradient
+	}
+	mask := make([]bool, w*h)
+	for i, v := range blurred.Pix {
+		mask[i] = int(v) > threshold
+	}
+
+	mask = erodeMask(dilateMask(mask, w, h, closeW, closeH), w, h, closeW, closeH)
+	mask = dilateMask(erodeMask(mask, w, h, 5, 5), w, h, 5, 5)
+
+	var rects []image.Rectangle
+	for _, c := range connectedComponents(mask, w, h) {
+		r := c.bounds
+		if r.Dx() < localizeMinWidth || r.Dy() < localizeMinHeight {
+			continue
+		}
+		if float64(c.pixels)/float64(area(r)) < localizeMinFill {
+			continue
+		}
+		rects = append(rects, r)
+	}
+	return rects
+}
+
+// localize2D finds QR codes by their finder patterns on a hybrid-binarized page.
+func localize2D(gray *image.Gray) []image.Rectangle {
+	bmp, err := gozxing.NewBinaryBitmap(gozxing.NewHybridBinarizer(gozxing.NewLuminanceSourceFromImage(gray)))
+	if err != nil {
+		return nil
+	}
+	matrix, err := bmp.GetBlackMatrix()
+	if err != nil {
+		return nil
+	}
+
+	hints := map[gozxing.DecodeHintType]interface{}{gozxing.DecodeHintType_TRY_HARDER: true}
+	infos, err := multidetector.NewMultiFinderPatternFinder(matrix, nil).FindMulti(hints)
+	if err != nil {
+		return nil
+	}
+
+	var rects []image.Rectangle
+	for _, info := range infos {
+		patterns := []interface {
+			GetX() float64
+			GetY() float64
+			GetEstimatedModuleSize() float64
+		}{info.GetTopLeft(), info.GetTopRight(), info.GetBottomLeft()}
+
+		minX, minY := patterns[0].GetX(), patterns[0].GetY()
+		maxX, maxY := minX, minY
+		var moduleSize float64
+		for _, p := range patterns {
+			minX, maxX = minFloat(minX, p.GetX()), maxFloat(maxX, p.GetX())
+			minY, maxY = minFloat(minY, p.GetY()), maxFloat(maxY, p.GetY())
+			moduleSize += p.GetEstimatedModuleSize() / 3
+		}
+		margin := moduleSize * finderPatternMargin
+		r := image.Rect(int(minX-margin), int(minY-margin), int(maxX+margin)+1, int(maxY+margin)+1)
+		rects = append(rects, r.Intersect(gray.Bounds()))
+	}
+	return rects
+}
+
+func regionFromRect(r image.Rectangle) *ImageRegion {
+	return &ImageRegion{X: r.Min.X, Y: r.Min.Y, Width: r.Dx(), Height: r.Dy()}
+}
+
+// cropImage returns the part of img inside r, sharing pixels where the image type allows it.
+func cropImage(img image.Image, r image.Rectangle) image.Image {
+	if sub, ok := img.(interface {
+		SubImage(image.Rectangle) image.Image
+	}); ok {
+		return sub.SubImage(r)
+	}
+	out := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	for y := 0; y < r.Dy(); y++ {
+		for x := 0; x < r.Dx(); x++ {
+			out.Set(x, y, img.At(r.Min.X+x, r.Min.Y+y))
+		}
+	}
+	return out
+}
+
+// scaleRect maps a rectangle from the working resolution back to the image and adds a quiet zone margin.
+func scaleRect(r image.Rectangle, scale float64, bounds image.Rectangle) image.Rectangle {
+	marginX := int(float64(r.Dx()) * localizeMargin * scale)
+	marginY := int(float64(r.Dy()) * localizeMargin * scale)
+	scaled := image.Rect(
+		int(float64(r.Min.X)*scale)-marginX,
+		int(float64(r.Min.Y)*scale)-marginY,
+		int(float64(r.Max.X)*scale)+marginX,
+		int(float64(r.Max.Y)*scale)+marginY,
+	)
+	return scaled.Intersect(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+}
+
+// mergeOverlapping unions rectangles that overlap until none do.
+func mergeOverlapping(rects []image.Rectangle) []image.Rectangle {
+	merged := append([]image.Rectangle(nil), rects...)
+	for changed := true; changed; {
+		changed = false
+		for i := 0; i < len(merged) && !changed; i++ {
+			for j := i + 1; j < len(merged); j++ {
+				if merged[i].Overlaps(merged[j]) {
+					merged[i] = merged[i].Union(merged[j])
+					merged = append(merged[:j], merged[j+1:]...)
+					changed = true
+					break
+				}
+			}
+		}
+	}
+	return merged
+}
+
+type component struct {
+	bounds image.Rectangle
+	pixels int
+}
+
+// connectedComponents labels 4-connected true pixels of a mask.
+func connectedComponents(mask []bool, w, h int) []component {
+	visited := make([]bool, len(mask))
+	var components []component
+	var stack []int
+	for start := range mask {
+		if !mask[start] || visited[start] {
+			continue
+		}
+		c := component{bounds: image.Rect(start%w, start/w, start%w+1, start/w+1)}
+		visited[start] = true
+		stack = append(stack[:0], start)
+		for len(stack) > 0 {
+			i := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			x, y := i%w, i/w
+			c.pixels++
+			c.bounds = c.bounds.Union(image.Rect(x, y, x+1, y+1))
+			for _, n := range [4][2]int{{x - 1, y}, {x + 1, y}, {x, y - 1}, {x, y + 1}} {
+				if n[0] < 0 || n[0] >= w || n[1] < 0 || n[1] >= h {
+					continue
+				}
+				j := n[1]*w + n[0]
+				if mask[j] && !visited[j] {
+					visited[j] = true
+					stack = append(stack, j)
+				}
+			}
+		}
+		components = append(components, c)
+	}
+	return components
+}
+
+// dilateMask sets every pixel within a kw x kh rectangle of a set pixel.
+func dilateMask(mask []bool, w, h, kw, kh int) []bool {
+	return rectFilterMask(mask, w, h, kw, kh, true)
+}
+
+// erodeMask keeps only pixels whose whole kw x kh neighbourhood is set.
+func erodeMask(mask []bool, w, h, kw, kh int) []bool {
+	return rectFilterMask(mask, w, h, kw, kh, false)
+}
+
+// rectFilterMask applies a separable rectangular max (dilate) or min (erode) filter.
+func rectFilterMask(mask []bool, w, h, kw, kh int, dilate bool) []bool {
+	pass := func(src []bool, length, count, stride, step, radius int) []bool {
+		dst := make([]bool, len(src))
+		for line := 0; line < count; line++ {
+			base := line * stride
+			// Sliding count of set pixels in the window
+			set := 0
+			for i := -radius; i < length+radius; i++ {
+				if i+radius < length && src[base+(i+radius)*step] {
+					set++
+				}
+				if i-radius-1 >= 0 && src[base+(i-radius-1)*step] {
+					set--
+				}
+				if i < 0 || i >= length {
+					continue
+				}
+				window := minInt(i+radius, length-1) - maxInt(i-radius, 0) + 1
+				if dilate {
+					dst[base+i*step] = set > 0
+				} else {
+					dst[base+i*step] = set == window
+				}
+			}
+		}
+		return dst
+	}
+	rows := pass(mask, w, h, w, 1, kw/2)
+	return pass(rows, h, w, 1, w, kh/2)
+}
+
+// boxBlur averages each pixel over a (2r+1) x (2r+1) window.
+func boxBlur(img *image.Gray, radius int) *image.Gray {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	sums, _ := integralImages(img, false)
+	out := image.NewGray(img.Bounds())
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			sum, n := windowSum(sums, w, h, x, y, radius)
+			out.Pix[y*out.Stride+x] = uint8(sum / float64(n))
+		}
+	}
+	return out
+}
+
+func area(r image.Rectangle) int {
+	return r.Dx() * r.Dy()
+}
+
+func absInt(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func minFloat(a, b float64) float64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxFloat(a, b float64) float64 {
+	if a > b {
+		return a
+	}
+	return b
+}
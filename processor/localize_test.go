@@ -0,0 +1,123 @@
+package processor
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+
+	"github.com/makiuchi-d/gozxing"
+	"github.com/makiuchi-d/gozxing/oned"
+	"github.com/makiuchi-d/gozxing/qrcode"
+)
+
+// testPage is a white A4 page at 150dpi with lines of fake text.
+func testPage(t *testing.T) *image.Gray {
+	t.Helper()
+	page := image.NewGray(image.Rect(0, 0, 1240, 1754))
+	for i := range page.Pix {
+		page.Pix[i] = 255
+	}
+
+	// Words of glyph-sized blobs, so the localizer has to reject text
+	rng := rand.New(rand.NewSource(7))
+	for line := 400; line < 1400; line += 30 {
+		for x := 100; x < 1100; {
+			word := 3 + rng.Intn(6)
+			for c := 0; c < word; c++ {
+				glyph := image.Rect(x, line, x+9, line+14)
+				for y := glyph.Min.Y; y < glyph.Max.Y; y++ {
+					for gx := glyph.Min.X; gx < glyph.Max.X; gx++ {
+						if rng.Intn(3) == 0 {
+							page.SetGray(gx, y, color.Gray{Y: 30})
+						}
+					}
+				}
+				x += 12
+			}
+			x += 15
+		}
+	}
+	return page
+}
+
+func drawMatrix(page *image.Gray, matrix *gozxing.BitMatrix, at image.Point) image.Rectangle {
+	for y := 0; y < matrix.GetHeight(); y++ {
+		for x := 0; x < matrix.GetWidth(); x++ {
+			if matrix.Get(x, y) {
+				page.SetGray(at.X+x, at.Y+y, color.Gray{Y: 0})
+			}
+		}
+	}
+	return image.Rect(at.X, at.Y, at.X+matrix.GetWidth(), at.Y+matrix.GetHeight())
+}
+
+func TestScanImageFindsBarcodesInPageCorners(t *testing.T) {
+	ctx := withLogger(context.Background(), discardLogger)
+
+	page := testPage(t)
+
+	linear, err := oned.NewCode128Writer().Encode("DOC-88123", gozxing.BarcodeFormat_CODE_128, 220, 60, nil)
+	if err != nil {
+		t.Fatalf("failed to encode Code128: %v", err)
+	}
+	linearRect := drawMatrix(page, linear, image.Pt(980, 40))
+
+	qr, err := qrcode.NewQRCodeWriter().Encode("https://example.com/forms/42", gozxing.BarcodeFormat_QR_CODE, 150, 150, nil)
+	if err != nil {
+		t.Fatalf("failed to encode QR code: %v", err)
+	}
+	qrRect := drawMatrix(page, qr, image.Pt(40, 1560))
+
+	want := map[string]image.Rectangle{
+		"DOC-88123":                    linearRect,
+		"https://example.com/forms/42": qrRect,
+	}
+
+	barcodes := scanImage(ctx, page)
+	if len(barcodes) != len(want) {
+		t.Fatalf("got %d barcodes %+v, want %d", len(barcodes), barcodes, len(want))
+	}
+	for _, b := range barcodes {
+		truth, ok := want[b.Text]
+		if !ok {
+			t.Errorf("unexpected barcode %q", b.Text)
+			continue
+		}
+		if b.ImageRegion == nil {
+			t.Errorf("barcode %q has no region", b.Text)
+			continue
+		}
+		got := image.Rect(b.ImageRegion.X, b.ImageRegion.Y, b.ImageRegion.X+b.ImageRegion.Width, b.ImageRegion.Y+b.ImageRegion.Height)
+		center := image.Pt((truth.Min.X+truth.Max.X)/2, (truth.Min.Y+truth.Max.Y)/2)
+		if !center.In(got) {
+			t.Errorf("barcode %q region %v does not cover its position %v", b.Text, got, truth)
+		}
+		if area(got) > 4*area(truth) {
+			t.Errorf("barcode %q region %v is much larger than the barcode %v", b.Text, got, truth)
+		}
+	}
+}
+
+func TestLocalizeBarcodesIgnoresText(t *testing.T) {
+	if candidates := localize1D(testPage(t)); len(candidates) != 0 {
+		t.Errorf("got %d candidates on a page with only text, want 0: %v", len(candidates), candidates)
+	}
+}
+
+func TestMergeOverlapping(t *testing.T) {
+	rects := []image.Rectangle{
+		image.Rect(0, 0, 10, 10),
+		image.Rect(5, 5, 20, 20),
+		image.Rect(100, 100, 110, 110),
+		image.Rect(15, 15, 30, 30),
+	}
+	merged := mergeOverlapping(rects)
+	if len(merged) != 2 {
+		t.Fatalf("got %d rectangles, want 2: %v", len(merged), merged)
+	}
+	if merged[0] != image.Rect(0, 0, 30, 30) {
+		t.Errorf("got %v, want %v", merged[0], image.Rect(0, 0, 30, 30))
+	}
+}
@@ -0,0 +1,82 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+)
+
+// loggerKey is the context key of the request's logger.
+type loggerKey struct{}
+
+// logOutput writes to the standard logger's output, so redirecting that
+// with log.SetOutput redirects the structured logs as well.
+type logOutput struct{}
+
+func (logOutput) Write(p []byte) (int, error) {
+	return log.Writer().Write(p)
+}
+
+// logLevel reads the level from LOG_LEVEL: debug, info (the default), warn
+// or error. DEBUG=true and TEST_DEBUG=true, which used to turn on extra
+// output, are read as debug when LOG_LEVEL is not set.
+func logLevel() (slog.Level, error) {
+	value := strings.TrimSpace(os.Getenv("LOG_LEVEL"))
+	if value == "" {
+		if os.Getenv("DEBUG") == "true" || os.Getenv("TEST_DEBUG") == "true" {
+			return slog.LevelDebug, nil
+		}
+		return slog.LevelInfo, nil
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(value)); err != nil {
+		return slog.LevelInfo, fmt.Errorf("invalid LOG_LEVEL %q", value)
+	}
+	return level, nil
+}
+
+// newLogger returns a logger writing JSON lines at the configured level.
+func newLogger() *slog.Logger {
+	level, err := logLevel()
+	logger := slog.New(slog.NewJSONHandler(logOutput{}, &slog.HandlerOptions{Level: level}))
+	if err != nil {
+		logger.Warn("Using info log level", "error", err)
+	}
+	return logger
+}
+
+// requestLogger returns a logger for a Lambda invocation, with its request
+// ID when the context carries one. It builds on the context's logger, so a
+// caller that gives one directs the invocation's logs.
+func requestLogger(ctx context.Context) *slog.Logger {
+	logger := loggerFrom(ctx)
+	if lc, ok := lambdacontext.FromContext(ctx); ok && lc.AwsRequestID != "" {
+		logger = logger.With("request_id", lc.AwsRequestID)
+	}
+	return logger
+}
+
+// withLogger returns a context carrying logger.
+func withLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// withLogAttrs returns a context whose logger adds the given attributes,
+// as key-value pairs, to every line.
+func withLogAttrs(ctx context.Context, args ...interface{}) context.Context {
+	return withLogger(ctx, loggerFrom(ctx).With(args...))
+}
+
+// loggerFrom returns the context's logger, or a new one without request
+// attributes.
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return newLogger()
+}
@@ -0,0 +1,158 @@
+package processor
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+)
+
+// discardLogger is given, with withLogger, to the code under tests that do
+// not look at the logs.
+var discardLogger = slog.New(slog.NewJSONHandler(io.Discard, nil))
+
+func TestLogLevel(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		want    slog.Level
+		wantErr bool
+	}{
+		{"Default", nil, slog.LevelInfo, false},
+		{"Debug", map[string]string{"LOG_LEVEL": "debug"}, slog.LevelDebug, false},
+		{"Upper case", map[string]string{"LOG_LEVEL": "WARN"}, slog.LevelWarn, false},
+		{"Invalid", map[string]string{"LOG_LEVEL": "loud"}, slog.LevelInfo, true},
+		{"Legacy DEBUG", map[string]string{"DEBUG": "true"}, slog.LevelDebug, false},
+		{"Legacy TEST_DEBUG", map[string]string{"TEST_DEBUG": "true"}, slog.LevelDebug, false},
+		{"LOG_LEVEL wins", map[string]string{"LOG_LEVEL": "error", "DEBUG": "true"}, slog.LevelError, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{"LOG_LEVEL", "DEBUG", "TEST_DEBUG"} {
+				os.Unsetenv(name)
+			}
+			for name, value := range tt.env {
+				os.Setenv(name, value)
+				defer os.Unsetenv(name)
+			}
+			got, err := logLevel()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// logLines parses JSON log lines.
+func logLines(t *testing.T, output []byte) []map[string]interface{} {
+	t.Helper()
+	var lines []map[string]interface{}
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var line map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("log line is not JSON: %s", scanner.Text())
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func TestLoggerAttributes(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	ctx := lambdacontext.NewContext(context.Background(), &lambdacontext.LambdaContext{AwsRequestID: "req-1"})
+	ctx = withLogger(ctx, requestLogger(ctx))
+	ctx = withLogAttrs(ctx, "bucket", "b", "key", "k")
+	loggerFrom(withLogAttrs(ctx, "page", 2)).Info("Found barcode")
+	loggerFrom(ctx).Debug("Hidden at info level")
+
+	lines := logLines(t, buf.Bytes())
+	if len(lines) != 1 {
+		t.Fatalf("got %d lines, want 1: %s", len(lines), buf.String())
+	}
+	want := map[string]interface{}{"msg": "Found barcode", "level": "INFO", "request_id": "req-1", "bucket": "b", "key": "k", "page": float64(2)}
+	for name, value := range want {
+		if lines[0][name] != value {
+			t.Errorf("%s: got %v, want %v", name, lines[0][name], value)
+		}
+	}
+}
+
+func TestHandleRequestLogs(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	img := barcodeImage(t, "LOG-1")
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	path := writeTestPDF(t, testPDFPage{
+		content: drawImages(1),
+		images: []testPDFImage{{
+			fmt.Sprintf("/Width %d /Height %d /ColorSpace /DeviceGray /BitsPerComponent 8", w, h),
+			img.Pix,
+		}},
+	})
+	os.Setenv("TEST_PDF_PATH", path)
+	os.Setenv("WEBHOOK_URL", server.URL)
+	os.Setenv("WEBHOOK_TOKEN", "test-token")
+	defer func() {
+		os.Unsetenv("TEST_PDF_PATH")
+		os.Unsetenv("WEBHOOK_URL")
+		os.Unsetenv("WEBHOOK_TOKEN")
+		os.Unsetenv("LOG_LEVEL")
+	}()
+	ctx := lambdacontext.NewContext(context.Background(), &lambdacontext.LambdaContext{AwsRequestID: "req-2"})
+
+	for _, level := range []string{"info", "debug"} {
+		t.Run(level, func(t *testing.T) {
+			var buf bytes.Buffer
+			log.SetOutput(&buf)
+			defer log.SetOutput(os.Stderr)
+			os.Setenv("LOG_LEVEL", level)
+
+			if _, err := HandleRequest(ctx, events.S3Event{}); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var found, readerLines int
+			for _, line := range logLines(t, buf.Bytes()) {
+				if line["request_id"] != "req-2" || line["key"] != path {
+					t.Errorf("line without request attributes: %v", line)
+				}
+				switch line["msg"] {
+				case "Found barcode":
+					found++
+					if line["page"] != float64(1) || line["image"] == nil {
+						t.Errorf("got %v, want page and image attributes", line)
+					}
+				case "Reader failed", "Reader found barcode":
+					readerLines++
+				}
+			}
+			if found != 1 {
+				t.Errorf("got %d found barcode lines, want 1", found)
+			}
+			if (readerLines > 0) != (level == "debug") {
+				t.Errorf("got %d reader lines at %s level", readerLines, level)
+			}
+		})
+	}
+}
@@ -0,0 +1,243 @@
+package processor
+
+import (
+	"bytes"
+	"encoding/xml"
+	"strings"
+
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
+)
+
+const (
+	// maxFieldDepth bounds how deeply the AcroForm field tree is followed
+	maxFieldDepth = 32
+	// maxFormFields bounds how many field values are reported
+	maxFormFields = 10000
+)
+
+// DocumentMetadata is what a PDF says about itself: its page count, Info
+// dictionary, XMP properties and AcroForm field values.
+type DocumentMetadata struct {
+	PageCount int `json:"page_count"`
+	// Info holds the entries of the Info dictionary, such as Title and Producer
+	Info map[string]string `json:"info,omitempty"`
+	// XMP holds the XMP properties keyed by their usual prefix, as in "dc:title"
+	XMP map[string]string `json:"xmp,omitempty"`
+	// Fields holds form field values keyed by their full names, as in "Order.Number"
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+// readPDFMetadata reads the metadata of a PDF. Parts that cannot be read are
+// left out rather than failing the whole read.
+func readPDFMetadata(ctx *model.Context) (*DocumentMetadata, error) {
+	metadata := &DocumentMetadata{PageCount: ctx.PageCount}
+	xRefTable := ctx.XRefTable
+	if ctx.Info != nil {
+		if info, err := xRefTable.DereferenceDict(*ctx.Info); err == nil {
+			metadata.Info = infoValues(xRefTable, info)
+		}
+	}
+
+	catalog, err := xRefTable.Catalog()
+	if err != nil {
+		return metadata, nil
+	}
+	if sd, _, err := xRefTable.DereferenceStreamDict(catalog["Metadata"]); err == nil && sd != nil {
+		if err := sd.Decode(); err == nil {
+			metadata.XMP = parseXMP(sd.Content)
+		}
+	}
+	if form, err := xRefTable.DereferenceDict(catalog["AcroForm"]); err == nil && form != nil {
+		if fields, err := xRefTable.DereferenceArray(form["Fields"]); err == nil {
+			metadata.Fields = map[string]string{}
+			seen := map[int]bool{}
+			for _, field := range fields {
+				collectFormFields(xRefTable, field, "", metadata.Fields, seen, 0)
+			}
+		}
+	}
+	return metadata, nil
+}
+
+// infoValues returns the entries of an Info dictionary as text.
+func infoValues(xRefTable *model.XRefTable, info types.Dict) map[string]string {
+	values := map[string]string{}
+	for key, obj := range info {
+		if value, ok := objectText(xRefTable, obj); ok && value != "" {
+			values[key] = value
+		}
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	return values
+}
+
+// objectText returns a string, name, number or boolean as text, and the
+// elements of an array separated by commas, as for multiple selections.
+// Arrays within the array are left out, so one referring to itself ends.
+func objectText(xRefTable *model.XRefTable, obj types.Object) (string, bool) {
+	obj, err := xRefTable.Dereference(obj)
+	if err != nil || obj == nil {
+		return "", false
+	}
+	switch obj := obj.(type) {
+	case types.StringLiteral, types.HexLiteral:
+		s, err := model.Text(obj)
+		return s, err == nil
+	case types.Name:
+		return obj.Value(), true
+	case types.Integer, types.Float, types.Boolean:
+		return obj.String(), true
+	case types.Array:
+		var values []string
+		for _, item := range obj {
+			item, err := xRefTable.Dereference(item)
+			if _, nested := item.(types.Array); err != nil || nested {
+				continue
+			}
+			if value, ok := objectText(xRefTable, item); ok {
+				values = append(values, value)
+			}
+		}
+		return strings.Join(values, ", "), true
+	}
+	return "", false
+}
+
+// collectFormFields adds the values of a field and of the fields below it,
+// named by joining partial names with dots. Kids without a partial name are
+// the field's widgets. seen holds the objects already visited, so a field
+// listed twice, or among its own kids, is read once.
+func collectFormFields(xRefTable *model.XRefTable, obj types.Object, parent string, fields map[string]string, seen map[int]bool, depth int) {
+	if depth > maxFieldDepth || len(fields) >= maxFormFields {
+		return
+	}
+	if ref, ok := obj.(types.IndirectRef); ok {
+		if seen[ref.ObjectNumber.Value()] {
+			return
+		}
+		seen[ref.ObjectNumber.Value()] = true
+	}
+	d, err := xRefTable.DereferenceDict(obj)
+	if err != nil || d == nil {
+		return
+	}
+	name := parent
+	if partial, err := xRefTable.DereferenceText(d["T"]); err == nil && partial != "" {
+		if name != "" {
+			name += "."
+		}
+		name += partial
+	}
+
+	hasChildFields := false
+	if kids, err := xRefTable.DereferenceArray(d["Kids"]); err == nil {
+		for _, kid := range kids {
+			kidDict, err := xRefTable.DereferenceDict(kid)
+			if err != nil || kidDict == nil || kidDict["T"] == nil {
+				continue
+			}
+			hasChildFields = true
+			collectFormFields(xRefTable, kid, name, fields, seen, depth+1)
+		}
+	}
+	if hasChildFields || name == "" {
+		return
+	}
+	value, _ := objectText(xRefTable, d["V"])
+	fields[name] = value
+}
+
+// xmpPrefixes are the usual prefixes of the XMP namespaces found in PDFs.
+// Properties in other namespaces are keyed by their local name.
+var xmpPrefixes = map[string]string{
+	"http://purl.org/dc/elements/1.1/":    "dc",
+	"http://ns.adobe.com/xap/1.0/":        "xmp",
+	"http://ns.adobe.com/xap/1.0/mm/":     "xmpMM",
+	"http://ns.adobe.com/pdf/1.3/":        "pdf",
+	"http://www.aiim.org/pdfa/ns/id/":     "pdfaid",
+	"http://ns.adobe.com/photoshop/1.0/":  "photoshop",
+	"http://ns.adobe.com/xap/1.0/rights/": "xmpRights",
+}
+
+const rdfNamespace = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+
+func xmpKey(name xml.Name) string {
+	if prefix, ok := xmpPrefixes[name.Space]; ok {
+		return prefix + ":" + name.Local
+	}
+	return name.Local
+}
+
+// parseXMP reads the simple properties of an XMP packet, given either as
+// attributes or as elements of rdf:Description. The items of a property's
+// rdf:Alt, rdf:Bag or rdf:Seq are joined with "; ".
+func parseXMP(data []byte) map[string]string {
+	properties := map[string]string{}
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	depth, descriptionDepth := 0, 0
+	var property string
+	var text strings.Builder
+	var items []string
+	inItem := false
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			break
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			depth++
+			switch {
+			case descriptionDepth == 0 && t.Name.Space == rdfNamespace && t.Name.Local == "Description":
+				descriptionDepth = depth
+				for _, attr := range t.Attr {
+					if attr.Name.Space == rdfNamespace || attr.Name.Space == "xmlns" || attr.Name.Space == "" {
+						continue
+					}
+					if value := strings.TrimSpace(attr.Value); value != "" {
+						properties[xmpKey(attr.Name)] = value
+					}
+				}
+			case descriptionDepth > 0 && depth == descriptionDepth+1:
+				property = xmpKey(t.Name)
+				text.Reset()
+				items = nil
+			case property != "" && t.Name.Space == rdfNamespace && t.Name.Local == "li":
+				inItem = true
+				text.Reset()
+			}
+		case xml.CharData:
+			if property != "" {
+				text.Write(t)
+			}
+		case xml.EndElement:
+			switch {
+			case inItem && t.Name.Space == rdfNamespace && t.Name.Local == "li":
+				inItem = false
+				if item := strings.TrimSpace(text.String()); item != "" {
+					items = append(items, item)
+				}
+				text.Reset()
+			case property != "" && depth == descriptionDepth+1:
+				value := strings.TrimSpace(text.String())
+				if len(items) > 0 {
+					value = strings.Join(items, "; ")
+				}
+				if value != "" {
+					properties[property] = value
+				}
+				property = ""
+			case depth == descriptionDepth:
+				descriptionDepth = 0
+			}
+			depth--
+		}
+	}
+	if len(properties) == 0 {
+		return nil
+	}
+	return properties
+}
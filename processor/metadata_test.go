@@ -0,0 +1,172 @@
+package processor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const testXMP = `<?xpacket begin="" id="W5M0MpCehiHzreSzNTczkc9d"?>
+<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about="" xmlns:pdf="http://ns.adobe.com/pdf/1.3/" pdf:Producer="Scanner 1.0"/>
+  <rdf:Description rdf:about="" xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:xmp="http://ns.adobe.com/xap/1.0/" xmlns:acme="http://example.com/acme/">
+   <dc:title><rdf:Alt><rdf:li xml:lang="x-default">Intake form</rdf:li></rdf:Alt></dc:title>
+   <dc:creator><rdf:Seq><rdf:li>Jo</rdf:li><rdf:li>Sam</rdf:li></rdf:Seq></dc:creator>
+   <xmp:CreateDate>2024-05-01T10:00:00Z</xmp:CreateDate>
+   <acme:Batch>42</acme:Batch>
+  </rdf:Description>
+ </rdf:RDF>
+</x:xmpmeta>
+<?xpacket end="w"?>`
+
+func TestReadPDFMetadata(t *testing.T) {
+	path := writePDFObjects(t, []string{
+		"<< /Type /Catalog /Pages 2 0 R /Metadata 5 0 R /AcroForm << /Fields [6 0 R 7 0 R] >> >>",
+		"<< /Type /Pages /Kids [3 0 R 4 0 R] /Count 2 >>",
+		"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 595 842] >>",
+		"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 595 842] >>",
+		fmt.Sprintf("<< /Type /Metadata /Subtype /XML /Length %d >>\nstream\n%s\nendstream", len(testXMP), testXMP),
+		"<< /T (Order) /Kids [8 0 R 9 0 R 12 0 R] >>",
+		"<< /T (Approved) /FT /Btn /V /Yes /Kids [10 0 R] >>",
+		"<< /T (Number) /FT /Tx /V (ORD-123) /Parent 6 0 R >>",
+		"<< /T (Date) /FT /Tx /Parent 6 0 R >>",
+		"<< /Type /Annot /Subtype /Widget /Parent 7 0 R >>",
+		"<< /Title (Intake form) /Author <FEFF004A006F> /Producer (Scanner 1.0) /Trapped /False >>",
+		"<< /T (Items) /FT /Ch /V [(A) (C)] /Parent 6 0 R >>",
+	}, "/Root 1 0 R /Info 11 0 R")
+
+	metadata, err := readPDFMetadata(readTestContext(t, path))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if metadata.PageCount != 2 {
+		t.Errorf("got page count %d, want 2", metadata.PageCount)
+	}
+
+	tests := []struct {
+		name string
+		got  map[string]string
+		want map[string]string
+	}{
+		{
+			name: "Info",
+			got:  metadata.Info,
+			want: map[string]string{"Title": "Intake form", "Author": "Jo", "Producer": "Scanner 1.0", "Trapped": "False"},
+		},
+		{
+			name: "XMP",
+			got:  metadata.XMP,
+			want: map[string]string{
+				"pdf:Producer":   "Scanner 1.0",
+				"dc:title":       "Intake form",
+				"dc:creator":     "Jo; Sam",
+				"xmp:CreateDate": "2024-05-01T10:00:00Z",
+				"Batch":          "42",
+			},
+		},
+		{
+			name: "Fields",
+			got:  metadata.Fields,
+			want: map[string]string{"Order.Number": "ORD-123", "Order.Date": "", "Order.Items": "A, C", "Approved": "Yes"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if len(tt.got) != len(tt.want) {
+				t.Errorf("got %v, want %v", tt.got, tt.want)
+			}
+			for key, want := range tt.want {
+				if got, ok := tt.got[key]; !ok || got != want {
+					t.Errorf("%s: got %q, want %q", key, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestReadPDFMetadataCyclicFields(t *testing.T) {
+	// A field among its own kids, several times over, and a value that
+	// refers to itself
+	path := writePDFObjects(t, []string{
+		"<< /Type /Catalog /Pages 2 0 R /AcroForm << /Fields [4 0 R 5 0 R 4 0 R] >> >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 595 842] >>",
+		"<< /T (a) /Kids [4 0 R 4 0 R 4 0 R] >>",
+		"<< /T (b) /FT /Ch /V 6 0 R >>",
+		"[(x) 6 0 R (y)]",
+	}, "/Root 1 0 R")
+
+	done := make(chan *DocumentMetadata)
+	go func() {
+		metadata, err := readPDFMetadata(readTestContext(t, path))
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		done <- metadata
+	}()
+	select {
+	case metadata := <-done:
+		want := map[string]string{"b": "x, y"}
+		if fmt.Sprint(metadata.Fields) != fmt.Sprint(want) {
+			t.Errorf("got fields %v, want %v", metadata.Fields, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("reading cyclic form fields did not finish")
+	}
+}
+
+func TestReadPDFMetadataWithout(t *testing.T) {
+	path := writeTestPDF(t, testPDFPage{})
+	metadata, err := readPDFMetadata(readTestContext(t, path))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if metadata.PageCount != 1 || metadata.Info != nil || metadata.XMP != nil || metadata.Fields != nil {
+		t.Errorf("got %+v, want only a page count of 1", metadata)
+	}
+}
+
+func TestHandleRequestMetadata(t *testing.T) {
+	ctx := withLogger(context.Background(), discardLogger)
+
+	var payload BarcodeData
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&payload)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	os.Setenv("TEST_PDF_PATH", writeTestPDF(t, testPDFPage{}, testPDFPage{}, testPDFPage{}))
+	os.Setenv("PROFILES_CONFIG", `{"profiles": [{"name": "forms", "metadata": true}]}`)
+	os.Setenv("WEBHOOK_URL", server.URL)
+	os.Setenv("WEBHOOK_TOKEN", "test-token")
+	defer func() {
+		os.Unsetenv("TEST_PDF_PATH")
+		os.Unsetenv("PROFILES_CONFIG")
+		os.Unsetenv("WEBHOOK_URL")
+		os.Unsetenv("WEBHOOK_TOKEN")
+	}()
+
+	response, err := HandleRequest(ctx, events.S3Event{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var body ResponseBody
+	if err := json.Unmarshal([]byte(response.Body), &body); err != nil {
+		t.Fatalf("invalid response body: %v", err)
+	}
+	if body.Metadata == nil || body.Metadata.PageCount != 3 {
+		t.Errorf("got response metadata %+v, want a page count of 3", body.Metadata)
+	}
+	if payload.Metadata == nil || payload.Metadata.PageCount != 3 {
+		t.Errorf("webhook got metadata %+v, want a page count of 3", payload.Metadata)
+	}
+}
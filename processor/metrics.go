@@ -0,0 +1,373 @@
+package processor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+const defaultMetricsNamespace = "PDFProcessor"
+
+// metricsOutput receives the metric records. CloudWatch picks up Embedded
+// Metric Format records from a Lambda function's stdout.
+var metricsOutput io.Writer = os.Stdout
+
+// Metric units.
+const (
+	unitCount        = "Count"
+	unitMilliseconds = "Milliseconds"
+)
+
+// Stages of processing a document whose durations are recorded.
+const (
+	stageExtract = "Extract"
+	stageDecode  = "Decode"
+	stageWebhook = "Webhook"
+	stageTotal   = "Total"
+)
+
+// metricsKey is the context key of a document's metrics.
+type metricsKey struct{}
+
+// documentMetrics collects the metrics of processing one document, written
+// as Embedded Metric Format records by flush. A nil *documentMetrics records
+// nothing.
+type documentMetrics struct {
+	mu          sync.Mutex
+	bucket      string
+	profile     string
+	counts      map[string]float64
+	durations   map[string]time.Duration
+	symbologies map[string]float64
+	statusCodes map[int]float64
+}
+
+func newDocumentMetrics(bucket string) *documentMetrics {
+	return &documentMetrics{
+		bucket:      bucket,
+		profile:     defaultProfile.Name,
+		counts:      map[string]float64{},
+		durations:   map[string]time.Duration{},
+		symbologies: map[string]float64{},
+		statusCodes: map[int]float64{},
+	}
+}
+
+// withMetrics returns a context carrying a document's metrics.
+func withMetrics(ctx context.Context, m *documentMetrics) context.Context {
+	return context.WithValue(ctx, metricsKey{}, m)
+}
+
+// metricsFrom returns the context's document metrics, or nil.
+func metricsFrom(ctx context.Context) *documentMetrics {
+	m, _ := ctx.Value(metricsKey{}).(*documentMetrics)
+	return m
+}
+
+func (m *documentMetrics) setProfile(name string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.profile = name
+}
+
+// count adds n to a counter.
+func (m *documentMetrics) count(name string, n int) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counts[name] += float64(n)
+}
+
+// timeStage adds the time since start to a stage's duration.
+func (m *documentMetrics) timeStage(stage string, start time.Time) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.durations[stage] += time.Since(start)
+}
+
+// barcodeFound counts a barcode by its symbology.
+func (m *documentMetrics) barcodeFound(format string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counts["BarcodesFound"]++
+	m.symbologies[format]++
+}
+
+// webhookAttempt counts a webhook request and its status code, 0 if no
+// response came back. Attempts after the first for the same payload are
+// retries.
+func (m *documentMetrics) webhookAttempt(statusCode int, retry bool) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counts["WebhookRequests"]++
+	// Retries are reported even when there are none
+	m.counts["WebhookRetries"] += 0
+	if retry {
+		m.counts["WebhookRetries"]++
+	}
+	if statusCode != 200 {
+		m.counts["WebhookFailures"]++
+	}
+	m.statusCodes[statusCode]++
+}
+
+// scannedPages returns how many pages of a document of pageCount pages are
+// scanned, up to the page limit and from the first page.
+func scannedPages(pageCount, pageLimit, firstPage int) int {
+	last := pageCount
+	if pageLimit > 0 && pageLimit < last {
+		last = pageLimit
+	}
+	return max(last-max(firstPage, 1)+1, 0)
+}
+
+// countPages returns how many pages the images came from, for documents
+// whose page count is unknown.
+func countPages(pdfImages []pdfImage) int {
+	pages := map[int]bool{}
+	for _, img := range pdfImages {
+		pages[img.Page] = true
+	}
+	return len(pages)
+}
+
+// emfDirective is the _aws member of an Embedded Metric Format record.
+type emfDirective struct {
+	Timestamp         int64            `json:"Timestamp"`
+	CloudWatchMetrics []emfMetricGroup `json:"CloudWatchMetrics"`
+}
+
+type emfMetricGroup struct {
+	Namespace  string         `json:"Namespace"`
+	Dimensions [][]string     `json:"Dimensions"`
+	Metrics    []emfMetricDef `json:"Metrics"`
+}
+
+type emfMetricDef struct {
+	Name string `json:"Name"`
+	Unit string `json:"Unit"`
+}
+
+// flush writes the metrics as Embedded Metric Format records: one with the
+// document's counters and durations, and one per symbology and per webhook
+// status code, all with the profile and bucket as dimensions.
+func (m *documentMetrics) flush() error {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	processMetrics.addDocument(m)
+
+	namespace := os.Getenv("METRICS_NAMESPACE")
+	if namespace == "" {
+		namespace = defaultMetricsNamespace
+	}
+	timestamp := time.Now().UnixMilli()
+	record := func(dimensions map[string]string, units map[string]string, values map[string]float64) error {
+		names := make([]string, 0, len(dimensions))
+		for name := range dimensions {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		group := emfMetricGroup{Namespace: namespace, Dimensions: [][]string{names}}
+		fields := map[string]interface{}{}
+		for name, value := range dimensions {
+			fields[name] = value
+		}
+		metricNames := make([]string, 0, len(values))
+		for name := range values {
+			metricNames = append(metricNames, name)
+		}
+		sort.Strings(metricNames)
+		for _, name := range metricNames {
+			group.Metrics = append(group.Metrics, emfMetricDef{Name: name, Unit: units[name]})
+			fields[name] = values[name]
+		}
+		fields["_aws"] = emfDirective{Timestamp: timestamp, CloudWatchMetrics: []emfMetricGroup{group}}
+		data, err := json.Marshal(fields)
+		if err != nil {
+			return err
+		}
+		_, err = metricsOutput.Write(append(data, '\n'))
+		return err
+	}
+
+	dimensions := func(extra ...string) map[string]string {
+		d := map[string]string{"Profile": m.profile, "Bucket": m.bucket}
+		for i := 0; i+1 < len(extra); i += 2 {
+			d[extra[i]] = extra[i+1]
+		}
+		return d
+	}
+
+	units := map[string]string{}
+	values := map[string]float64{}
+	for name, value := range m.counts {
+		units[name] = unitCount
+		values[name] = value
+	}
+	for stage, duration := range m.durations {
+		name := stage + "Duration"
+		units[name] = unitMilliseconds
+		values[name] = float64(duration.Microseconds()) / 1000
+	}
+	if err := record(dimensions(), units, values); err != nil {
+		return err
+	}
+
+	symbologies := make([]string, 0, len(m.symbologies))
+	for symbology := range m.symbologies {
+		symbologies = append(symbologies, symbology)
+	}
+	sort.Strings(symbologies)
+	for _, symbology := range symbologies {
+		if err := record(dimensions("Symbology", symbology),
+			map[string]string{"BarcodesFound": unitCount}, map[string]float64{"BarcodesFound": m.symbologies[symbology]}); err != nil {
+			return err
+		}
+	}
+	statusCodes := make([]int, 0, len(m.statusCodes))
+	for statusCode := range m.statusCodes {
+		statusCodes = append(statusCodes, statusCode)
+	}
+	sort.Ints(statusCodes)
+	for _, statusCode := range statusCodes {
+		if err := record(dimensions("StatusCode", strconv.Itoa(statusCode)),
+			map[string]string{"WebhookResponses": unitCount}, map[string]float64{"WebhookResponses": m.statusCodes[statusCode]}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// metricsPrefix starts the names of the metrics the server exposes.
+const metricsPrefix = "pdf_processor_"
+
+// processMetrics adds up the metrics of every document the process handled,
+// for the server's /metrics endpoint.
+var processMetrics = newMetricsRegistry()
+
+// metricsRegistry keeps metric families in the Prometheus text format:
+// counters, gauges and summaries with a sum and count, each sample under its
+// labels.
+type metricsRegistry struct {
+	mu      sync.Mutex
+	kinds   map[string]string
+	samples map[string]map[string]float64
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{kinds: map[string]string{}, samples: map[string]map[string]float64{}}
+}
+
+// add adds v to the sample of a family with the given suffix and labels, as
+// key-value pairs.
+func (r *metricsRegistry) add(kind, family, suffix string, v float64, labels ...string) {
+	var sample strings.Builder
+	sample.WriteString(family + suffix)
+	if len(labels) > 0 {
+		sample.WriteString("{")
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				sample.WriteString(",")
+			}
+			fmt.Fprintf(&sample, "%s=%q", labels[i], labels[i+1])
+		}
+		sample.WriteString("}")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.kinds[family] = kind
+	if r.samples[family] == nil {
+		r.samples[family] = map[string]float64{}
+	}
+	r.samples[family][sample.String()] += v
+}
+
+// addDocument adds the metrics of a document, labelled with its profile and
+// bucket.
+func (r *metricsRegistry) addDocument(m *documentMetrics) {
+	labels := []string{"profile", m.profile, "bucket", m.bucket}
+	for name, value := range m.counts {
+		r.add("counter", metricsPrefix+snakeCase(name)+"_total", "", value, labels...)
+	}
+	for stage, duration := range m.durations {
+		stageLabels := append([]string{"stage", strings.ToLower(stage)}, labels...)
+		r.add("summary", metricsPrefix+"stage_duration_seconds", "_sum", duration.Seconds(), stageLabels...)
+		r.add("summary", metricsPrefix+"stage_duration_seconds", "_count", 1, stageLabels...)
+	}
+	for symbology, value := range m.symbologies {
+		r.add("counter", metricsPrefix+"symbology_barcodes_total", "", value, append([]string{"symbology", symbology}, labels...)...)
+	}
+	for statusCode, value := range m.statusCodes {
+		r.add("counter", metricsPrefix+"webhook_responses_total", "", value, append([]string{"status_code", strconv.Itoa(statusCode)}, labels...)...)
+	}
+}
+
+// writeTo writes the metrics in the Prometheus text format, in order.
+func (r *metricsRegistry) writeTo(w io.Writer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	families := make([]string, 0, len(r.kinds))
+	for family := range r.kinds {
+		families = append(families, family)
+	}
+	sort.Strings(families)
+	for _, family := range families {
+		if _, err := fmt.Fprintf(w, "# TYPE %s %s\n", family, r.kinds[family]); err != nil {
+			return err
+		}
+		samples := make([]string, 0, len(r.samples[family]))
+		for sample := range r.samples[family] {
+			samples = append(samples, sample)
+		}
+		sort.Strings(samples)
+		for _, sample := range samples {
+			value := strconv.FormatFloat(r.samples[family][sample], 'g', -1, 64)
+			if _, err := fmt.Fprintf(w, "%s %s\n", sample, value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// snakeCase turns a CloudWatch metric name such as "DocumentsProcessed" into
+// "documents_processed".
+func snakeCase(name string) string {
+	var b strings.Builder
+	for i, r := range name {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
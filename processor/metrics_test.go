@@ -0,0 +1,314 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// metricRecords parses the EMF records written to buf.
+func metricRecords(t *testing.T, data []byte) []map[string]interface{} {
+	t.Helper()
+	var records []map[string]interface{}
+	for _, line := range bytes.Split(bytes.TrimSpace(data), []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		var record map[string]interface{}
+		if err := json.Unmarshal(line, &record); err != nil {
+			t.Fatalf("invalid metric record %q: %v", line, err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+// recordMetrics returns the names and units declared in a record's _aws
+// directive, and its dimensions.
+func recordMetrics(t *testing.T, record map[string]interface{}) (map[string]string, []interface{}) {
+	t.Helper()
+	var directive emfDirective
+	data, _ := json.Marshal(record["_aws"])
+	if err := json.Unmarshal(data, &directive); err != nil || len(directive.CloudWatchMetrics) != 1 {
+		t.Fatalf("invalid _aws directive in %v", record)
+	}
+	group := directive.CloudWatchMetrics[0]
+	units := map[string]string{}
+	for _, metric := range group.Metrics {
+		units[metric.Name] = metric.Unit
+		if _, ok := record[metric.Name]; !ok {
+			t.Errorf("metric %s has no value", metric.Name)
+		}
+	}
+	var dimensions []interface{}
+	for _, name := range group.Dimensions[0] {
+		dimensions = append(dimensions, record[name])
+	}
+	return units, dimensions
+}
+
+func TestDocumentMetricsFlush(t *testing.T) {
+	var buf bytes.Buffer
+	metricsOutput = &buf
+	defer func() { metricsOutput = os.Stdout }()
+	os.Setenv("METRICS_NAMESPACE", "Test")
+	defer os.Unsetenv("METRICS_NAMESPACE")
+
+	m := newDocumentMetrics("bucket")
+	m.setProfile("invoices")
+	m.count("Images", 2)
+	m.barcodeFound("CODE_128")
+	m.barcodeFound("QR_CODE")
+	m.barcodeFound("CODE_128")
+	m.webhookAttempt(500, false)
+	m.webhookAttempt(200, true)
+	m.timeStage(stageDecode, time.Now().Add(-time.Second))
+	if err := m.flush(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	records := metricRecords(t, buf.Bytes())
+	if len(records) != 5 {
+		t.Fatalf("got %d records, want 5", len(records))
+	}
+	want := []struct {
+		dimensions []interface{}
+		values     map[string]float64
+	}{
+		{[]interface{}{"bucket", "invoices"}, map[string]float64{"Images": 2, "BarcodesFound": 3, "WebhookRequests": 2, "WebhookRetries": 1, "WebhookFailures": 1}},
+		{[]interface{}{"bucket", "invoices", "CODE_128"}, map[string]float64{"BarcodesFound": 2}},
+		{[]interface{}{"bucket", "invoices", "QR_CODE"}, map[string]float64{"BarcodesFound": 1}},
+		{[]interface{}{"bucket", "invoices", "200"}, map[string]float64{"WebhookResponses": 1}},
+		{[]interface{}{"bucket", "invoices", "500"}, map[string]float64{"WebhookResponses": 1}},
+	}
+	for i, record := range records {
+		units, dimensions := recordMetrics(t, record)
+		if fmt.Sprint(dimensions) != fmt.Sprint(want[i].dimensions) {
+			t.Errorf("record %d: got dimensions %v, want %v", i, dimensions, want[i].dimensions)
+		}
+		for name, value := range want[i].values {
+			if record[name] != value || units[name] != unitCount {
+				t.Errorf("record %d: got %s=%v (%s), want %v Count", i, name, record[name], units[name], value)
+			}
+		}
+		namespace := record["_aws"].(map[string]interface{})["CloudWatchMetrics"].([]interface{})[0].(map[string]interface{})["Namespace"]
+		if namespace != "Test" {
+			t.Errorf("record %d: got namespace %v, want Test", i, namespace)
+		}
+	}
+	if records[0]["DecodeDuration"].(float64) < 1000 {
+		t.Errorf("got decode duration %v, want at least 1000ms", records[0]["DecodeDuration"])
+	}
+	if units, _ := recordMetrics(t, records[0]); units["DecodeDuration"] != unitMilliseconds {
+		t.Errorf("got decode duration unit %q, want %s", units["DecodeDuration"], unitMilliseconds)
+	}
+}
+
+func TestNilDocumentMetrics(t *testing.T) {
+	m := metricsFrom(context.Background())
+	m.count("Images", 1)
+	m.barcodeFound("CODE_128")
+	m.webhookAttempt(200, false)
+	if err := m.flush(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestMetricsRegistry(t *testing.T) {
+	m := newDocumentMetrics("scans")
+	m.setProfile("invoices")
+	m.count("DocumentsProcessed", 1)
+	m.barcodeFound("QR_CODE")
+	m.webhookAttempt(200, false)
+	m.durations[stageTotal] = 1500 * time.Millisecond
+
+	r := newMetricsRegistry()
+	r.addDocument(m)
+	r.addDocument(m)
+	r.add("gauge", metricsPrefix+"http_requests_in_flight", "", 1)
+	var buf bytes.Buffer
+	if err := r.writeTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		"# TYPE pdf_processor_documents_processed_total counter\n" +
+			`pdf_processor_documents_processed_total{profile="invoices",bucket="scans"} 2` + "\n",
+		`pdf_processor_barcodes_found_total{profile="invoices",bucket="scans"} 2`,
+		`pdf_processor_symbology_barcodes_total{symbology="QR_CODE",profile="invoices",bucket="scans"} 2`,
+		`pdf_processor_webhook_responses_total{status_code="200",profile="invoices",bucket="scans"} 2`,
+		"# TYPE pdf_processor_stage_duration_seconds summary\n",
+		`pdf_processor_stage_duration_seconds_count{stage="total",profile="invoices",bucket="scans"} 2`,
+		`pdf_processor_stage_duration_seconds_sum{stage="total",profile="invoices",bucket="scans"} 3`,
+		"# TYPE pdf_processor_http_requests_in_flight gauge\npdf_processor_http_requests_in_flight 1\n",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("metrics do not contain %q:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestScannedPages(t *testing.T) {
+	tests := []struct {
+		name                            string
+		pageCount, pageLimit, firstPage int
+		want                            int
+	}{
+		{"Within the limit", 2, 5, 0, 2},
+		{"Up to the limit", 10, 3, 0, 3},
+		{"Without a limit", 10, 0, 0, 10},
+		{"From a first page", 10, 5, 3, 3},
+		{"First page past the end", 2, 5, 4, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := scannedPages(tt.pageCount, tt.pageLimit, tt.firstPage); got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleRequestMetrics(t *testing.T) {
+	ctx := withLogger(context.Background(), discardLogger)
+	var buf bytes.Buffer
+	metricsOutput = &buf
+	defer func() { metricsOutput = os.Stdout }()
+
+	status := http.StatusOK
+	// failNext requests fail with 503 before the webhook answers with status
+	failNext := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failNext > 0 {
+			failNext--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	img := barcodeImage(t, "METRICS-1")
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	dict := fmt.Sprintf("/Width %d /Height %d /ColorSpace /DeviceGray /BitsPerComponent 8", w, h)
+	path := writeTestPDF(t,
+		testPDFPage{content: drawImages(1), images: []testPDFImage{{dict, img.Pix}}},
+		testPDFPage{content: drawImages(1), images: []testPDFImage{{dict, bytes.Repeat([]byte{0xff}, w*h)}}},
+		testPDFPage{content: drawImages(1), images: []testPDFImage{{dict + " /Filter /JBIG2Decode", []byte{0, 1, 2, 3}}}},
+		// A page without images is scanned all the same
+		testPDFPage{},
+	)
+	os.Setenv("TEST_PDF_PATH", path)
+	os.Setenv("WEBHOOK_URL", server.URL)
+	os.Setenv("WEBHOOK_TOKEN", "test-token")
+	os.Setenv("PDF_PAGE_LIMIT", "4")
+	// Retries are off by default, and counted when they are on
+	os.Setenv("WEBHOOK_RETRIES", "2")
+	defer func() {
+		os.Unsetenv("TEST_PDF_PATH")
+		os.Unsetenv("WEBHOOK_URL")
+		os.Unsetenv("WEBHOOK_TOKEN")
+		os.Unsetenv("PDF_PAGE_LIMIT")
+		os.Unsetenv("WEBHOOK_RETRIES")
+	}()
+
+	tests := []struct {
+		name            string
+		status          int
+		failNext        int
+		wantErr         bool
+		want            map[string]float64
+		wantStatusCodes map[string]float64
+	}{
+		{
+			name:            "Webhook accepts",
+			status:          http.StatusOK,
+			wantStatusCodes: map[string]float64{"200": 2},
+			want: map[string]float64{
+				"DocumentsProcessed":    1,
+				"Pages":                 4,
+				"Images":                3,
+				"BarcodesFound":         1,
+				"UndecodableImages":     1,
+				"ImagesWithoutBarcodes": 1,
+				"WebhookRequests":       2,
+				"WebhookFailures":       0,
+				"WebhookRetries":        0,
+			},
+		},
+		{
+			name:            "Webhook recovers",
+			status:          http.StatusOK,
+			failNext:        1,
+			wantStatusCodes: map[string]float64{"200": 2, "503": 1},
+			want: map[string]float64{
+				"WebhookRequests": 3,
+				"WebhookFailures": 1,
+				"WebhookRetries":  1,
+			},
+		},
+		{
+			// Both barcode payloads are sent and retried twice
+			name:            "Webhook fails",
+			status:          http.StatusBadGateway,
+			wantErr:         true,
+			wantStatusCodes: map[string]float64{"502": 6},
+			want: map[string]float64{
+				"DocumentsProcessed": 1,
+				"WebhookRequests":    6,
+				"WebhookFailures":    6,
+				"WebhookRetries":     4,
+				"DeliveryErrors":     1,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf.Reset()
+			status = tt.status
+			failNext = tt.failNext
+			if _, err := HandleRequest(ctx, events.S3Event{}); (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error: %v", err, tt.wantErr)
+			}
+
+			records := metricRecords(t, buf.Bytes())
+			if len(records) != 2+len(tt.wantStatusCodes) {
+				t.Fatalf("got %d records, want document, symbology and status codes", len(records))
+			}
+			document := records[0]
+			_, dimensions := recordMetrics(t, document)
+			if fmt.Sprint(dimensions) != "[test-bucket default]" {
+				t.Errorf("got dimensions %v, want bucket and profile", dimensions)
+			}
+			for name, value := range tt.want {
+				if document[name] != value && !(value == 0 && document[name] == nil) {
+					t.Errorf("got %s=%v, want %v", name, document[name], value)
+				}
+			}
+			for _, stage := range []string{stageExtract, stageDecode, stageWebhook, stageTotal} {
+				if _, ok := document[stage+"Duration"].(float64); !ok {
+					t.Errorf("no %s duration", stage)
+				}
+			}
+			if records[1]["Symbology"] != "CODE_128" || records[1]["BarcodesFound"] != float64(1) {
+				t.Errorf("got symbology record %v, want one CODE_128", records[1])
+			}
+			for _, record := range records[2:] {
+				statusCode, _ := record["StatusCode"].(string)
+				if record["WebhookResponses"] != tt.wantStatusCodes[statusCode] {
+					t.Errorf("got status code record %v, want %v", record, tt.wantStatusCodes)
+				}
+			}
+		})
+	}
+}
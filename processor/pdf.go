@@ -5,28 +5,26 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"image"
-	"image/color"
+	"image/png"
 	"io"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
-	"sort"
 	"time"
 
-	
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/makiuchi-d/gozxing"
-	"github.com/makiuchi-d/gozxing/oned"
-	"github.com/pdfcpu/pdfcpu/pkg/api"
 	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 )
 
 type Response struct {
@@ -35,29 +33,87 @@ type Response struct {
 }
 
 type ResponseBody struct {
-	Bucket   string   `json:"bucket"`
-	Key      string   `json:"key"`
-	Barcodes []string `json:"barcodes"`
+	Bucket      string            `json:"bucket"`
+	Key         string            `json:"key"`
+	Barcodes    []string          `json:"barcodes"`
+	Results     []Barcode         `json:"results,omitempty"`
+	Undecodable []ImageError      `json:"undecodable,omitempty"`
+	Outcome     string            `json:"outcome,omitempty"`
+	Recovery    string            `json:"recovery,omitempty"`
+	TextMatches []TextMatch       `json:"text_matches,omitempty"`
+	Metadata    *DocumentMetadata `json:"metadata,omitempty"`
+	Annotated   string            `json:"annotated,omitempty"`
+	Artifacts   []Artifact        `json:"artifacts,omitempty"`
+	DebugBundle string            `json:"debug_bundle,omitempty"`
+	// Documents holds the outcome for each document unpacked from an archive
+	Documents []DocumentResponse `json:"documents,omitempty"`
+}
+
+// DocumentResponse is the outcome for one document unpacked from an archive.
+type DocumentResponse struct {
+	Key        string        `json:"key"`
+	StatusCode int           `json:"status_code"`
+	Result     *ResponseBody `json:"result,omitempty"`
+	Error      string        `json:"error,omitempty"`
 }
 
 type BarcodeData struct {
-	S3Key        string   `json:"s3_key"`
-	BarcodeArray []string `json:"barcode_array"`
+	S3Key        string            `json:"s3_key"`
+	BarcodeArray []string          `json:"barcode_array"`
+	Results      []Barcode         `json:"results,omitempty"`
+	Undecodable  []ImageError      `json:"undecodable,omitempty"`
+	Outcome      string            `json:"outcome,omitempty"`
+	Recovery     string            `json:"recovery,omitempty"`
+	TextMatches  []TextMatch       `json:"text_matches,omitempty"`
+	Metadata     *DocumentMetadata `json:"metadata,omitempty"`
+	Annotated    string            `json:"annotated,omitempty"`
+	Artifacts    []Artifact        `json:"artifacts,omitempty"`
+	DebugBundle  string            `json:"debug_bundle,omitempty"`
 }
 
-func getFileSize(path string) int64 {
-	info, err := os.Stat(path)
-	if err != nil {
-		return 0
-	}
-	return info.Size()
+// Barcode is a decoded barcode together with where it was found.
+type Barcode struct {
+	Text   string `json:"text"`
+	Format string `json:"format"`
+	Page   int    `json:"page,omitempty"`
+	Image  string `json:"image,omitempty"`
+	// Region is where the barcode is on its page, known for PDF pages
+	Region *PageRegion `json:"region,omitempty"`
+	// ImageRegion is where the barcode is in the image it was read from
+	ImageRegion *ImageRegion `json:"image_region,omitempty"`
+}
+
+// PageRegion is a rectangle on a PDF page in points, in the page's user
+// space: the origin is at the bottom-left and y grows upwards.
+type PageRegion struct {
+	X      float64 `json:"x"`
+	Y      float64 `json:"y"`
+	Width  float64 `json:"width"`
+	Height float64 `json:"height"`
+}
+
+// ImageRegion is a rectangle in the pixels of an image, counted from its
+// top-left corner.
+type ImageRegion struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// ImageError reports an image that was found in the PDF but could not be decoded.
+type ImageError struct {
+	Image    string `json:"image"`
+	Page     int    `json:"page,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Error    string `json:"error"`
 }
 
 func getS3Client() (*s3.Client, error) {
 	if os.Getenv("TEST_PDF_PATH") != "" {
 		return nil, nil
 	}
-	
+
 	cfg, err := config.LoadDefaultConfig(context.TODO(),
 		config.WithRetryMaxAttempts(3),
 		config.WithRetryMode(aws.RetryModeStandard),
@@ -68,116 +124,51 @@ func getS3Client() (*s3.Client, error) {
 	return s3.NewFromConfig(cfg), nil
 }
 
-func preprocessImage(img image.Image) image.Image {
-	// Convert to grayscale and apply contrast enhancement
-	bounds := img.Bounds()
-	gray := image.NewGray(bounds)
-
-	// First pass: calculate min and max values
-	var min, max uint8 = 255, 0
-	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			r, g, b, _ := img.At(x, y).RGBA()
-			// Convert to grayscale using luminance formula
-			grayVal := uint8((0.299*float64(r>>8) + 0.587*float64(g>>8) + 0.114*float64(b>>8)))
-			if grayVal < min {
-				min = grayVal
-			}
-			if grayVal > max {
-				max = grayVal
-			}
-			gray.Set(x, y, color.Gray{Y: grayVal})
-		}
-	}
-
-	log.Printf("Image preprocessing - Min value: %d, Max value: %d, Contrast: %d", min, max, max-min)
-
-	// Always apply contrast enhancement for small images that might contain barcodes
-	if bounds.Dx() < 100 || bounds.Dy() < 100 {
-		log.Printf("Small image detected (%dx%d), applying aggressive contrast enhancement", bounds.Dx(), bounds.Dy())
-		min = 0 // Force full range contrast
-		max = 255
-		log.Printf("Forcing full contrast range: min=%d, max=%d", min, max)
-	} else if max-min < 30 {
-		log.Printf("Not enough contrast, using original grayscale")
-		return gray
-	}
-
-	// Second pass: apply contrast stretching
-	enhanced := image.NewGray(bounds)
-	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			original := gray.GrayAt(x, y).Y
-			// Apply contrast stretching
-			normalized := uint8((float64(original-min) / float64(max-min)) * 255)
-			// Apply thresholding for better barcode detection
-			if normalized > 128 {
-				normalized = 255
-			} else {
-				normalized = 0
-			}
-			enhanced.Set(x, y, color.Gray{Y: normalized})
-		}
-	}
-
-	return enhanced
+func getWebhookURL() string {
+	return os.Getenv("WEBHOOK_URL")
 }
 
-func extractBarcodeFromImage(img image.Image) (string, error) {
-	// Log image dimensions for debugging
-	bounds := img.Bounds()
-	log.Printf("Processing image with dimensions: %dx%d", bounds.Dx(), bounds.Dy())
+// defaultWebhookRetries is 0 as the webhook may have received a request
+// that failed, and Lambda and SQS already deliver a failed event again.
+const defaultWebhookRetries = 0
 
-	// Preprocess image
-	processedImg := preprocessImage(img)
+// webhookRetryDelay is the wait before the first retry of a webhook request,
+// doubled for each one after.
+var webhookRetryDelay = 500 * time.Millisecond
 
-	// Create binary bitmap
-	bmp, err := gozxing.NewBinaryBitmapFromImage(processedImg)
-	if err != nil {
-		return "", fmt.Errorf("error creating binary bitmap: %v", err)
+// getWebhookRetries reads how many times a failed webhook request is retried
+// from WEBHOOK_RETRIES, none by default. Retries resend a payload the webhook
+// may already have processed, so it must tolerate repeats when they are on.
+func getWebhookRetries(ctx context.Context) int {
+	value := os.Getenv("WEBHOOK_RETRIES")
+	if value == "" {
+		return defaultWebhookRetries
 	}
-
-	// Create hints map
-	hints := map[gozxing.DecodeHintType]interface{}{
-		gozxing.DecodeHintType_TRY_HARDER: true,
-		gozxing.DecodeHintType_PURE_BARCODE: true,
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		loggerFrom(ctx).Warn("Invalid WEBHOOK_RETRIES, using the default", "value", value)
+		return defaultWebhookRetries
 	}
+	return n
+}
 
-	// Try different barcode formats
-	readers := []struct {
-		name   string
-		reader gozxing.Reader
-	}{
-		{"UPC/EAN", oned.NewMultiFormatUPCEANReader(hints)},
-		{"Code128", oned.NewCode128Reader()},
-		{"Code39", oned.NewCode39Reader()},
-		{"Code93", oned.NewCode93Reader()},
-		{"ITF", oned.NewITFReader()},
-		{"CodaBar", oned.NewCodaBarReader()},
-	}
+// defaultPageLimit scans only the first page.
+const defaultPageLimit = 1
 
-	var lastErr error
-	for _, r := range readers {
-		// Try normal orientation
-		result, err := r.reader.Decode(bmp, hints)
-		if err == nil {
-			format := result.GetBarcodeFormat().String()
-			log.Printf("Found %s barcode using %s reader: %s", format, r.name, result.GetText())
-			return result.GetText(), nil
-		}
-		lastErr = err
-		log.Printf("Attempt with %s reader failed: %v", r.name, err)
+// getPageLimit reads how many pages of a document are scanned from
+// PDF_PAGE_LIMIT, the first page by default. Every frame of a TIFF input is a
+// page, so the limit applies to frames too.
+func getPageLimit(ctx context.Context) int {
+	value := os.Getenv("PDF_PAGE_LIMIT")
+	if value == "" {
+		return defaultPageLimit
 	}
-
-	return "", fmt.Errorf("no barcode found with any reader, last error: %v", lastErr)
-}
-
-func getWebhookURL() string {
-	url := os.Getenv("WEBHOOK_URL")
-	if url == "" {
-		log.Printf("Warning: WEBHOOK_URL not set")
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		loggerFrom(ctx).Warn("Invalid PDF_PAGE_LIMIT, using the default", "value", value)
+		return defaultPageLimit
 	}
-	return url
+	return n
 }
 
 func getWebhookToken() (string, error) {
@@ -188,7 +179,7 @@ func getWebhookToken() (string, error) {
 	return token, nil
 }
 
-func makeWebhookRequest(method, url string, payload io.Reader) (*http.Response, error) {
+func makeWebhookRequest(ctx context.Context, method, url string, payload io.Reader) (*http.Response, error) {
 	// Create custom client with TLS skip verification if needed
 	client := &http.Client{
 		Transport: &http.Transport{
@@ -206,7 +197,7 @@ func makeWebhookRequest(method, url string, payload io.Reader) (*http.Response,
 	}
 
 	// Create request
-	req, err := http.NewRequest(method, url, payload)
+	req, err := http.NewRequestWithContext(ctx, method, url, payload)
 	if err != nil {
 		return nil, fmt.Errorf("error creating request: %v", err)
 	}
@@ -221,22 +212,31 @@ func makeWebhookRequest(method, url string, payload io.Reader) (*http.Response,
 	req.Header.Set("Accept", "*/*")
 	req.Header.Set("User-Agent", "Go-http-client/2.0")
 
-	// Debug logging if enabled
-	if os.Getenv("DEBUG") == "true" {
-		log.Printf("Making request to: %s\n", url)
-		log.Printf("Headers: %v\n", req.Header)
-	}
+	// The Authorization header holds the token, so only the URL is logged
+	loggerFrom(ctx).Debug("Making webhook request", "method", method, "url", url)
 
-	// Make the request
+	// Make the request, in a span whose context the webhook receives
+	ctx, span := startSpan(ctx, spanWebhook, attribute.String("url", url))
+	injectTraceContext(ctx, req.Header)
 	res, err := client.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("error making request: %v\nTry setting SKIP_TLS_VERIFY=true if having TLS issues", err)
+		endSpan(span, err)
+		return nil, fmt.Errorf("error making request: %w\nTry setting SKIP_TLS_VERIFY=true if having TLS issues", err)
 	}
 
+	span.SetAttributes(attribute.Int("status_code", res.StatusCode))
+	if res.StatusCode >= 400 {
+		span.SetStatus(codes.Error, res.Status)
+	}
+	span.End()
 	return res, nil
 }
 
-func callRubyEndpoint(data BarcodeData) error {
+func callWebhook(ctx context.Context, data BarcodeData) error {
+	if !scanOptionsFrom(ctx).sinkEnabled(sinkWebhook) {
+		loggerFrom(ctx).Debug("Not sending barcode data, the webhook is not a sink of the request")
+		return nil
+	}
 	url := getWebhookURL()
 	if url == "" {
 		return fmt.Errorf("WEBHOOK_URL environment variable not set")
@@ -247,74 +247,128 @@ func callRubyEndpoint(data BarcodeData) error {
 		return fmt.Errorf("error marshaling JSON: %v", err)
 	}
 
-	res, err := makeWebhookRequest("POST", url, bytes.NewReader(jsonData))
+	metrics := metricsFrom(ctx)
+	defer metrics.timeStage(stageWebhook, time.Now())
+	retries := getWebhookRetries(ctx)
+	for attempt := 0; ; attempt++ {
+		retry, err := postWebhook(ctx, url, jsonData, attempt > 0)
+		if err == nil {
+			loggerFrom(ctx).Info("Sent barcode data to webhook", "barcodes", data.BarcodeArray, "attempts", attempt+1)
+			return nil
+		}
+		if !retry || attempt >= retries {
+			return err
+		}
+		delay := webhookRetryDelay << attempt
+		loggerFrom(ctx).Warn("Webhook request failed, retrying", "attempt", attempt+1, "delay", delay, "error", err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// postWebhook sends barcode data to the webhook once, and reports whether a
+// failure is worth retrying: no connection, throttling or a server error.
+func postWebhook(ctx context.Context, url string, jsonData []byte, retry bool) (bool, error) {
+	metrics := metricsFrom(ctx)
+	res, err := makeWebhookRequest(ctx, "POST", url, bytes.NewReader(jsonData))
 	if err != nil {
-		return fmt.Errorf("error making webhook request: %v", err)
+		metrics.webhookAttempt(0, retry)
+		// Only a request that never reached the webhook is surely safe to
+		// send again
+		var opErr *net.OpError
+		notSent := errors.As(err, &opErr) && opErr.Op == "dial"
+		return notSent, fmt.Errorf("error making webhook request: %v", err)
 	}
 	defer res.Body.Close()
+	metrics.webhookAttempt(res.StatusCode, retry)
 
+	// The webhook answered, so it has the payload whatever its body says
 	body, err := io.ReadAll(res.Body)
 	if err != nil {
-		return fmt.Errorf("error reading response body: %v", err)
+		return false, fmt.Errorf("error reading response body: %v", err)
 	}
 
 	if res.StatusCode != http.StatusOK {
-		return fmt.Errorf("webhook returned non-200 status: %d, body: %s", res.StatusCode, string(body))
+		retryable := res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500
+		return retryable, fmt.Errorf("webhook returned non-200 status: %d, body: %s", res.StatusCode, string(body))
 	}
-
-	log.Printf("Successfully sent barcode data to webhook: %v", data.BarcodeArray)
-	return nil
+	return false, nil
 }
 
+// HandleRequest processes the object of an S3 event, or the local test file.
 func HandleRequest(ctx context.Context, s3Event events.S3Event) (Response, error) {
-	// Create debug directory if in test mode
-	if os.Getenv("TEST_DEBUG") == "true" {
-		os.MkdirAll("debug-images", 0755)
-	}
-	// Get page limit from environment variable, default to processing first page only if not set
-	pageLimit := 1 // Default to scanning only first page
-	if limitStr := os.Getenv("PDF_PAGE_LIMIT"); limitStr != "" {
-		limit, err := strconv.Atoi(limitStr)
-		if err == nil && limit > 0 {
-			pageLimit = limit
-		}
+	var j job
+	if jobs := s3EventJobs(s3Event); len(jobs) > 0 {
+		j = jobs[0]
 	}
+	return processJob(ctx, j)
+}
+
+// processJob processes one object, and decides whether its errors fail the
+// invocation.
+func processJob(ctx context.Context, j job) (Response, error) {
+	logger := requestLogger(ctx).With("source", j.Source)
+	if j.MessageID != "" {
+		logger = logger.With("message_id", j.MessageID)
+	}
+	ctx = withLogger(ctx, logger)
+	initTracing(ctx)
+	ctx, span := startSpan(ctx, spanHandleRequest, attribute.String("source", j.Source))
+	response, err := handleJob(ctx, j)
+	response, err = applyFailurePolicy(ctx, response, err)
+	if err != nil {
+		err = invocationError(ctx, newFailureRecord(ctx, j, err), err)
+	}
+	span.SetAttributes(attribute.Int("status_code", response.StatusCode))
+	endSpan(span, err)
+	flushTraces(ctx)
+	return response, err
+}
+
+// handleJob reads the object of a job, or the local test file, and processes
+// it.
+func handleJob(ctx context.Context, j job) (Response, error) {
+	pageLimit := getPageLimit(ctx)
 
 	var pdfBytes []byte
 	var err error
 	var bucket, key string
-
-	if testPath := os.Getenv("TEST_PDF_PATH"); testPath != "" {
+	// version identifies the content of the object, for the dedupe store
+	var version string
+
+	if j.Data != nil {
+		// The document came with a direct request
+		pdfBytes = j.Data
+		bucket = j.Bucket
+		key = j.Key
+	} else if testPath := os.Getenv("TEST_PDF_PATH"); testPath != "" {
 		// Local testing mode - read file directly
 		pdfBytes, err = os.ReadFile(testPath)
 		if err != nil {
-			return Response{StatusCode: 500, Body: "Error reading test PDF"}, err
+			return Response{StatusCode: 500, Body: "Error reading test PDF"}, processingError(ErrorSource, err)
 		}
 		key = testPath
 		bucket = "test-bucket"
 	} else {
-		// Get the S3 bucket and key
-		if len(s3Event.Records) == 0 {
-			return Response{StatusCode: 400, Body: "No S3 event records"}, fmt.Errorf("no S3 event records")
-		}
-		
-		record := s3Event.Records[0]
-		bucket = record.S3.Bucket.Name
-		key = record.S3.Object.Key
+		bucket = j.Bucket
+		key = j.Key
 
 		// Validate bucket and key
 		if bucket == "" || key == "" {
-			return Response{StatusCode: 400, Body: "Invalid S3 event: missing bucket or key"}, 
-                   fmt.Errorf("invalid S3 event: bucket=%q, key=%q", bucket, key)
+			return Response{StatusCode: 400, Body: "Invalid event: missing bucket or key"},
+				processingError(ErrorSource, fmt.Errorf("invalid event: bucket=%q, key=%q", bucket, key))
 		}
 
-		// Log the attempt
-		log.Printf("Attempting to get object from S3 - Bucket: %s, Key: %s", bucket, key)
+		ctx = withLogAttrs(ctx, "bucket", bucket, "key", key)
+		loggerFrom(ctx).Debug("Getting object from S3")
 
 		// Initialize S3 client
 		s3Client, err := getS3Client()
 		if err != nil {
-			return Response{StatusCode: 500, Body: fmt.Sprintf("Failed to initialize S3 client: %v", err)}, err
+			return Response{StatusCode: 500, Body: fmt.Sprintf("Failed to initialize S3 client: %v", err)}, processingError(ErrorSource, err)
 		}
 
 		// Get the PDF directly from S3
@@ -322,22 +376,23 @@ func HandleRequest(ctx context.Context, s3Event events.S3Event) (Response, error
 			Bucket: aws.String(bucket),
 			Key:    aws.String(key),
 		}
-		
-		result, err := s3Client.GetObject(ctx, input)
+
+		getCtx, getSpan := startSpan(ctx, spanGetObject, attribute.String("bucket", bucket), attribute.String("key", key))
+		result, err := s3Client.GetObject(getCtx, input)
 		if err != nil {
-			// Log detailed error for debugging
-			log.Printf("S3 GetObject error - Bucket: %s, Key: %s, Error: %v", bucket, key, err)
+			endSpan(getSpan, err)
+			loggerFrom(ctx).Error("Error getting object from S3", "error", err)
 			return Response{
 				StatusCode: 500,
-				Body: fmt.Sprintf("Failed to get object from S3 (bucket: %s, key: %s): %v", 
-                       bucket, key, err),
-			}, err
+				Body: fmt.Sprintf("Failed to get object from S3 (bucket: %s, key: %s): %v",
+					bucket, key, err),
+			}, processingError(ErrorSource, err)
 		}
 		defer result.Body.Close()
 
 		// Create a buffer with reasonable size
 		buf := bytes.NewBuffer(make([]byte, 0, 1024*1024)) // 1MB initial capacity
-		
+
 		// Copy with timeout
 		done := make(chan error, 1)
 		go func() {
@@ -347,51 +402,110 @@ func HandleRequest(ctx context.Context, s3Event events.S3Event) (Response, error
 
 		select {
 		case <-time.After(30 * time.Second):
-			return Response{StatusCode: 500, Body: "Timeout reading PDF from S3"}, fmt.Errorf("timeout reading PDF")
+			endSpan(getSpan, fmt.Errorf("timeout reading PDF"))
+			return Response{StatusCode: 500, Body: "Timeout reading PDF from S3"}, processingError(ErrorSource, fmt.Errorf("timeout reading PDF"))
 		case err := <-done:
+			endSpan(getSpan, err)
 			if err != nil {
-				return Response{StatusCode: 500, Body: "Error reading PDF from S3"}, err
+				return Response{StatusCode: 500, Body: "Error reading PDF from S3"}, processingError(ErrorSource, err)
 			}
 		}
-		
+
 		pdfBytes = buf.Bytes()
-		
+		version = objectVersion(aws.ToString(result.VersionId), aws.ToString(result.ETag))
+
 		// Validate PDF size
 		if len(pdfBytes) == 0 {
-			return Response{StatusCode: 400, Body: "Empty PDF file from S3"}, 
-                   fmt.Errorf("empty PDF file from S3: bucket=%s, key=%s", bucket, key)
+			return Response{StatusCode: 400, Body: "Empty PDF file from S3"},
+				processingError(ErrorSource, fmt.Errorf("empty PDF file from S3: bucket=%s, key=%s", bucket, key))
 		}
 	}
 
-	log.Printf("Read PDF file: %s (size: %d bytes)", key, len(pdfBytes))
-	
+	if j.Data != nil || os.Getenv("TEST_PDF_PATH") != "" {
+		ctx = withLogAttrs(ctx, "bucket", bucket, "key", key)
+	}
+	loggerFrom(ctx).Info("Read document", "size", len(pdfBytes))
+
 	// Validate PDF contents
 	if len(pdfBytes) == 0 {
-		return Response{StatusCode: 400, Body: "Empty PDF file"}, fmt.Errorf("empty PDF file")
+		return Response{StatusCode: 400, Body: "Empty PDF file"}, processingError(ErrorSource, fmt.Errorf("empty PDF file"))
+	}
+
+	// Repeated events for a version of the object already processed get the
+	// stored result, without scanning or calling the webhook again, and those
+	// for a version being processed are retried
+	// Direct requests may scan again with other settings, so they skip it
+	var dedupe dedupeStore
+	if j.Source != sourceDirect {
+		dedupe, err = getDedupeStore(ctx)
+		if err != nil {
+			loggerFrom(ctx).Warn("Error opening dedupe store, processing object", "error", err)
+		}
+	}
+	if version == "" {
+		version = contentVersion(pdfBytes)
 	}
-	
-	// Check if it's a valid PDF (starts with %PDF)
-	if len(pdfBytes) < 4 || string(pdfBytes[0:4]) != "%PDF" {
-		return Response{StatusCode: 400, Body: "Invalid PDF format"}, fmt.Errorf("invalid PDF format")
+	claim, stored, err := claimObject(ctx, dedupe, bucket, key, version)
+	if err != nil {
+		return Response{StatusCode: 409, Body: "Object is being processed"}, err
+	}
+	if stored != nil {
+		return *stored, nil
+	}
+
+	// Archives and emails are unpacked, and each document in them processed
+	// under a composite key
+	var response Response
+	if format := sniffInput(pdfBytes); isArchiveFormat(format) {
+		response, err = processArchive(ctx, bucket, key, pdfBytes, format, pageLimit)
+	} else {
+		response, err = processDocument(ctx, bucket, key, pdfBytes, pageLimit)
+	}
+	recordResult(ctx, dedupe, claim, bucket, key, version, response, err)
+	return response, err
+}
+
+// processDocument extracts the barcodes from a PDF or image and sends them
+// to the webhook under key, then writes the document's metrics.
+func processDocument(ctx context.Context, bucket, key string, pdfBytes []byte, pageLimit int) (Response, error) {
+	metrics := newDocumentMetrics(bucket)
+	start := time.Now()
+	response, err := scanDocument(withMetrics(ctx, metrics), bucket, key, pdfBytes, pageLimit)
+	metrics.count("DocumentsProcessed", 1)
+	for _, kind := range errorKindsOf(err) {
+		metrics.count(kind.metricName(), 1)
+	}
+	metrics.timeStage(stageTotal, start)
+	if err := metrics.flush(); err != nil {
+		loggerFrom(ctx).Warn("Error writing metrics", "error", err)
+	}
+	return response, err
+}
+
+// scanDocument does the work of processDocument.
+func scanDocument(ctx context.Context, bucket, key string, pdfBytes []byte, pageLimit int) (Response, error) {
+	logger := loggerFrom(ctx)
+	metrics := metricsFrom(ctx)
+	// Check the content is a PDF or an image we can read
+	format := sniffInput(pdfBytes)
+	if format == "" || isArchiveFormat(format) {
+		return Response{StatusCode: 400, Body: "Unsupported input format"}, processingError(ErrorParse, fmt.Errorf("unsupported input format"))
 	}
 
 	// Create a temporary directory for extracted images
 	tmpDir, err := os.MkdirTemp("", "pdf-images-*")
 	if err != nil {
-		return Response{StatusCode: 500, Body: "Error creating temp directory"}, err
+		return Response{StatusCode: 500, Body: "Error creating temp directory"}, processingError(ErrorExtract, err)
 	}
 	defer os.RemoveAll(tmpDir)
 
 	// Write PDF to temporary file
 	tmpPDF := filepath.Join(tmpDir, "input.pdf")
-	if err := os.WriteFile(tmpPDF, pdfBytes, 0644); err != nil {
-		return Response{StatusCode: 500, Body: "Error writing temporary PDF"}, err
-	}
-
-	// Get page limit from environment variable
-	pageRange := os.Getenv("PDF_PAGE_LIMIT")
-	if pageRange == "" {
-		pageRange = "1" // Default to 1 page
+	_, writeSpan := startSpan(ctx, spanWriteTemp, attribute.Int("size", len(pdfBytes)))
+	err = os.WriteFile(tmpPDF, pdfBytes, 0644)
+	endSpan(writeSpan, err)
+	if err != nil {
+		return Response{StatusCode: 500, Body: "Error writing temporary PDF"}, processingError(ErrorExtract, err)
 	}
 
 	// Configure PDF processing
@@ -402,110 +516,329 @@ func HandleRequest(ctx context.Context, s3Event events.S3Event) (Response, error
 	// Create a directory for processed pages
 	tmpPagesDir := filepath.Join(tmpDir, "pages")
 	if err := os.MkdirAll(tmpPagesDir, 0755); err != nil {
-		return Response{StatusCode: 500, Body: "Error creating pages directory"}, err
+		return Response{StatusCode: 500, Body: "Error creating pages directory"}, processingError(ErrorExtract, err)
+	}
+
+	// Look up the processing profile
+	profile := getProfile(ctx, bucket, key)
+	metrics.setProfile(profile.Name)
+
+	// Direct requests choose the pages and the profile's outputs to use
+	options := scanOptionsFrom(ctx)
+	profile = options.apply(profile)
+	if options.LastPage > 0 {
+		pageLimit = options.LastPage
+	}
+
+	// Documents already scanned with the same settings are answered from the
+	// result cache, without extracting or decoding anything
+	cache, cacheKey := getResultCache(ctx, pdfBytes, profile, pageLimit)
+	cached := lookupCachedScan(ctx, cache, cacheKey)
+
+	// Images are decoded directly, with every frame as a page of its own.
+	// Regions in points need the layout of a PDF page, so they are skipped.
+	var pdfImages []pdfImage
+	var recovery string
+	var layouts []pageLayout
+	// pageCount is the number of pages of the document, 0 if unknown
+	var pageCount int
+	var pageTexts []string
+	var metadata *DocumentMetadata
+	extractStart := time.Now()
+	if cached != nil {
+		recovery = cached.Recovery
+		metadata = cached.Metadata
+	} else if format != inputPDF {
+		logger.Info("Decoding image input", "format", format)
+		_, extractSpan := startSpan(ctx, spanExtract, attribute.String("format", format))
+		pdfImages, err = decodeImageInput(pdfBytes, format, pageLimit)
+		pageCount = len(pdfImages)
+		extractSpan.SetAttributes(attribute.Int("images", len(pdfImages)))
+		endSpan(extractSpan, err)
+		if err != nil {
+			logger.Error("Error decoding image input", "error", err)
+			return Response{StatusCode: 500, Body: "Error decoding image input"}, processingError(ErrorParse, err)
+		}
+	} else {
+		// Decrypt encrypted PDFs with the profile's passwords before reading them
+		encrypted, err := isEncryptedPDF(tmpPDF)
+		if err != nil {
+			logger.Warn("Error checking PDF encryption", "error", err)
+		}
+		if encrypted {
+			logger.Info("PDF is encrypted, trying profile passwords")
+			err := decryptPDF(ctx, tmpPDF, profilePasswords(ctx, profile))
+			if errors.Is(err, errNoPassword) {
+				logger.Warn("No password opens encrypted PDF")
+				data := BarcodeData{
+					S3Key:        key,
+					BarcodeArray: []string{},
+					Outcome:      outcomeEncryptedNoPassword,
+				}
+				deliveryErr := callWebhook(ctx, data)
+				if deliveryErr != nil {
+					logger.Error("Error sending encrypted PDF outcome to API", "error", deliveryErr)
+				}
+				// Retrying cannot help until a password is configured, so this is not an error
+				jsonBody, _ := json.Marshal(ResponseBody{
+					Bucket:   bucket,
+					Key:      key,
+					Barcodes: []string{},
+					Outcome:  outcomeEncryptedNoPassword,
+				})
+				return Response{StatusCode: 422, Body: string(jsonBody)}, processingError(ErrorDelivery, deliveryErr)
+			}
+			if err != nil {
+				logger.Error("Error decrypting PDF", "error", err)
+				return Response{StatusCode: 500, Body: "Error decrypting PDF"}, processingError(ErrorParse, err)
+			}
+		}
+
+		// Extract and decode the images on the pages within the limit
+		logger.Debug("Extracting images from PDF", "path", tmpPDF)
+		extractCtx, extractSpan := startSpan(ctx, spanExtract, attribute.String("format", format))
+		pdfImages, recovery, err = extractPDFImagesWithRecovery(extractCtx, tmpPDF, pageLimit, config)
+		extractSpan.SetAttributes(attribute.Int("images", len(pdfImages)), attribute.String("recovery", recovery))
+		endSpan(extractSpan, err)
+		if err != nil {
+			logger.Error("Error extracting images from PDF", "error", err)
+			return Response{StatusCode: 500, Body: "Error extracting images from PDF"}, processingError(ErrorExtract, err)
+		}
+		if recovery != recoveryNone {
+			logger.Warn("Recovered images from malformed PDF", "recovery", recovery)
+		}
+
+		// The rest is read from one read of the PDF. A file whose images were
+		// only found by a raw scan is one pdfcpu cannot read, so it is not
+		// read again.
+		if recovery != recoveryRawScan {
+			pdfCtx, err := readPDFContext(tmpPDF, config)
+			if err != nil {
+				logger.Warn("Error reading PDF, its layout, text and metadata will be skipped", "error", err)
+			} else {
+				pageCount = pdfCtx.PageCount
+				// The page layouts place regions in points on the images and
+				// the barcodes found in the images on their pages
+				layouts, err = guarded(func() ([]pageLayout, error) {
+					return readPageLayouts(pdfCtx, pageLimit)
+				})
+				if err != nil {
+					logger.Warn("Error reading page layouts, regions in points and barcode page regions will be skipped", "error", err)
+				}
+
+				// The text layer is only read when the profile looks for patterns in it
+				if len(profile.TextPatterns) > 0 {
+					pageTexts, err = guarded(func() ([]string, error) {
+						return extractPDFText(pdfCtx, pageLimit)
+					})
+					if err != nil {
+						logger.Warn("Error extracting text from PDF, text patterns will be skipped", "error", err)
+					}
+				}
+
+				if profile.Metadata {
+					metadata, err = guarded(func() (*DocumentMetadata, error) {
+						return readPDFMetadata(pdfCtx)
+					})
+					if err != nil {
+						logger.Warn("Error reading PDF metadata", "error", err)
+					}
+				}
+			}
+		}
 	}
 
-	// Convert page limit to integer for splitting
-	pageLimit, err = strconv.Atoi(pageRange)
-	if err != nil {
-		log.Printf("Invalid page limit %s, defaulting to 1", pageRange)
-		pageLimit = 1
+	// Pages before a direct request's first page are not scanned
+	pdfImages = options.keepPages(pdfImages)
+	pages := scannedPages(pageCount, pageLimit, options.FirstPage)
+	switch {
+	case recovery == recoveryRawScan:
+		// A raw scan takes every image for a page of its own
+		pages = len(pdfImages)
+	case pageCount == 0:
+		pages = countPages(pdfImages)
+	}
+	for i := 0; i < len(pageTexts) && i+1 < options.FirstPage; i++ {
+		pageTexts[i] = ""
 	}
 
-	// Extract images from the PDF
-	log.Printf("Extracting images from PDF %s to %s", tmpPDF, tmpDir)
-	if err := api.ExtractImagesFile(tmpPDF, tmpDir, nil, config); err != nil {
-		log.Printf("Error extracting images from PDF: %v", err)
-		return Response{StatusCode: 500, Body: "Error extracting images from PDF"}, err
+	imageCount := len(pdfImages)
+	if cached != nil {
+		imageCount = cached.Images
+		metrics.count("Images", cached.Images)
+		metrics.count("Pages", cached.Pages)
+	} else {
+		metrics.timeStage(stageExtract, extractStart)
+		metrics.count("Images", len(pdfImages))
+		metrics.count("Pages", pages)
 	}
 
-	// Save extracted images to debug directory if in test mode
-	if os.Getenv("TEST_DEBUG") == "true" {
+	// Save extracted images to a debug directory in local debug runs
+	if os.Getenv("TEST_PDF_PATH") != "" && logger.Enabled(ctx, slog.LevelDebug) {
 		debugDir := "/tmp/pdf-debug"
-		files, err := os.ReadDir(tmpDir)
-		if err == nil {
-			for _, file := range files {
-				if !file.IsDir() && filepath.Ext(file.Name()) != ".pdf" {
-					src := filepath.Join(tmpDir, file.Name())
-					dst := filepath.Join(debugDir, file.Name())
-					input, err := os.ReadFile(src)
-					if err == nil {
-						os.WriteFile(dst, input, 0644)
-					}
-				}
+		os.MkdirAll(debugDir, 0755)
+		for _, extracted := range pdfImages {
+			if extracted.Err != nil {
+				continue
+			}
+			name := strings.TrimSuffix(extracted.Name, filepath.Ext(extracted.Name)) + ".png"
+			if f, err := os.Create(filepath.Join(debugDir, name)); err == nil {
+				png.Encode(f, extracted.Image)
+				f.Close()
 			}
 		}
 	}
-	
-	// List extracted files
-	extractedFiles, err := os.ReadDir(tmpDir)
-	if err != nil {
-		log.Printf("Error reading temp dir: %v", err)
-	} else {
-		log.Printf("Extracted files in %s:", tmpDir)
-		for _, f := range extractedFiles {
-			log.Printf("  - %s (size: %d bytes)", f.Name(), getFileSize(filepath.Join(tmpDir, f.Name())))
+
+	// List extracted images
+	logger.Info("Extracted images", "images", len(pdfImages))
+	for _, extracted := range pdfImages {
+		if extracted.Err != nil {
+			continue
+		}
+		logger.Debug("Extracted image", "image", extracted.Name, "page", extracted.Page, "encoding", extracted.Encoding, "type", fmt.Sprintf("%T", extracted.Image))
+	}
+
+	// Process each image and collect barcodes. Images that could not be
+	// decoded are reported alongside the results.
+	var foundResults []Barcode
+	var undecodable []ImageError
+	for i, extracted := range pdfImages {
+		fileName := extracted.Name
+		imageCtx := withLogAttrs(ctx, "page", extracted.Page, "image", fileName)
+		imageLogger := loggerFrom(imageCtx)
+		if extracted.Err != nil {
+			imageLogger.Warn("Error decoding image", "encoding", extracted.Encoding, "error", extracted.Err)
+			undecodable = append(undecodable, ImageError{
+				Image:    fileName,
+				Page:     extracted.Page,
+				Encoding: extracted.Encoding,
+				Error:    extracted.Err.Error(),
+			})
+			// A gap in the image decoders, not a missed barcode
+			metrics.count("UndecodableImages", 1)
+			continue
+		}
+		img := extracted.Image
+
+		imageLogger.Debug("Processing image", "index", i+1, "width", img.Bounds().Dx(), "height", img.Bounds().Dy())
+		// Try to detect barcodes, starting with the profile's regions of interest
+		page := extracted.Page
+		var placement *pdfMatrix
+		if page > 0 && page <= len(layouts) {
+			m := layouts[page-1].placement(extracted.Resource)
+			placement = &m
+		}
+		scanStart := time.Now()
+		scanCtx, scanSpan := startSpan(imageCtx, spanDecodeImage, attribute.Int("page", page), attribute.String("image", fileName))
+		barcodes := scanPage(scanCtx, img, profile, page, placement)
+		scanSpan.SetAttributes(attribute.Int("barcodes", len(barcodes)))
+		endSpan(scanSpan, nil)
+		metrics.timeStage(stageDecode, scanStart)
+		if len(barcodes) == 0 {
+			imageLogger.Info("No barcode in image")
+			metrics.count("ImagesWithoutBarcodes", 1)
+			// Don't continue, try next image
+		}
+		for _, barcode := range barcodes {
+			barcode.Page = page
+			barcode.Image = fileName
+			foundResults = append(foundResults, barcode)
 		}
 	}
 
-	// Read extracted images from temp directory and only process up to pageLimit
-	files, err := os.ReadDir(tmpDir)
-	if err != nil {
-		return Response{StatusCode: 500, Body: "Error reading extracted images"}, err
-	}
-
-	// Get all image files from pages within the limit
-	sortedFiles := make([]string, 0)
-	for _, file := range files {
-		if !file.IsDir() && filepath.Ext(file.Name()) != ".pdf" {
-			// Check if image is from a page within our limit
-			parts := strings.Split(file.Name(), "_")
-			if len(parts) >= 2 {
-				pageNum, err := strconv.Atoi(parts[1])
-				if err == nil && pageNum <= pageLimit {
-					sortedFiles = append(sortedFiles, file.Name())
-				}
-			}
+	// Place the barcodes read from PDF pages on their pages, in points
+	if len(layouts) > 0 && len(foundResults) > 0 {
+		images := map[string]pdfImage{}
+		for _, img := range pdfImages {
+			images[img.Name] = img
 		}
+		placeBarcodes(foundResults, images, layouts)
 	}
-	// Sort files for consistent processing order
-	sort.Strings(sortedFiles)
-	// Process all images from the selected pages
-	processFiles := sortedFiles
 
-	// Process each selected image file and collect barcodes
+	// Match the text patterns and compare them with the decoded barcodes
+	textMatches := matchTextPatterns(pageTexts, profile.textPatterns())
+	compareTextMatches(textMatches, foundResults)
+	if cached != nil {
+		foundResults = cached.Barcodes
+		undecodable = cached.Undecodable
+		textMatches = cached.TextMatches
+	} else {
+		saveCachedScan(ctx, cache, cacheKey, documentScan{
+			Barcodes:    foundResults,
+			Undecodable: undecodable,
+			Recovery:    recovery,
+			TextMatches: textMatches,
+			Metadata:    metadata,
+			Images:      len(pdfImages),
+			Pages:       pages,
+		})
+	}
+
+	// Send each barcode to the webhook on its own, then all of them together
 	var foundBarcodes []string
-	for i, fileName := range processFiles {
-		imgPath := filepath.Join(tmpDir, fileName)
-		imgFile, err := os.Open(imgPath)
-		if err != nil {
-			log.Printf("Error opening image %s: %v", fileName, err)
-			continue
+	// deliveryErr is the last webhook call that failed
+	var deliveryErr error
+	for _, barcode := range foundResults {
+		imageCtx := withLogAttrs(ctx, "page", barcode.Page, "image", barcode.Image)
+		imageLogger := loggerFrom(imageCtx)
+		imageLogger.Info("Found barcode", "text", barcode.Text, "format", barcode.Format)
+		metrics.barcodeFound(barcode.Format)
+		foundBarcodes = append(foundBarcodes, barcode.Text)
+		data := BarcodeData{
+			S3Key:        key,
+			BarcodeArray: []string{barcode.Text},
+			Results:      []Barcode{barcode},
 		}
+		if err := callWebhook(imageCtx, data); err != nil {
+			imageLogger.Error("Error sending barcode data to API", "error", err)
+			deliveryErr = err
+		}
+	}
 
-		img, _, err := image.Decode(imgFile)
-		imgFile.Close()
-		if err != nil {
-			log.Printf("Error decoding image %s: %v", fileName, err)
-			continue
+	for _, match := range textMatches {
+		logger.Info("Text pattern matched", "pattern", match.Pattern, "text", match.Text, "page", match.Page, "agreement", match.Agreement)
+	}
+
+	// Stamp the decoded values onto a copy of the PDF
+	var annotated string
+	if format == inputPDF && profile.AnnotateOutput != "" && len(foundResults) > 0 {
+		if len(layouts) == 0 {
+			logger.Warn("Page layouts unknown, the PDF is not annotated")
+		} else if annotated, err = saveAnnotatedPDF(ctx, tmpPDF, key, foundResults, layouts, profile.AnnotateOutput, config); err != nil {
+			logger.Error("Error saving annotated PDF", "error", err)
+		} else {
+			logger.Info("Saved annotated PDF", "location", annotated)
 		}
+	}
 
-		log.Printf("Processing image %d: %s (dimensions: %dx%d)", i+1, fileName, img.Bounds().Dx(), img.Bounds().Dy())
-		// Try to detect barcode
-		barcode, err := extractBarcodeFromImage(img)
+	// Save page thumbnails and barcode crops, which show what was scanned
+	// without downloading the document
+	var artifacts []Artifact
+	if profile.ArtifactOutput != "" {
+		artifacts, err = saveArtifacts(ctx, key, pdfImages, foundResults, profile.ArtifactOutput)
 		if err != nil {
-			log.Printf("Failed to extract barcode from image %s: %v", fileName, err)
-			// Don't continue, try next image
-		} else if barcode != "" {
-			log.Printf("Found barcode in image %s: %s", fileName, barcode)
-			foundBarcodes = append(foundBarcodes, barcode)
-			data := BarcodeData{
-				S3Key:        key,
-				BarcodeArray: []string{barcode},
-			}
-			if err := callRubyEndpoint(data); err != nil {
-				log.Printf("Error sending barcode data to API: %v", err)
-			}
+			logger.Error("Error saving artifacts", "error", err)
+		}
+		logger.Info("Saved artifacts", "artifacts", len(artifacts))
+	}
+
+	// Keep what is needed to look into misses and contradicted reads
+	var debugBundle string
+	if reason := debugBundleReason(foundResults, textMatches); reason != "" && profile.DebugBundleOutput != "" {
+		debugBundle, err = saveDebugBundle(ctx, profile, pdfImages, debugSummary{
+			Bucket:      bucket,
+			Key:         key,
+			Reason:      reason,
+			Created:     time.Now(),
+			Recovery:    recovery,
+			Results:     foundResults,
+			Undecodable: undecodable,
+			TextMatches: textMatches,
+		})
+		if err != nil {
+			logger.Error("Error saving debug bundle", "error", err)
+		} else {
+			logger.Info("Saved debug bundle", "reason", reason, "location", debugBundle)
 		}
 	}
 
@@ -515,40 +848,74 @@ func HandleRequest(ctx context.Context, s3Event events.S3Event) (Response, error
 		data := BarcodeData{
 			S3Key:        key,
 			BarcodeArray: foundBarcodes,
+			Results:      foundResults,
+			Undecodable:  undecodable,
+			Recovery:     recovery,
+			TextMatches:  textMatches,
+			Metadata:     metadata,
+			Annotated:    annotated,
+			Artifacts:    artifacts,
+			DebugBundle:  debugBundle,
 		}
-		if err := callRubyEndpoint(data); err != nil {
-			log.Printf("Error sending barcode data to API: %v", err)
+		if err := callWebhook(ctx, data); err != nil {
+			logger.Error("Error sending barcode data to API", "error", err)
+			deliveryErr = err
 		}
 
 		// Return success response with found barcodes
 		jsonBody, _ := json.Marshal(ResponseBody{
-			Bucket:   bucket,
-			Key:      key,
-			Barcodes: foundBarcodes,
+			Bucket:      bucket,
+			Key:         key,
+			Barcodes:    foundBarcodes,
+			Results:     foundResults,
+			Undecodable: undecodable,
+			Recovery:    recovery,
+			TextMatches: textMatches,
+			Metadata:    metadata,
+			Annotated:   annotated,
+			Artifacts:   artifacts,
+			DebugBundle: debugBundle,
 		})
 		return Response{
 			StatusCode: 200,
 			Body:       string(jsonBody),
-		}, nil
+		}, processingError(ErrorDelivery, deliveryErr)
 	}
 
 	// Call webhook with empty barcode array if no barcodes found
+	metrics.count("DocumentsWithoutBarcodes", 1)
 	data := BarcodeData{
 		S3Key:        key,
 		BarcodeArray: []string{},
+		Undecodable:  undecodable,
+		Recovery:     recovery,
+		TextMatches:  textMatches,
+		Metadata:     metadata,
+		Artifacts:    artifacts,
+		DebugBundle:  debugBundle,
 	}
-	if err := callRubyEndpoint(data); err != nil {
-		log.Printf("Error sending empty barcode data to API: %v", err)
+	if err := callWebhook(ctx, data); err != nil {
+		logger.Error("Error sending empty barcode data to API", "error", err)
+		deliveryErr = err
 	}
 
 	// Return success response with empty barcode array
 	jsonBody, _ := json.Marshal(ResponseBody{
-		Bucket:   bucket,
-		Key:      key,
-		Barcodes: []string{},
+		Bucket:      bucket,
+		Key:         key,
+		Barcodes:    []string{},
+		Undecodable: undecodable,
+		Recovery:    recovery,
+		TextMatches: textMatches,
+		Metadata:    metadata,
+		Artifacts:   artifacts,
+		DebugBundle: debugBundle,
 	})
 	return Response{
 		StatusCode: 200,
 		Body:       string(jsonBody),
-	}, nil
-}
\ No newline at end of file
+	}, errors.Join(
+		processingError(ErrorDecode, fmt.Errorf("no barcode found in %d images", imageCount)),
+		processingError(ErrorDelivery, deliveryErr),
+	)
+}
@@ -4,31 +4,46 @@ import (
 	"context"
 	"image"
 	"image/color"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
+func TestMain(m *testing.M) {
+	// Failing webhooks are retried without the wait a real endpoint gets
+	webhookRetryDelay = time.Millisecond
+	os.Exit(m.Run())
+}
+
 func TestPreprocessImage(t *testing.T) {
 	tests := []struct {
 		name     string
 		imgSize  image.Rectangle
 		contrast bool
+		// wantSize is the size after the chains that upscale small images
+		wantSize image.Rectangle
 	}{
 		{
 			name:     "Small image with aggressive contrast",
 			imgSize:  image.Rect(0, 0, 50, 50),
 			contrast: true,
+			wantSize: image.Rect(0, 0, 200, 200),
 		},
 		{
 			name:     "Normal image with sufficient contrast",
 			imgSize:  image.Rect(0, 0, 200, 200),
 			contrast: true,
+			wantSize: image.Rect(0, 0, 200, 200),
 		},
 		{
 			name:     "Normal image with low contrast",
 			imgSize:  image.Rect(0, 0, 200, 200),
 			contrast: false,
+			wantSize: image.Rect(0, 0, 200, 200),
 		},
 	}
 
@@ -57,17 +72,32 @@ func TestPreprocessImage(t *testing.T) {
 				}
 			}
 
-			// Process image
-			processed := preprocessImage(img)
-			
-			// Verify the processed image is not nil
-			if processed == nil {
-				t.Error("preprocessImage returned nil")
-			}
-			
-			// Verify dimensions are preserved
-			if processed.Bounds() != tt.imgSize {
-				t.Errorf("processed image size %v, want %v", processed.Bounds(), tt.imgSize)
+			// Process the image with every default chain
+			for _, chain := range getPreprocessChains(context.Background()) {
+				processed := chain.apply(img)
+				if processed == nil {
+					t.Fatalf("chain %q returned nil", chain.name)
+				}
+
+				// Verify dimensions are preserved, unless the chain upscales
+				want := tt.imgSize
+				if strings.HasPrefix(chain.name, "upscale") {
+					want = tt.wantSize
+				}
+				if processed.Bounds() != want {
+					t.Errorf("chain %q: processed image size %v, want %v", chain.name, processed.Bounds(), want)
+				}
+
+				// A flat image has nothing for a local threshold to pick out as foreground
+				thresholds := strings.Contains(chain.name, "adaptive") || strings.Contains(chain.name, "sauvola")
+				if !tt.contrast && thresholds {
+					for _, v := range processed.Pix {
+						if v != 255 {
+							t.Errorf("chain %q: flat image has a foreground pixel", chain.name)
+							break
+						}
+					}
+				}
 			}
 		})
 	}
@@ -136,6 +166,16 @@ func TestExtractBarcodeFromImage(t *testing.T) {
 }
 
 func TestWebhookIntegration(t *testing.T) {
+	// Local stand-in for the Rails webhook
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "test-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
 	tests := []struct {
 		name       string
 		setupEnv   func()
@@ -176,7 +216,7 @@ func TestWebhookIntegration(t *testing.T) {
 		{
 			name: "Valid configuration",
 			setupEnv: func() {
-				os.Setenv("WEBHOOK_URL", "https://localhost:3000")
+				os.Setenv("WEBHOOK_URL", server.URL)
 				os.Setenv("WEBHOOK_TOKEN", "test-token")
 			},
 			cleanupEnv: func() {
@@ -202,7 +242,7 @@ func TestWebhookIntegration(t *testing.T) {
 				defer tt.cleanupEnv()
 			}
 
-			err := callWebhook(tt.data)
+			err := callWebhook(context.Background(), tt.data)
 			
 			if tt.wantErr {
 				if err == nil {
@@ -274,4 +314,96 @@ func TestGetS3Client(t *testing.T) {
 			}
 		})
 	}
-}
\ No newline at end of file
+}
+
+func TestGetPageLimit(t *testing.T) {
+	ctx := withLogger(context.Background(), discardLogger)
+	defer os.Unsetenv("PDF_PAGE_LIMIT")
+
+	tests := []struct {
+		value string
+		want  int
+	}{
+		{"", defaultPageLimit},
+		{"5", 5},
+		{"0", defaultPageLimit},
+		{"all", defaultPageLimit},
+	}
+	for _, tt := range tests {
+		os.Setenv("PDF_PAGE_LIMIT", tt.value)
+		if got := getPageLimit(ctx); got != tt.want {
+			t.Errorf("PDF_PAGE_LIMIT=%q: got %d, want %d", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestCallWebhookRetries(t *testing.T) {
+	var requests int
+	statuses := []int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := http.StatusOK
+		if requests < len(statuses) {
+			status = statuses[requests]
+		}
+		requests++
+		// -1 accepts the request but hangs up in the middle of the body
+		if status == -1 {
+			w.Header().Set("Content-Length", "10")
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("ok"))
+			return
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	// Nothing listens where a closed server was
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	os.Setenv("WEBHOOK_TOKEN", "test-token")
+	defer func() {
+		os.Unsetenv("WEBHOOK_URL")
+		os.Unsetenv("WEBHOOK_TOKEN")
+		os.Unsetenv("WEBHOOK_RETRIES")
+	}()
+
+	tests := []struct {
+		name         string
+		retries      string
+		url          string
+		statuses     []int
+		wantRequests int
+		wantErr      bool
+	}{
+		{"Accepted", "", server.URL, nil, 1, false},
+		{"Not retried by default", "", server.URL, []int{503}, 1, true},
+		{"Server error then accepted", "2", server.URL, []int{500, 503}, 3, false},
+		{"Throttled then accepted", "1", server.URL, []int{429}, 2, false},
+		{"Retries run out", "2", server.URL, []int{502, 502, 502, 200}, 3, true},
+		{"Client error not retried", "2", server.URL, []int{400}, 1, true},
+		{"Body cut off not retried", "2", server.URL, []int{-1}, 1, true},
+		{"Connection refused", "2", closed.URL, nil, 3, true},
+		{"Invalid setting uses the default", "many", server.URL, []int{500}, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("WEBHOOK_RETRIES", tt.retries)
+			os.Setenv("WEBHOOK_URL", tt.url)
+			requests, statuses = 0, tt.statuses
+			metrics := newDocumentMetrics("bucket")
+			err := callWebhook(withMetrics(context.Background(), metrics), BarcodeData{S3Key: "a.pdf", BarcodeArray: []string{"A"}})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want one: %v", err, tt.wantErr)
+			}
+			// Requests that never connected are only counted by the metrics
+			if got := metrics.counts["WebhookRequests"]; got != float64(tt.wantRequests) {
+				t.Errorf("got %v requests, want %d", got, tt.wantRequests)
+			}
+			if tt.url == server.URL && requests != tt.wantRequests {
+				t.Errorf("got %d requests received, want %d", requests, tt.wantRequests)
+			}
+			if got := metrics.counts["WebhookRetries"]; got != float64(tt.wantRequests-1) {
+				t.Errorf("got %v retries counted, want %d", got, tt.wantRequests-1)
+			}
+		})
+	}
+}
@@ -0,0 +1,461 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"math"
+	"os"
+	"strings"
+)
+
+const (
+	// Images whose shorter side is below this are upscaled before thresholding
+	upscaleMinDimension = 200
+	// Upper bound on the upscale factor so tiny thumbnails don't explode in memory
+	upscaleMaxFactor = 4
+
+	// Sauvola parameters: sensitivity and dynamic range of the standard deviation
+	sauvolaK = 0.2
+	sauvolaR = 128.0
+
+	// Adaptive mean threshold offset; pixels must be this much darker than
+	// their neighbourhood mean to be treated as foreground
+	adaptiveOffset = 10
+)
+
+// defaultPreprocessChains are tried in order when PREPROCESS_CHAINS is not set.
+// The first chain leaves the image as plain grayscale for gozxing's own
+// binarizers; the rest progressively deal with small images, blur, uneven
+// lighting and speckle from phone scans.
+var defaultPreprocessChains = []string{
+	"gray",
+	"upscale,sharpen",
+	"upscale,sauvola",
+	"upscale,median,adaptive,close",
+}
+
+// preprocessStep transforms a grayscale image as one stage of a preprocessing chain.
+type preprocessStep func(*image.Gray) *image.Gray
+
+// preprocessSteps maps the names usable in PREPROCESS_CHAINS to their implementation.
+var preprocessSteps = map[string]preprocessStep{
+	"gray":     func(img *image.Gray) *image.Gray { return img },
+	"upscale":  upscaleSmall,
+	"stretch":  stretchContrast,
+	"median":   medianDenoise,
+	"close":    morphologicalClose,
+	"sharpen":  sharpen,
+	"otsu":     otsuThreshold,
+	"adaptive": adaptiveThreshold,
+	"sauvola":  sauvolaThreshold,
+}
+
+// preprocessChain is a named sequence of steps applied to an image before decoding.
+// Every chain starts from the grayscale conversion of the input image.
+type preprocessChain struct {
+	name  string
+	steps []preprocessStep
+}
+
+func (c preprocessChain) apply(img image.Image) *image.Gray {
+	gray := toGray(img)
+	for _, step := range c.steps {
+		gray = step(gray)
+	}
+	return gray
+}
+
+// parsePreprocessChain builds a chain from a comma separated list of step names, e.g. "upscale,sauvola".
+func parsePreprocessChain(spec string) (preprocessChain, error) {
+	chain := preprocessChain{name: spec}
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.TrimSpace(name)
+		step, ok := preprocessSteps[name]
+		if !ok {
+			return preprocessChain{}, fmt.Errorf("unknown preprocessing step %q in chain %q", name, spec)
+		}
+		chain.steps = append(chain.steps, step)
+	}
+	return chain, nil
+}
+
+// getPreprocessChains returns the chains to try, read from PREPROCESS_CHAINS
+// (chains separated by ";", steps by ","). Invalid chains are logged and skipped.
+func getPreprocessChains(ctx context.Context) []preprocessChain {
+	specs := defaultPreprocessChains
+	if env := os.Getenv("PREPROCESS_CHAINS"); env != "" {
+		specs = strings.Split(env, ";")
+	}
+
+	chains := make([]preprocessChain, 0, len(specs))
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		chain, err := parsePreprocessChain(spec)
+		if err != nil {
+			loggerFrom(ctx).Warn("Ignoring preprocessing chain", "error", err)
+			continue
+		}
+		chains = append(chains, chain)
+	}
+
+	if len(chains) == 0 {
+		loggerFrom(ctx).Warn("No valid preprocessing chains configured, using plain grayscale")
+		chains = append(chains, preprocessChain{name: "gray"})
+	}
+	return chains
+}
+
+// toGray converts an image to grayscale using the luminance formula,
+// with a fast path for the formats image decoders commonly return.
+func toGray(img image.Image) *image.Gray {
+	bounds := img.Bounds()
+	gray := image.NewGray(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+
+	switch src := img.(type) {
+	case *image.Gray:
+		for y := 0; y < bounds.Dy(); y++ {
+			srcOff := src.PixOffset(bounds.Min.X, bounds.Min.Y+y)
+			copy(gray.Pix[y*gray.Stride:y*gray.Stride+bounds.Dx()], src.Pix[srcOff:srcOff+bounds.Dx()])
+		}
+	case *image.YCbCr:
+		// The Y plane already is the luminance
+		for y := 0; y < bounds.Dy(); y++ {
+			for x := 0; x < bounds.Dx(); x++ {
+				gray.Pix[y*gray.Stride+x] = src.Y[src.YOffset(bounds.Min.X+x, bounds.Min.Y+y)]
+			}
+		}
+	default:
+		for y := 0; y < bounds.Dy(); y++ {
+			for x := 0; x < bounds.Dx(); x++ {
+				r, g, b, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+				gray.Pix[y*gray.Stride+x] = uint8(0.299*float64(r>>8) + 0.587*float64(g>>8) + 0.114*float64(b>>8))
+			}
+		}
+	}
+	return gray
+}
+
+// upscaleSmall enlarges images whose shorter side is below upscaleMinDimension
+// using bilinear interpolation, so that thin bars survive thresholding.
+func upscaleSmall(img *image.Gray) *image.Gray {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	shorter := w
+	if h < shorter {
+		shorter = h
+	}
+	if shorter == 0 || shorter >= upscaleMinDimension {
+		return img
+	}
+
+	factor := (upscaleMinDimension + shorter - 1) / shorter
+	if factor > upscaleMaxFactor {
+		factor = upscaleMaxFactor
+	}
+	return resizeGray(img, w*factor, h*factor)
+}
+
+// resizeGray scales a grayscale image to the given size using bilinear interpolation.
+func resizeGray(img *image.Gray, newW, newH int) *image.Gray {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	out := image.NewGray(image.Rect(0, 0, newW, newH))
+	if w == 0 || h == 0 || newW == 0 || newH == 0 {
+		return out
+	}
+
+	xRatio := float64(w) / float64(newW)
+	yRatio := float64(h) / float64(newH)
+	for y := 0; y < newH; y++ {
+		sy := (float64(y)+0.5)*yRatio - 0.5
+		y0 := clampInt(int(math.Floor(sy)), 0, h-1)
+		y1 := clampInt(y0+1, 0, h-1)
+		fy := sy - float64(y0)
+		if fy < 0 {
+			fy = 0
+		}
+		for x := 0; x < newW; x++ {
+			sx := (float64(x)+0.5)*xRatio - 0.5
+			x0 := clampInt(int(math.Floor(sx)), 0, w-1)
+			x1 := clampInt(x0+1, 0, w-1)
+			fx := sx - float64(x0)
+			if fx < 0 {
+				fx = 0
+			}
+			top := float64(grayAt(img, x0, y0))*(1-fx) + float64(grayAt(img, x1, y0))*fx
+			bottom := float64(grayAt(img, x0, y1))*(1-fx) + float64(grayAt(img, x1, y1))*fx
+			out.Pix[y*out.Stride+x] = uint8(top*(1-fy) + bottom*fy + 0.5)
+		}
+	}
+	return out
+}
+
+// stretchContrast linearly maps the darkest and brightest pixel to 0 and 255.
+func stretchContrast(img *image.Gray) *image.Gray {
+	var min, max uint8 = 255, 0
+	for _, v := range img.Pix {
+		if v < min {
+			min = v
+		}
+		if v > max {
+			max = v
+		}
+	}
+	if max <= min {
+		return img
+	}
+
+	out := image.NewGray(img.Bounds())
+	scale := 255.0 / float64(max-min)
+	for i, v := range img.Pix {
+		out.Pix[i] = uint8(float64(v-min)*scale + 0.5)
+	}
+	return out
+}
+
+// medianDenoise applies a 3x3 median filter to remove salt-and-pepper noise.
+func medianDenoise(img *image.Gray) *image.Gray {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	out := image.NewGray(img.Bounds())
+	var window [9]uint8
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			i := 0
+			for dy := -1; dy <= 1; dy++ {
+				for dx := -1; dx <= 1; dx++ {
+					window[i] = grayAt(img, clampInt(x+dx, 0, w-1), clampInt(y+dy, 0, h-1))
+					i++
+				}
+			}
+			out.Pix[y*out.Stride+x] = median9(&window)
+		}
+	}
+	return out
+}
+
+// median9Network is a sorting network of 19 compare-exchanges that leaves
+// the median of nine values at index 4, without sorting the rest.
+var median9Network = [19][2]int{
+	{1, 2}, {4, 5}, {7, 8}, {0, 1}, {3, 4}, {6, 7}, {1, 2}, {4, 5}, {7, 8},
+	{0, 3}, {5, 8}, {4, 7}, {3, 6}, {1, 4}, {2, 5}, {4, 7}, {4, 2}, {6, 4}, {4, 2},
+}
+
+// median9 returns the median of the nine values, reordering them.
+func median9(v *[9]uint8) uint8 {
+	for _, pair := range median9Network {
+		if v[pair[0]] > v[pair[1]] {
+			v[pair[0]], v[pair[1]] = v[pair[1]], v[pair[0]]
+		}
+	}
+	return v[4]
+}
+
+// morphologicalClose fills small gaps in dark foreground (dilate then erode).
+// The structuring element is a vertical 1x3 line so broken bars are joined
+// without merging neighbouring bars of a 1D barcode.
+func morphologicalClose(img *image.Gray) *image.Gray {
+	return verticalFilter(verticalFilter(img, minUint8), maxUint8)
+}
+
+func verticalFilter(img *image.Gray, pick func(a, b uint8) uint8) *image.Gray {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	out := image.NewGray(img.Bounds())
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := grayAt(img, x, y)
+			v = pick(v, grayAt(img, x, clampInt(y-1, 0, h-1)))
+			v = pick(v, grayAt(img, x, clampInt(y+1, 0, h-1)))
+			out.Pix[y*out.Stride+x] = v
+		}
+	}
+	return out
+}
+
+// sharpen applies a 3x3 Laplacian sharpening kernel to crisp up blurred bar edges.
+func sharpen(img *image.Gray) *image.Gray {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	out := image.NewGray(img.Bounds())
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := 5*int(grayAt(img, x, y)) -
+				int(grayAt(img, clampInt(x-1, 0, w-1), y)) -
+				int(grayAt(img, clampInt(x+1, 0, w-1), y)) -
+				int(grayAt(img, x, clampInt(y-1, 0, h-1))) -
+				int(grayAt(img, x, clampInt(y+1, 0, h-1)))
+			out.Pix[y*out.Stride+x] = uint8(clampInt(v, 0, 255))
+		}
+	}
+	return out
+}
+
+// otsuThreshold binarizes using the global threshold that maximises between-class variance.
+func otsuThreshold(img *image.Gray) *image.Gray {
+	threshold := otsuLevel(img)
+	out := image.NewGray(img.Bounds())
+	for i, v := range img.Pix {
+		if int(v) > threshold {
+			out.Pix[i] = 255
+		}
+	}
+	return out
+}
+
+// otsuLevel returns the Otsu threshold of the image's histogram.
+func otsuLevel(img *image.Gray) int {
+	var histogram [256]int
+	for _, v := range img.Pix {
+		histogram[v]++
+	}
+
+	total := len(img.Pix)
+	var sum float64
+	for i, count := range histogram {
+		sum += float64(i * count)
+	}
+
+	var sumBackground, bestVariance float64
+	var weightBackground int
+	threshold := 128
+	for i, count := range histogram {
+		weightBackground += count
+		if weightBackground == 0 {
+			continue
+		}
+		weightForeground := total - weightBackground
+		if weightForeground == 0 {
+			break
+		}
+		sumBackground += float64(i * count)
+		meanBackground := sumBackground / float64(weightBackground)
+		meanForeground := (sum - sumBackground) / float64(weightForeground)
+		variance := float64(weightBackground) * float64(weightForeground) *
+			(meanBackground - meanForeground) * (meanBackground - meanForeground)
+		if variance > bestVariance {
+			bestVariance = variance
+			threshold = i
+		}
+	}
+	return threshold
+}
+
+// adaptiveThreshold binarizes each pixel against the mean of its neighbourhood,
+// which copes with shadows and lighting gradients across the page.
+func adaptiveThreshold(img *image.Gray) *image.Gray {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	sums, _ := integralImages(img, false)
+	radius := thresholdRadius(w, h)
+
+	out := image.NewGray(img.Bounds())
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			sum, n := windowSum(sums, w, h, x, y, radius)
+			mean := sum / float64(n)
+			if float64(grayAt(img, x, y)) > mean-adaptiveOffset {
+				out.Pix[y*out.Stride+x] = 255
+			}
+		}
+	}
+	return out
+}
+
+// sauvolaThreshold binarizes using Sauvola's local threshold, which adapts
+// to both the local mean and local contrast and handles uneven backgrounds well.
+func sauvolaThreshold(img *image.Gray) *image.Gray {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	sums, squares := integralImages(img, true)
+	radius := thresholdRadius(w, h)
+
+	out := image.NewGray(img.Bounds())
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			sum, n := windowSum(sums, w, h, x, y, radius)
+			sumSq, _ := windowSum(squares, w, h, x, y, radius)
+			mean := sum / float64(n)
+			variance := sumSq/float64(n) - mean*mean
+			if variance < 0 {
+				variance = 0
+			}
+			threshold := mean * (1 + sauvolaK*(math.Sqrt(variance)/sauvolaR-1))
+			if float64(grayAt(img, x, y)) > threshold {
+				out.Pix[y*out.Stride+x] = 255
+			}
+		}
+	}
+	return out
+}
+
+// thresholdRadius picks a local window of roughly 1/16 of the longer side.
+// Windows much smaller than that sit entirely inside runs of wide bars and
+// misclassify them, which matters for tightly cropped 1D barcodes.
+func thresholdRadius(w, h int) int {
+	longer := w
+	if h > longer {
+		longer = h
+	}
+	return clampInt(longer/16, 7, 50)
+}
+
+// integralImages returns summed-area tables of pixel values (and optionally
+// squared values) with one row and column of zero padding.
+func integralImages(img *image.Gray, withSquares bool) ([]float64, []float64) {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	stride := w + 1
+	sums := make([]float64, stride*(h+1))
+	var squares []float64
+	if withSquares {
+		squares = make([]float64, stride*(h+1))
+	}
+
+	for y := 0; y < h; y++ {
+		var rowSum, rowSq float64
+		for x := 0; x < w; x++ {
+			v := float64(grayAt(img, x, y))
+			rowSum += v
+			sums[(y+1)*stride+x+1] = sums[y*stride+x+1] + rowSum
+			if withSquares {
+				rowSq += v * v
+				squares[(y+1)*stride+x+1] = squares[y*stride+x+1] + rowSq
+			}
+		}
+	}
+	return sums, squares
+}
+
+// windowSum returns the sum and pixel count of the window centred on (x, y), clipped to the image.
+func windowSum(table []float64, w, h, x, y, radius int) (float64, int) {
+	stride := w + 1
+	x0, y0 := clampInt(x-radius, 0, w), clampInt(y-radius, 0, h)
+	x1, y1 := clampInt(x+radius+1, 0, w), clampInt(y+radius+1, 0, h)
+	sum := table[y1*stride+x1] - table[y0*stride+x1] - table[y1*stride+x0] + table[y0*stride+x0]
+	return sum, (x1 - x0) * (y1 - y0)
+}
+
+func grayAt(img *image.Gray, x, y int) uint8 {
+	return img.Pix[y*img.Stride+x]
+}
+
+func clampInt(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
+
+func minUint8(a, b uint8) uint8 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxUint8(a, b uint8) uint8 {
+	if a > b {
+		return a
+	}
+	return b
+}
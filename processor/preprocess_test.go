@@ -0,0 +1,202 @@
+package processor
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/makiuchi-d/gozxing"
+	"github.com/makiuchi-d/gozxing/oned"
+)
+
+func TestPreprocessChains(t *testing.T) {
+	tests := []struct {
+		name     string
+		imgSize  image.Rectangle
+		contrast bool
+	}{
+		{
+			name:     "Small image",
+			imgSize:  image.Rect(0, 0, 50, 50),
+			contrast: true,
+		},
+		{
+			name:     "Normal image with sufficient contrast",
+			imgSize:  image.Rect(0, 0, 200, 200),
+			contrast: true,
+		},
+		{
+			name:     "Normal image with low contrast",
+			imgSize:  image.Rect(0, 0, 200, 200),
+			contrast: false,
+		},
+	}
+
+	for _, tt := range tests {
+		for _, spec := range defaultPreprocessChains {
+			t.Run(tt.name+"/"+spec, func(t *testing.T) {
+				// Create test image
+				img := image.NewRGBA(tt.imgSize)
+				for y := 0; y < tt.imgSize.Max.Y; y++ {
+					for x := 0; x < tt.imgSize.Max.X; x++ {
+						switch {
+						case !tt.contrast:
+							img.Set(x, y, color.Gray{Y: 128})
+						case (x+y)%2 == 0:
+							img.Set(x, y, color.White)
+						default:
+							img.Set(x, y, color.Black)
+						}
+					}
+				}
+
+				chain, err := parsePreprocessChain(spec)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				processed := chain.apply(img)
+				if processed == nil {
+					t.Fatal("chain returned nil")
+				}
+
+				// Only upscaling may change the dimensions, and only for small images
+				want := tt.imgSize
+				if strings.Contains(spec, "upscale") && tt.imgSize.Dx() < upscaleMinDimension {
+					factor := upscaleMinDimension / tt.imgSize.Dx()
+					want = image.Rect(0, 0, tt.imgSize.Dx()*factor, tt.imgSize.Dy()*factor)
+				}
+				if processed.Bounds() != want {
+					t.Errorf("processed image size %v, want %v", processed.Bounds(), want)
+				}
+			})
+		}
+	}
+}
+
+func TestGetPreprocessChains(t *testing.T) {
+	tests := []struct {
+		name      string
+		env       string
+		wantNames []string
+	}{
+		{
+			name:      "Defaults",
+			wantNames: defaultPreprocessChains,
+		},
+		{
+			name:      "Custom chains",
+			env:       "sauvola; upscale,median,otsu",
+			wantNames: []string{"sauvola", "upscale,median,otsu"},
+		},
+		{
+			name:      "Unknown step is skipped",
+			env:       "sauvola;blur,otsu",
+			wantNames: []string{"sauvola"},
+		},
+		{
+			name:      "Nothing valid falls back to grayscale",
+			env:       "blur",
+			wantNames: []string{"gray"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.env != "" {
+				os.Setenv("PREPROCESS_CHAINS", tt.env)
+				defer os.Unsetenv("PREPROCESS_CHAINS")
+			}
+
+			chains := getPreprocessChains(context.Background())
+			if len(chains) != len(tt.wantNames) {
+				t.Fatalf("got %d chains, want %d", len(chains), len(tt.wantNames))
+			}
+			for i, chain := range chains {
+				if chain.name != tt.wantNames[i] {
+					t.Errorf("chain %d is %q, want %q", i, chain.name, tt.wantNames[i])
+				}
+			}
+		})
+	}
+}
+
+func TestLocalThresholdUnevenLighting(t *testing.T) {
+	// Dark bars under lighting that fades from bright to dim, as with a phone
+	// photo lit from one side. The bars on the left are brighter than the
+	// paper on the right, so no single global threshold separates them.
+	img := image.NewGray(image.Rect(0, 0, 400, 100))
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 400; x++ {
+			img.SetGray(x, y, shadedPixel(x, 400, (x/10)%2 == 1))
+		}
+	}
+
+	for name, step := range map[string]preprocessStep{"adaptive": adaptiveThreshold, "sauvola": sauvolaThreshold} {
+		t.Run(name, func(t *testing.T) {
+			binary := step(img)
+			for x := 5; x < 400; x += 10 {
+				wantBar := (x/10)%2 == 1
+				gotBar := binary.GrayAt(x, 50).Y == 0
+				if gotBar != wantBar {
+					t.Errorf("column %d: got bar=%v, want %v", x, gotBar, wantBar)
+				}
+			}
+		})
+	}
+}
+
+func TestExtractBarcodeFromUnevenlyLitImage(t *testing.T) {
+	const want = "PROC-000123"
+	matrix, err := oned.NewCode128Writer().Encode(want, gozxing.BarcodeFormat_CODE_128, 400, 120, nil)
+	if err != nil {
+		t.Fatalf("failed to encode test barcode: %v", err)
+	}
+
+	// Render the barcode with a strong left-to-right lighting gradient
+	bounds := matrix.Bounds()
+	img := image.NewGray(bounds)
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			img.SetGray(x, y, shadedPixel(x, bounds.Dx(), matrix.Get(x, y)))
+		}
+	}
+
+	got, err := extractBarcodeFromImage(img)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got != want {
+		t.Errorf("got barcode %q, want %q", got, want)
+	}
+}
+
+// shadedPixel models paper lit from the left: illumination falls from 240 to
+// 60 across the width and ink reflects 30% of the light that reaches it.
+func shadedPixel(x, width int, ink bool) color.Gray {
+	light := 240 - x*180/width
+	if ink {
+		light = light * 3 / 10
+	}
+	return color.Gray{Y: uint8(light)}
+}
+
+func TestMedian9(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for n := 0; n < 10000; n++ {
+		var window [9]uint8
+		for i := range window {
+			// A narrow range gives plenty of ties
+			window[i] = uint8(rng.Intn(4) * 60)
+		}
+		sorted := append([]uint8(nil), window[:]...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		if got := median9(&window); got != sorted[4] {
+			t.Fatalf("median of %v: got %d, want %d", sorted, got, sorted[4])
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package processor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Profile holds the processing settings for one kind of document. The first
+// profile whose bucket and key prefix match an object is used for it.
+type Profile struct {
+	Name      string `json:"name"`
+	Bucket    string `json:"bucket,omitempty"`
+	KeyPrefix string `json:"key_prefix,omitempty"`
+
+	// Regions are decoded before anything else on the pages they apply to
+	Regions []RegionOfInterest `json:"regions,omitempty"`
+	// NoFallback skips scanning whole pages when no region yields a barcode
+	NoFallback bool `json:"no_fallback,omitempty"`
+
+	// Passwords are tried in order on encrypted PDFs
+	Passwords []PDFPassword `json:"passwords,omitempty"`
+	// PasswordSecrets name secrets holding further passwords, tried after Passwords
+	PasswordSecrets []string `json:"password_secrets,omitempty"`
+
+	// TextPatterns are regular expressions applied to the text layer of PDF
+	// pages. A pattern's first capture group, if it has one, is the value.
+	TextPatterns []string `json:"text_patterns,omitempty"`
+
+	// Metadata adds the page count, document metadata and form field values
+	// of PDFs to the results
+	Metadata bool `json:"metadata,omitempty"`
+
+	// AnnotateOutput turns on stamping decoded values onto a copy of the PDF,
+	// saved under the object's key in this location: "s3://bucket/prefix/"
+	// or a local directory
+	AnnotateOutput string `json:"annotate_output,omitempty"`
+
+	// ArtifactOutput turns on saving a thumbnail of each page and a crop of
+	// each barcode found, under the object's key in this location:
+	// "s3://bucket/prefix/" or a local directory
+	ArtifactOutput string `json:"artifact_output,omitempty"`
+
+	// DebugBundleOutput turns on saving a zip of the images, preprocessed
+	// variants, reader errors and settings when no barcode is found or the
+	// text layer disagrees with one, to "s3://bucket/prefix/" or a local
+	// directory. S3 objects are tagged retention-days with
+	// DebugBundleRetentionDays, 30 by default, for lifecycle rules to act on.
+	DebugBundleOutput        string `json:"debug_bundle_output,omitempty"`
+	DebugBundleRetentionDays int    `json:"debug_bundle_retention_days,omitempty"`
+}
+
+type profileConfig struct {
+	Profiles []Profile `json:"profiles"`
+}
+
+var defaultProfile = Profile{Name: "default"}
+
+// loadProfiles reads the profiles configured in PROFILES_CONFIG, which holds
+// either the JSON document itself or the path of a file containing it.
+func loadProfiles() ([]Profile, error) {
+	configValue := strings.TrimSpace(os.Getenv("PROFILES_CONFIG"))
+	if configValue == "" {
+		return nil, nil
+	}
+
+	data := []byte(configValue)
+	if !strings.HasPrefix(configValue, "{") {
+		var err error
+		data, err = os.ReadFile(configValue)
+		if err != nil {
+			return nil, fmt.Errorf("error reading profiles config: %v", err)
+		}
+	}
+
+	var config profileConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("error parsing profiles config: %v", err)
+	}
+	for i, profile := range config.Profiles {
+		if profile.Name == "" {
+			return nil, fmt.Errorf("profile %d has no name", i)
+		}
+		for _, region := range profile.Regions {
+			if err := region.validate(); err != nil {
+				return nil, fmt.Errorf("profile %q: %v", profile.Name, err)
+			}
+		}
+		for _, pattern := range profile.TextPatterns {
+			if _, err := regexp.Compile(pattern); err != nil {
+				return nil, fmt.Errorf("profile %q: invalid text pattern: %v", profile.Name, err)
+			}
+		}
+	}
+	return config.Profiles, nil
+}
+
+// selectProfile returns the first profile matching the object, or the default profile.
+func selectProfile(profiles []Profile, bucket, key string) Profile {
+	for _, profile := range profiles {
+		if profile.Bucket != "" && profile.Bucket != bucket {
+			continue
+		}
+		if !strings.HasPrefix(key, profile.KeyPrefix) {
+			continue
+		}
+		return profile
+	}
+	return defaultProfile
+}
+
+// getProfile loads the configured profiles and selects the one for an object.
+// Configuration errors are logged and processing continues with the default profile.
+func getProfile(ctx context.Context, bucket, key string) Profile {
+	logger := loggerFrom(ctx)
+	profiles, err := loadProfiles()
+	if err != nil {
+		logger.Warn("Invalid profiles config, using default profile", "error", err)
+		return defaultProfile
+	}
+	profile := selectProfile(profiles, bucket, key)
+	logger.Info("Using processing profile", "profile", profile.Name)
+	return profile
+}
+
+// regionsForPage returns the regions of interest that apply to a page.
+func (p Profile) regionsForPage(page int) []RegionOfInterest {
+	var regions []RegionOfInterest
+	for _, region := range p.Regions {
+		if region.Page == 0 || region.Page == page {
+			regions = append(regions, region)
+		}
+	}
+	return regions
+}
+
+// textPatterns compiles the profile's text patterns. loadProfiles has
+// checked they compile.
+func (p Profile) textPatterns() []*regexp.Regexp {
+	patterns := make([]*regexp.Regexp, 0, len(p.TextPatterns))
+	for _, pattern := range p.TextPatterns {
+		if re, err := regexp.Compile(pattern); err == nil {
+			patterns = append(patterns, re)
+		}
+	}
+	return patterns
+}
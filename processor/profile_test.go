@@ -0,0 +1,107 @@
+package processor
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadProfiles(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "profiles.json")
+	if err := os.WriteFile(configFile, []byte(`{"profiles": [{"name": "forms", "key_prefix": "forms/"}]}`), 0644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		config    string
+		wantNames []string
+		wantErr   bool
+	}{
+		{
+			name: "Not configured",
+		},
+		{
+			name:      "Inline JSON",
+			config:    `{"profiles": [{"name": "forms", "regions": [{"x": 0.8, "y": 0, "width": 0.2, "height": 0.2}]}]}`,
+			wantNames: []string{"forms"},
+		},
+		{
+			name:      "Config file",
+			config:    configFile,
+			wantNames: []string{"forms"},
+		},
+		{
+			name:    "Missing file",
+			config:  filepath.Join(dir, "missing.json"),
+			wantErr: true,
+		},
+		{
+			name:    "Profile without name",
+			config:  `{"profiles": [{"key_prefix": "forms/"}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "Region outside the page",
+			config:  `{"profiles": [{"name": "forms", "regions": [{"x": 0.9, "y": 0, "width": 0.2, "height": 0.2}]}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "Invalid text pattern",
+			config:  `{"profiles": [{"name": "forms", "text_patterns": ["INV-(\\d+"]}]}`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("PROFILES_CONFIG", tt.config)
+			defer os.Unsetenv("PROFILES_CONFIG")
+
+			profiles, err := loadProfiles()
+			if tt.wantErr {
+				if err == nil {
+					t.Error("expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(profiles) != len(tt.wantNames) {
+				t.Fatalf("got %d profiles, want %d", len(profiles), len(tt.wantNames))
+			}
+			for i, profile := range profiles {
+				if profile.Name != tt.wantNames[i] {
+					t.Errorf("profile %d is %q, want %q", i, profile.Name, tt.wantNames[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSelectProfile(t *testing.T) {
+	profiles := []Profile{
+		{Name: "partner-forms", Bucket: "partner-bucket", KeyPrefix: "forms/"},
+		{Name: "forms", KeyPrefix: "forms/"},
+		{Name: "scans", KeyPrefix: "scans/"},
+	}
+
+	tests := []struct {
+		bucket string
+		key    string
+		want   string
+	}{
+		{"partner-bucket", "forms/a.pdf", "partner-forms"},
+		{"other-bucket", "forms/a.pdf", "forms"},
+		{"other-bucket", "scans/2024/a.pdf", "scans"},
+		{"other-bucket", "invoices/a.pdf", "default"},
+	}
+
+	for _, tt := range tests {
+		if got := selectProfile(profiles, tt.bucket, tt.key); got.Name != tt.want {
+			t.Errorf("selectProfile(%q, %q) = %q, want %q", tt.bucket, tt.key, got.Name, tt.want)
+		}
+	}
+}
@@ -0,0 +1,426 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
+)
+
+// Recovery levels, from a PDF that reads cleanly to one whose images were
+// only found by scanning the raw file.
+const (
+	recoveryNone     = "none"
+	recoveryRepaired = "repaired"
+	recoveryRawScan  = "raw_scan"
+)
+
+// objectHeader matches the start of an indirect object, "12 0 obj".
+var objectHeader = regexp.MustCompile(`(\d+)\s+(\d+)\s+obj\b`)
+
+// extractPDFImagesWithRecovery extracts the images of a PDF, falling back to
+// a repaired read and then to a raw scan of the file when pdfcpu cannot read
+// it. It returns the recovery level that was needed.
+func extractPDFImagesWithRecovery(ctx context.Context, path string, pageLimit int, conf *model.Configuration) ([]pdfImage, string, error) {
+	logger := loggerFrom(ctx)
+	images, err := guarded(func() ([]pdfImage, error) {
+		return extractPDFImages(path, pageLimit, conf)
+	})
+	if err == nil {
+		return images, recoveryNone, nil
+	}
+	logger.Warn("Error extracting images, trying to repair PDF", "error", err)
+
+	images, repairErr := guarded(func() ([]pdfImage, error) {
+		return extractRepairedPDFImages(logger, path, pageLimit, conf)
+	})
+	if repairErr == nil {
+		return images, recoveryRepaired, nil
+	}
+	logger.Warn("Error repairing PDF, scanning raw streams for images", "error", repairErr)
+
+	images, scanErr := guarded(func() ([]pdfImage, error) {
+		return scanRawPDFImages(path, pageLimit)
+	})
+	if scanErr == nil && len(images) > 0 {
+		return images, recoveryRawScan, nil
+	}
+	if scanErr == nil {
+		scanErr = fmt.Errorf("no image streams found")
+	}
+	logger.Warn("Error scanning raw PDF streams", "error", scanErr)
+	return nil, "", err
+}
+
+// guarded turns a panic in pdfcpu on a malformed file into an error.
+func guarded[T any](read func() (T, error)) (result T, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic reading PDF: %v", r)
+		}
+	}()
+	return read()
+}
+
+// readPDFContext reads a PDF once for the readers of its pages and catalog.
+func readPDFContext(path string, conf *model.Configuration) (*model.Context, error) {
+	return guarded(func() (*model.Context, error) {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		ctx, err := api.ReadContext(f, conf)
+		if err != nil {
+			return nil, fmt.Errorf("error reading PDF: %v", err)
+		}
+		if err := ctx.EnsurePageCount(); err != nil {
+			return nil, fmt.Errorf("error counting pages: %v", err)
+		}
+		return ctx, nil
+	})
+}
+
+// extractRepairedPDFImages reads a PDF without validating it. If that fails
+// too, the cross-reference table is rebuilt from the objects found in the
+// file. The file is replaced with the rewritten document so later steps read
+// the repaired copy.
+func extractRepairedPDFImages(logger *slog.Logger, path string, pageLimit int, conf *model.Configuration) ([]pdfImage, error) {
+	c := *conf
+	c.Cmd = model.EXTRACTIMAGES
+	ctx, err := readRepairedContext(path, &c)
+	if err != nil {
+		logger.Warn("Error reading PDF without validation, rebuilding cross-reference table", "error", err)
+		data, readErr := os.ReadFile(path)
+		if readErr != nil {
+			return nil, readErr
+		}
+		rebuilt, rebuildErr := rebuildXRef(data, scanRawObjects(data))
+		if rebuildErr != nil {
+			return nil, fmt.Errorf("error rebuilding cross-reference table: %v", rebuildErr)
+		}
+		rebuiltPath := path + ".rebuilt"
+		if err := os.WriteFile(rebuiltPath, rebuilt, 0644); err != nil {
+			return nil, err
+		}
+		defer os.Remove(rebuiltPath)
+		if ctx, err = readRepairedContext(rebuiltPath, &c); err != nil {
+			return nil, fmt.Errorf("error reading rebuilt PDF: %v", err)
+		}
+	}
+
+	images := extractContextImages(ctx, strings.TrimSuffix(filepath.Base(path), ".pdf"), pageLimit)
+
+	repaired := path + ".repaired"
+	if err := api.WriteContextFile(ctx, repaired); err != nil {
+		logger.Warn("Error writing repaired PDF, keeping the original", "error", err)
+		os.Remove(repaired)
+	} else if err := os.Rename(repaired, path); err != nil {
+		logger.Warn("Error replacing PDF with repaired copy", "error", err)
+	}
+	return images, nil
+}
+
+// readRepairedContext reads and optimizes a PDF without validating it.
+// Panics in pdfcpu on malformed files are returned as errors.
+func readRepairedContext(path string, conf *model.Configuration) (ctx *model.Context, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	defer func() {
+		if r := recover(); r != nil {
+			ctx, err = nil, fmt.Errorf("panic reading PDF: %v", r)
+		}
+	}()
+
+	if ctx, err = api.ReadContext(f, conf); err != nil {
+		return nil, err
+	}
+	if err := api.OptimizeContext(ctx); err != nil {
+		return nil, fmt.Errorf("error optimizing PDF: %v", err)
+	}
+	return ctx, nil
+}
+
+// rawObject is an indirect object found by scanning a PDF's bytes. obj is
+// nil for objects that could not be parsed.
+type rawObject struct {
+	nr     int
+	gen    int
+	offset int
+	obj    types.Object
+}
+
+// scanRawObjects finds the indirect objects in a PDF in file order, ignoring
+// its cross-reference table.
+func scanRawObjects(data []byte) []rawObject {
+	var objects []rawObject
+	headers := objectHeader.FindAllSubmatchIndex(data, -1)
+	end := 0
+	for i, loc := range headers {
+		if loc[0] < end {
+			// Inside the stream data of the previous object
+			continue
+		}
+		limit := len(data)
+		if i+1 < len(headers) {
+			limit = headers[i+1][0]
+		}
+		nr, _ := strconv.Atoi(string(data[loc[2]:loc[3]]))
+		gen, _ := strconv.Atoi(string(data[loc[4]:loc[5]]))
+		obj, objEnd, err := parseRawObject(data, loc[1], limit)
+		end = objEnd
+		if err != nil {
+			obj = nil
+		}
+		objects = append(objects, rawObject{nr: nr, gen: gen, offset: loc[0], obj: obj})
+	}
+	return objects
+}
+
+// rootRef matches the reference to the document catalog in a trailer.
+var rootRef = regexp.MustCompile(`/Root\s+(\d+)\s+\d+\s+R`)
+
+// rebuildXRef appends a cross-reference table listing the objects found in
+// the file, so readers ignore the original one. Later definitions of an
+// object win, as they do for incremental updates.
+func rebuildXRef(data []byte, objects []rawObject) ([]byte, error) {
+	offsets := map[int]rawObject{}
+	size := 1
+	root := 0
+	for _, o := range objects {
+		offsets[o.nr] = o
+		size = max(size, o.nr+1)
+		if d, ok := o.obj.(types.Dict); ok && d.Type() != nil && *d.Type() == "Catalog" {
+			root = o.nr
+		}
+	}
+	// Prefer the catalog the trailer names, if it exists
+	if matches := rootRef.FindAllSubmatch(data, -1); len(matches) > 0 {
+		nr, _ := strconv.Atoi(string(matches[len(matches)-1][1]))
+		if _, ok := offsets[nr]; ok {
+			root = nr
+		}
+	}
+	if root == 0 {
+		return nil, fmt.Errorf("no document catalog found")
+	}
+
+	var buf bytes.Buffer
+	buf.Write(data)
+	buf.WriteString("\n")
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", size)
+	for nr := 1; nr < size; nr++ {
+		if o, ok := offsets[nr]; ok {
+			fmt.Fprintf(&buf, "%010d %05d n \n", o.offset, o.gen)
+		} else {
+			buf.WriteString("0000000000 00000 f \n")
+		}
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root %d %d R >>\nstartxref\n%d\n%%%%EOF\n", size, root, offsets[root].gen, xref)
+	return buf.Bytes(), nil
+}
+
+// scanRawPDFImages finds image XObjects by scanning a PDF for indirect
+// objects, ignoring its cross-reference table. Objects are collected into a
+// table of their own so references to lengths and color spaces resolve. The
+// pages images belong to are unknown, so every image is reported on page 0
+// under its object number. Scans hold an image per page, so the images are
+// taken in the order they appear in the file, up to one per page of the page
+// limit.
+func scanRawPDFImages(path string, pageLimit int) ([]pdfImage, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	xRefTable := &model.XRefTable{Table: map[int]*model.XRefTableEntry{}}
+	// offsets are where the objects kept in the table are defined
+	offsets := map[int]int{}
+	for _, o := range scanRawObjects(data) {
+		if o.obj != nil {
+			xRefTable.Table[o.nr] = model.NewXRefTableEntryGen0(o.obj)
+			offsets[o.nr] = o.offset
+		}
+	}
+
+	// Stream lengths may be indirect objects that follow the stream, so
+	// streams are only cut to length once every object is known
+	var images []int
+	masks := map[int]bool{}
+	for nr, entry := range xRefTable.Table {
+		sd, ok := entry.Object.(types.StreamDict)
+		if !ok {
+			continue
+		}
+		entry.Object = trimStreamLength(xRefTable, sd)
+		if sd.Subtype() == nil || *sd.Subtype() != "Image" {
+			continue
+		}
+		images = append(images, nr)
+		for _, key := range []string{"SMask", "Mask"} {
+			if ref := sd.IndirectRefEntry(key); ref != nil {
+				masks[ref.ObjectNumber.Value()] = true
+			}
+		}
+	}
+
+	base := strings.TrimSuffix(filepath.Base(path), ".pdf")
+	sort.Slice(images, func(i, j int) bool { return offsets[images[i]] < offsets[images[j]] })
+	var found []pdfImage
+	for _, nr := range images {
+		if masks[nr] {
+			continue
+		}
+		if pageLimit > 0 && len(found) == pageLimit {
+			break
+		}
+		sd := xRefTable.Table[nr].Object.(types.StreamDict)
+		found = append(found, decodePDFImage(xRefTable, &sd, base, 0, fmt.Sprintf("Obj%d", nr)))
+	}
+	return found, nil
+}
+
+// parseRawObject parses the object whose body starts at offset start, and
+// returns it together with the offset its scan ends at. Only stream data may
+// run past limit, the start of the next object header.
+func parseRawObject(data []byte, start, limit int) (types.Object, int, error) {
+	rest := data[start:]
+	bodyEnd := limit - start
+	if i := bytes.Index(rest[:bodyEnd], []byte("endobj")); i >= 0 {
+		bodyEnd = i
+	}
+	streamAt := bytes.Index(rest[:bodyEnd], []byte("stream"))
+	if streamAt < 0 {
+		body := string(rest[:bodyEnd])
+		obj, err := model.ParseObject(&body)
+		return obj, start + bodyEnd, err
+	}
+
+	head := string(rest[:streamAt])
+	obj, err := model.ParseObject(&head)
+	if err != nil {
+		return nil, start + streamAt, err
+	}
+	dict, ok := obj.(types.Dict)
+	if !ok {
+		return nil, start + streamAt, fmt.Errorf("stream without dictionary")
+	}
+
+	// Stream data starts after the end of line following "stream" and runs
+	// to "endstream", which may also occur inside binary data; the Length
+	// entry settles that once it can be resolved
+	dataStart := start + streamAt + len("stream")
+	if dataStart < len(data) && data[dataStart] == '\r' {
+		dataStart++
+	}
+	if dataStart < len(data) && data[dataStart] == '\n' {
+		dataStart++
+	}
+	dataEnd := -1
+	if length := dict.IntEntry("Length"); length != nil && *length >= 0 && dataStart+*length <= len(data) {
+		if i := bytes.Index(data[dataStart+*length:], []byte("endstream")); i >= 0 && i <= 2 {
+			dataEnd = dataStart + *length
+		}
+	}
+	if dataEnd < 0 {
+		// The last "endstream" before the next object is the stream's own
+		dataEnd = len(data)
+		if i := bytes.LastIndex(data[dataStart:max(limit, dataStart)], []byte("endstream")); i >= 0 {
+			dataEnd = dataStart + i
+		} else if i := bytes.Index(data[dataStart:], []byte("endstream")); i >= 0 {
+			dataEnd = dataStart + i
+		}
+		// Drop the end of line in front of "endstream"
+		if dataEnd > dataStart && data[dataEnd-1] == '\n' {
+			dataEnd--
+		}
+		if dataEnd > dataStart && data[dataEnd-1] == '\r' {
+			dataEnd--
+		}
+	}
+
+	filters, err := filterPipeline(dict)
+	if err != nil {
+		return nil, dataEnd, err
+	}
+	sd := types.NewStreamDict(dict, int64(dataStart), nil, nil, filters)
+	sd.Raw = data[dataStart:dataEnd]
+	return sd, dataEnd, nil
+}
+
+// trimStreamLength cuts stream data to its Length once an indirect Length
+// can be resolved.
+func trimStreamLength(xRefTable *model.XRefTable, sd types.StreamDict) types.StreamDict {
+	ref := sd.IndirectRefEntry("Length")
+	if ref == nil {
+		return sd
+	}
+	if length, err := xRefTable.DereferenceInteger(*ref); err == nil && length != nil {
+		if n := length.Value(); n >= 0 && n <= len(sd.Raw) {
+			sd.Raw = sd.Raw[:n]
+		}
+	}
+	return sd
+}
+
+// filterPipeline reads the Filter and DecodeParms entries of a stream
+// dictionary, which may each be a single value or an array.
+func filterPipeline(dict types.Dict) ([]types.PDFFilter, error) {
+	o, found := dict.Find("Filter")
+	if !found {
+		return nil, nil
+	}
+
+	var names []string
+	switch f := o.(type) {
+	case types.Name:
+		names = []string{string(f)}
+	case types.Array:
+		for _, n := range f {
+			name, ok := n.(types.Name)
+			if !ok {
+				return nil, fmt.Errorf("invalid filter %v", n)
+			}
+			names = append(names, string(name))
+		}
+	default:
+		return nil, fmt.Errorf("invalid filter %v", o)
+	}
+
+	var parms []types.Dict
+	if p, found := dict.Find("DecodeParms"); found {
+		switch p := p.(type) {
+		case types.Dict:
+			parms = []types.Dict{p}
+		case types.Array:
+			for _, d := range p {
+				d, _ := d.(types.Dict)
+				parms = append(parms, d)
+			}
+		}
+	}
+
+	filters := make([]types.PDFFilter, len(names))
+	for i, name := range names {
+		filters[i].Name = name
+		if i < len(parms) {
+			filters[i].DecodeParms = parms[i]
+		}
+	}
+	return filters, nil
+}
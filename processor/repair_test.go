@@ -0,0 +1,274 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/makiuchi-d/gozxing"
+	"github.com/makiuchi-d/gozxing/oned"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+)
+
+func TestExtractPDFImagesWithRecovery(t *testing.T) {
+	ctx := withLogger(context.Background(), discardLogger)
+
+	const text = "FIX-2024"
+	matrix, err := oned.NewCode128Writer().Encode(text, gozxing.BarcodeFormat_CODE_128, 300, 80, nil)
+	if err != nil {
+		t.Fatalf("failed to encode Code128: %v", err)
+	}
+	w, h := matrix.GetWidth(), matrix.GetHeight()
+	samples := packSamples(w, h, 1, 8, func(x, y, c int) int {
+		if matrix.Get(x, y) {
+			return 0
+		}
+		return 255
+	})
+	dict := fmt.Sprintf("/Width %d /Height %d /ColorSpace /DeviceGray /BitsPerComponent 8 /Filter /FlateDecode", w, h)
+	img := testPDFImage{dict, flateEncode(t, samples)}
+
+	tests := []struct {
+		name     string
+		corrupt  func([]byte) []byte
+		want     string
+		wantPage int
+		wantErr  bool
+	}{
+		{
+			name:     "Intact",
+			corrupt:  func(b []byte) []byte { return b },
+			want:     recoveryNone,
+			wantPage: 1,
+		},
+		{
+			name: "Wrong startxref",
+			corrupt: func(b []byte) []byte {
+				return regexp.MustCompile(`startxref\n\d+`).ReplaceAll(b, []byte("startxref\n99999"))
+			},
+			want:     recoveryRepaired,
+			wantPage: 1,
+		},
+		{
+			name: "Wrong object offsets",
+			corrupt: func(b []byte) []byte {
+				return regexp.MustCompile(`\d{10} 00000 n`).ReplaceAll(b, []byte("0000000003 00000 n"))
+			},
+			want:     recoveryRepaired,
+			wantPage: 1,
+		},
+		{
+			name:     "Truncated before the cross-reference table",
+			corrupt:  func(b []byte) []byte { return b[:bytes.Index(b, []byte("xref\n0"))] },
+			want:     recoveryRepaired,
+			wantPage: 1,
+		},
+		{
+			name: "Missing catalog",
+			corrupt: func(b []byte) []byte {
+				return bytes.Replace(b, []byte("/Root 1 0 R"), []byte("/Root 99 0 R"), 1)
+			},
+			want:     recoveryRepaired,
+			wantPage: 1,
+		},
+		{
+			name: "Unreadable catalog",
+			corrupt: func(b []byte) []byte {
+				return bytes.Replace(b, []byte("<< /Type /Catalog /Pages 2 0 R >>"), []byte("<< /Type /Catalog /Pages 2 0 R"), 1)
+			},
+			want:     recoveryRawScan,
+			wantPage: 0,
+		},
+		{
+			name: "No objects",
+			corrupt: func(b []byte) []byte {
+				return []byte("%PDF-1.7\ngarbage\n%%EOF\n")
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeTestPDF(t, testPDFPage{content: drawImages(1), images: []testPDFImage{img}})
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("failed to read test PDF: %v", err)
+			}
+			if err := os.WriteFile(path, tt.corrupt(data), 0644); err != nil {
+				t.Fatalf("failed to write test PDF: %v", err)
+			}
+
+			conf := model.NewDefaultConfiguration()
+			conf.ValidationMode = model.ValidationRelaxed
+			images, recovery, err := extractPDFImagesWithRecovery(ctx, path, 0, conf)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected error but got %d images", len(images))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if recovery != tt.want {
+				t.Errorf("got recovery %q, want %q", recovery, tt.want)
+			}
+			if len(images) != 1 {
+				t.Fatalf("got %d images, want 1", len(images))
+			}
+			if images[0].Page != tt.wantPage {
+				t.Errorf("got page %d, want %d", images[0].Page, tt.wantPage)
+			}
+			if images[0].Err != nil {
+				t.Fatalf("unexpected decode error: %v", images[0].Err)
+			}
+			if got, err := extractBarcodeFromImage(images[0].Image); err != nil || got != text {
+				t.Errorf("got barcode %q (err: %v), want %q", got, err, text)
+			}
+
+			if tt.want == recoveryRepaired {
+				// The repaired copy replaces the file and reads cleanly
+				conf := model.NewDefaultConfiguration()
+				conf.ValidationMode = model.ValidationRelaxed
+				if _, err := extractPDFImages(path, 0, conf); err != nil {
+					t.Errorf("repaired PDF does not read cleanly: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestScanRawPDFImagesIndirectLength(t *testing.T) {
+	// The image's Length is an indirect object after the stream, and its data
+	// contains "endstream"
+	data := []byte("endstream and more")
+	pdf := "%PDF-1.7\n" +
+		"4 0 obj\n<< /Type /XObject /Subtype /Image /Width 6 /Height 3 /ColorSpace /DeviceGray /BitsPerComponent 8 /Length 5 0 R >>\nstream\n" +
+		string(data) + "\nendstream\nendobj\n" +
+		"5 0 obj\n18\nendobj\n"
+	path := writeTestPDF(t)
+	if err := os.WriteFile(path, []byte(pdf), 0644); err != nil {
+		t.Fatalf("failed to write test PDF: %v", err)
+	}
+
+	images, err := scanRawPDFImages(path, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(images) != 1 {
+		t.Fatalf("got %d images, want 1", len(images))
+	}
+	if images[0].Err != nil {
+		t.Fatalf("unexpected decode error: %v", images[0].Err)
+	}
+	if images[0].Name != "input_0_Obj4.png" {
+		t.Errorf("got name %q, want input_0_Obj4.png", images[0].Name)
+	}
+	if got := images[0].Image.Bounds(); got.Dx() != 6 || got.Dy() != 3 {
+		t.Errorf("got %v image, want 6x3", got)
+	}
+}
+
+func TestScanRawPDFImagesPageLimit(t *testing.T) {
+	// Three images and a mask, numbered out of the order they appear in
+	image := func(nr int, extra string) string {
+		return fmt.Sprintf("%d 0 obj\n<< /Type /XObject /Subtype /Image /Width 2 /Height 1 /ColorSpace /DeviceGray /BitsPerComponent 8%s /Length 2 >>\nstream\n\x00\xff\nendstream\nendobj\n", nr, extra)
+	}
+	pdf := "%PDF-1.7\n" + image(9, " /SMask 2 0 R") + image(2, "") + image(4, "") + image(7, "")
+	path := writeTestPDF(t)
+	if err := os.WriteFile(path, []byte(pdf), 0644); err != nil {
+		t.Fatalf("failed to write test PDF: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		pageLimit int
+		want      []string
+	}{
+		{"No limit", 0, []string{"input_0_Obj9.png", "input_0_Obj4.png", "input_0_Obj7.png"}},
+		{"Two pages", 2, []string{"input_0_Obj9.png", "input_0_Obj4.png"}},
+		{"More pages than images", 5, []string{"input_0_Obj9.png", "input_0_Obj4.png", "input_0_Obj7.png"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			images, err := scanRawPDFImages(path, tt.pageLimit)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var names []string
+			for _, image := range images {
+				names = append(names, image.Name)
+			}
+			if fmt.Sprint(names) != fmt.Sprint(tt.want) {
+				t.Errorf("got images %v, want %v", names, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleRequestRawScanSkipsPDFReaders(t *testing.T) {
+	ctx := withLogger(context.Background(), discardLogger)
+
+	var payload BarcodeData
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&payload)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	img := barcodeImage(t, "RAW-1")
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	path := writeTestPDF(t, testPDFPage{
+		content: drawImages(1),
+		images: []testPDFImage{{
+			fmt.Sprintf("/Width %d /Height %d /ColorSpace /DeviceGray /BitsPerComponent 8", w, h),
+			img.Pix,
+		}},
+	})
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read test PDF: %v", err)
+	}
+	// An unreadable catalog leaves only the raw scan
+	data = bytes.Replace(data, []byte("<< /Type /Catalog /Pages 2 0 R >>"), []byte("<< /Type /Catalog /Pages 2 0 R"), 1)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("failed to write test PDF: %v", err)
+	}
+	output := t.TempDir()
+
+	os.Setenv("TEST_PDF_PATH", path)
+	os.Setenv("PROFILES_CONFIG", fmt.Sprintf(`{"profiles": [{"name": "all", "text_patterns": ["RAW-\\d"], "metadata": true, "annotate_output": %q, "regions": [{"units": "points", "x": 0, "y": 0, "width": 100, "height": 100}]}]}`, output))
+	os.Setenv("WEBHOOK_URL", server.URL)
+	os.Setenv("WEBHOOK_TOKEN", "test-token")
+	defer func() {
+		os.Unsetenv("TEST_PDF_PATH")
+		os.Unsetenv("PROFILES_CONFIG")
+		os.Unsetenv("WEBHOOK_URL")
+		os.Unsetenv("WEBHOOK_TOKEN")
+	}()
+
+	response, err := HandleRequest(ctx, events.S3Event{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if response.StatusCode != 200 {
+		t.Fatalf("got status %d, want 200", response.StatusCode)
+	}
+	if payload.Recovery != recoveryRawScan {
+		t.Errorf("got recovery %q, want %q", payload.Recovery, recoveryRawScan)
+	}
+	if len(payload.BarcodeArray) != 1 || payload.BarcodeArray[0] != "RAW-1" {
+		t.Errorf("got barcodes %v, want [RAW-1]", payload.BarcodeArray)
+	}
+	if payload.Metadata != nil || payload.Annotated != "" || len(payload.TextMatches) != 0 {
+		t.Errorf("PDF readers ran on a raw scan: %+v", payload)
+	}
+}
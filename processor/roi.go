@@ -0,0 +1,124 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"math"
+)
+
+const (
+	roiUnitsRelative = "relative"
+	roiUnitsPoints   = "points"
+)
+
+// RegionOfInterest is an area of a page where barcodes are expected.
+// Relative regions are fractions of the page measured from its top-left
+// corner, so {"x": 0.8, "y": 0, "width": 0.2, "height": 0.2} is the top-right
+// corner. Point regions are in PDF user space, with the origin bottom-left.
+type RegionOfInterest struct {
+	// Page is the 1-based page the region applies to, 0 for every page
+	Page   int     `json:"page,omitempty"`
+	Units  string  `json:"units,omitempty"`
+	X      float64 `json:"x"`
+	Y      float64 `json:"y"`
+	Width  float64 `json:"width"`
+	Height float64 `json:"height"`
+}
+
+func (r RegionOfInterest) validate() error {
+	if r.Width <= 0 || r.Height <= 0 {
+		return fmt.Errorf("region of interest must have a positive width and height")
+	}
+	switch r.Units {
+	case "", roiUnitsRelative:
+		if r.X < 0 || r.Y < 0 || r.X+r.Width > 1 || r.Y+r.Height > 1 {
+			return fmt.Errorf("relative region of interest must lie within 0..1")
+		}
+	case roiUnitsPoints:
+	default:
+		return fmt.Errorf("unknown region of interest units %q", r.Units)
+	}
+	return nil
+}
+
+// rect returns the region in the pixels of an image of a page. Relative
+// regions take the image to show the whole page; regions in points are
+// mapped through placement, the matrix the image is drawn on the page with.
+func (r RegionOfInterest) rect(bounds image.Rectangle, placement *pdfMatrix) (image.Rectangle, error) {
+	w, h := float64(bounds.Dx()), float64(bounds.Dy())
+	var x0, y0, x1, y1 float64
+	switch r.Units {
+	case "", roiUnitsRelative:
+		x0, y0 = r.X*w, r.Y*h
+		x1, y1 = (r.X+r.Width)*w, (r.Y+r.Height)*h
+	case roiUnitsPoints:
+		if placement == nil {
+			return image.Rectangle{}, fmt.Errorf("page layout unknown for region in points")
+		}
+		toImage, ok := placement.invert()
+		if !ok {
+			return image.Rectangle{}, fmt.Errorf("image is not drawn with an area on its page")
+		}
+		x0, y0 = math.Inf(1), math.Inf(1)
+		x1, y1 = math.Inf(-1), math.Inf(-1)
+		for _, corner := range [][2]float64{{r.X, r.Y}, {r.X + r.Width, r.Y}, {r.X, r.Y + r.Height}, {r.X + r.Width, r.Y + r.Height}} {
+			u, v := toImage.apply(corner[0], corner[1])
+			// Image space has its origin at the bottom-left
+			x, y := u*w, (1-v)*h
+			x0, y0 = math.Min(x0, x), math.Min(y0, y)
+			x1, y1 = math.Max(x1, x), math.Max(y1, y)
+		}
+		// Clamp regions far off the image before they are made integers
+		x0, y0 = math.Max(x0, -1), math.Max(y0, -1)
+		x1, y1 = math.Min(x1, w+1), math.Min(y1, h+1)
+	default:
+		return image.Rectangle{}, fmt.Errorf("unknown region of interest units %q", r.Units)
+	}
+
+	rect := image.Rect(int(x0), int(y0), int(x1+0.5), int(y1+0.5)).Add(bounds.Min)
+	return rect.Intersect(bounds), nil
+}
+
+// scanPage decodes the barcodes in one extracted image using the profile's
+// regions of interest for its page. Only images that show a whole page are
+// cropped to the regions; if the regions yield nothing, the whole image is
+// scanned unless the profile disables that fallback.
+func scanPage(ctx context.Context, img image.Image, profile Profile, page int, placement *pdfMatrix) []Barcode {
+	if img == nil {
+		return nil
+	}
+	regions := profile.regionsForPage(page)
+	if len(regions) == 0 || classifyImage(img.Bounds()) != imageKindPage {
+		return scanImage(ctx, img)
+	}
+
+	logger := loggerFrom(ctx)
+	var found []Barcode
+	for _, region := range regions {
+		rect, err := region.rect(img.Bounds(), placement)
+		if err != nil {
+			logger.Warn("Skipping region of interest", "error", err)
+			continue
+		}
+		if rect.Empty() {
+			continue
+		}
+
+		logger.Debug("Scanning region of interest", "region", rect.String())
+		offset := rect.Min.Sub(img.Bounds().Min)
+		for _, barcode := range scanImage(ctx, cropImage(img, rect)) {
+			if barcode.ImageRegion != nil {
+				barcode.ImageRegion.X += offset.X
+				barcode.ImageRegion.Y += offset.Y
+			}
+			found = append(found, barcode)
+		}
+	}
+
+	if len(found) > 0 || profile.NoFallback {
+		return found
+	}
+	logger.Debug("Nothing found in regions of interest, scanning the whole page")
+	return scanImage(ctx, img)
+}
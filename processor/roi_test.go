@@ -0,0 +1,120 @@
+package processor
+
+import (
+	"context"
+	"image"
+	"testing"
+
+	"github.com/makiuchi-d/gozxing"
+	"github.com/makiuchi-d/gozxing/oned"
+)
+
+func TestRegionOfInterestRect(t *testing.T) {
+	// A4 page rendered at 150dpi
+	bounds := image.Rect(0, 0, 1240, 1754)
+	a4 := &pdfMatrix{595, 0, 0, 842, 0, 0}
+
+	tests := []struct {
+		name      string
+		region    RegionOfInterest
+		placement *pdfMatrix
+		want      image.Rectangle
+		wantErr   bool
+	}{
+		{
+			name:   "Relative top-right corner",
+			region: RegionOfInterest{X: 0.8, Y: 0, Width: 0.2, Height: 0.2},
+			want:   image.Rect(992, 0, 1240, 351),
+		},
+		{
+			name:      "Points from the bottom-left origin",
+			region:    RegionOfInterest{Units: roiUnitsPoints, X: 0, Y: 0, Width: 297.5, Height: 421},
+			placement: a4,
+			want:      image.Rect(0, 877, 620, 1754),
+		},
+		{
+			name:    "Points without page layout",
+			region:  RegionOfInterest{Units: roiUnitsPoints, X: 0, Y: 0, Width: 100, Height: 100},
+			wantErr: true,
+		},
+		{
+			name:      "Points beyond the page are clipped",
+			region:    RegionOfInterest{Units: roiUnitsPoints, X: 500, Y: 800, Width: 200, Height: 200},
+			placement: a4,
+			want:      image.Rect(1042, 0, 1240, 87),
+		},
+		{
+			// The image fills the top-right quarter of the page
+			name:      "Points on an image drawn on part of the page",
+			region:    RegionOfInterest{Units: roiUnitsPoints, X: 446.25, Y: 631.5, Width: 148.75, Height: 210.5},
+			placement: &pdfMatrix{297.5, 0, 0, 421, 297.5, 421},
+			want:      image.Rect(620, 0, 1240, 877),
+		},
+		{
+			name:      "Points on an image drawn without an area",
+			region:    RegionOfInterest{Units: roiUnitsPoints, X: 0, Y: 0, Width: 100, Height: 100},
+			placement: &pdfMatrix{},
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.region.rect(bounds, tt.placement)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScanPageRegionsOfInterest(t *testing.T) {
+	ctx := withLogger(context.Background(), discardLogger)
+
+	page := testPage(t)
+	matrix, err := oned.NewCode128Writer().Encode("DOC-88123", gozxing.BarcodeFormat_CODE_128, 220, 60, nil)
+	if err != nil {
+		t.Fatalf("failed to encode Code128: %v", err)
+	}
+	barcodeRect := drawMatrix(page, matrix, image.Pt(980, 40))
+
+	topRight := RegionOfInterest{X: 0.75, Y: 0, Width: 0.25, Height: 0.2}
+	bottomLeft := RegionOfInterest{X: 0, Y: 0.8, Width: 0.25, Height: 0.2}
+
+	tests := []struct {
+		name    string
+		profile Profile
+		page    int
+		want    int
+	}{
+		{"No regions", Profile{}, 1, 1},
+		{"Region containing the barcode", Profile{Regions: []RegionOfInterest{topRight}}, 1, 1},
+		{"Region for another page falls through to full scan", Profile{Regions: []RegionOfInterest{{Page: 2, X: 0, Y: 0.8, Width: 0.25, Height: 0.2}}}, 1, 1},
+		{"Empty region falls back to full page", Profile{Regions: []RegionOfInterest{bottomLeft}}, 1, 1},
+		{"Empty region without fallback", Profile{Regions: []RegionOfInterest{bottomLeft}, NoFallback: true}, 1, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			barcodes := scanPage(ctx, page, tt.profile, tt.page, nil)
+			if len(barcodes) != tt.want {
+				t.Fatalf("got %d barcodes, want %d", len(barcodes), tt.want)
+			}
+			for _, b := range barcodes {
+				got := image.Rect(b.ImageRegion.X, b.ImageRegion.Y, b.ImageRegion.X+b.ImageRegion.Width, b.ImageRegion.Y+b.ImageRegion.Height)
+				if !got.Overlaps(barcodeRect) {
+					t.Errorf("region %v is not in page coordinates of the barcode at %v", got, barcodeRect)
+				}
+			}
+		})
+	}
+}
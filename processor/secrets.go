@@ -0,0 +1,74 @@
+package processor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+)
+
+// secretSource looks up secret values by name.
+type secretSource interface {
+	GetSecret(ctx context.Context, name string) (string, error)
+}
+
+// secretsManagerSource reads secrets from AWS Secrets Manager.
+type secretsManagerSource struct {
+	client *secretsmanager.Client
+}
+
+func (s *secretsManagerSource) GetSecret(ctx context.Context, name string) (string, error) {
+	out, err := s.client.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(name),
+	})
+	if err != nil {
+		return "", fmt.Errorf("error getting secret %s: %v", name, err)
+	}
+	if out.SecretString == nil {
+		return "", fmt.Errorf("secret %s has no string value", name)
+	}
+	return *out.SecretString, nil
+}
+
+// fileSecretSource reads secrets from a local JSON file mapping secret names
+// to values. It stands in for Secrets Manager in local runs and tests.
+type fileSecretSource struct {
+	path string
+}
+
+func (s *fileSecretSource) GetSecret(ctx context.Context, name string) (string, error) {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return "", fmt.Errorf("error reading secrets file: %v", err)
+	}
+	var secrets map[string]string
+	if err := json.Unmarshal(data, &secrets); err != nil {
+		return "", fmt.Errorf("error parsing secrets file: %v", err)
+	}
+	value, ok := secrets[name]
+	if !ok {
+		return "", fmt.Errorf("secret %s not found in %s", name, s.path)
+	}
+	return value, nil
+}
+
+// getSecretSource returns the file named by SECRETS_FILE if set, and Secrets
+// Manager otherwise.
+func getSecretSource(ctx context.Context) (secretSource, error) {
+	if path := os.Getenv("SECRETS_FILE"); path != "" {
+		return &fileSecretSource{path: path}, nil
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx,
+		config.WithRetryMaxAttempts(3),
+		config.WithRetryMode(aws.RetryModeStandard),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %v", err)
+	}
+	return &secretsManagerSource{client: secretsmanager.NewFromConfig(cfg)}, nil
+}
@@ -0,0 +1,60 @@
+package processor
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileSecretSource(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "secrets.json")
+	if err := os.WriteFile(path, []byte(`{"bank/pdf": "s3cret"}`), 0644); err != nil {
+		t.Fatalf("failed to write secrets: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		secret  string
+		want    string
+		wantErr bool
+	}{
+		{"Existing secret", path, "bank/pdf", "s3cret", false},
+		{"Missing secret", path, "bank/other", "", true},
+		{"Missing file", filepath.Join(dir, "missing.json"), "bank/pdf", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := &fileSecretSource{path: tt.path}
+			got, err := source.GetSecret(context.Background(), tt.secret)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetSecretSourceFile(t *testing.T) {
+	os.Setenv("SECRETS_FILE", "secrets.json")
+	defer os.Unsetenv("SECRETS_FILE")
+
+	source, err := getSecretSource(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := source.(*fileSecretSource); !ok {
+		t.Errorf("got %T, want *fileSecretSource", source)
+	}
+}
@@ -0,0 +1,299 @@
+package processor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// uploadMemory is how much of a multipart upload is held in memory before
+	// the rest goes to temporary files
+	uploadMemory = 8 << 20
+	// requestOverhead is allowed on top of the document size for the rest of
+	// a request's body
+	requestOverhead       = 1 << 20
+	defaultQueueTimeout   = 30 * time.Second
+	serverShutdownTimeout = 30 * time.Second
+)
+
+// ServerConfig are the limits of the HTTP server.
+type ServerConfig struct {
+	// MaxRequestBytes bounds the body of a request, by default enough for a
+	// document of MAX_DOCUMENT_BYTES sent base64-encoded
+	MaxRequestBytes int64
+	// Concurrency is how many requests are scanned at once, by default the
+	// number of CPUs
+	Concurrency int
+	// QueueTimeout is how long a request waits for a scan to finish before it
+	// is turned away, 30 seconds by default
+	QueueTimeout time.Duration
+	// Logger receives the logs of the server and its scans, by default JSON
+	// lines on the standard logger's output
+	Logger *slog.Logger
+}
+
+// withDefaults fills in the limits that are not set.
+func (c ServerConfig) withDefaults(ctx context.Context) ServerConfig {
+	if c.MaxRequestBytes <= 0 {
+		c.MaxRequestBytes = getMaxDocumentBytes(ctx)*4/3 + requestOverhead
+	}
+	if c.Concurrency <= 0 {
+		c.Concurrency = runtime.NumCPU()
+	}
+	if c.QueueTimeout <= 0 {
+		c.QueueTimeout = defaultQueueTimeout
+	}
+	if c.Logger == nil {
+		c.Logger = newLogger()
+	}
+	return c
+}
+
+// server answers scan requests over HTTP with the pipeline of direct
+// invocations.
+type server struct {
+	config ServerConfig
+	// slots holds a value for each request being scanned
+	slots chan struct{}
+}
+
+// NewServer returns the handler of the HTTP API:
+//
+//	POST /scan     scan a multipart upload's "file", or a JSON ScanRequest
+//	GET  /healthz  report the server is up
+//	GET  /metrics  the metrics of the documents processed, in the Prometheus
+//	               text format
+//
+// Scans answer with a ScanResponse, whose status code is the response's.
+// Requests that do not name their sinks use those configured: the webhook
+// only if WEBHOOK_URL is set.
+func NewServer(config ServerConfig) http.Handler {
+	config = config.withDefaults(context.Background())
+	s := &server{config: config, slots: make(chan struct{}, config.Concurrency)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/scan", s.handleScan)
+	mux.HandleFunc("/healthz", s.handleHealth)
+	mux.HandleFunc("/metrics", s.handleMetrics)
+	return s.instrument(mux)
+}
+
+// Serve runs the HTTP API on addr until ctx is done, then waits for the
+// requests in progress. Metrics are only served on /metrics, not written as
+// Embedded Metric Format records.
+func Serve(ctx context.Context, addr string, config ServerConfig) error {
+	metricsOutput = io.Discard
+	config = config.withDefaults(ctx)
+	httpServer := &http.Server{
+		Addr:              addr,
+		Handler:           NewServer(config),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- httpServer.ListenAndServe()
+	}()
+	config.Logger.Info("Serving the HTTP API", "addr", addr,
+		"max_request_bytes", config.MaxRequestBytes, "concurrency", config.Concurrency)
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+	config.Logger.Info("Shutting down the HTTP API")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), serverShutdownTimeout)
+	defer cancel()
+	return httpServer.Shutdown(shutdownCtx)
+}
+
+// statusRecorder keeps the status code of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	statusCode int
+}
+
+func (r *statusRecorder) WriteHeader(statusCode int) {
+	r.statusCode = statusCode
+	r.ResponseWriter.WriteHeader(statusCode)
+}
+
+// instrument counts requests by path and status code, and the requests in
+// progress, and gives requests the server's logger.
+func (s *server) instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = r.WithContext(withLogger(r.Context(), s.config.Logger))
+		processMetrics.add("gauge", metricsPrefix+"http_requests_in_flight", "", 1)
+		defer processMetrics.add("gauge", metricsPrefix+"http_requests_in_flight", "", -1)
+		recorder := &statusRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+		processMetrics.add("counter", metricsPrefix+"http_requests_total", "", 1,
+			"path", r.URL.Path, "status_code", strconv.Itoa(recorder.statusCode))
+	})
+}
+
+func (s *server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"status":"ok"}` + "\n"))
+}
+
+func (s *server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := processMetrics.writeTo(w); err != nil {
+		s.config.Logger.Warn("Error writing metrics", "error", err)
+	}
+}
+
+// handleScan reads the document of a request, then scans it once a slot is
+// free, or turns the request away if none is before the queue timeout.
+func (s *server) handleScan(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, s.config.MaxRequestBytes)
+	request, err := readScanRequest(r)
+	if err != nil {
+		status := http.StatusBadRequest
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			status = http.StatusRequestEntityTooLarge
+			err = fmt.Errorf("request is larger than %d bytes", tooLarge.Limit)
+		}
+		writeScanResponse(w, ScanResponse{StatusCode: status, Error: err.Error()})
+		return
+	}
+	if request.Sinks == nil {
+		request.Sinks = configuredSinks()
+	}
+
+	timer := time.NewTimer(s.config.QueueTimeout)
+	defer timer.Stop()
+	select {
+	case s.slots <- struct{}{}:
+		defer func() { <-s.slots }()
+	case <-timer.C:
+		w.Header().Set("Retry-After", strconv.Itoa(int(s.config.QueueTimeout.Seconds())+1))
+		writeScanResponse(w, ScanResponse{StatusCode: http.StatusServiceUnavailable, Error: "too many scans in progress"})
+		return
+	case <-r.Context().Done():
+		return
+	}
+	writeScanResponse(w, ScanDocument(r.Context(), request))
+}
+
+// configuredSinks are the sinks of a request that names none. The webhook is
+// left out without WEBHOOK_URL, as a server often runs without one; the
+// profile's outputs are only used where the profile sets them.
+func configuredSinks() []string {
+	configured := []string{}
+	for _, sink := range sinks {
+		if sink == sinkWebhook && os.Getenv("WEBHOOK_URL") == "" {
+			continue
+		}
+		configured = append(configured, sink)
+	}
+	return configured
+}
+
+// readScanRequest reads a ScanRequest from a JSON body, or from a multipart
+// form with the document as "file" and the settings as form values, lists
+// separated by commas.
+func readScanRequest(r *http.Request) (ScanRequest, error) {
+	var request ScanRequest
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return request, fmt.Errorf("invalid content type: %v", err)
+	}
+
+	switch mediaType {
+	case "application/json":
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			return request, fmt.Errorf("invalid request: %w", err)
+		}
+		return request, nil
+
+	case "multipart/form-data":
+		if err := r.ParseMultipartForm(uploadMemory); err != nil {
+			return request, fmt.Errorf("invalid form: %w", err)
+		}
+		defer r.MultipartForm.RemoveAll()
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			return request, fmt.Errorf("form has no file: %v", err)
+		}
+		defer file.Close()
+		request.document, err = io.ReadAll(file)
+		if err != nil {
+			return request, fmt.Errorf("error reading file: %w", err)
+		}
+
+		request.Bucket = r.FormValue("bucket")
+		request.Key = r.FormValue("key")
+		if name := path.Base(header.Filename); request.Key == "" && name != "." && name != "/" {
+			request.Key = name
+		}
+		request.Pages = r.FormValue("pages")
+		request.Symbologies = formList(r, "symbologies")
+		request.Sinks = formList(r, "sinks")
+		if value := r.FormValue("return_inline"); value != "" {
+			inline, err := strconv.ParseBool(value)
+			if err != nil {
+				return request, fmt.Errorf("invalid return_inline %q", value)
+			}
+			request.ReturnInline = &inline
+		}
+		return request, nil
+	}
+	return request, fmt.Errorf("unsupported content type %q, expected application/json or multipart/form-data", mediaType)
+}
+
+// formList reads a comma-separated form value. It is nil if the form does not
+// have the field, and empty if the field is.
+func formList(r *http.Request, name string) []string {
+	if _, ok := r.MultipartForm.Value[name]; !ok {
+		return nil
+	}
+	list := []string{}
+	for _, item := range strings.Split(r.FormValue(name), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func writeScanResponse(w http.ResponseWriter, response ScanResponse) {
+	if response.StatusCode == 0 {
+		response.StatusCode = http.StatusInternalServerError
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(response.StatusCode)
+	json.NewEncoder(w).Encode(response)
+}
+
+func writeMethodNotAllowed(w http.ResponseWriter, allowed string) {
+	w.Header().Set("Allow", allowed)
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+}
@@ -0,0 +1,209 @@
+package processor
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// multipartBody builds a form with a file and the given fields.
+func multipartBody(t *testing.T, filename string, data []byte, fields map[string]string) (string, *bytes.Buffer) {
+	var buf bytes.Buffer
+	form := multipart.NewWriter(&buf)
+	for name, value := range fields {
+		if err := form.WriteField(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if filename != "" {
+		part, err := form.CreateFormFile("file", filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write(data)
+	}
+	if err := form.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return form.FormDataContentType(), &buf
+}
+
+func TestServerScan(t *testing.T) {
+	metricsOutput = io.Discard
+	defer func() { metricsOutput = os.Stdout }()
+
+	img := barcodeImage(t, "SERVE-1")
+	data, err := os.ReadFile(writeTestPDF(t, testPDFPage{
+		content: drawImages(1),
+		images: []testPDFImage{{
+			fmt.Sprintf("/Width %d /Height %d /ColorSpace /DeviceGray /BitsPerComponent 8", img.Bounds().Dx(), img.Bounds().Dy()),
+			img.Pix,
+		}},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(NewServer(ServerConfig{MaxRequestBytes: 64 << 10, Logger: discardLogger}))
+	defer server.Close()
+
+	uploadType, upload := multipartBody(t, "in/scan.pdf", data, map[string]string{"sinks": ""})
+	// Without WEBHOOK_URL a request naming no sinks is not sent to the webhook
+	bareType, bare := multipartBody(t, "scan.pdf", data, nil)
+	namedType, named := multipartBody(t, "scan.pdf", data, map[string]string{"key": "named.pdf", "sinks": "", "symbologies": "QR_CODE, AZTEC"})
+	notInlineType, notInline := multipartBody(t, "scan.pdf", data, map[string]string{"sinks": "", "return_inline": "no"})
+	traversalType, traversal := multipartBody(t, "scan.pdf", data, map[string]string{"key": "../../etc/cron.d/x"})
+	noFileType, noFile := multipartBody(t, "", nil, map[string]string{"key": "a.pdf"})
+	tooLargeType, tooLarge := multipartBody(t, "scan.pdf", bytes.Repeat([]byte("%"), 128<<10), nil)
+	jsonBody := mustJSON(t, ScanRequest{Body: base64.StdEncoding.EncodeToString(data), Sinks: []string{}})
+
+	tests := []struct {
+		name         string
+		contentType  string
+		body         io.Reader
+		wantStatus   int
+		wantKey      string
+		wantBarcodes []string
+		wantErr      bool
+	}{
+		{"Upload", uploadType, upload, 200, "scan.pdf", []string{"SERVE-1"}, false},
+		{"Bare upload", bareType, bare, 200, "scan.pdf", []string{"SERVE-1"}, false},
+		{"Upload with settings", namedType, named, 200, "named.pdf", []string{}, false},
+		{"JSON", "application/json", strings.NewReader(jsonBody), 200, "body", []string{"SERVE-1"}, false},
+		{"Invalid return_inline", notInlineType, notInline, 400, "", nil, true},
+		{"Key climbing out", traversalType, traversal, 400, "", nil, true},
+		{"Upload without file", noFileType, noFile, 400, "", nil, true},
+		{"Too large", tooLargeType, tooLarge, 413, "", nil, true},
+		{"Invalid JSON", "application/json", strings.NewReader("{"), 400, "", nil, true},
+		{"Unsupported content type", "application/pdf", bytes.NewReader(data), 400, "", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := http.Post(server.URL+"/scan", tt.contentType, tt.body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+			var response ScanResponse
+			if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+				t.Fatalf("invalid response: %v", err)
+			}
+			if res.StatusCode != tt.wantStatus || response.StatusCode != tt.wantStatus || (response.Error != "") != tt.wantErr {
+				t.Fatalf("got status %d and %+v, want status %d and an error: %v", res.StatusCode, response, tt.wantStatus, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if response.Result == nil {
+				t.Fatalf("got no result inline")
+			}
+			if response.Result.Key != tt.wantKey || !reflect.DeepEqual(response.Result.Barcodes, tt.wantBarcodes) {
+				t.Errorf("got %s with barcodes %v, want %s with %v", response.Result.Key, response.Result.Barcodes, tt.wantKey, tt.wantBarcodes)
+			}
+		})
+	}
+}
+
+func TestServerConcurrency(t *testing.T) {
+	// The first request holds the only slot while its document is fetched.
+	// Requests are read before they wait for one, so a request that is too
+	// large is turned away as such.
+	fetching := make(chan struct{})
+	release := make(chan struct{})
+	documents := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(fetching)
+		<-release
+		http.NotFound(w, r)
+	}))
+	defer documents.Close()
+	server := httptest.NewServer(NewServer(ServerConfig{MaxRequestBytes: 64 << 10, Concurrency: 1, QueueTimeout: 50 * time.Millisecond, Logger: discardLogger}))
+	defer server.Close()
+	os.Setenv("FETCH_ALLOWED_HOSTS", "127.0.0.1")
+	defer os.Unsetenv("FETCH_ALLOWED_HOSTS")
+
+	post := func() (*http.Response, error) {
+		return http.Post(server.URL+"/scan", "application/json", strings.NewReader(mustJSON(t, ScanRequest{URL: documents.URL})))
+	}
+	first := make(chan int)
+	go func() {
+		res, err := post()
+		if err != nil {
+			first <- 0
+			return
+		}
+		res.Body.Close()
+		first <- res.StatusCode
+	}()
+	<-fetching
+
+	res, err := post()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusServiceUnavailable || res.Header.Get("Retry-After") == "" {
+		t.Errorf("got status %d with Retry-After %q, want 503 with one", res.StatusCode, res.Header.Get("Retry-After"))
+	}
+	tooLargeType, tooLarge := multipartBody(t, "scan.pdf", bytes.Repeat([]byte("%"), 128<<10), nil)
+	res, err = http.Post(server.URL+"/scan", tooLargeType, tooLarge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("got status %d for a request too large while the slot is taken, want 413", res.StatusCode)
+	}
+	close(release)
+	if status := <-first; status != http.StatusBadRequest {
+		t.Errorf("got status %d for the first request, want 400 for its missing document", status)
+	}
+}
+
+func TestServerEndpoints(t *testing.T) {
+	server := httptest.NewServer(NewServer(ServerConfig{}))
+	defer server.Close()
+	// Count a request to see on /metrics
+	if res, err := http.Get(server.URL + "/healthz"); err == nil {
+		res.Body.Close()
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		wantStatus int
+		wantBody   string
+	}{
+		{"Health", http.MethodGet, "/healthz", 200, `{"status":"ok"}`},
+		{"Metrics", http.MethodGet, "/metrics", 200, `pdf_processor_http_requests_total{path="/healthz",status_code="200"}`},
+		{"Scan with GET", http.MethodGet, "/scan", 405, "method not allowed"},
+		{"Metrics with POST", http.MethodPost, "/metrics", 405, "method not allowed"},
+		{"Unknown path", http.MethodGet, "/scans", 404, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, server.URL+tt.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+			body, _ := io.ReadAll(res.Body)
+			if res.StatusCode != tt.wantStatus || !strings.Contains(string(body), tt.wantBody) {
+				t.Errorf("got status %d with %q, want %d with %q", res.StatusCode, body, tt.wantStatus, tt.wantBody)
+			}
+		})
+	}
+}
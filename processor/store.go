@@ -0,0 +1,198 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// objectStore saves output files under a key, and reads them back.
+type objectStore interface {
+	Put(ctx context.Context, key string, data []byte, contentType string) error
+	Get(ctx context.Context, key string) ([]byte, error)
+	// List returns the keys starting with prefix, in order
+	List(ctx context.Context, prefix string) ([]string, error)
+	// Location describes where a key is saved, for reporting
+	Location(key string) string
+}
+
+// s3Store saves objects to an S3 bucket, with tags if any are set.
+type s3Store struct {
+	client *s3.Client
+	bucket string
+	tags   map[string]string
+}
+
+func (s *s3Store) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String(contentType),
+	}
+	if len(s.tags) > 0 {
+		tags := url.Values{}
+		for name, value := range s.tags {
+			tags.Set(name, value)
+		}
+		input.Tagging = aws.String(tags.Encode())
+	}
+	_, err := s.client.PutObject(ctx, input)
+	if err != nil {
+		return fmt.Errorf("error saving s3://%s/%s: %v", s.bucket, key, err)
+	}
+	return nil
+}
+
+func (s *s3Store) Get(ctx context.Context, key string) ([]byte, error) {
+	result, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error getting s3://%s/%s: %w", s.bucket, key, err)
+	}
+	defer result.Body.Close()
+	data, err := io.ReadAll(result.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading s3://%s/%s: %v", s.bucket, key, err)
+	}
+	return data, nil
+}
+
+func (s *s3Store) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("error listing s3://%s/%s: %v", s.bucket, prefix, err)
+		}
+		for _, object := range page.Contents {
+			keys = append(keys, aws.ToString(object.Key))
+		}
+	}
+	return keys, nil
+}
+
+func (s *s3Store) Location(key string) string {
+	return "s3://" + s.bucket + "/" + key
+}
+
+// dirStore saves objects as files below a local directory, for local runs
+// and tests.
+type dirStore struct {
+	dir string
+}
+
+func (s *dirStore) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("error creating directory for %s: %v", path, err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("error saving %s: %v", path, err)
+	}
+	return nil
+}
+
+func (s *dirStore) Get(ctx context.Context, key string) ([]byte, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(path)
+}
+
+func (s *dirStore) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	err := filepath.WalkDir(s.dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(s.dir, path)
+		if err != nil {
+			return err
+		}
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing %s: %v", s.dir, err)
+	}
+	return keys, nil
+}
+
+func (s *dirStore) Location(key string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(key))
+}
+
+// path returns the file of a key, which must be within the directory: keys
+// come from object keys and requests, and one such as "../x" would otherwise
+// write anywhere.
+func (s *dirStore) path(key string) (string, error) {
+	path := s.Location(key)
+	if rel, err := filepath.Rel(s.dir, path); err != nil || !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("key %q is outside %s", key, s.dir)
+	}
+	return path, nil
+}
+
+// isNotFound reports whether a Get failed because there is no object under
+// the key.
+func isNotFound(err error) bool {
+	var noSuchKey *s3types.NoSuchKey
+	return errors.Is(err, fs.ErrNotExist) || errors.As(err, &noSuchKey)
+}
+
+// openObjectStore returns the store for an output location, either
+// "s3://bucket/prefix" or a local directory, together with the key prefix
+// within it.
+func openObjectStore(location string) (objectStore, string, error) {
+	if rest, ok := strings.CutPrefix(location, "s3://"); ok {
+		bucket, prefix, _ := strings.Cut(rest, "/")
+		if bucket == "" {
+			return nil, "", fmt.Errorf("output location %q has no bucket", location)
+		}
+		client, err := getS3Client()
+		if err != nil {
+			return nil, "", err
+		}
+		if client == nil {
+			return nil, "", fmt.Errorf("output location %q needs S3, which local test runs do not use", location)
+		}
+		return &s3Store{client: client, bucket: bucket}, prefix, nil
+	}
+	return &dirStore{dir: strings.TrimPrefix(location, "file://")}, "", nil
+}
+
+// withTags returns a store that tags the objects it saves, as used by
+// lifecycle rules. Files in local directories cannot be tagged and are saved
+// as they are.
+func withTags(store objectStore, tags map[string]string) objectStore {
+	if s, ok := store.(*s3Store); ok {
+		tagged := *s
+		tagged.tags = tags
+		return &tagged
+	}
+	return store
+}
@@ -0,0 +1,114 @@
+package processor
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenObjectStore(t *testing.T) {
+	tests := []struct {
+		name       string
+		location   string
+		wantDir    string
+		wantPrefix string
+		wantErr    bool
+	}{
+		{"Local directory", "/tmp/out", "/tmp/out", "", false},
+		{"File URL", "file:///tmp/out", "/tmp/out", "", false},
+		{"S3 without bucket", "s3:///prefix/", "", "", true},
+		// Local test runs have no S3 client
+		{"S3 in test mode", "s3://bucket/prefix/", "", "", true},
+	}
+	os.Setenv("TEST_PDF_PATH", "unused.pdf")
+	defer os.Unsetenv("TEST_PDF_PATH")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, prefix, err := openObjectStore(tt.location)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected an error, got %T", store)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			dir, ok := store.(*dirStore)
+			if !ok || dir.dir != tt.wantDir || prefix != tt.wantPrefix {
+				t.Errorf("got %#v with prefix %q, want directory %q with prefix %q", store, prefix, tt.wantDir, tt.wantPrefix)
+			}
+		})
+	}
+}
+
+func TestDirStorePut(t *testing.T) {
+	store := &dirStore{dir: t.TempDir()}
+	key := "out/2024/scan.pdf"
+	if err := store.Put(context.Background(), key, []byte("data"), "application/pdf"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := filepath.Join(store.dir, "out", "2024", "scan.pdf")
+	if got := store.Location(key); got != want {
+		t.Errorf("got location %q, want %q", got, want)
+	}
+	if data, err := os.ReadFile(want); err != nil || string(data) != "data" {
+		t.Errorf("got %q (%v), want the saved data", data, err)
+	}
+}
+
+func TestDirStoreOutside(t *testing.T) {
+	ctx := context.Background()
+	parent := t.TempDir()
+	store := &dirStore{dir: filepath.Join(parent, "out")}
+	for _, key := range []string{"../escaped.pdf", "a/../../escaped.pdf", "/../escaped.pdf", ".."} {
+		if err := store.Put(ctx, key, []byte("data"), "application/pdf"); err == nil {
+			t.Errorf("Put(%q) saved a file outside the directory", key)
+		}
+		if _, err := store.Get(ctx, key); err == nil || isNotFound(err) {
+			t.Errorf("Get(%q) got error %v, want one refusing the key", key, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(parent, "escaped.pdf")); err == nil {
+		t.Errorf("file was written outside the directory")
+	}
+	// Absolute keys, such as local test paths, are saved within the directory
+	for _, key := range []string{"in/..hidden/../scan.pdf", "/tmp/scan.pdf"} {
+		if err := store.Put(ctx, key, []byte("data"), "application/pdf"); err != nil {
+			t.Errorf("unexpected error for %q within the directory: %v", key, err)
+		}
+	}
+}
+
+func TestDirStoreListGet(t *testing.T) {
+	ctx := context.Background()
+	store := &dirStore{dir: t.TempDir()}
+	for _, key := range []string{"failures/b.json", "failures/a.json", "other/c.json"} {
+		if err := store.Put(ctx, key, []byte(key), "application/json"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	keys, err := store.List(ctx, "failures/")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(keys) != 2 || keys[0] != "failures/a.json" || keys[1] != "failures/b.json" {
+		t.Errorf("got keys %v, want the two failures in order", keys)
+	}
+	if data, err := store.Get(ctx, keys[0]); err != nil || string(data) != "failures/a.json" {
+		t.Errorf("got %q (%v), want the saved data", data, err)
+	}
+}
+
+func TestWithTags(t *testing.T) {
+	tags := map[string]string{"retention-days": "30"}
+	tagged := withTags(&s3Store{bucket: "b"}, tags)
+	if s, ok := tagged.(*s3Store); !ok || s.tags["retention-days"] != "30" || s.bucket != "b" {
+		t.Errorf("got %#v, want a tagged S3 store", tagged)
+	}
+	dir := &dirStore{dir: "/tmp/out"}
+	if got := withTags(dir, tags); got != dir {
+		t.Errorf("got %#v, want the directory store unchanged", got)
+	}
+}
@@ -0,0 +1,690 @@
+package processor
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
+)
+
+// How a text match compares with the barcodes decoded from the images on its page.
+const (
+	textAgrees    = "agree"
+	textDisagrees = "disagree"
+	textOnly      = "text_only"
+)
+
+// maxFormDepth bounds how deeply form XObjects are followed for text.
+const maxFormDepth = 8
+
+// TextMatch is a value one of the profile's text patterns found in the text
+// layer of a page.
+type TextMatch struct {
+	Text    string `json:"text"`
+	Pattern string `json:"pattern"`
+	Page    int    `json:"page"`
+	// Agreement is "agree" if a barcode with the same value was decoded on
+	// the page, "disagree" if only other values were, and "text_only" if no
+	// barcode was decoded there
+	Agreement string `json:"agreement"`
+}
+
+// extractPDFText returns the text shown on the first pageLimit pages of a
+// PDF, or on every page if pageLimit is 0, one string per page with a line
+// break between lines.
+func extractPDFText(ctx *model.Context, pageLimit int) ([]string, error) {
+	var pages []string
+	for page := 1; page <= ctx.PageCount; page++ {
+		if pageLimit > 0 && page > pageLimit {
+			break
+		}
+		d, _, inherited, err := ctx.PageDict(page, false)
+		if err != nil {
+			return nil, fmt.Errorf("error reading page %d: %v", page, err)
+		}
+		content, err := ctx.PageContent(d)
+		if err != nil && !errors.Is(err, model.ErrNoContent) {
+			return nil, fmt.Errorf("error reading content of page %d: %v", page, err)
+		}
+		e := &textExtractor{xRefTable: ctx.XRefTable, fonts: map[string]*textFont{}}
+		e.run(content, inherited.Resources, 0)
+		pages = append(pages, strings.TrimSpace(e.text.String()))
+	}
+	return pages, nil
+}
+
+// matchTextPatterns applies the patterns to the text of each page. A pattern
+// with a capture group matches the value of its first group, otherwise the
+// whole match. The same value is reported once per page and pattern.
+func matchTextPatterns(pageTexts []string, patterns []*regexp.Regexp) []TextMatch {
+	var matches []TextMatch
+	for i, text := range pageTexts {
+		for _, pattern := range patterns {
+			seen := map[string]bool{}
+			for _, m := range pattern.FindAllStringSubmatch(text, -1) {
+				value := m[0]
+				if len(m) > 1 {
+					value = m[1]
+				}
+				value = strings.TrimSpace(value)
+				if value == "" || seen[value] {
+					continue
+				}
+				seen[value] = true
+				matches = append(matches, TextMatch{Text: value, Pattern: pattern.String(), Page: i + 1})
+			}
+		}
+	}
+	return matches
+}
+
+// compareTextMatches sets the agreement of each text match with the barcodes
+// decoded on its page.
+func compareTextMatches(matches []TextMatch, barcodes []Barcode) {
+	for i := range matches {
+		matches[i].Agreement = textOnly
+		for _, barcode := range barcodes {
+			if barcode.Page != matches[i].Page {
+				continue
+			}
+			if strings.TrimSpace(barcode.Text) == matches[i].Text {
+				matches[i].Agreement = textAgrees
+				break
+			}
+			matches[i].Agreement = textDisagrees
+		}
+	}
+}
+
+// textExtractor collects the text shown by content streams.
+type textExtractor struct {
+	xRefTable *model.XRefTable
+	fonts     map[string]*textFont
+	text      strings.Builder
+}
+
+// newline ends the current line unless it is empty.
+func (e *textExtractor) newline() {
+	if s := e.text.String(); s != "" && !strings.HasSuffix(s, "\n") {
+		e.text.WriteByte('\n')
+	}
+}
+
+// run interprets the text operators of a content stream, following form
+// XObjects into their own content.
+func (e *textExtractor) run(content []byte, resources types.Dict, depth int) {
+	lexer := &contentLexer{data: content}
+	var font *textFont
+	var operands []interface{}
+	lineY := 0.0
+	for {
+		obj, ok := lexer.next()
+		if !ok {
+			return
+		}
+		op, isOp := obj.(contentOperator)
+		if !isOp {
+			operands = append(operands, obj)
+			continue
+		}
+
+		switch op {
+		case "BT", "ET", "T*":
+			e.newline()
+		case "Tf":
+			if len(operands) >= 1 {
+				if name, ok := operands[0].(contentName); ok {
+					font = e.font(resources, string(name))
+				}
+			}
+		case "Td", "TD":
+			if len(operands) == 2 {
+				if ty, ok := operands[1].(float64); ok && ty != 0 {
+					e.newline()
+				}
+			}
+		case "Tm":
+			if len(operands) == 6 {
+				if y, ok := operands[5].(float64); ok && y != lineY {
+					lineY = y
+					e.newline()
+				}
+			}
+		case "Tj":
+			e.show(font, operands, 0)
+		case "'":
+			e.newline()
+			e.show(font, operands, 0)
+		case "\"":
+			e.newline()
+			e.show(font, operands, 2)
+		case "TJ":
+			if len(operands) == 1 {
+				if array, ok := operands[0].([]interface{}); ok {
+					for _, item := range array {
+						switch item := item.(type) {
+						case []byte:
+							e.text.WriteString(font.decode(item))
+						case float64:
+							// Large negative adjustments move on by about a space
+							if item < -250 {
+								e.text.WriteByte(' ')
+							}
+						}
+					}
+				}
+			}
+		case "Do":
+			if len(operands) == 1 && depth < maxFormDepth {
+				if name, ok := operands[0].(contentName); ok {
+					e.form(resources, string(name), depth)
+				}
+			}
+		case "BI":
+			lexer.skipInlineImage()
+		}
+		operands = operands[:0]
+	}
+}
+
+// show writes the string operand at index i.
+func (e *textExtractor) show(font *textFont, operands []interface{}, i int) {
+	if i < len(operands) {
+		if s, ok := operands[i].([]byte); ok {
+			e.text.WriteString(font.decode(s))
+		}
+	}
+}
+
+// resourceEntry returns a named entry from a category of a resource dictionary.
+func resourceEntry(xRefTable *model.XRefTable, resources types.Dict, category, name string) types.Object {
+	if resources == nil {
+		return nil
+	}
+	entries, err := xRefTable.DereferenceDict(resources[category])
+	if err != nil || entries == nil {
+		return nil
+	}
+	return entries[name]
+}
+
+// form runs the content of a form XObject.
+func (e *textExtractor) form(resources types.Dict, name string, depth int) {
+	sd, _, err := e.xRefTable.DereferenceStreamDict(resourceEntry(e.xRefTable, resources, "XObject", name))
+	if err != nil || sd == nil {
+		return
+	}
+	if subtype := sd.Subtype(); subtype == nil || *subtype != "Form" {
+		return
+	}
+	if err := sd.Decode(); err != nil {
+		return
+	}
+	formResources, err := e.xRefTable.DereferenceDict(sd.Dict["Resources"])
+	if err != nil || formResources == nil {
+		formResources = resources
+	}
+	e.run(sd.Content, formResources, depth+1)
+}
+
+// font loads a font from the resources, caching it by object.
+func (e *textExtractor) font(resources types.Dict, name string) *textFont {
+	obj := resourceEntry(e.xRefTable, resources, "Font", name)
+	cacheKey := name
+	if ref, ok := obj.(types.IndirectRef); ok {
+		cacheKey = ref.String()
+	}
+	if font, ok := e.fonts[cacheKey]; ok {
+		return font
+	}
+	font := &textFont{codeLength: 1}
+	if d, err := e.xRefTable.DereferenceDict(obj); err == nil && d != nil {
+		font = loadTextFont(e.xRefTable, d)
+	}
+	e.fonts[cacheKey] = font
+	return font
+}
+
+// textFont maps the character codes of a font to text.
+type textFont struct {
+	// codeLength is the number of bytes per character code
+	codeLength int
+	// toUnicode holds the font's ToUnicode mapping, if any
+	toUnicode map[uint32]string
+	// simple maps the codes of simple fonts without ToUnicode entries
+	simple map[byte]rune
+	// composite fonts have no fallback for codes missing from toUnicode
+	composite bool
+}
+
+func loadTextFont(xRefTable *model.XRefTable, d types.Dict) *textFont {
+	font := &textFont{codeLength: 1}
+	if subtype := d.NameEntry("Subtype"); subtype != nil && *subtype == "Type0" {
+		font.codeLength = 2
+		font.composite = true
+	}
+
+	if sd, _, err := xRefTable.DereferenceStreamDict(d["ToUnicode"]); err == nil && sd != nil {
+		if err := sd.Decode(); err == nil {
+			var codeLength int
+			font.toUnicode, codeLength = parseToUnicodeCMap(sd.Content)
+			if codeLength > 0 {
+				font.codeLength = codeLength
+			}
+		}
+	}
+
+	if !font.composite {
+		// Codes follow Latin-1, which agrees with the standard encodings for
+		// the characters barcode values use, unless Differences rename them
+		font.simple = map[byte]rune{}
+		if encoding, err := xRefTable.DereferenceDict(d["Encoding"]); err == nil && encoding != nil {
+			if differences, err := xRefTable.DereferenceArray(encoding["Differences"]); err == nil {
+				code := 0
+				for _, item := range differences {
+					switch item := item.(type) {
+					case types.Integer:
+						code = item.Value()
+					case types.Name:
+						if r, ok := glyphRune(string(item)); ok && code >= 0 && code < 256 {
+							font.simple[byte(code)] = r
+						}
+						code++
+					}
+				}
+			}
+		}
+	}
+	return font
+}
+
+// decode turns a shown string into text. A nil font decodes bytes as Latin-1.
+func (f *textFont) decode(s []byte) string {
+	if f == nil {
+		f = &textFont{codeLength: 1}
+	}
+	var b strings.Builder
+	for i := 0; i+f.codeLength <= len(s); i += f.codeLength {
+		var code uint32
+		for _, c := range s[i : i+f.codeLength] {
+			code = code<<8 | uint32(c)
+		}
+		if text, ok := f.toUnicode[code]; ok {
+			b.WriteString(text)
+			continue
+		}
+		if f.composite {
+			continue
+		}
+		if r, ok := f.simple[byte(code)]; ok {
+			b.WriteRune(r)
+			continue
+		}
+		b.WriteRune(rune(code))
+	}
+	return b.String()
+}
+
+// glyphNames maps the glyph names of the characters found in barcode values
+// that are not single letters or uniXXXX names.
+var glyphNames = map[string]rune{
+	"space": ' ', "exclam": '!', "quotedbl": '"', "numbersign": '#', "dollar": '$',
+	"percent": '%', "ampersand": '&', "quotesingle": '\'', "parenleft": '(', "parenright": ')',
+	"asterisk": '*', "plus": '+', "comma": ',', "hyphen": '-', "period": '.', "slash": '/',
+	"zero": '0', "one": '1', "two": '2', "three": '3', "four": '4',
+	"five": '5', "six": '6', "seven": '7', "eight": '8', "nine": '9',
+	"colon": ':', "semicolon": ';', "less": '<', "equal": '=', "greater": '>', "question": '?',
+	"at": '@', "bracketleft": '[', "backslash": '\\', "bracketright": ']', "underscore": '_',
+}
+
+// glyphRune returns the character a glyph name stands for.
+func glyphRune(name string) (rune, bool) {
+	if r, ok := glyphNames[name]; ok {
+		return r, true
+	}
+	if len(name) == 1 {
+		return rune(name[0]), true
+	}
+	if strings.HasPrefix(name, "uni") && len(name) == 7 {
+		if v, err := strconv.ParseUint(name[3:], 16, 16); err == nil {
+			return rune(v), true
+		}
+	}
+	return 0, false
+}
+
+// parseToUnicodeCMap reads the bfchar and bfrange mappings of a ToUnicode
+// CMap, and the code length of its code space, or 0 if it declares none.
+func parseToUnicodeCMap(data []byte) (map[uint32]string, int) {
+	mapping := map[uint32]string{}
+	codeLength := 0
+	lexer := &contentLexer{data: data}
+	var operands []interface{}
+	for {
+		obj, ok := lexer.next()
+		if !ok {
+			return mapping, codeLength
+		}
+		op, isOp := obj.(contentOperator)
+		if !isOp {
+			operands = append(operands, obj)
+			continue
+		}
+
+		switch op {
+		case "endcodespacerange":
+			if len(operands) >= 1 {
+				if lo, ok := operands[0].([]byte); ok && len(lo) > 0 {
+					codeLength = len(lo)
+				}
+			}
+		case "endbfchar":
+			for i := 0; i+1 < len(operands); i += 2 {
+				src, ok1 := operands[i].([]byte)
+				dst, ok2 := operands[i+1].([]byte)
+				if ok1 && ok2 {
+					mapping[cmapCode(src)] = utf16BEString(dst)
+				}
+			}
+		case "endbfrange":
+			for i := 0; i+2 < len(operands); i += 3 {
+				lo, ok1 := operands[i].([]byte)
+				hi, ok2 := operands[i+1].([]byte)
+				if !ok1 || !ok2 {
+					continue
+				}
+				start, end := cmapCode(lo), cmapCode(hi)
+				if end < start || end-start > 0xffff {
+					continue
+				}
+				switch dst := operands[i+2].(type) {
+				case []byte:
+					// The last UTF-16 unit counts up through the range
+					units := utf16Units(dst)
+					if len(units) == 0 {
+						continue
+					}
+					for code := start; code <= end; code++ {
+						mapping[code] = string(utf16.Decode(units))
+						units[len(units)-1]++
+					}
+				case []interface{}:
+					for j, item := range dst {
+						if s, ok := item.([]byte); ok && start+uint32(j) <= end {
+							mapping[start+uint32(j)] = utf16BEString(s)
+						}
+					}
+				}
+			}
+		}
+		operands = operands[:0]
+	}
+}
+
+func cmapCode(b []byte) uint32 {
+	var code uint32
+	for _, c := range b {
+		code = code<<8 | uint32(c)
+	}
+	return code
+}
+
+func utf16Units(b []byte) []uint16 {
+	units := make([]uint16, len(b)/2)
+	for i := range units {
+		units[i] = uint16(b[2*i])<<8 | uint16(b[2*i+1])
+	}
+	return units
+}
+
+func utf16BEString(b []byte) string {
+	return string(utf16.Decode(utf16Units(b)))
+}
+
+// Objects read by contentLexer besides numbers (float64), strings ([]byte)
+// and arrays ([]interface{}). Dictionaries and other objects are read as nil.
+type (
+	contentOperator string
+	contentName     string
+)
+
+// contentLexer reads the objects and operators of a content stream or CMap.
+type contentLexer struct {
+	data []byte
+	pos  int
+}
+
+func isPDFWhitespace(c byte) bool {
+	return c == ' ' || c == '\n' || c == '\r' || c == '\t' || c == '\f' || c == 0
+}
+
+func isPDFDelimiter(c byte) bool {
+	return strings.IndexByte("()<>[]{}/%", c) >= 0
+}
+
+// skipSpace skips whitespace and comments.
+func (l *contentLexer) skipSpace() {
+	for l.pos < len(l.data) {
+		c := l.data[l.pos]
+		if c == '%' {
+			for l.pos < len(l.data) && l.data[l.pos] != '\n' && l.data[l.pos] != '\r' {
+				l.pos++
+			}
+			continue
+		}
+		if !isPDFWhitespace(c) {
+			return
+		}
+		l.pos++
+	}
+}
+
+// next returns the next object or operator, and false at the end of the data.
+// Arrays and dictionaries are read with a stack of those open rather than by
+// recursion, so no nesting or run of stray delimiters runs out of stack.
+func (l *contentLexer) next() (interface{}, bool) {
+	// open are the arrays and dictionaries being read, innermost last. The
+	// entries of dictionaries are skipped.
+	type container struct {
+		dict  bool
+		array []interface{}
+	}
+	var open []container
+	for {
+		l.skipSpace()
+		if l.pos >= len(l.data) {
+			if len(open) == 0 {
+				return nil, false
+			}
+			// What is open at the end of the data closes there
+			var obj interface{}
+			for len(open) > 0 {
+				top := open[len(open)-1]
+				open = open[:len(open)-1]
+				obj = nil
+				if !top.dict {
+					obj = top.array
+				}
+				if len(open) > 0 && !open[len(open)-1].dict {
+					open[len(open)-1].array = append(open[len(open)-1].array, obj)
+				}
+			}
+			return obj, true
+		}
+
+		c := l.data[l.pos]
+		inDict := len(open) > 0 && open[len(open)-1].dict
+		var obj interface{}
+		switch {
+		case c == '(':
+			obj = l.literalString()
+		case c == '<' && l.pos+1 < len(l.data) && l.data[l.pos+1] == '<':
+			l.pos += 2
+			open = append(open, container{dict: true})
+			continue
+		case c == '>' && inDict && l.pos+1 < len(l.data) && l.data[l.pos+1] == '>':
+			l.pos += 2
+			open = open[:len(open)-1]
+		case c == '<':
+			obj = l.hexString()
+		case c == '[':
+			l.pos++
+			open = append(open, container{})
+			continue
+		case c == ']' && len(open) > 0 && !inDict:
+			l.pos++
+			obj = open[len(open)-1].array
+			open = open[:len(open)-1]
+		case c == '/':
+			l.pos++
+			obj = contentName(l.regular())
+		case c == ']' || c == '>' || c == ')' || c == '{' || c == '}':
+			// Stray delimiters are skipped
+			l.pos++
+			continue
+		default:
+			obj = l.word()
+		}
+
+		if len(open) == 0 {
+			return obj, true
+		}
+		if top := &open[len(open)-1]; !top.dict {
+			top.array = append(top.array, obj)
+		}
+	}
+}
+
+// word reads a number, boolean, null or operator.
+func (l *contentLexer) word() interface{} {
+	word := l.regular()
+	if n, err := strconv.ParseFloat(word, 64); err == nil {
+		return n
+	}
+	switch word {
+	case "true", "false", "null":
+		return nil
+	}
+	return contentOperator(word)
+}
+
+// regular reads a run of regular characters.
+func (l *contentLexer) regular() string {
+	start := l.pos
+	for l.pos < len(l.data) && !isPDFWhitespace(l.data[l.pos]) && !isPDFDelimiter(l.data[l.pos]) {
+		l.pos++
+	}
+	if l.pos == start && l.pos < len(l.data) {
+		l.pos++
+	}
+	return string(l.data[start:l.pos])
+}
+
+func (l *contentLexer) literalString() []byte {
+	l.pos++ // (
+	var s []byte
+	depth := 1
+	for l.pos < len(l.data) {
+		c := l.data[l.pos]
+		l.pos++
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return s
+			}
+		case '\\':
+			if l.pos >= len(l.data) {
+				return s
+			}
+			e := l.data[l.pos]
+			l.pos++
+			switch e {
+			case 'n':
+				s = append(s, '\n')
+			case 'r':
+				s = append(s, '\r')
+			case 't':
+				s = append(s, '\t')
+			case 'b':
+				s = append(s, '\b')
+			case 'f':
+				s = append(s, '\f')
+			case '\r':
+				// Line continuation
+				if l.pos < len(l.data) && l.data[l.pos] == '\n' {
+					l.pos++
+				}
+			case '\n':
+			default:
+				if e >= '0' && e <= '7' {
+					v := int(e - '0')
+					for i := 0; i < 2 && l.pos < len(l.data) && l.data[l.pos] >= '0' && l.data[l.pos] <= '7'; i++ {
+						v = v*8 + int(l.data[l.pos]-'0')
+						l.pos++
+					}
+					s = append(s, byte(v))
+				} else {
+					s = append(s, e)
+				}
+			}
+			continue
+		}
+		s = append(s, c)
+	}
+	return s
+}
+
+func (l *contentLexer) hexString() []byte {
+	l.pos++ // <
+	var digits []byte
+	for l.pos < len(l.data) && l.data[l.pos] != '>' {
+		c := l.data[l.pos]
+		if (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F') {
+			digits = append(digits, c)
+		}
+		l.pos++
+	}
+	l.pos++ // >
+	if len(digits)%2 == 1 {
+		digits = append(digits, '0')
+	}
+	s := make([]byte, len(digits)/2)
+	for i := range s {
+		v, _ := strconv.ParseUint(string(digits[2*i:2*i+2]), 16, 8)
+		s[i] = byte(v)
+	}
+	return s
+}
+
+// skipInlineImage skips the dictionary and data of an inline image after BI,
+// up to and including EI.
+func (l *contentLexer) skipInlineImage() {
+	for {
+		obj, ok := l.next()
+		if !ok {
+			return
+		}
+		if op, isOp := obj.(contentOperator); isOp && op == "ID" {
+			break
+		}
+	}
+	l.pos++ // the whitespace after ID
+	for l.pos+2 <= len(l.data) {
+		if l.data[l.pos] == 'E' && l.data[l.pos+1] == 'I' &&
+			isPDFWhitespace(l.data[l.pos-1]) &&
+			(l.pos+2 == len(l.data) || isPDFWhitespace(l.data[l.pos+2])) {
+			l.pos += 2
+			return
+		}
+		l.pos++
+	}
+	l.pos = len(l.data)
+}
@@ -0,0 +1,273 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
+)
+
+func TestTextExtractorRun(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"Shown string", "BT /F1 12 Tf 72 700 Td (INV-12345) Tj ET", "INV-12345"},
+		{"Hex string", "BT <494E56> Tj ET", "INV"},
+		{"Escapes", `BT (a\(b\)\101\\) Tj ET`, `a(b)A\`},
+		{"Nested parentheses", "BT (f(x)) Tj ET", "f(x)"},
+		{"Kerning and word gaps", "BT [(AB) -50 (CD) -500 (EF)] TJ ET", "ABCD EF"},
+		{"Lines", "BT (one) Tj 0 -14 Td (two) Tj T* (three) Tj ET", "one\ntwo\nthree"},
+		{"Glyphs placed on one line", "BT (A) Tj 10 0 Td (B) Tj 1 0 0 1 90 700 Tm (C) Tj 1 0 0 1 100 700 Tm (D) Tj ET", "AB\nCD"},
+		{"Quote operators", "BT (one) Tj (two) ' 1 2 (three) \" ET", "one\ntwo\nthree"},
+		{"Text objects", "BT (one) Tj ET BT (two) Tj ET", "one\ntwo"},
+		{"Inline image", "q BI /W 2 /H 1 /BPC 8 /CS /G ID \x00EI\x01 EI Q BT (after) Tj ET", "after"},
+		{"Comments and dictionaries", "% comment\n/Span << /ActualText (x) >> BDC BT (text) Tj ET EMC", "text"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &textExtractor{
+				xRefTable: &model.XRefTable{Table: map[int]*model.XRefTableEntry{}},
+				fonts:     map[string]*textFont{},
+			}
+			e.run([]byte(tt.content), nil, 0)
+			if got := strings.TrimSpace(e.text.String()); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestContentLexer(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []interface{}
+	}{
+		{"Objects", "1.5 (a) <62> /N true op", []interface{}{1.5, []byte("a"), []byte("b"), contentName("N"), nil, contentOperator("op")}},
+		{"Nested arrays", "[1 [2 [] (x)] 3] TJ", []interface{}{[]interface{}{1.0, []interface{}{2.0, []interface{}(nil), []byte("x")}, 3.0}, contentOperator("TJ")}},
+		{"Dictionaries", "<< /A [1 2] /B << /C 3 >> >> BDC", []interface{}{nil, contentOperator("BDC")}},
+		{"Array in a dictionary closes the array", "[1 << /A ] >> 2] x", []interface{}{[]interface{}{1.0, nil, 2.0}, contentOperator("x")}},
+		{"Stray delimiters", "] > ) } { 1 ]] op", []interface{}{1.0, contentOperator("op")}},
+		{"Unterminated", "[1 [2 << /A", []interface{}{[]interface{}{1.0, []interface{}{2.0, nil}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lexer := &contentLexer{data: []byte(tt.content)}
+			var got []interface{}
+			for {
+				obj, ok := lexer.next()
+				if !ok {
+					break
+				}
+				got = append(got, obj)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTextExtractorRunDeepContent(t *testing.T) {
+	// Crafted content that compresses to a few kilobytes must not exhaust
+	// the stack
+	tests := []struct {
+		name    string
+		content []byte
+		want    string
+	}{
+		{"Stray delimiters", bytes.Repeat([]byte("]"), 4_000_000), "before\nafter"},
+		// What follows an unclosed array or dictionary is part of it
+		{"Nested arrays", bytes.Repeat([]byte("["), 1_000_000), "before"},
+		{"Nested dictionaries", bytes.Repeat([]byte("<<"), 1_000_000), "before"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := append(append([]byte("BT (before) Tj ET "), tt.content...), " BT (after) Tj ET"...)
+			e := &textExtractor{
+				xRefTable: &model.XRefTable{Table: map[int]*model.XRefTableEntry{}},
+				fonts:     map[string]*textFont{},
+			}
+			e.run(content, nil, 0)
+			if got := strings.TrimSpace(e.text.String()); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+
+			placements := map[string]pdfMatrix{}
+			collectImagePlacements(e.xRefTable, content, nil, placements)
+			if len(placements) != 0 {
+				t.Errorf("got placements %v, want none", placements)
+			}
+		})
+	}
+}
+
+func TestTextFontDecode(t *testing.T) {
+	cmap := `/CIDInit /ProcSet findresource begin
+12 dict begin
+begincmap
+1 begincodespacerange
+<0000> <FFFF>
+endcodespacerange
+2 beginbfchar
+<0003> <0020>
+<0010> <002D>
+endbfchar
+2 beginbfrange
+<0013> <001C> <0030>
+<0024> <0026> [<0041> <0042> <0043>]
+endbfrange
+endcmap`
+	toUnicode, codeLength := parseToUnicodeCMap([]byte(cmap))
+	if codeLength != 2 {
+		t.Errorf("got code length %d, want 2", codeLength)
+	}
+
+	tests := []struct {
+		name string
+		font *textFont
+		data []byte
+		want string
+	}{
+		{
+			name: "Composite font with ToUnicode",
+			font: &textFont{codeLength: 2, toUnicode: toUnicode, composite: true},
+			data: []byte{0, 0x24, 0, 0x25, 0, 0x10, 0, 0x14, 0, 0x15, 0, 0x03, 0, 0x26, 0, 0x99},
+			want: "AB-12 C",
+		},
+		{
+			name: "Simple font with Differences",
+			font: &textFont{codeLength: 1, simple: map[byte]rune{1: '4', 2: '2'}},
+			data: []byte{1, 2, 'x'},
+			want: "42x",
+		},
+		{
+			name: "No font",
+			data: []byte("plain"),
+			want: "plain",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.font.decode(tt.data); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadTextFontDifferences(t *testing.T) {
+	encoding := "<< /Type /Encoding /Differences [65 /three /seven /uni0041 /g17 /Z] >>"
+	d, err := model.ParseObject(&encoding)
+	if err != nil {
+		t.Fatalf("failed to parse encoding: %v", err)
+	}
+	font := loadTextFont(&model.XRefTable{Table: map[int]*model.XRefTableEntry{}},
+		types.Dict{"Subtype": types.Name("Type1"), "Encoding": d})
+	// Unknown glyph names keep their code's Latin-1 character
+	if got, want := font.decode([]byte("ABCDEF")), "37ADZF"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestMatchTextPatterns(t *testing.T) {
+	pageTexts := []string{
+		"Invoice INV-1001\nRef INV-1001\nTotal 12.00",
+		"Invoice INV-2002",
+		"Nothing here",
+	}
+	patterns := []*regexp.Regexp{regexp.MustCompile(`INV-\d+`), regexp.MustCompile(`\*(\w+)\*`)}
+	barcodes := []Barcode{
+		{Text: "INV-1001", Page: 1},
+		{Text: "INV-9999", Page: 2},
+	}
+
+	matches := matchTextPatterns(pageTexts, patterns)
+	compareTextMatches(matches, barcodes)
+	want := []TextMatch{
+		{Text: "INV-1001", Pattern: `INV-\d+`, Page: 1, Agreement: textAgrees},
+		{Text: "INV-2002", Pattern: `INV-\d+`, Page: 2, Agreement: textDisagrees},
+	}
+	if len(matches) != len(want) {
+		t.Fatalf("got %+v, want %+v", matches, want)
+	}
+	for i := range want {
+		if matches[i] != want[i] {
+			t.Errorf("match %d is %+v, want %+v", i, matches[i], want[i])
+		}
+	}
+
+	// A capture group selects the value, as for barcode fonts with start and stop characters
+	matches = matchTextPatterns([]string{"*A123*"}, patterns)
+	compareTextMatches(matches, nil)
+	if len(matches) != 1 || matches[0].Text != "A123" || matches[0].Agreement != textOnly {
+		t.Errorf("got %+v, want A123 without barcodes", matches)
+	}
+}
+
+func TestHandleRequestTextPatterns(t *testing.T) {
+	ctx := withLogger(context.Background(), discardLogger)
+
+	var payload BarcodeData
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&payload)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	const text = "TXT-4242"
+	img := barcodeImage(t, text)
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	page := testPDFPage{
+		content: drawImages(1) + "BT /F1 10 Tf 20 680 Td (Ref: TXT-4242) Tj 0 -12 Td (Alt: TXT-0001) Tj ET",
+		images: []testPDFImage{{
+			fmt.Sprintf("/Width %d /Height %d /ColorSpace /DeviceGray /BitsPerComponent 8", w, h),
+			img.Pix,
+		}},
+	}
+	path := writeTestPDF(t, page)
+
+	os.Setenv("TEST_PDF_PATH", path)
+	os.Setenv("PROFILES_CONFIG", `{"profiles": [{"name": "text", "text_patterns": ["TXT-\\d{4}"]}]}`)
+	os.Setenv("WEBHOOK_URL", server.URL)
+	os.Setenv("WEBHOOK_TOKEN", "test-token")
+	defer func() {
+		os.Unsetenv("TEST_PDF_PATH")
+		os.Unsetenv("PROFILES_CONFIG")
+		os.Unsetenv("WEBHOOK_URL")
+		os.Unsetenv("WEBHOOK_TOKEN")
+	}()
+
+	response, err := HandleRequest(ctx, events.S3Event{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if response.StatusCode != 200 {
+		t.Fatalf("got status %d, want 200", response.StatusCode)
+	}
+	want := []TextMatch{
+		{Text: "TXT-4242", Pattern: `TXT-\d{4}`, Page: 1, Agreement: textAgrees},
+		{Text: "TXT-0001", Pattern: `TXT-\d{4}`, Page: 1, Agreement: textDisagrees},
+	}
+	if len(payload.TextMatches) != len(want) {
+		t.Fatalf("webhook got text matches %+v, want %+v", payload.TextMatches, want)
+	}
+	for i := range want {
+		if payload.TextMatches[i] != want[i] {
+			t.Errorf("text match %d is %+v, want %+v", i, payload.TextMatches[i], want[i])
+		}
+	}
+}
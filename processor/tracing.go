@@ -0,0 +1,107 @@
+package processor
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"sync"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	tracerName         = "github.com/swiveltech/pdf-processor/processor"
+	defaultServiceName = "pdf-processor"
+)
+
+// Span names of the stages of a request.
+const (
+	spanHandleRequest = "HandleRequest"
+	spanGetObject     = "S3 GetObject"
+	spanWriteTemp     = "write temp file"
+	spanExtract       = "extract images"
+	spanDecodeImage   = "decode image"
+	spanReaderAttempt = "reader attempt"
+	spanWebhook       = "webhook POST"
+)
+
+// tracePropagator writes the traceparent header of webhook requests.
+var tracePropagator = propagation.TraceContext{}
+
+var (
+	tracingOnce     sync.Once
+	tracingProvider *sdktrace.TracerProvider
+)
+
+// tracingEnabled reports whether an OTLP endpoint is configured, with the
+// exporter's standard environment variables.
+func tracingEnabled() bool {
+	return os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != ""
+}
+
+// initTracing installs a tracer provider exporting spans over OTLP/HTTP when
+// an endpoint is configured, e.g. OTEL_EXPORTER_OTLP_ENDPOINT=http://localhost:4318
+// for a local collector. The service is named pdf-processor unless
+// OTEL_SERVICE_NAME says otherwise. Without an endpoint spans are not
+// recorded.
+func initTracing(ctx context.Context) {
+	tracingOnce.Do(func() {
+		if !tracingEnabled() {
+			return
+		}
+		logger := loggerFrom(ctx)
+		exporter, err := otlptracehttp.New(ctx)
+		if err != nil {
+			logger.Warn("Error creating trace exporter, tracing is off", "error", err)
+			return
+		}
+		res, err := resource.New(ctx,
+			resource.WithAttributes(attribute.String("service.name", defaultServiceName)),
+			resource.WithFromEnv(),
+		)
+		if err != nil {
+			logger.Warn("Error reading trace resource attributes", "error", err)
+		}
+		tracingProvider = sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+		otel.SetTracerProvider(tracingProvider)
+		otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	})
+}
+
+// flushTraces exports the spans ended so far. Lambda may freeze the process
+// as soon as a request returns, so spans are not left in the batch.
+func flushTraces(ctx context.Context) {
+	if tracingProvider == nil {
+		return
+	}
+	if err := tracingProvider.ForceFlush(ctx); err != nil {
+		loggerFrom(ctx).Warn("Error exporting traces", "error", err)
+	}
+}
+
+// startSpan starts a span of the global tracer provider.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan ends a span, marking it failed if err is not nil.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// injectTraceContext adds the traceparent header of the context's span to
+// an outgoing request.
+func injectTraceContext(ctx context.Context, header http.Header) {
+	tracePropagator.Inject(ctx, propagation.HeaderCarrier(header))
+}
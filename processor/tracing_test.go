@@ -0,0 +1,166 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// setupTracingTest writes a one-barcode PDF for HandleRequest and a webhook
+// that records the traceparent headers it receives.
+func setupTracingTest(t *testing.T) *[]string {
+	t.Helper()
+	var mu sync.Mutex
+	var traceparents []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		traceparents = append(traceparents, r.Header.Get("traceparent"))
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(server.Close)
+
+	img := barcodeImage(t, "TRACE-1")
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	path := writeTestPDF(t, testPDFPage{
+		content: drawImages(1),
+		images: []testPDFImage{{
+			fmt.Sprintf("/Width %d /Height %d /ColorSpace /DeviceGray /BitsPerComponent 8", w, h),
+			img.Pix,
+		}},
+	})
+	os.Setenv("TEST_PDF_PATH", path)
+	os.Setenv("WEBHOOK_URL", server.URL)
+	os.Setenv("WEBHOOK_TOKEN", "test-token")
+	t.Cleanup(func() {
+		os.Unsetenv("TEST_PDF_PATH")
+		os.Unsetenv("WEBHOOK_URL")
+		os.Unsetenv("WEBHOOK_TOKEN")
+	})
+	return &traceparents
+}
+
+func TestHandleRequestSpans(t *testing.T) {
+	ctx := withLogger(context.Background(), discardLogger)
+	metricsOutput = io.Discard
+	defer func() { metricsOutput = os.Stdout }()
+	traceparents := setupTracingTest(t)
+
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(previous)
+
+	if _, err := HandleRequest(ctx, events.S3Event{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	spans := map[string][]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = append(spans[span.Name()], span)
+	}
+	for _, name := range []string{spanHandleRequest, spanWriteTemp, spanExtract, spanDecodeImage, spanReaderAttempt, spanWebhook} {
+		if len(spans[name]) == 0 {
+			t.Errorf("no %q span", name)
+		}
+	}
+	if len(spans[spanHandleRequest]) != 1 {
+		t.Fatalf("got %d request spans, want 1", len(spans[spanHandleRequest]))
+	}
+	root := spans[spanHandleRequest][0].SpanContext()
+	for _, span := range recorder.Ended() {
+		if span.SpanContext().TraceID() != root.TraceID() {
+			t.Errorf("span %q is in another trace", span.Name())
+		}
+	}
+	decodeSpan := spans[spanDecodeImage][0].SpanContext().SpanID()
+	for _, span := range spans[spanReaderAttempt] {
+		if span.Parent().SpanID() != decodeSpan {
+			t.Errorf("reader attempt is not a child of the image decode")
+		}
+	}
+
+	// The webhook sees the span of its own request as the parent
+	webhookSpans := map[string]bool{}
+	for _, span := range spans[spanWebhook] {
+		webhookSpans[fmt.Sprintf("00-%s-%s-01", span.SpanContext().TraceID(), span.SpanContext().SpanID())] = true
+	}
+	if len(*traceparents) != 2 {
+		t.Fatalf("got %d webhook calls, want 2", len(*traceparents))
+	}
+	for _, traceparent := range *traceparents {
+		if !webhookSpans[traceparent] {
+			t.Errorf("got traceparent %q, want one of the webhook spans", traceparent)
+		}
+	}
+}
+
+func TestInjectTraceContextWithoutSpan(t *testing.T) {
+	header := http.Header{}
+	injectTraceContext(context.Background(), header)
+	if got := header.Get("traceparent"); got != "" {
+		t.Errorf("got traceparent %q without a span, want none", got)
+	}
+
+	ctx := trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{1},
+		SpanID:     trace.SpanID{2},
+		TraceFlags: trace.FlagsSampled,
+	}))
+	injectTraceContext(ctx, header)
+	if got, want := header.Get("traceparent"), "00-01000000000000000000000000000000-0200000000000000-01"; got != want {
+		t.Errorf("got traceparent %q, want %q", got, want)
+	}
+}
+
+func TestInitTracingExportsOTLP(t *testing.T) {
+	ctx := withLogger(context.Background(), discardLogger)
+	metricsOutput = io.Discard
+	defer func() { metricsOutput = os.Stdout }()
+	setupTracingTest(t)
+
+	// A local collector
+	var exports int32
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/traces" {
+			atomic.AddInt32(&exports, 1)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer collector.Close()
+	os.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", collector.URL)
+	defer os.Unsetenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+
+	previous := otel.GetTracerProvider()
+	tracingOnce = sync.Once{}
+	defer func() {
+		if tracingProvider != nil {
+			tracingProvider.Shutdown(ctx)
+		}
+		tracingProvider = nil
+		tracingOnce = sync.Once{}
+		otel.SetTracerProvider(previous)
+	}()
+
+	if _, err := HandleRequest(ctx, events.S3Event{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if tracingProvider == nil {
+		t.Fatal("tracing not set up with an OTLP endpoint")
+	}
+	if atomic.LoadInt32(&exports) == 0 {
+		t.Error("no spans exported at the end of the request")
+	}
+}